@@ -2,13 +2,20 @@ package main
 
 import (
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"time"
 
 	"sentinel/internal/auth"
 	"sentinel/internal/db"
+	"sentinel/internal/extauthz"
 	"sentinel/internal/handlers"
+	"sentinel/internal/mail"
+	"sentinel/internal/password"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
 )
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -24,6 +31,26 @@ func main() {
 	defer db.DB.Close()
 	log.Println("Defere DB")
 
+	// Load the JWT key ring
+	if err := auth.InitKeyRing(); err != nil {
+		log.Fatal("Failed to load JWT keys:", err)
+	}
+	if interval, err := time.ParseDuration(os.Getenv("JWT_KEYS_RELOAD_INTERVAL")); err == nil && interval > 0 && os.Getenv("JWT_KEYS_FILE") != "" {
+		if err := auth.WatchKeyRing(interval); err != nil {
+			log.Fatal("Failed to watch JWT keys:", err)
+		}
+	}
+
+	// Configure outgoing mail (defaults to logging messages)
+	if err := mail.Init(); err != nil {
+		log.Fatal("Failed to configure mail sender:", err)
+	}
+
+	// Configure password hashing and load the breached-password list, if configured
+	if err := password.Init(); err != nil {
+		log.Fatal("Failed to configure password handling:", err)
+	}
+
 	// Create a new router
 	r := mux.NewRouter()
 	log.Println("Routers Start")
@@ -35,8 +62,43 @@ func main() {
 	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
 		handlers.LoginHandler(w, r, db.DB)
 	}).Methods("POST")
+	r.HandleFunc("/login/mfa", handlers.LoginMFAHandler).Methods("POST")
+	r.HandleFunc("/login/mfa/enroll", handlers.LoginMFAEnrollHandler).Methods("POST")
+	r.HandleFunc("/login/password", handlers.LoginPasswordChangeHandler).Methods("POST")
+	r.HandleFunc("/login/magic", handlers.RequestMagicLinkHandler).Methods("POST")
+	r.HandleFunc("/login/magic/redeem", handlers.RedeemMagicLinkHandler).Methods("POST")
+	r.HandleFunc("/login/passkey/begin", handlers.BeginPasskeyLoginHandler).Methods("POST")
+	r.HandleFunc("/login/passkey/finish", handlers.FinishPasskeyLoginHandler).Methods("POST")
+	r.HandleFunc("/login/federated", handlers.ListFederatedConnectionsHandler).Methods("GET")
+	r.HandleFunc("/login/federated/start", handlers.StartFederatedLoginHandler).Methods("GET")
+	r.HandleFunc("/login/federated/callback", handlers.FederatedCallbackHandler).Methods("GET")
+	r.HandleFunc("/login/federated/complete", handlers.CompleteFederatedLoginHandler).Methods("POST")
+	r.HandleFunc("/saml/{tenant_id}/metadata", handlers.SAMLMetadataHandler).Methods("GET")
+	r.HandleFunc("/saml/{tenant_id}/login", handlers.StartSAMLLoginHandler).Methods("GET")
+	r.HandleFunc("/saml/{tenant_id}/acs", handlers.SAMLACSHandler).Methods("POST")
+	r.HandleFunc("/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		handlers.RefreshTokenHandler(w, r, db.DB)
+	}).Methods("POST")
 	r.HandleFunc("/register", handlers.RegisterUser).Methods("POST")
+	r.HandleFunc("/password/forgot", handlers.ForgotPasswordHandler).Methods("POST")
+	r.HandleFunc("/password/reset", handlers.ResetPasswordHandler).Methods("POST")
+	r.HandleFunc("/email/confirm", handlers.ConfirmEmailHandler).Methods("POST")
+	r.HandleFunc("/email/confirm/resend", handlers.ResendConfirmationHandler).Methods("POST")
 	r.HandleFunc("/logout", handlers.LogoutHandler).Methods("POST") // Add this for logout
+	r.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler).Methods("GET")
+	// Forward-auth for apps behind the ingress (nginx auth_request, Traefik ForwardAuth)
+	r.HandleFunc("/auth/verify", handlers.VerifyForwardAuthHandler)
+	// OpenID Connect provider
+	r.HandleFunc("/.well-known/openid-configuration", handlers.OpenIDConfigurationHandler).Methods("GET")
+	r.HandleFunc("/authorize", handlers.AuthorizeHandler).Methods("GET", "POST")
+	r.HandleFunc("/token", handlers.OIDCTokenHandler).Methods("POST")
+	r.HandleFunc("/userinfo", handlers.OIDCUserInfoHandler).Methods("GET", "POST")
+	// OAuth2 token endpoint: client-credentials grant for service accounts, device code grant for CLIs
+	r.HandleFunc("/oauth/token", handlers.OAuthTokenHandler).Methods("POST")
+	r.HandleFunc("/oauth/device/code", handlers.DeviceAuthorizationHandler).Methods("POST")
+	// Token introspection (RFC 7662) and revocation (RFC 7009)
+	r.HandleFunc("/oauth/introspect", handlers.IntrospectTokenHandler).Methods("POST")
+	r.HandleFunc("/oauth/revoke", handlers.RevokeTokenHandler).Methods("POST")
 
 	// Secure routes with JWT middleware
 	secure := r.PathPrefix("/api").Subrouter()
@@ -46,19 +108,94 @@ func main() {
 		return auth.AuthMiddleware(next, db.DB) // Wrap AuthMiddleware to match mux.MiddlewareFunc
 	})
 
+	// Sensitive routes need a recent sign-in, renewed at /api/reauth
+	stepUp := func(h http.HandlerFunc) http.Handler {
+		return auth.RequireStepUp(h, db.DB)
+	}
+	secure.HandleFunc("/reauth", handlers.ReauthenticateHandler).Methods("POST")
+
 	secure.HandleFunc("/user/{id}", handlers.GetUserDetails).Methods("GET")
 	secure.HandleFunc("/userinfo", handlers.GetUserDetails).Methods("GET") // 👈 This is the fix
 	secure.HandleFunc("/user", handlers.UpdateUserDetailsHandler).Methods("PUT")
 	secure.HandleFunc("/user/tenant/{tenant_id}", handlers.GetUsersByTenant).Methods("GET")
-	secure.HandleFunc("/user/{id}", handlers.DeleteUserHandler).Methods("DELETE")
+	secure.Handle("/user/{id}", stepUp(handlers.DeleteUserHandler)).Methods("DELETE")
+
+	secure.HandleFunc("/user/{id}/sessions", handlers.ListUserSessionsHandler).Methods("GET")
+	secure.HandleFunc("/user/{id}/sessions", handlers.RevokeAllUserSessionsHandler).Methods("DELETE")
+	secure.HandleFunc("/user/{id}/sessions/{session_id}", handlers.RevokeUserSessionHandler).Methods("DELETE")
+
+	secure.HandleFunc("/sessions", handlers.ListSessionsHandler).Methods("GET")
+	secure.HandleFunc("/sessions", handlers.RevokeOtherSessionsHandler).Methods("DELETE")
+	secure.HandleFunc("/sessions/{session_id}", handlers.RevokeSessionHandler).Methods("DELETE")
+
+	secure.HandleFunc("/mfa", handlers.GetMFAStatusHandler).Methods("GET")
+	secure.HandleFunc("/mfa/totp", handlers.EnrollTOTPHandler).Methods("POST")
+	secure.HandleFunc("/mfa/totp/verify", handlers.VerifyTOTPHandler).Methods("POST")
+	secure.HandleFunc("/mfa/totp", handlers.DisableMFAHandler).Methods("DELETE")
+	secure.HandleFunc("/mfa/recovery-codes", handlers.RegenerateRecoveryCodesHandler).Methods("POST")
+	secure.HandleFunc("/user/{id}/mfa", handlers.ResetUserMFAHandler).Methods("DELETE")
+	secure.HandleFunc("/user/{id}/unlock", handlers.UnlockUserHandler).Methods("POST")
+	secure.Handle("/impersonate/{user_id}", stepUp(handlers.ImpersonateUserHandler)).Methods("POST")
+
+	secure.HandleFunc("/passkeys", handlers.ListPasskeysHandler).Methods("GET")
+	secure.Handle("/passkeys/register/begin", stepUp(handlers.BeginPasskeyRegistrationHandler)).Methods("POST")
+	secure.Handle("/passkeys/register/finish", stepUp(handlers.FinishPasskeyRegistrationHandler)).Methods("POST")
+	secure.HandleFunc("/passkeys/{id}", handlers.DeletePasskeyHandler).Methods("DELETE")
+
+	secure.HandleFunc("/keys", handlers.ListAPIKeysHandler).Methods("GET")
+	secure.Handle("/keys", stepUp(handlers.CreateAPIKeyHandler)).Methods("POST")
+	secure.HandleFunc("/keys/{id}", handlers.DeleteAPIKeyHandler).Methods("DELETE")
+
+	secure.HandleFunc("/tenant/settings", handlers.GetTenantSettingsHandler).Methods("GET")
+	secure.Handle("/tenant/settings", stepUp(handlers.UpdateTenantSettingsHandler)).Methods("PUT")
+
+	secure.HandleFunc("/oauth/clients", handlers.ListOAuthClientsHandler).Methods("GET")
+	secure.HandleFunc("/oauth/clients", handlers.CreateOAuthClientHandler).Methods("POST")
+	secure.HandleFunc("/oauth/clients/{client_id}", handlers.DeleteOAuthClientHandler).Methods("DELETE")
+
+	secure.HandleFunc("/device", handlers.GetDeviceAuthorizationHandler).Methods("GET")
+	secure.HandleFunc("/device", handlers.ApproveDeviceHandler).Methods("POST")
+
+	secure.HandleFunc("/service-accounts", handlers.ListServiceAccountsHandler).Methods("GET")
+	secure.Handle("/service-accounts", stepUp(handlers.CreateServiceAccountHandler)).Methods("POST")
+	secure.HandleFunc("/service-accounts/{id}", handlers.DeleteServiceAccountHandler).Methods("DELETE")
+	secure.HandleFunc("/service-accounts/{id}/secret", handlers.RotateServiceAccountSecretHandler).Methods("POST")
+
+	secure.HandleFunc("/federation/connections", handlers.ListOIDCConnectionsHandler).Methods("GET")
+	secure.Handle("/federation/connections", stepUp(handlers.CreateOIDCConnectionHandler)).Methods("POST")
+	secure.HandleFunc("/federation/connections/{id}", handlers.DeleteOIDCConnectionHandler).Methods("DELETE")
+
+	secure.HandleFunc("/saml", handlers.GetSAMLConnectionHandler).Methods("GET")
+	secure.Handle("/saml", stepUp(handlers.UpdateSAMLConnectionHandler)).Methods("PUT")
+	secure.HandleFunc("/saml", handlers.DeleteSAMLConnectionHandler).Methods("DELETE")
+
+	secure.HandleFunc("/ldap", handlers.GetLDAPConnectionHandler).Methods("GET")
+	secure.Handle("/ldap", stepUp(handlers.UpdateLDAPConnectionHandler)).Methods("PUT")
+	secure.HandleFunc("/ldap", handlers.DeleteLDAPConnectionHandler).Methods("DELETE")
 
 	secure.HandleFunc("/team", handlers.GetTeamsByTenantHandler).Methods("GET")
 	secure.HandleFunc("/team", handlers.CreateOrUpdateTeamHandler).Methods("POST", "PUT")
-	secure.HandleFunc("/team/{id}", handlers.DeleteTeamHandler).Methods("DELETE")
+	secure.Handle("/team/{id}", stepUp(handlers.DeleteTeamHandler)).Methods("DELETE")
 
 	r.PathPrefix("/api").Handler(secure)
 	log.Println("Routers End")
 
+	// Envoy ext_authz gRPC server, next to the HTTP router
+	extAuthzAddr := os.Getenv("EXT_AUTHZ_ADDR")
+	if extAuthzAddr == "" {
+		extAuthzAddr = ":9191"
+	}
+	lis, err := net.Listen("tcp", extAuthzAddr)
+	if err != nil {
+		log.Fatal("Failed to listen for ext_authz:", err)
+	}
+	grpcServer := grpc.NewServer()
+	extauthz.Register(grpcServer, db.DB)
+	go func() {
+		log.Println("ext_authz gRPC server starting on", extAuthzAddr)
+		log.Fatal(grpcServer.Serve(lis))
+	}()
+
 	log.Println("Sentinel starting on :8080")
 	handler := auth.EnableCORS(r) // ✅ wrap router with CORS middleware
 	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Roles a user or service account can have
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// ValidRole reports whether role is one Sentinel knows
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember
+}
+
+// RoleAllowed reports whether role is one of the comma-separated roles in required
+func RoleAllowed(role, required string) bool {
+	for _, r := range strings.Split(required, ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasModuleAccess reports whether the user was granted access to the named module of
+// the tenant, at any access level
+func HasModuleAccess(dbInstance *sql.DB, userID, tenantID int, module string) (bool, error) {
+	var allowed bool
+	err := dbInstance.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM user_modules um JOIN modules m ON m.id = um.module_id
+			WHERE um.user_id = $1 AND m.tenant_id = $2 AND m.name = $3)`, userID, tenantID, module).Scan(&allowed)
+	return allowed, err
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, so leaked keys are easy to recognise and scan for
+const APIKeyPrefix = "snt_"
+
+// Scopes an API key can be limited to
+const (
+	ScopeRead  = "read"  // GET and HEAD requests
+	ScopeWrite = "write" // Every other method
+)
+
+// ErrInvalidAPIKey is returned by AuthenticateAPIKey for an unknown, expired or deleted key
+var ErrInvalidAPIKey = errors.New("invalid or expired API key")
+
+// APIKeyPrincipal is the user an API key acts for, with the key's scopes
+type APIKeyPrincipal struct {
+	KeyID    int
+	UserID   int
+	TenantID int
+	Email    string
+	Role     string
+	Scopes   []string
+}
+
+// NewAPIKey returns a new random API key and the short prefix shown to identify it
+func NewAPIKey() (key, displayPrefix string, err error) {
+	random, err := RandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	key = APIKeyPrefix + random
+	return key, key[:len(APIKeyPrefix)+6], nil
+}
+
+// ValidScope reports whether s is a scope an API key can have
+func ValidScope(s string) bool {
+	return s == ScopeRead || s == ScopeWrite
+}
+
+// AuthenticateAPIKey looks up an API key by its hash and records its use. The key acts
+// with the current role of its user, so demoting or deleting the user takes effect at once.
+// Keys created before the user's last security-relevant change, like a password reset,
+// are revoked along with the user's tokens (see RevokeUserTokens).
+func AuthenticateAPIKey(dbInstance *sql.DB, key string) (*APIKeyPrincipal, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+	var (
+		p      APIKeyPrincipal
+		scopes []byte
+	)
+	err := dbInstance.QueryRow(`
+		UPDATE api_keys k SET last_used_at = NOW()
+		FROM users u
+		WHERE u.id = k.user_id AND k.key_hash = $1 AND k.expires_at > NOW() AND k.token_version = u.token_version
+		RETURNING k.id, u.id, u.tenant_id, u.email, u.role, k.scopes`, HashToken(key)).
+		Scan(&p.KeyID, &p.UserID, &p.TenantID, &p.Email, &p.Role, &scopes)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(scopes, &p.Scopes); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Allows reports whether the key's scopes cover a request with the given method
+func (p *APIKeyPrincipal) Allows(method string) bool {
+	return scopesAllow(p.Scopes, method)
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	key, prefix, err := NewAPIKey()
+	if err != nil {
+		t.Fatalf("NewAPIKey failed: %v", err)
+	}
+	if !strings.HasPrefix(key, APIKeyPrefix) || !strings.HasPrefix(key, prefix) || len(prefix) >= len(key) {
+		t.Errorf("unexpected key %q with prefix %q", key, prefix)
+	}
+	other, _, _ := NewAPIKey()
+	if other == key {
+		t.Error("expected distinct keys")
+	}
+}
+
+func TestAPIKeyPrincipalAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		method string
+		want   bool
+	}{
+		{[]string{ScopeRead}, http.MethodGet, true},
+		{[]string{ScopeRead}, http.MethodHead, true},
+		{[]string{ScopeRead}, http.MethodPost, false},
+		{[]string{ScopeRead}, http.MethodDelete, false},
+		{[]string{ScopeWrite}, http.MethodGet, true},
+		{[]string{ScopeWrite}, http.MethodPut, true},
+		{nil, http.MethodGet, false},
+	}
+	for _, tt := range tests {
+		p := &APIKeyPrincipal{Scopes: tt.scopes}
+		if got := p.Allows(tt.method); got != tt.want {
+			t.Errorf("scopes %v, %s: expected %v, got %v", tt.scopes, tt.method, tt.want, got)
+		}
+	}
+}
+
+func TestAuthMiddleware_APIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	key := APIKeyPrefix + "abc123"
+	// Keys from before the user's tokens were last revoked no longer match
+	mock.ExpectQuery("UPDATE api_keys k SET last_used_at = NOW\\(\\).*AND k.token_version = u.token_version").
+		WithArgs(HashToken(key)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "tenant_id", "email", "role", "scopes"}).
+			AddRow(3, 7, 42, "ci@example.com", "admin", `["read"]`))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "ApiKey "+key)
+	rr := httptest.NewRecorder()
+
+	called := false
+	handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		ctx := r.Context()
+		if email, _ := GetEmail(ctx); email != "ci@example.com" {
+			t.Errorf("expected email in context, got %q", email)
+		}
+		if tenantID, _ := GetTenantID(ctx); tenantID != 42 {
+			t.Errorf("expected tenantID 42, got %d", tenantID)
+		}
+		if role, _ := GetRole(ctx); role != "admin" {
+			t.Errorf("expected role admin, got %q", role)
+		}
+		if keyID := GetAPIKeyID(ctx); keyID != 3 {
+			t.Errorf("expected API key ID 3, got %d", keyID)
+		}
+	}), db)
+	handler.ServeHTTP(rr, req)
+
+	if !called || rr.Code != http.StatusOK {
+		t.Errorf("expected next handler with 200, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAuthMiddleware_APIKeyRejected(t *testing.T) {
+	tests := []struct {
+		name           string
+		key            string
+		method         string
+		rows           *sqlmock.Rows
+		expectedStatus int
+	}{
+		{"Missing prefix", "abc123", "GET", nil, http.StatusUnauthorized},
+		{"Unknown or expired key", APIKeyPrefix + "unknown", "GET", sqlmock.NewRows([]string{"id"}), http.StatusUnauthorized},
+		{"Read-only key writing", APIKeyPrefix + "readonly", "POST",
+			sqlmock.NewRows([]string{"id", "user_id", "tenant_id", "email", "role", "scopes"}).
+				AddRow(3, 7, 42, "ci@example.com", "member", `["read"]`), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock database: %v", err)
+			}
+			defer db.Close()
+			if tt.rows != nil {
+				mock.ExpectQuery("UPDATE api_keys").WithArgs(HashToken(tt.key)).WillReturnRows(tt.rows)
+			}
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.Header.Set("Authorization", "ApiKey "+tt.key)
+			rr := httptest.NewRecorder()
+			AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Should not call next handler")
+			}), db).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
@@ -2,48 +2,154 @@ package auth
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"sentinel/internal/db"
+	"sentinel/internal/models"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
 // Claims struct to hold JWT claims
+// The jti (StandardClaims.Id) names the server-side session the token belongs to,
+// and TokenVersion must match users.token_version for the token to be accepted.
+// Tokens with a Purpose are single-use links (see SignPurposeToken) and never grant access.
+// Neither do tokens with another audience than AccessTokenAudience, which were issued to
+// another application (see oidc.go).
+// Tokens of service accounts carry PrincipalType and ServiceAccountID instead of a UserID
+// (see serviceaccount.go). Impersonation tokens carry the admin acting as the user in
+// Actor (see impersonation.go). AuthTime and AMR tell when and how the user last proved
+// who they are, for operations that need a recent sign-in (see stepup.go).
 type Claims struct {
-	Email    string `json:"email"`
-	TenantID int    `json:"tenant_id"` // Add Tenant ID to support multi-tenancy
-	Role     string `json:"role"`
+	Email            string   `json:"email"`
+	TenantID         int      `json:"tenant_id"` // Add Tenant ID to support multi-tenancy
+	Role             string   `json:"role"`
+	UserID           int      `json:"user_id,omitempty"`
+	TokenVersion     int      `json:"ver,omitempty"`
+	Purpose          string   `json:"purpose,omitempty"`
+	Scope            string   `json:"scope,omitempty"` // Granted scopes of an OIDC or service account access token
+	PrincipalType    string   `json:"principal_type,omitempty"`
+	ServiceAccountID int      `json:"service_account_id,omitempty"`
+	Actor            *Actor   `json:"act,omitempty"`
+	AuthTime         int64    `json:"auth_time,omitempty"`
+	AMR              []string `json:"amr,omitempty"`
 	jwt.StandardClaims
 }
 
+// jwtKey is the development fallback used when no keys are configured, see LoadKeyRing
 const jwtKey string = "ikud1U6vzc8OhVoNw0vadTKt7MA20Vlk"
 
-// GenerateJWT creates a JWT for authenticated users
-func GenerateJWT(email string, tenantID int, role string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	log.Println("JWT Generation started. jwtkey")
-	claims := &Claims{
+// NewClaims builds access token claims that expire after AccessTokenTTL
+func NewClaims(email string, tenantID int, role string) *Claims {
+	now := time.Now()
+	return &Claims{
 		Email:    email,
 		TenantID: tenantID,
 		Role:     role,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL()).Unix(),
 		},
 	}
-	log.Println(claims)
+}
+
+// GenerateJWT creates a JWT for authenticated users
+func GenerateJWT(email string, tenantID int, role string) (string, error) {
+	log.Println("JWT Generation started.")
+	claims := NewClaims(email, tenantID, role)
+
+	return SignClaims(claims)
+}
+
+// GenerateSessionJWT creates a JWT bound to a user's server-side session and token version,
+// carrying the session's last authentication
+func GenerateSessionJWT(user models.User, sessionID string, authn Authentication) (string, error) {
+	claims := NewClaims(user.Email, user.TenantID, user.Role)
+	claims.UserID = user.ID
+	claims.TokenVersion = user.TokenVersion
+	claims.Id = sessionID
+	if !authn.Time.IsZero() {
+		claims.AuthTime = authn.Time.Unix()
+	}
+	claims.AMR = authn.Methods
+	return SignClaims(claims)
+}
+
+// AccessTokenType is the typ header of access tokens (RFC 9068). Purpose tokens and ID
+// tokens are signed with the same keys but keep the default typ.
+const AccessTokenType = "at+jwt"
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	jwtKey := []byte(jwtKey)
-	log.Println("JWT Generation started. jwtkey")
-	log.Println(jwtKey)
-	tokenString, err := token.SignedString(jwtKey)
+// AccessTokenAudience is the aud of access tokens: Sentinel's own API, at Issuer. ID tokens
+// and OIDC access tokens name the client instead, purpose tokens have no aud.
+func AccessTokenAudience() string {
+	return Issuer()
+}
+
+// SignClaims signs access token claims with the current key of the key ring. It sets the
+// kid and typ headers and the iss and aud claims, so offline verifiers can tell access
+// tokens from the other tokens signed with the published keys.
+func SignClaims(claims *Claims) (string, error) {
+	claims.Issuer = Issuer()
+	claims.Audience = AccessTokenAudience()
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	return signWithKey(key, claims, AccessTokenType)
+}
+
+// signToken signs any claims set with the current key of the key ring
+func signToken(claims jwt.Claims) (string, error) {
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	return signWithKey(key, claims, "")
+}
+
+// currentSigningKey is the key of the key ring that signs new tokens
+func currentSigningKey() (SigningKey, error) {
+	kr, err := currentKeyRing()
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return kr.SigningKey(time.Now())
+}
+
+// signWithKey signs any claims set with the given key and sets the kid header, and the
+// typ header unless it is empty
+func signWithKey(key SigningKey, claims jwt.Claims, typ string) (string, error) {
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
+	tokenString, err := token.SignedString(key.signKey)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
+// keyFunc resolves the verification key for a token from its kid header.
+// The token's alg must match the key's algorithm so a public key can never be used as an HMAC secret.
+func keyFunc(token *jwt.Token) (interface{}, error) {
+	kr, err := currentKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, err := kr.VerificationKey(kid, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
 // Patch point for blacklist check
 var isTokenBlacklisted = func(token string) (bool, error) {
 	var exists bool
@@ -57,19 +163,30 @@ var ValidateToken = validateToken
 func validateToken(tokenStr string) (*Claims, error) {
 	log.Println("Starting JWT token validation...")
 
-	// Fetch JWT secret from environment variables
-	if jwtKey == "" {
-		log.Println("JWT secret not found in environment variables.")
-		return nil, errors.New("JWT secret not found")
+	claims, err := ParseAccessToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the token is blacklisted
+	exists, err := isTokenBlacklisted(tokenStr)
+	if err != nil {
+		log.Println("Token blacklist check error.")
+		return nil, errors.New("token is expired")
+	}
+	if exists {
+		log.Println("Token in token_blacklist.")
+		return nil, errors.New("token is expired")
 	}
+	return claims, nil
+}
 
-	log.Println("JWT secret successfully loaded.")
+// ParseAccessToken checks the signature and expiry of an access token, without the blacklist
+func ParseAccessToken(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
 
-	// Parse the token with claims
-	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(jwtKey), nil
-	})
+	// Parse the token with claims, picking the key by its kid header
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keyFunc)
 
 	if err != nil {
 		log.Printf("Error parsing token: %v\n", err)
@@ -85,15 +202,17 @@ func validateToken(tokenStr string) (*Claims, error) {
 		return nil, errors.New("error validating token")
 	}
 
-	// Check if the token is blacklisted
-	exists, err := isTokenBlacklisted(tokenStr)
-	if err != nil {
-		log.Println("Token blacklist check error.")
-		return nil, errors.New("token is expired")
+	// Single-use link and challenge tokens never grant access
+	if claims.Purpose != "" {
+		log.Println("Purpose token used as an access token.")
+		return nil, errors.New("invalid token")
 	}
-	if exists {
-		log.Println("Token in token_blacklist.")
-		return nil, errors.New("token is expired")
+
+	// ID tokens and OIDC access tokens belong to the application they were issued to.
+	// Access tokens issued before they carried an aud have none.
+	if claims.Audience != "" && claims.Audience != AccessTokenAudience() {
+		log.Println("Token issued to an OIDC client used as an access token.")
+		return nil, errors.New("invalid token")
 	}
 
 	if !token.Valid {
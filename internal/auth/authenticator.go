@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"sentinel/internal/password"
+)
+
+var (
+	// ErrInvalidCredentials is returned by an Authenticator when the password is wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnknownUser is returned by an Authenticator that has no account for the email
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// Identity is what a login backend knows about the user it authenticated
+type Identity struct {
+	Email  string
+	Name   string   // Display name, when the backend has one
+	Groups []string // Groups the user is a member of, when the backend has them
+	// NeedsRehash is set by the password backend when the stored hash uses an outdated
+	// algorithm or cost and should be upgraded while the password is at hand
+	NeedsRehash bool
+}
+
+// Authenticator checks the email and password a user typed at /login against one backend
+type Authenticator interface {
+	Authenticate(ctx context.Context, email, password string) (*Identity, error)
+}
+
+// PasswordAuthenticator checks the password against the hash Sentinel stores for the user.
+// An empty hash means Sentinel has no such user.
+type PasswordAuthenticator struct {
+	Hash string
+}
+
+func (a PasswordAuthenticator) Authenticate(ctx context.Context, email, pw string) (*Identity, error) {
+	if a.Hash == "" {
+		return nil, ErrUnknownUser
+	}
+	ok, outdated, err := password.Verify(pw, a.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Email: email, NeedsRehash: outdated}, nil
+}
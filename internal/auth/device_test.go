@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewUserCode(t *testing.T) {
+	format := regexp.MustCompile(`^[` + userCodeAlphabet + `]{4}-[` + userCodeAlphabet + `]{4}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		code, err := NewUserCode()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !format.MatchString(code) {
+			t.Errorf("unexpected user code %q", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) < 19 {
+		t.Errorf("expected random user codes, got %v", seen)
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	for input, expected := range map[string]string{
+		"WDJB-MJHT":  "WDJBMJHT",
+		"wdjb mjht":  "WDJBMJHT",
+		" Wdjb-mJht": "WDJBMJHT",
+		"":           "",
+	} {
+		if got := NormalizeUserCode(input); got != expected {
+			t.Errorf("NormalizeUserCode(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
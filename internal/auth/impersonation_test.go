@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSignImpersonationToken(t *testing.T) {
+	useKeyRing(t, SigningKey{ID: "k1", Secret: "secret-1"})
+	noBlacklist(t)
+
+	target := models.User{ID: 7, TenantID: 1, Email: "user@example.com", Role: "member", TokenVersion: 4}
+	token, err := SignImpersonationToken(target, Actor{Subject: "3", UserID: 3, Email: "admin@example.com", TokenVersion: 2}, "admin-session")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	claims, err := ValidateToken(token)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if claims.UserID != 7 || claims.Subject != "7" || claims.TokenVersion != 4 || claims.Id != "admin-session" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if claims.Actor == nil || claims.Actor.UserID != 3 || claims.Actor.Subject != "3" || claims.Actor.TokenVersion != 2 {
+		t.Errorf("unexpected act claim: %+v", claims.Actor)
+	}
+	if ttl := time.Until(time.Unix(claims.ExpiresAt, 0)); ttl > ImpersonationTTL() {
+		t.Errorf("expected the token to expire within %s, got %s", ImpersonationTTL(), ttl)
+	}
+}
+
+func TestAuthMiddleware_Impersonation(t *testing.T) {
+	orig := ValidateToken
+	t.Cleanup(func() { ValidateToken = orig })
+	ValidateToken = func(token string) (*Claims, error) {
+		return &Claims{Email: "user@example.com", TenantID: 1, Role: "member", UserID: 7,
+			Actor: &Actor{Subject: "3", UserID: 3, TokenVersion: 2}}, nil
+	}
+
+	tests := []struct {
+		name           string
+		actorVersion   int
+		auditErr       error
+		expectedStatus int
+	}{
+		{"Request is audited", 2, nil, http.StatusOK},
+		{"Admin changed password or role since", 3, nil, http.StatusUnauthorized},
+		{"Request that cannot be audited is refused", 2, sqlmock.ErrCancelled, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock database: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery(`SELECT token_version FROM users WHERE id = \$1`).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+			mock.ExpectQuery(`SELECT token_version FROM users WHERE id = \$1`).WithArgs(3).
+				WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(tt.actorVersion))
+			if tt.actorVersion == 2 {
+				exec := mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 3, "impersonated_request", "user@example.com", sqlmock.AnyArg(), sqlmock.AnyArg())
+				if tt.auditErr != nil {
+					exec.WillReturnError(tt.auditErr)
+				} else {
+					exec.WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/userinfo", nil)
+			req.Header.Set("Authorization", "Bearer impersonation-token")
+			rr := httptest.NewRecorder()
+			AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if actorID := GetActorID(r.Context()); actorID != 3 {
+					t.Errorf("expected actor 3 in the context, got %d", actorID)
+				}
+				w.WriteHeader(http.StatusOK)
+			}), db).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
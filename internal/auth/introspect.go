@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"database/sql"
+	"strconv"
+)
+
+// TokenInfo is what introspection learns about an access token
+type TokenInfo struct {
+	Active  bool
+	Revoked bool    // Blacklisted, or revoked through its user, session or service account
+	Claims  *Claims // Set for every well-signed, unexpired access token, active or not
+}
+
+// SubjectID names the principal of the token: the user ID, the service account, or the
+// email of tokens that carry no user ID
+func (c *Claims) SubjectID() string {
+	switch {
+	case c.ServiceAccountID != 0:
+		return PrincipalServiceAccount + ":" + strconv.Itoa(c.ServiceAccountID)
+	case c.UserID != 0:
+		return strconv.Itoa(c.UserID)
+	}
+	return c.Email
+}
+
+// IntrospectToken runs the checks of Authenticate on an access token and reports why a
+// valid signature is no longer accepted. Unlike Authenticate it does not mark the
+// token's session as used.
+func IntrospectToken(dbInstance *sql.DB, tokenStr string) (TokenInfo, error) {
+	claims, err := ParseAccessToken(tokenStr)
+	if err != nil {
+		return TokenInfo{}, nil
+	}
+	info := TokenInfo{Claims: claims}
+
+	var blacklisted bool
+	if err := dbInstance.QueryRow("SELECT EXISTS(SELECT 1 FROM token_blacklist WHERE token=$1)", tokenStr).Scan(&blacklisted); err != nil {
+		return info, err
+	}
+	if blacklisted {
+		info.Revoked = true
+		return info, nil
+	}
+
+	check := func(err error) (bool, error) {
+		if err == ErrTokenRevoked {
+			info.Revoked = true
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if claims.UserID != 0 {
+		if ok, err := check(checkTokenVersion(dbInstance, claims)); !ok {
+			return info, err
+		}
+	}
+	if claims.Actor != nil {
+		if ok, err := check(checkActor(dbInstance, claims.Actor)); !ok {
+			return info, err
+		}
+	}
+	if claims.ServiceAccountID != 0 {
+		if ok, err := check(checkServiceAccount(dbInstance, claims)); !ok {
+			return info, err
+		}
+	}
+	if claims.Id != "" {
+		var active bool
+		err := dbInstance.QueryRow(`SELECT EXISTS(SELECT 1 FROM sessions WHERE jti = $1 AND revoked_at IS NULL)`, claims.Id).Scan(&active)
+		if err != nil {
+			return info, err
+		}
+		if !active {
+			info.Revoked = true
+			return info, nil
+		}
+	}
+	info.Active = true
+	return info, nil
+}
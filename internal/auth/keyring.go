@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SigningKey is one entry of the JWT key ring.
+// A key signs new tokens from NotBefore onwards (until a newer key takes over)
+// and keeps verifying tokens until RetireAt. Zero times mean "no limit".
+//
+// HS256 keys use Secret. RS256, ES256 and EdDSA keys are read from PEM files;
+// with Generate set a missing PrivateKeyFile is created, or an in-memory key is
+// generated when no file is given. A key with only PublicKeyFile verifies but never signs.
+type SigningKey struct {
+	ID             string    `json:"kid"`
+	Algorithm      string    `json:"alg,omitempty"`
+	Secret         string    `json:"secret,omitempty"`
+	PrivateKeyFile string    `json:"private_key_file,omitempty"`
+	PublicKeyFile  string    `json:"public_key_file,omitempty"`
+	Generate       bool      `json:"generate,omitempty"`
+	NotBefore      time.Time `json:"not_before,omitempty"`
+	RetireAt       time.Time `json:"retire_at,omitempty"`
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeyRing holds every key that may sign or verify tokens
+type KeyRing struct {
+	keys []SigningKey
+}
+
+// defaultKeyID is used when a single secret is configured without a kid
+const defaultKeyID = "default"
+
+// NewKeyRing validates the keys, loads their key material and builds a key ring from them
+func NewKeyRing(keys []SigningKey) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("key ring needs at least one key")
+	}
+	keys = append([]SigningKey(nil), keys...)
+	seen := make(map[string]bool)
+	for i := range keys {
+		if err := keys[i].load(); err != nil {
+			return nil, err
+		}
+		k := keys[i]
+		if k.ID == "" {
+			return nil, errors.New("key ring entry without kid")
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("duplicate kid %q in key ring", k.ID)
+		}
+		if !k.RetireAt.IsZero() && !k.NotBefore.IsZero() && !k.RetireAt.After(k.NotBefore) {
+			return nil, fmt.Errorf("key %q retires before it becomes active", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return &KeyRing{keys: keys}, nil
+}
+
+func (k SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// SigningKey returns the key new tokens should be signed with.
+// It is the active key with the most recent NotBefore; on a tie the key listed first wins.
+func (kr *KeyRing) SigningKey(now time.Time) (SigningKey, error) {
+	var (
+		best  SigningKey
+		found bool
+	)
+	for _, k := range kr.keys {
+		if !k.canSign() || k.retired(now) || now.Before(k.NotBefore) {
+			continue
+		}
+		if !found || k.NotBefore.After(best.NotBefore) {
+			best = k
+			found = true
+		}
+	}
+	if !found {
+		return SigningKey{}, errors.New("no active signing key")
+	}
+	return best, nil
+}
+
+// VerificationKey returns the key with the given kid if it has not been retired.
+// Keys that are not yet signing still verify, so they can be rolled out ahead of time.
+// Tokens without a kid predate the key ring and are checked against the current signing key.
+func (kr *KeyRing) VerificationKey(kid string, now time.Time) (SigningKey, error) {
+	if kid == "" {
+		return kr.SigningKey(now)
+	}
+	for _, k := range kr.keys {
+		if k.ID != kid {
+			continue
+		}
+		if k.retired(now) {
+			return SigningKey{}, fmt.Errorf("key %q is retired", kid)
+		}
+		return k, nil
+	}
+	return SigningKey{}, fmt.Errorf("unknown key %q", kid)
+}
+
+// PublicJWKS returns the public keys of every non-retired asymmetric key.
+// Shared HS256 secrets are never published.
+func (kr *KeyRing) PublicJWKS(now time.Time) JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range kr.keys {
+		if k.retired(now) {
+			continue
+		}
+		if jwk, ok := k.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// LoadKeyRing builds the key ring from the environment.
+// Sources are tried in order:
+//   - JWT_KEYS_FILE: path to a JSON array of SigningKey entries
+//   - JWT_SIGNING_ALG: RS256, ES256 or EdDSA key read from (or generated at) JWT_PRIVATE_KEY_FILE,
+//     which is required,
+//     with JWT_SECRET kept as a verify key while HS256 tokens expire
+//   - JWT_KEYS: comma separated "kid:secret" pairs, the first pair signs
+//   - JWT_SECRET: a single secret with kid "default"
+//
+// Without any of them the built-in development key is used.
+func LoadKeyRing() (*KeyRing, error) {
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		return loadKeyRingFile(path)
+	}
+	if alg := os.Getenv("JWT_SIGNING_ALG"); alg != "" && alg != AlgHS256 {
+		// Replicas must share the key, so it is never generated in memory here
+		path := os.Getenv("JWT_PRIVATE_KEY_FILE")
+		if path == "" {
+			return nil, errors.New("JWT_SIGNING_ALG needs JWT_PRIVATE_KEY_FILE")
+		}
+		keys := []SigningKey{{
+			ID:             os.Getenv("JWT_KEY_ID"),
+			Algorithm:      alg,
+			PrivateKeyFile: path,
+			Generate:       true,
+		}}
+		if secret := os.Getenv("JWT_SECRET"); secret != "" {
+			keys = append(keys, SigningKey{ID: defaultKeyID, Secret: secret})
+		}
+		return NewKeyRing(keys)
+	}
+	if list := os.Getenv("JWT_KEYS"); list != "" {
+		keys, err := parseKeyList(list)
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyRing(keys)
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return NewKeyRing([]SigningKey{{ID: defaultKeyID, Secret: secret}})
+	}
+	log.Println("No JWT keys configured, falling back to the built-in development key")
+	return NewKeyRing([]SigningKey{{ID: defaultKeyID, Secret: jwtKey}})
+}
+
+func loadKeyRingFile(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	var keys []SigningKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parsing key file: %w", err)
+	}
+	return NewKeyRing(keys)
+}
+
+func parseKeyList(list string) ([]SigningKey, error) {
+	var keys []SigningKey
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, secret, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("JWT_KEYS entry %q is not kid:secret", kid)
+		}
+		keys = append(keys, SigningKey{ID: kid, Secret: secret})
+	}
+	return keys, nil
+}
+
+// PublicJWKS returns the published keys of the process wide key ring
+func PublicJWKS() (JWKSet, error) {
+	kr, err := currentKeyRing()
+	if err != nil {
+		return JWKSet{}, err
+	}
+	return kr.PublicJWKS(time.Now()), nil
+}
+
+// Process wide key ring, loaded lazily from the environment
+var (
+	keyRing   *KeyRing
+	keyRingMu sync.RWMutex
+)
+
+// InitKeyRing loads the key ring from the environment and installs it
+func InitKeyRing() error {
+	kr, err := LoadKeyRing()
+	if err != nil {
+		return err
+	}
+	SetKeyRing(kr)
+	return nil
+}
+
+// SetKeyRing replaces the key ring used to sign and verify tokens
+func SetKeyRing(kr *KeyRing) {
+	keyRingMu.Lock()
+	defer keyRingMu.Unlock()
+	keyRing = kr
+}
+
+func currentKeyRing() (*KeyRing, error) {
+	keyRingMu.RLock()
+	kr := keyRing
+	keyRingMu.RUnlock()
+	if kr != nil {
+		return kr, nil
+	}
+
+	keyRingMu.Lock()
+	defer keyRingMu.Unlock()
+	if keyRing == nil {
+		loaded, err := LoadKeyRing()
+		if err != nil {
+			return nil, err
+		}
+		keyRing = loaded
+	}
+	return keyRing, nil
+}
+
+// inMemory reports whether the key was generated without a file to keep it in. Loading
+// its entry again generates a different key.
+func (k SigningKey) inMemory() bool {
+	return k.Generate && k.PrivateKeyFile == "" && k.PublicKeyFile == ""
+}
+
+// checkReloadable fails for key rings with in-memory keys: every reload would replace
+// them and invalidate the tokens they signed
+func checkReloadable(kr *KeyRing) error {
+	for _, k := range kr.keys {
+		if k.inMemory() {
+			return fmt.Errorf("key %q is generated in memory and cannot be reloaded; give it a private_key_file", k.ID)
+		}
+	}
+	return nil
+}
+
+// WatchKeyRing starts reloading the key ring every interval so keys added to
+// JWT_KEYS_FILE are picked up without a restart. A failed reload keeps the old ring.
+// Key rings with in-memory keys cannot be reloaded.
+func WatchKeyRing(interval time.Duration) error {
+	kr, err := currentKeyRing()
+	if err != nil {
+		return err
+	}
+	if err := checkReloadable(kr); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := reloadKeyRing(); err != nil {
+				log.Println("Key ring reload failed:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadKeyRing loads the key ring from the environment again and installs it
+func reloadKeyRing() error {
+	kr, err := LoadKeyRing()
+	if err != nil {
+		return err
+	}
+	if err := checkReloadable(kr); err != nil {
+		return err
+	}
+	SetKeyRing(kr)
+	return nil
+}
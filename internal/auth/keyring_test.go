@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// useKeyRing installs a key ring for the duration of a test
+func useKeyRing(t *testing.T, keys ...SigningKey) {
+	t.Helper()
+	kr, err := NewKeyRing(keys)
+	if err != nil {
+		t.Fatalf("failed to build key ring: %v", err)
+	}
+	orig := keyRing
+	SetKeyRing(kr)
+	t.Cleanup(func() { SetKeyRing(orig) })
+}
+
+// noBlacklist disables the blacklist lookup for the duration of a test
+func noBlacklist(t *testing.T) {
+	t.Helper()
+	orig := isTokenBlacklisted
+	isTokenBlacklisted = func(token string) (bool, error) { return false, nil }
+	t.Cleanup(func() { isTokenBlacklisted = orig })
+}
+
+func TestNewKeyRing_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []SigningKey
+	}{
+		{"empty", nil},
+		{"missing kid", []SigningKey{{Secret: "s"}}},
+		{"missing secret", []SigningKey{{ID: "a"}}},
+		{"duplicate kid", []SigningKey{{ID: "a", Secret: "s"}, {ID: "a", Secret: "t"}}},
+		{"retires before active", []SigningKey{{
+			ID: "a", Secret: "s",
+			NotBefore: time.Unix(200, 0),
+			RetireAt:  time.Unix(100, 0),
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyRing(tt.keys); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestKeyRing_SigningKeySchedule(t *testing.T) {
+	now := time.Now()
+	kr, err := NewKeyRing([]SigningKey{
+		{ID: "old", Secret: "old-secret", RetireAt: now.Add(time.Hour)},
+		{ID: "current", Secret: "current-secret", NotBefore: now.Add(-time.Minute)},
+		{ID: "next", Secret: "next-secret", NotBefore: now.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("failed to build key ring: %v", err)
+	}
+
+	key, err := kr.SigningKey(now)
+	if err != nil || key.ID != "current" {
+		t.Errorf("expected current key, got %q, err: %v", key.ID, err)
+	}
+	key, err = kr.SigningKey(now.Add(2 * time.Hour))
+	if err != nil || key.ID != "next" {
+		t.Errorf("expected next key after rollover, got %q, err: %v", key.ID, err)
+	}
+
+	// Keys that are not signing yet still verify
+	if _, err := kr.VerificationKey("next", now); err != nil {
+		t.Errorf("expected next key to verify, got %v", err)
+	}
+	if _, err := kr.VerificationKey("old", now.Add(2*time.Hour)); err == nil {
+		t.Error("expected retired key to be rejected")
+	}
+	if _, err := kr.VerificationKey("missing", now); err == nil {
+		t.Error("expected unknown key to be rejected")
+	}
+}
+
+func TestLoadKeyRing_Sources(t *testing.T) {
+	t.Setenv("JWT_KEYS_FILE", "")
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("JWT_SECRET", "")
+
+	kr, err := LoadKeyRing()
+	if err != nil {
+		t.Fatalf("Expected fallback key ring, got error: %v", err)
+	}
+	if key, _ := kr.SigningKey(time.Now()); key.Secret != jwtKey {
+		t.Error("expected development key without configuration")
+	}
+
+	t.Setenv("JWT_SECRET", "from-env")
+	kr, err = LoadKeyRing()
+	if err != nil {
+		t.Fatalf("Expected key ring from JWT_SECRET, got error: %v", err)
+	}
+	if key, _ := kr.SigningKey(time.Now()); key.ID != defaultKeyID || key.Secret != "from-env" {
+		t.Errorf("unexpected key from JWT_SECRET: %+v", key)
+	}
+
+	t.Setenv("JWT_KEYS", "k2:second, k1:first")
+	kr, err = LoadKeyRing()
+	if err != nil {
+		t.Fatalf("Expected key ring from JWT_KEYS, got error: %v", err)
+	}
+	if key, _ := kr.SigningKey(time.Now()); key.ID != "k2" {
+		t.Errorf("expected first JWT_KEYS entry to sign, got %q", key.ID)
+	}
+	if _, err := kr.VerificationKey("k1", time.Now()); err != nil {
+		t.Errorf("expected k1 to verify, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data := `[{"kid":"file-old","secret":"a","retire_at":"2000-01-01T00:00:00Z"},{"kid":"file-new","secret":"b"}]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	t.Setenv("JWT_KEYS_FILE", path)
+	kr, err = LoadKeyRing()
+	if err != nil {
+		t.Fatalf("Expected key ring from file, got error: %v", err)
+	}
+	if key, _ := kr.SigningKey(time.Now()); key.ID != "file-new" {
+		t.Errorf("expected file-new to sign, got %q", key.ID)
+	}
+
+	t.Setenv("JWT_KEYS_FILE", "")
+	t.Setenv("JWT_KEYS", "no-separator")
+	if _, err := LoadKeyRing(); err == nil {
+		t.Error("expected error for malformed JWT_KEYS")
+	}
+
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("JWT_SIGNING_ALG", AlgES256)
+	t.Setenv("JWT_PRIVATE_KEY_FILE", "")
+	if _, err := LoadKeyRing(); err == nil {
+		t.Error("expected JWT_SIGNING_ALG without JWT_PRIVATE_KEY_FILE to be refused")
+	}
+	t.Setenv("JWT_PRIVATE_KEY_FILE", filepath.Join(t.TempDir(), "es256.pem"))
+	kr, err = LoadKeyRing()
+	if err != nil {
+		t.Fatalf("Expected key ring from JWT_SIGNING_ALG, got error: %v", err)
+	}
+	if key, _ := kr.SigningKey(time.Now()); key.Algorithm != AlgES256 {
+		t.Errorf("expected an ES256 signing key, got %+v", key)
+	}
+}
+
+func TestValidateToken_KeyRotation(t *testing.T) {
+	noBlacklist(t)
+	useKeyRing(t, SigningKey{ID: "k1", Secret: "first-secret"})
+
+	oldToken, err := GenerateJWT("test@example.com", 1, "admin")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(oldToken, &Claims{})
+	if parsed.Header["kid"] != "k1" {
+		t.Errorf("expected kid header k1, got %v", parsed.Header["kid"])
+	}
+
+	// Rotate: k2 signs, k1 still verifies
+	useKeyRing(t,
+		SigningKey{ID: "k2", Secret: "second-secret", NotBefore: time.Now().Add(-time.Second)},
+		SigningKey{ID: "k1", Secret: "first-secret"},
+	)
+	newToken, err := GenerateJWT("test@example.com", 1, "admin")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	parsed, _, _ = new(jwt.Parser).ParseUnverified(newToken, &Claims{})
+	if parsed.Header["kid"] != "k2" {
+		t.Errorf("expected kid header k2, got %v", parsed.Header["kid"])
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := ValidateToken(token); err != nil {
+			t.Errorf("Expected valid token during rotation, got error: %v", err)
+		}
+	}
+
+	// Retire k1: tokens signed with it are rejected
+	useKeyRing(t,
+		SigningKey{ID: "k2", Secret: "second-secret"},
+		SigningKey{ID: "k1", Secret: "first-secret", RetireAt: time.Now().Add(-time.Second)},
+	)
+	if _, err := ValidateToken(oldToken); err == nil {
+		t.Error("Expected token signed with a retired key to be rejected")
+	}
+	if _, err := ValidateToken(newToken); err != nil {
+		t.Errorf("Expected valid token, got error: %v", err)
+	}
+}
+
+func TestWatchKeyRing_InMemoryKey(t *testing.T) {
+	useKeyRing(t, SigningKey{ID: "ec", Algorithm: AlgES256, Generate: true})
+	if err := WatchKeyRing(time.Hour); err == nil {
+		t.Error("expected a key ring with an in-memory key not to be reloaded")
+	}
+}
+
+func TestReloadKeyRing_KeepsKeyFromFile(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys.json")
+	os.WriteFile(keysFile, []byte(`[{"kid": "ed", "alg": "EdDSA", "private_key_file": "`+filepath.Join(dir, "ed.pem")+`", "generate": true}]`), 0o600)
+	t.Setenv("JWT_KEYS_FILE", keysFile)
+	useKeyRing(t, SigningKey{ID: "default", Secret: "secret"})
+
+	if err := reloadKeyRing(); err != nil {
+		t.Fatalf("expected reload to succeed, got %v", err)
+	}
+	claims := jwt.StandardClaims{Subject: "1", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	token, err := signToken(claims)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	if err := reloadKeyRing(); err != nil {
+		t.Fatalf("expected reload to succeed, got %v", err)
+	}
+	kr, _ := currentKeyRing()
+	if _, err := jwt.Parse(token, func(tok *jwt.Token) (interface{}, error) {
+		k, err := kr.VerificationKey(tok.Header["kid"].(string), time.Now())
+		return k.verifyKey, err
+	}); err != nil {
+		t.Errorf("expected a token signed before the reload to verify, got %v", err)
+	}
+
+	os.WriteFile(keysFile, []byte(`[{"kid": "ec", "alg": "ES256", "generate": true}]`), 0o600)
+	if err := reloadKeyRing(); err == nil {
+		t.Error("expected an in-memory key to be refused on reload")
+	}
+}
@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// JWK is the public half of a signing key as published in the JWKS document
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// load resolves the key material of an asymmetric key from disk, generating it when requested
+func (k *SigningKey) load() error {
+	if k.Algorithm == "" {
+		k.Algorithm = AlgHS256
+	}
+	if k.Algorithm == AlgHS256 {
+		if k.Secret == "" {
+			return fmt.Errorf("key %q has an empty secret", k.ID)
+		}
+		k.signKey = []byte(k.Secret)
+		k.verifyKey = []byte(k.Secret)
+		return nil
+	}
+	if k.Algorithm != AlgRS256 && k.Algorithm != AlgES256 && k.Algorithm != AlgEdDSA {
+		return fmt.Errorf("key %q has unsupported algorithm %q", k.ID, k.Algorithm)
+	}
+
+	switch {
+	case k.PrivateKeyFile != "":
+		data, err := os.ReadFile(k.PrivateKeyFile)
+		if errors.Is(err, os.ErrNotExist) && k.Generate {
+			return k.generate()
+		}
+		if err != nil {
+			return fmt.Errorf("reading private key for %q: %w", k.ID, err)
+		}
+		priv, err := parsePrivateKey(k.Algorithm, data)
+		if err != nil {
+			return fmt.Errorf("parsing private key for %q: %w", k.ID, err)
+		}
+		k.signKey = priv
+		k.verifyKey = priv.Public()
+	case k.PublicKeyFile != "":
+		// Verify-only key, e.g. a retired key whose private half was destroyed
+		data, err := os.ReadFile(k.PublicKeyFile)
+		if err != nil {
+			return fmt.Errorf("reading public key for %q: %w", k.ID, err)
+		}
+		pub, err := parsePublicKey(k.Algorithm, data)
+		if err != nil {
+			return fmt.Errorf("parsing public key for %q: %w", k.ID, err)
+		}
+		k.verifyKey = pub
+	case k.Generate:
+		log.Printf("Generating an in-memory %s key; tokens will not verify across restarts or replicas", k.Algorithm)
+		return k.generate()
+	default:
+		return fmt.Errorf("key %q needs private_key_file, public_key_file or generate", k.ID)
+	}
+
+	if k.ID == "" {
+		k.ID = thumbprint(k.verifyKey)
+	}
+	return nil
+}
+
+// generate creates a fresh key pair and writes it to PrivateKeyFile when one is set
+func (k *SigningKey) generate() error {
+	var (
+		priv crypto.Signer
+		err  error
+	)
+	switch k.Algorithm {
+	case AlgRS256:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return fmt.Errorf("generating %s key: %w", k.Algorithm, err)
+	}
+
+	if k.PrivateKeyFile != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(k.PrivateKeyFile, data, 0o600); err != nil {
+			return fmt.Errorf("writing private key for %q: %w", k.ID, err)
+		}
+		log.Printf("Generated %s key at %s", k.Algorithm, k.PrivateKeyFile)
+	}
+
+	k.signKey = priv
+	k.verifyKey = priv.Public()
+	if k.ID == "" {
+		k.ID = thumbprint(k.verifyKey)
+	}
+	return nil
+}
+
+func parsePrivateKey(alg string, data []byte) (crypto.Signer, error) {
+	switch alg {
+	case AlgRS256:
+		return jwt.ParseRSAPrivateKeyFromPEM(data)
+	case AlgES256:
+		key, err := jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 needs a P-256 key")
+		}
+		return key, nil
+	default:
+		key, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("not an Ed25519 private key")
+		}
+		return signer, nil
+	}
+}
+
+func parsePublicKey(alg string, data []byte) (crypto.PublicKey, error) {
+	switch alg {
+	case AlgRS256:
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	case AlgES256:
+		key, err := jwt.ParseECPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 needs a P-256 key")
+		}
+		return key, nil
+	default:
+		return jwt.ParseEdPublicKeyFromPEM(data)
+	}
+}
+
+// canSign reports whether the private half of the key is available
+func (k SigningKey) canSign() bool {
+	return k.signKey != nil
+}
+
+func (k SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// JWK returns the public JWK of an asymmetric key; ok is false for shared secrets
+func (k SigningKey) JWK() (jwk JWK, ok bool) {
+	jwk = JWK{KeyID: k.ID, Use: "sig", Algorithm: k.Algorithm}
+	switch pub := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = b64(pub.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = b64(pub.X.FillBytes(make([]byte, 32)))
+		jwk.Y = b64(pub.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = b64(pub)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+// PublicKey decodes the key material of a JWK, such as one published by an upstream identity provider
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch j.KeyType {
+	case "RSA":
+		n, e := decode(j.N), decode(j.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA JWK")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[j.Curve]
+		x, y := decode(j.X), decode(j.Y)
+		if !ok || x == nil || y == nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC JWK")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if j.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP JWK")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported JWK key type %q", j.KeyType)
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint, used as kid when none is configured
+func thumbprint(pub crypto.PublicKey) string {
+	jwk, ok := SigningKey{verifyKey: pub}.JWK()
+	if !ok {
+		return ""
+	}
+	// Members in lexicographic order as required by RFC 7638
+	var members interface{}
+	switch jwk.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Curve, jwk.KeyType, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return b64(sum[:])
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
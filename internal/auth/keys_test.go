@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestAsymmetricSigning(t *testing.T) {
+	noBlacklist(t)
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			useKeyRing(t, SigningKey{Algorithm: alg, Generate: true})
+
+			token, err := GenerateJWT("test@example.com", 1, "admin")
+			if err != nil {
+				t.Fatalf("Error generating token: %v", err)
+			}
+			parsed, _, _ := new(jwt.Parser).ParseUnverified(token, &Claims{})
+			if parsed.Method.Alg() != alg {
+				t.Errorf("expected alg %s, got %s", alg, parsed.Method.Alg())
+			}
+			if parsed.Header["kid"] == "" {
+				t.Error("expected a thumbprint kid")
+			}
+
+			claims, err := ValidateToken(token)
+			if err != nil {
+				t.Fatalf("Expected valid token, got error: %v", err)
+			}
+			if claims.Email != "test@example.com" {
+				t.Errorf("unexpected email %q", claims.Email)
+			}
+		})
+	}
+}
+
+func TestPublicJWKS_VerifiesOffline(t *testing.T) {
+	useKeyRing(t,
+		SigningKey{ID: "rsa", Algorithm: AlgRS256, Generate: true},
+		SigningKey{ID: "ec", Algorithm: AlgES256, Generate: true, NotBefore: time.Now().Add(time.Hour)},
+		SigningKey{ID: "hmac", Secret: "shared"},
+	)
+
+	set, err := PublicJWKS()
+	if err != nil {
+		t.Fatalf("Expected JWKS, got error: %v", err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("expected 2 published keys, got %d", len(set.Keys))
+	}
+	for _, jwk := range set.Keys {
+		if jwk.KeyID == "hmac" {
+			t.Error("HMAC secret must not be published")
+		}
+	}
+
+	token, err := GenerateJWT("test@example.com", 1, "admin")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+
+	// Verify with nothing but the published RSA key, as a downstream service would
+	var rsaJWK JWK
+	for _, jwk := range set.Keys {
+		if jwk.KeyType == "RSA" {
+			rsaJWK = jwk
+		}
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	e, _ := base64.RawURLEncoding.DecodeString(rsaJWK.E)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	_, err = jwt.ParseWithClaims(token, &Claims{}, func(*jwt.Token) (interface{}, error) { return pub, nil })
+	if err != nil {
+		t.Errorf("Expected token to verify with published key, got error: %v", err)
+	}
+}
+
+func TestAccessTokensAreTyped(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "https://sso.example.com")
+	useKeyRing(t, SigningKey{ID: "ec", Algorithm: AlgES256, Generate: true})
+
+	// What an offline verifier checks besides the signature
+	isAccessToken := func(token string) bool {
+		claims := &Claims{}
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, claims)
+		return err == nil && parsed.Header["typ"] == AccessTokenType &&
+			claims.Issuer == "https://sso.example.com" && claims.Audience == "https://sso.example.com"
+	}
+
+	access, _ := GenerateJWT("test@example.com", 1, "admin")
+	account, _ := SignServiceAccountToken(5, 1, 0, "member", ScopeRead)
+	challenge, _, _ := SignPurposeToken(PurposeMFAChallenge, 7, 1, time.Minute)
+	link, _, _ := SignPurposeToken(PurposeMagicLink, 7, 1, time.Minute)
+	idToken, _ := SignIDToken(&IDTokenClaims{}, "client-1")
+	for name, tt := range map[string]struct {
+		token  string
+		access bool
+	}{
+		"user access token":            {access, true},
+		"service account access token": {account, true},
+		"MFA challenge":                {challenge, false},
+		"magic link":                   {link, false},
+		"ID token":                     {idToken, false},
+	} {
+		if isAccessToken(tt.token) != tt.access {
+			t.Errorf("%s: expected access token %v", name, tt.access)
+		}
+	}
+}
+
+func TestValidateToken_AlgorithmConfusion(t *testing.T) {
+	noBlacklist(t)
+	useKeyRing(t, SigningKey{ID: "rsa", Algorithm: AlgRS256, Generate: true})
+	kr, _ := currentKeyRing()
+	key, _ := kr.SigningKey(time.Now())
+
+	// Sign an HS256 token using the public key as the HMAC secret
+	pubDER, _ := x509.MarshalPKIXPublicKey(key.verifyKey)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		Email:          "attacker@example.com",
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	})
+	token.Header["kid"] = "rsa"
+	tokenString, _ := token.SignedString(pubPEM)
+
+	if _, err := ValidateToken(tokenString); err == nil {
+		t.Error("Expected HS256 token against an RS256 key to be rejected")
+	}
+}
+
+func TestSigningKey_GeneratedFileIsReused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	first, err := NewKeyRing([]SigningKey{{ID: "ed", Algorithm: AlgEdDSA, PrivateKeyFile: path, Generate: true}})
+	if err != nil {
+		t.Fatalf("Expected generated key, got error: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected key file to be written: %v", err)
+	}
+	second, err := NewKeyRing([]SigningKey{{ID: "ed", Algorithm: AlgEdDSA, PrivateKeyFile: path}})
+	if err != nil {
+		t.Fatalf("Expected key from file, got error: %v", err)
+	}
+	k1, _ := first.SigningKey(time.Now())
+	k2, _ := second.SigningKey(time.Now())
+	if !k1.verifyKey.(ed25519.PublicKey).Equal(k2.verifyKey) {
+		t.Error("expected the generated key to be read back from disk")
+	}
+}
+
+func TestSigningKey_PublicOnlyNeverSigns(t *testing.T) {
+	signer, err := NewKeyRing([]SigningKey{{ID: "ec", Algorithm: AlgES256, Generate: true}})
+	if err != nil {
+		t.Fatalf("Expected generated key, got error: %v", err)
+	}
+	key, _ := signer.SigningKey(time.Now())
+	der, _ := x509.MarshalPKIXPublicKey(key.verifyKey.(*ecdsa.PublicKey))
+	path := filepath.Join(t.TempDir(), "public.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	kr, err := NewKeyRing([]SigningKey{{ID: "ec", Algorithm: AlgES256, PublicKeyFile: path}})
+	if err != nil {
+		t.Fatalf("Expected verify-only key, got error: %v", err)
+	}
+	if _, err := kr.SigningKey(time.Now()); err == nil {
+		t.Error("expected no signing key for a public-only ring")
+	}
+	if _, err := kr.VerificationKey("ec", time.Now()); err != nil {
+		t.Errorf("expected public key to verify, got %v", err)
+	}
+}
+
+func TestSigningKey_PublicKeyOnWrongCurve(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	path := filepath.Join(t.TempDir(), "public.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	if _, err := NewKeyRing([]SigningKey{{ID: "ec", Algorithm: AlgES256, PublicKeyFile: path}}); err == nil {
+		t.Error("expected error for an ES256 public key on P-384")
+	}
+}
+
+func TestSigningKey_UnsupportedAlgorithm(t *testing.T) {
+	if _, err := NewKeyRing([]SigningKey{{ID: "x", Algorithm: "none", Generate: true}}); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestJWK_PublicKeyRoundTrip(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			key := SigningKey{Algorithm: alg, Generate: true}
+			if err := key.load(); err != nil {
+				t.Fatalf("failed to generate key: %v", err)
+			}
+			jwk, ok := key.JWK()
+			if !ok {
+				t.Fatal("expected a public JWK")
+			}
+			pub, err := jwk.PublicKey()
+			if err != nil {
+				t.Fatalf("Expected the JWK to decode, got error: %v", err)
+			}
+			if !pub.(interface{ Equal(x crypto.PublicKey) bool }).Equal(key.verifyKey) {
+				t.Error("decoded key differs from the original")
+			}
+		})
+	}
+
+	if _, err := (JWK{KeyType: "EC", Curve: "P-256", X: "AQ", Y: "AQ"}).PublicKey(); err == nil {
+		t.Error("expected a point off the curve to be rejected")
+	}
+	if _, err := (JWK{KeyType: "oct"}).PublicKey(); err == nil {
+		t.Error("expected symmetric keys to be rejected")
+	}
+}
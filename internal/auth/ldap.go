@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"sentinel/internal/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrDirectoryUnavailable wraps failures to reach or query an LDAP server
+var ErrDirectoryUnavailable = errors.New("directory unavailable")
+
+// Timeout of every LDAP connection and operation
+var ldapTimeout = 10 * time.Second
+
+// Defaults for the optional settings of an LDAP connection, matching Active Directory
+const (
+	DefaultLDAPUserFilter     = "(mail={email})"
+	DefaultLDAPNameAttribute  = "displayName"
+	DefaultLDAPGroupAttribute = "memberOf"
+)
+
+// Attribute holding the address the directory has on file for a user
+const ldapMailAttribute = "mail"
+
+// LDAPAuthenticator checks passwords against a tenant's directory. It searches for the
+// user with the service account, then binds as the user's DN with the typed password.
+type LDAPAuthenticator struct {
+	Conn models.LDAPConnection
+}
+
+func (a LDAPAuthenticator) Authenticate(ctx context.Context, email, password string) (*Identity, error) {
+	// A bind with an empty password is an anonymous bind, which most servers accept
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDirectoryUnavailable, err)
+	}
+	defer conn.Close()
+
+	if a.Conn.BindDN != "" {
+		if err := conn.Bind(a.Conn.BindDN, a.Conn.BindPassword); err != nil {
+			return nil, fmt.Errorf("%w: service account bind: %v", ErrDirectoryUnavailable, err)
+		}
+	}
+
+	nameAttr := firstNonEmpty(a.Conn.NameAttribute, DefaultLDAPNameAttribute)
+	groupAttr := firstNonEmpty(a.Conn.GroupAttribute, DefaultLDAPGroupAttribute)
+	filter := strings.ReplaceAll(firstNonEmpty(a.Conn.UserFilter, DefaultLDAPUserFilter), "{email}", ldap.EscapeFilter(email))
+	res, err := conn.Search(ldap.NewSearchRequest(a.Conn.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, filter, []string{ldapMailAttribute, nameAttr, groupAttr}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("%w: search: %v", ErrDirectoryUnavailable, err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+	default:
+		return nil, fmt.Errorf("%w: %d entries match %s", ErrDirectoryUnavailable, len(res.Entries), filter)
+	}
+
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("%w: user bind: %v", ErrDirectoryUnavailable, err)
+	}
+	// The directory's address, not the one as typed, which may differ in case or, with a
+	// custom filter, not be an address at all
+	return &Identity{
+		Email:  firstNonEmpty(entry.GetEqualFoldAttributeValue(ldapMailAttribute), email),
+		Name:   entry.GetEqualFoldAttributeValue(nameAttr),
+		Groups: entry.GetEqualFoldAttributeValues(groupAttr),
+	}, nil
+}
+
+// dial connects to the directory, upgrading the connection with StartTLS when asked
+func (a LDAPAuthenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	u, err := url.Parse(a.Conn.URL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	conn, err := ldap.DialURL(a.Conn.URL, ldap.DialWithDialer(dialer))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if a.Conn.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ValidLDAPURL accepts ldap:// and ldaps:// URLs with a host
+func ValidLDAPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "ldap" || u.Scheme == "ldaps") && u.Host != ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
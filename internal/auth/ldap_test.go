@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"sentinel/internal/auth/ldaptest"
+	"sentinel/internal/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	serviceDN = "cn=sentinel,ou=services,dc=example,dc=com"
+	janeDN    = "cn=Jane Doe,ou=people,dc=example,dc=com"
+	adminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+)
+
+func directory() *ldaptest.Server {
+	return ldaptest.NewServer(
+		ldaptest.Entry{DN: serviceDN, Password: "service-secret"},
+		ldaptest.Entry{DN: janeDN, Password: "jane-secret", Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"mail":        {"jane@example.com"},
+			"displayName": {"Jane Doe"},
+			"memberOf":    {adminsDN, "cn=engineering,ou=groups,dc=example,dc=com"},
+		}},
+		// Same address twice: the search must not pick one at random
+		ldaptest.Entry{DN: "cn=dup1,ou=people,dc=example,dc=com", Password: "x", Attributes: map[string][]string{"mail": {"dup@example.com"}}},
+		ldaptest.Entry{DN: "cn=dup2,ou=people,dc=example,dc=com", Password: "x", Attributes: map[string][]string{"mail": {"dup@example.com"}}},
+	)
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	server := directory()
+	defer server.Close()
+	conn := models.LDAPConnection{
+		URL:          server.URL,
+		BindDN:       serviceDN,
+		BindPassword: "service-secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(mail={email}))",
+	}
+
+	tests := []struct {
+		name     string
+		conn     func(c models.LDAPConnection) models.LDAPConnection
+		email    string
+		password string
+		wantErr  error
+	}{
+		{name: "Valid password", email: "jane@example.com", password: "jane-secret"},
+		{name: "Email is case-insensitive", email: "JANE@example.com", password: "jane-secret"},
+		{name: "Wrong password", email: "jane@example.com", password: "wrong", wantErr: ErrInvalidCredentials},
+		{name: "Empty password", email: "jane@example.com", password: "", wantErr: ErrInvalidCredentials},
+		{name: "Unknown user", email: "nobody@example.com", password: "jane-secret", wantErr: ErrUnknownUser},
+		{name: "Filter injection", email: "*)(mail=*", password: "jane-secret", wantErr: ErrUnknownUser},
+		{name: "Ambiguous user", email: "dup@example.com", password: "x",
+			conn:    func(c models.LDAPConnection) models.LDAPConnection { c.UserFilter = ""; return c },
+			wantErr: ErrDirectoryUnavailable},
+		{name: "Wrong service password", email: "jane@example.com", password: "jane-secret",
+			conn:    func(c models.LDAPConnection) models.LDAPConnection { c.BindPassword = "wrong"; return c },
+			wantErr: ErrDirectoryUnavailable},
+		{name: "Server down", email: "jane@example.com", password: "jane-secret",
+			conn:    func(c models.LDAPConnection) models.LDAPConnection { c.URL = "ldap://127.0.0.1:1"; return c },
+			wantErr: ErrDirectoryUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := conn
+			if tt.conn != nil {
+				c = tt.conn(c)
+			}
+			identity, err := LDAPAuthenticator{Conn: c}.Authenticate(context.Background(), tt.email, tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate failed: %v", err)
+			}
+			if identity.Email != "jane@example.com" || identity.Name != "Jane Doe" || len(identity.Groups) != 2 || identity.Groups[0] != adminsDN {
+				t.Errorf("unexpected identity %+v", identity)
+			}
+		})
+	}
+}
+
+func TestPasswordAuthenticator(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+
+	identity, err := PasswordAuthenticator{Hash: string(hash)}.Authenticate(context.Background(), "jane@example.com", "password123")
+	if err != nil || identity.Email != "jane@example.com" {
+		t.Fatalf("expected the password to be accepted, got %v", err)
+	}
+	if !identity.NeedsRehash {
+		t.Error("expected a low-cost bcrypt hash to need rehashing")
+	}
+	if _, err := (PasswordAuthenticator{Hash: string(hash)}).Authenticate(context.Background(), "jane@example.com", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := (PasswordAuthenticator{}).Authenticate(context.Background(), "jane@example.com", "password123"); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser, got %v", err)
+	}
+}
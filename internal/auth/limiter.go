@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// KeyedLimiter rate limits actions per key, e.g. per email address or client IP.
+// Keys are often chosen by the caller, so limiters that have been idle long enough to
+// be full again are dropped; a new limiter for the key starts out the same.
+type KeyedLimiter struct {
+	mu        sync.Mutex
+	limiters  map[string]*keyedLimit
+	limit     rate.Limit
+	burst     int
+	idle      time.Duration // How long a limiter takes to refill completely
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type keyedLimit struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewKeyedLimiter allows burst actions per key, refilled at one action per interval
+func NewKeyedLimiter(interval time.Duration, burst int) *KeyedLimiter {
+	return &KeyedLimiter{
+		limiters: make(map[string]*keyedLimit),
+		limit:    rate.Every(interval),
+		burst:    burst,
+		idle:     interval * time.Duration(burst),
+		now:      time.Now,
+	}
+}
+
+// Allow reports whether one more action is allowed for the key
+func (l *KeyedLimiter) Allow(key string) bool {
+	now := l.now()
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) >= l.idle {
+		l.sweep(now)
+	}
+	entry, exists := l.limiters[key]
+	if !exists {
+		entry = &keyedLimit{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = now
+	l.mu.Unlock()
+	return entry.limiter.AllowN(now, 1)
+}
+
+// sweep drops the limiters that were not used for l.idle. The caller holds l.mu.
+func (l *KeyedLimiter) sweep(now time.Time) {
+	for key, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) >= l.idle {
+			delete(l.limiters, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiter_DropsIdleKeys(t *testing.T) {
+	now := time.Now()
+	l := NewKeyedLimiter(time.Minute, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		l.Allow("203.0.113." + strconv.Itoa(i))
+	}
+	if !l.Allow("victim") || !l.Allow("victim") || l.Allow("victim") {
+		t.Fatal("expected the burst to be used up")
+	}
+
+	// Two minutes on, every limiter is full again: only the key seen since is kept
+	now = now.Add(2 * time.Minute)
+	if !l.Allow("victim") {
+		t.Error("expected the limiter to have refilled")
+	}
+	if len(l.limiters) != 1 {
+		t.Errorf("expected idle limiters to be dropped, %d left", len(l.limiters))
+	}
+	if !l.Allow("victim") || l.Allow("victim") {
+		t.Error("expected the kept limiter to keep counting")
+	}
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockoutPolicy describes how failed logins for one key (an account or a client IP) are throttled.
+// Failures older than Window are forgotten. Each failure delays the next attempt by BaseDelay,
+// doubling up to MaxDelay, and Threshold failures lock the key for Duration.
+type LockoutPolicy struct {
+	Threshold int
+	Duration  time.Duration
+	Window    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// AccountLockoutPolicy applies to an email within a tenant, whether or not the account exists.
+// LOGIN_LOCKOUT_THRESHOLD (10) and LOGIN_LOCKOUT_DURATION (15m) tune it.
+func AccountLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold: intFromEnv("LOGIN_LOCKOUT_THRESHOLD", 10),
+		Duration:  durationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		Window:    durationFromEnv("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		BaseDelay: time.Second,
+		MaxDelay:  time.Minute,
+	}
+}
+
+// IPLockoutPolicy applies to a client IP across all accounts. It has no per-attempt delay
+// and a higher threshold, since many users can share an address behind NAT.
+// LOGIN_IP_LOCKOUT_THRESHOLD (50) tunes it.
+func IPLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold: intFromEnv("LOGIN_IP_LOCKOUT_THRESHOLD", 50),
+		Duration:  durationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		Window:    durationFromEnv("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+	}
+}
+
+func intFromEnv(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// AccountLockKey is the throttling key of an email within a tenant
+func AccountLockKey(tenantID int, email string) string {
+	return "account:" + strconv.Itoa(tenantID) + ":" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// IPLockKey is the throttling key of a client IP
+func IPLockKey(ip string) string {
+	return "ip:" + ip
+}
+
+// delay is how long to wait after the given number of failures
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if p.BaseDelay <= 0 || failures <= 0 {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// retryAfter is how long a key with this state must wait before its next attempt
+func (p LockoutPolicy) retryAfter(failures int, lastFailure time.Time, lockedUntil sql.NullTime, now time.Time) time.Duration {
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		return lockedUntil.Time.Sub(now)
+	}
+	if lastFailure.Before(now.Add(-p.Window)) {
+		return 0
+	}
+	if next := lastFailure.Add(p.delay(failures)); next.After(now) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// LoginRetryAfter returns how long the caller must wait before trying to log in to the account
+// from the IP, or 0 when the attempt may go ahead
+func LoginRetryAfter(dbInstance *sql.DB, accountKey, ipKey string) (time.Duration, error) {
+	rows, err := dbInstance.Query(`SELECT key, failures, last_failure_at, locked_until FROM login_attempts WHERE key IN ($1, $2)`, accountKey, ipKey)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var wait time.Duration
+	for rows.Next() {
+		var (
+			key         string
+			failures    int
+			lastFailure time.Time
+			lockedUntil sql.NullTime
+		)
+		if err := rows.Scan(&key, &failures, &lastFailure, &lockedUntil); err != nil {
+			return 0, err
+		}
+		policy := AccountLockoutPolicy()
+		if key == ipKey {
+			policy = IPLockoutPolicy()
+		}
+		if d := policy.retryAfter(failures, lastFailure, lockedUntil, now); d > wait {
+			wait = d
+		}
+	}
+	return wait, rows.Err()
+}
+
+// RecordLoginFailure counts a failed login against the key. It returns true when
+// this failure locks the key, so the caller can log the lockout.
+func RecordLoginFailure(dbInstance *sql.DB, key string, policy LockoutPolicy) (bool, error) {
+	now := time.Now()
+	var failures int
+	err := dbInstance.QueryRow(`
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures`, key, now, now.Add(-policy.Window)).Scan(&failures)
+	if err != nil {
+		return false, err
+	}
+	if failures < policy.Threshold {
+		return false, nil
+	}
+	_, err = dbInstance.Exec(`UPDATE login_attempts SET locked_until = $1 WHERE key = $2`, now.Add(policy.Duration), key)
+	return err == nil, err
+}
+
+// ClearLoginFailures forgets the failures of a key, after a successful login or an admin unlock.
+// It returns false when the key had none.
+func ClearLoginFailures(dbInstance *sql.DB, key string) (bool, error) {
+	res, err := dbInstance.Exec(`DELETE FROM login_attempts WHERE key = $1`, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
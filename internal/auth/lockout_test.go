@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLockoutPolicy_Delay(t *testing.T) {
+	p := LockoutPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{7, time.Minute},
+		{30, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := p.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+	if got := (LockoutPolicy{}).delay(5); got != 0 {
+		t.Errorf("expected no delay without a base delay, got %v", got)
+	}
+}
+
+func TestLockoutPolicy_RetryAfter(t *testing.T) {
+	p := LockoutPolicy{Window: 15 * time.Minute, BaseDelay: time.Second, MaxDelay: time.Minute}
+	now := time.Now()
+
+	if got := p.retryAfter(3, now.Add(-time.Second), sql.NullTime{}, now); got != 3*time.Second {
+		t.Errorf("expected 3s backoff, got %v", got)
+	}
+	if got := p.retryAfter(3, now.Add(-10*time.Second), sql.NullTime{}, now); got != 0 {
+		t.Errorf("expected no wait once the backoff elapsed, got %v", got)
+	}
+	locked := sql.NullTime{Time: now.Add(5 * time.Minute), Valid: true}
+	if got := p.retryAfter(10, now.Add(-time.Hour), locked, now); got != 5*time.Minute {
+		t.Errorf("expected the lock to apply, got %v", got)
+	}
+	if got := p.retryAfter(8, now.Add(-time.Hour), sql.NullTime{}, now); got != 0 {
+		t.Errorf("expected failures outside the window to be ignored, got %v", got)
+	}
+}
+
+func TestLoginRetryAfter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT key, failures, last_failure_at, locked_until FROM login_attempts WHERE key IN \(\$1, \$2\)`).
+		WithArgs("account:1:user@test.com", "ip:10.0.0.1").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "failures", "last_failure_at", "locked_until"}).
+			AddRow("account:1:user@test.com", 10, now, now.Add(10*time.Minute)).
+			AddRow("ip:10.0.0.1", 3, now, nil))
+
+	wait, err := LoginRetryAfter(db, "account:1:user@test.com", "ip:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if wait < 9*time.Minute || wait > 10*time.Minute {
+		t.Errorf("expected the account lock to set the wait, got %v", wait)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestRecordLoginFailure(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 3, Duration: time.Minute, Window: time.Minute}
+
+	t.Run("below threshold", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create mock database: %v", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("INSERT INTO login_attempts").
+			WithArgs("ip:10.0.0.1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(2))
+
+		locked, err := RecordLoginFailure(db, "ip:10.0.0.1", policy)
+		if err != nil || locked {
+			t.Errorf("expected no lock, got %v, %v", locked, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("locks at threshold", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create mock database: %v", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("INSERT INTO login_attempts").
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(3))
+		mock.ExpectExec(`UPDATE login_attempts SET locked_until = \$1 WHERE key = \$2`).
+			WithArgs(sqlmock.AnyArg(), "ip:10.0.0.1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		locked, err := RecordLoginFailure(db, "ip:10.0.0.1", policy)
+		if err != nil || !locked {
+			t.Errorf("expected the key to be locked, got %v, %v", locked, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %v", err)
+		}
+	})
+}
+
+func TestAccountLockKey(t *testing.T) {
+	if got := AccountLockKey(4, " User@Test.com "); got != "account:4:user@test.com" {
+		t.Errorf("unexpected key %q", got)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
@@ -21,12 +22,71 @@ const (
 type CtxKey string
 
 const (
-	EmailKey    CtxKey = "email"
-	TenantIDKey CtxKey = "tenant_id"
-	RoleKey     CtxKey = "role"
+	EmailKey     CtxKey = "email"
+	TenantIDKey  CtxKey = "tenant_id"
+	RoleKey      CtxKey = "role"
+	UserIDKey    CtxKey = "user_id"
+	SessionIDKey CtxKey = "session_id"
+	APIKeyIDKey  CtxKey = "api_key_id"
+	ActorIDKey   CtxKey = "actor_id"
+	AuthTimeKey  CtxKey = "auth_time"
+	AMRKey       CtxKey = "amr"
+
+	PrincipalTypeKey    CtxKey = "principal_type"
+	ServiceAccountIDKey CtxKey = "service_account_id"
 )
 
-// AuthMiddleware checks for the JWT token and validates it
+// ErrInvalidToken is returned by Authenticate for a malformed, expired or blacklisted token
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Authenticate runs every check an access token must pass: signature and expiry, the
+// blacklist, the user's token version and the state of its session. It returns
+// ErrInvalidToken, ErrTokenRevoked or ErrSessionRevoked when the token is refused.
+func Authenticate(dbInstance *sql.DB, tokenStr string) (*Claims, error) {
+	// ValidateToken also checks the blacklist
+	claims, err := ValidateToken(tokenStr)
+	if err != nil {
+		log.Println("Middleware error")
+		log.Println(err)
+		return nil, ErrInvalidToken
+	}
+
+	// Tokens issued before a password or role change, or to a deleted user, are rejected
+	if claims.UserID != 0 {
+		if err := checkTokenVersion(dbInstance, claims); err != nil {
+			log.Println("Token version check failed:", err)
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	// Impersonation tokens also need the admin's token version to be current
+	if claims.Actor != nil {
+		if err := checkActor(dbInstance, claims.Actor); err != nil {
+			log.Println("Impersonation actor check failed:", err)
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	// Tokens of a deleted service account, or issued before its secret was rotated, are rejected
+	if claims.ServiceAccountID != 0 {
+		if err := checkServiceAccount(dbInstance, claims); err != nil {
+			log.Println("Service account check failed:", err)
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	// Tokens bound to a session stop working as soon as the session is revoked
+	if claims.Id != "" {
+		if err := touchSession(dbInstance, claims.Id); err != nil {
+			log.Println("Session check failed:", err)
+			return nil, ErrSessionRevoked
+		}
+	}
+	return claims, nil
+}
+
+// AuthMiddleware checks for the JWT token and validates it.
+// Scripts can send "Authorization: ApiKey <key>" instead.
 func AuthMiddleware(next http.Handler, dbInstance *sql.DB) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -34,30 +94,58 @@ func AuthMiddleware(next http.Handler, dbInstance *sql.DB) http.Handler {
 			http.Error(w, "Authorization header required", http.StatusUnauthorized)
 			return
 		}
+		if key, ok := strings.CutPrefix(authHeader, "ApiKey "); ok {
+			apiKeyMiddleware(next, dbInstance, key).ServeHTTP(w, r)
+			return
+		}
 
 		// Extract token
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-		claims, err := ValidateToken(tokenStr) // Ensure ValidateToken is implemented and imported
-		if err != nil {
-			log.Println("Middleware error")
-			log.Println(err)
+		claims, err := Authenticate(dbInstance, tokenStr)
+		switch err {
+		case nil:
+		case ErrTokenRevoked:
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		case ErrSessionRevoked:
+			http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+			return
+		default:
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
 
-		var exists bool
-		x := dbInstance.QueryRow("SELECT EXISTS(SELECT 1 FROM token_blacklist WHERE token=$1)", tokenStr).Scan(&exists)
-		if x != nil || exists {
-			log.Printf("Printing token 2 %s", tokenStr)
-			http.Error(w, "Token is invalid", http.StatusUnauthorized)
+		// Service account tokens are limited to their granted scopes
+		principalType := PrincipalUser
+		if claims.PrincipalType == PrincipalServiceAccount {
+			principalType = PrincipalServiceAccount
+		}
+		if !claims.Allows(r.Method) {
+			http.Error(w, "Token scope does not allow this request", http.StatusForbidden)
 			return
 		}
 
+		// Every request made while impersonating a user is audited
+		actorID := 0
+		if claims.Actor != nil {
+			if !auditImpersonation(w, r, dbInstance, claims) {
+				return
+			}
+			actorID = claims.Actor.UserID
+		}
+
 		// Add claims to request context
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, EmailKey, claims.Email)
 		ctx = context.WithValue(ctx, TenantIDKey, claims.TenantID)
 		ctx = context.WithValue(ctx, RoleKey, claims.Role) // Add this line to store role in context
+		ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, SessionIDKey, claims.Id)
+		ctx = context.WithValue(ctx, PrincipalTypeKey, principalType)
+		ctx = context.WithValue(ctx, ServiceAccountIDKey, claims.ServiceAccountID)
+		ctx = context.WithValue(ctx, ActorIDKey, actorID)
+		ctx = context.WithValue(ctx, AuthTimeKey, claims.AuthTime)
+		ctx = context.WithValue(ctx, AMRKey, claims.AMR)
 		r = r.WithContext(ctx)
 
 		// Proceed to the next handler
@@ -65,6 +153,35 @@ func AuthMiddleware(next http.Handler, dbInstance *sql.DB) http.Handler {
 	})
 }
 
+// apiKeyMiddleware authenticates a request made with an API key. The context gets the
+// same values as for a token, without a session.
+func apiKeyMiddleware(next http.Handler, dbInstance *sql.DB, key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := AuthenticateAPIKey(dbInstance, key)
+		if err != nil {
+			if err != ErrInvalidAPIKey {
+				log.Println("API key check failed:", err)
+			}
+			http.Error(w, "Invalid or expired API key", http.StatusUnauthorized)
+			return
+		}
+		if !principal.Allows(r.Method) {
+			http.Error(w, "API key scope does not allow this request", http.StatusForbidden)
+			return
+		}
+
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, EmailKey, principal.Email)
+		ctx = context.WithValue(ctx, TenantIDKey, principal.TenantID)
+		ctx = context.WithValue(ctx, RoleKey, principal.Role)
+		ctx = context.WithValue(ctx, UserIDKey, principal.UserID)
+		ctx = context.WithValue(ctx, SessionIDKey, "")
+		ctx = context.WithValue(ctx, APIKeyIDKey, principal.KeyID)
+		ctx = context.WithValue(ctx, PrincipalTypeKey, PrincipalUser)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // GetTenantID fetches the tenant_id from the context
 func GetTenantID(ctx context.Context) (int, error) {
 	tenantIDValue := ctx.Value(TenantIDKey) // Fetch from context using tenantIDKey
@@ -104,6 +221,64 @@ func GetEmail(ctx context.Context) (string, error) {
 	return email, nil
 }
 
+// GetUserID fetches the user ID from the context
+func GetUserID(ctx context.Context) (int, error) {
+	userID, ok := ctx.Value(UserIDKey).(int)
+	if !ok || userID == 0 {
+		log.Println("Error: user_id not found in context or invalid type")
+		return 0, errors.New("user_id not found in context or invalid type")
+	}
+	return userID, nil
+}
+
+// GetSessionID fetches the session ID (the token's jti) from the context
+func GetSessionID(ctx context.Context) string {
+	sessionID, _ := ctx.Value(SessionIDKey).(string)
+	return sessionID
+}
+
+// GetAPIKeyID fetches the ID of the API key that authenticated the request, or 0
+func GetAPIKeyID(ctx context.Context) int {
+	keyID, _ := ctx.Value(APIKeyIDKey).(int)
+	return keyID
+}
+
+// GetPrincipalType tells whether a user or a service account made the request.
+// Requests without a principal type in the context were made by a user.
+func GetPrincipalType(ctx context.Context) string {
+	if principalType, ok := ctx.Value(PrincipalTypeKey).(string); ok && principalType != "" {
+		return principalType
+	}
+	return PrincipalUser
+}
+
+// GetServiceAccountID fetches the ID of the service account that made the request, or 0
+func GetServiceAccountID(ctx context.Context) int {
+	accountID, _ := ctx.Value(ServiceAccountIDKey).(int)
+	return accountID
+}
+
+// GetActorID fetches the ID of the admin impersonating the user of the request, or 0
+func GetActorID(ctx context.Context) int {
+	actorID, _ := ctx.Value(ActorIDKey).(int)
+	return actorID
+}
+
+// GetAuthTime fetches when the user of the request last signed in or re-authenticated.
+// It is zero for API keys, service accounts and tokens without an auth_time.
+func GetAuthTime(ctx context.Context) time.Time {
+	if authTime, _ := ctx.Value(AuthTimeKey).(int64); authTime != 0 {
+		return time.Unix(authTime, 0)
+	}
+	return time.Time{}
+}
+
+// GetAMR fetches the methods the user of the request last authenticated with
+func GetAMR(ctx context.Context) []string {
+	amr, _ := ctx.Value(AMRKey).([]string)
+	return amr
+}
+
 // User-specific rate limiter map
 var (
 	userLimiters = make(map[string]*rate.Limiter)
@@ -138,11 +313,64 @@ func getUserLimiter(user string) *rate.Limiter {
 	return limiter
 }
 
+// publicPaths are served without an Authorization header
+var publicPaths = map[string]bool{
+	"/health":                   true,
+	"/register":                 true,
+	"/login":                    true,
+	"/login/mfa":                true,
+	"/login/mfa/enroll":         true,
+	"/login/password":           true,
+	"/login/magic":              true,
+	"/login/magic/redeem":       true,
+	"/login/passkey/begin":      true,
+	"/login/passkey/finish":     true,
+	"/login/federated":          true,
+	"/login/federated/start":    true,
+	"/login/federated/callback": true,
+	"/login/federated/complete": true,
+	"/logout":                   true,
+	"/token/refresh":            true,
+	"/password/forgot":          true,
+	"/password/reset":           true,
+	"/email/confirm":            true,
+	"/email/confirm/resend":     true,
+	"/.well-known/jwks.json":    true,
+	"/auth/verify":              true,
+
+	"/.well-known/openid-configuration": true,
+	"/authorize":                        true,
+	"/token":                            true,
+	"/userinfo":                         true,
+	"/oauth/token":                      true,
+	"/oauth/device/code":                true,
+	"/oauth/introspect":                 true,
+	"/oauth/revoke":                     true,
+}
+
+// publicPrefixes are path prefixes served without an Authorization header, for public
+// routes with path variables
+var publicPrefixes = []string{
+	"/saml/",
+}
+
+func isPublicPath(path string) bool {
+	if publicPaths[path] {
+		return true
+	}
+	for _, prefix := range publicPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // RateLimitMiddleware applies rate limiting per user
 func RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Use the Authorization header as the user identifier
-		if r.URL.Path == "/health" || r.URL.Path == "/register" || r.URL.Path == "/login" || r.URL.Path == "/logout" {
+		if isPublicPath(r.URL.Path) {
 			next.ServeHTTP(w, r)
 			return
 		}
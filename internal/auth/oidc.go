@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// PurposeOIDCAccess marks access tokens issued to OIDC clients. They are only good at
+// /userinfo; like every token with a purpose they never grant access to /api.
+const PurposeOIDCAccess = "oidc_access"
+
+// Issuer is the URL Sentinel is reached at as an OpenID provider, OIDC_ISSUER or http://localhost:8080.
+// It is the iss of ID tokens and the base of the endpoints in the discovery document.
+func Issuer() string {
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		return strings.TrimRight(issuer, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// IDTokenClaims are the claims of an OpenID Connect ID token. Optional claims are
+// only filled in when the matching scope was granted.
+type IDTokenClaims struct {
+	Nonce         string `json:"nonce,omitempty"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	TenantID      int    `json:"tenant_id"`
+	TenantName    string `json:"tenant_name,omitempty"`
+	Role          string `json:"role,omitempty"`
+	jwt.StandardClaims
+}
+
+// ErrNoOIDCSigningKey is returned when the current signing key is a shared HS256 secret.
+// Relying parties verify ID tokens with the keys of the JWKS, where secrets are never
+// published, and the secret would let them mint every Sentinel token.
+var ErrNoOIDCSigningKey = errors.New("OpenID Connect needs an RS256, ES256 or EdDSA signing key")
+
+// oidcSigningKey is the current signing key, provided relying parties can verify it
+func oidcSigningKey() (SigningKey, error) {
+	kr, err := currentKeyRing()
+	if err != nil {
+		return SigningKey{}, err
+	}
+	key, err := kr.SigningKey(time.Now())
+	if err != nil {
+		return SigningKey{}, err
+	}
+	if _, ok := key.JWK(); !ok {
+		return SigningKey{}, ErrNoOIDCSigningKey
+	}
+	return key, nil
+}
+
+// SignIDToken signs an ID token for the client, valid for AccessTokenTTL. It fails with
+// ErrNoOIDCSigningKey unless the current signing key is published in the JWKS.
+func SignIDToken(claims *IDTokenClaims, clientID string) (string, error) {
+	key, err := oidcSigningKey()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims.Issuer = Issuer()
+	claims.Audience = clientID
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(AccessTokenTTL()).Unix()
+	return signWithKey(key, claims, "")
+}
+
+// SignOIDCAccessToken signs the access token handed to an OIDC client next to the ID token
+func SignOIDCAccessToken(userID, tenantID, tokenVersion int, clientID, scope string) (string, error) {
+	jti, err := RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return signToken(&Claims{
+		UserID:       userID,
+		TenantID:     tenantID,
+		TokenVersion: tokenVersion,
+		Purpose:      PurposeOIDCAccess,
+		Scope:        scope,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Issuer:    Issuer(),
+			Subject:   strconv.Itoa(userID),
+			Audience:  clientID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL()).Unix(),
+		},
+	})
+}
+
+// ParseOIDCAccessToken verifies an access token signed by SignOIDCAccessToken
+func ParseOIDCAccessToken(tokenStr string) (*Claims, error) {
+	claims, err := ParsePurposeToken(tokenStr, PurposeOIDCAccess)
+	if err != nil || claims.Audience == "" {
+		return nil, ErrInvalidPurposeToken
+	}
+	return claims, nil
+}
+
+// VerifyPKCE checks a code_verifier against an S256 code_challenge (RFC 7636)
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// IDTokenSigningAlgorithms are the algorithms of the keys published in the JWKS, for the
+// discovery document. It fails with ErrNoOIDCSigningKey when ID tokens cannot be signed.
+func IDTokenSigningAlgorithms() ([]string, error) {
+	if _, err := oidcSigningKey(); err != nil {
+		return nil, err
+	}
+	set, err := PublicJWKS()
+	if err != nil {
+		return nil, err
+	}
+	var algs []string
+	seen := map[string]bool{}
+	for _, k := range set.Keys {
+		if !seen[k.Algorithm] {
+			seen[k.Algorithm] = true
+			algs = append(algs, k.Algorithm)
+		}
+	}
+	return algs, nil
+}
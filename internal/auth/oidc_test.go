@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// Example from RFC 7636, appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !VerifyPKCE(verifier, challenge) {
+		t.Error("expected the RFC 7636 verifier to match its challenge")
+	}
+	if VerifyPKCE(verifier+"x", challenge) {
+		t.Error("expected a different verifier to be rejected")
+	}
+	if VerifyPKCE("short", challenge) {
+		t.Error("expected a verifier below 43 characters to be rejected")
+	}
+}
+
+func TestOIDCTokensAreNotAccessTokens(t *testing.T) {
+	useKeyRing(t, SigningKey{ID: "k1", Algorithm: AlgES256, Generate: true})
+	noBlacklist(t)
+
+	accessToken, err := SignOIDCAccessToken(7, 1, 0, "client-1", "openid")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := validateToken(accessToken); err == nil {
+		t.Error("expected an OIDC access token to be rejected as a Sentinel access token")
+	}
+	claims, err := ParseOIDCAccessToken(accessToken)
+	if err != nil || claims.UserID != 7 || claims.Scope != "openid" {
+		t.Errorf("expected the OIDC access token to parse, got %+v, %v", claims, err)
+	}
+
+	idToken, err := SignIDToken(&IDTokenClaims{TenantID: 1}, "client-1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := validateToken(idToken); err == nil {
+		t.Error("expected an ID token to be rejected as a Sentinel access token")
+	}
+	if _, err := ParseOIDCAccessToken(idToken); err == nil {
+		t.Error("expected an ID token to be rejected as an OIDC access token")
+	}
+}
+
+func TestSignIDToken_SharedSecret(t *testing.T) {
+	useKeyRing(t, SigningKey{ID: "k1", Secret: "test-secret"})
+
+	if _, err := SignIDToken(&IDTokenClaims{TenantID: 1}, "client-1"); err != ErrNoOIDCSigningKey {
+		t.Errorf("expected ErrNoOIDCSigningKey, got %v", err)
+	}
+	if _, err := IDTokenSigningAlgorithms(); err != ErrNoOIDCSigningKey {
+		t.Errorf("expected ErrNoOIDCSigningKey, got %v", err)
+	}
+}
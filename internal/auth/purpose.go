@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Purposes of the signed single-use tokens sent in links or handed out between login steps
+const (
+	PurposeEmailConfirmation = "email_confirmation"
+	PurposeMFAChallenge      = "mfa_challenge"   // Password checked, second factor pending
+	PurposeMFAEnrollment     = "mfa_enrollment"  // Password checked, the tenant requires MFA but the user has none yet
+	PurposePasswordChange    = "password_change" // Password checked but past the tenant's maximum age
+	PurposeMagicLink         = "magic_link"      // Passwordless login link sent by email
+)
+
+var ErrInvalidPurposeToken = errors.New("invalid or expired token")
+
+// SignPurposeToken signs a short-lived token for one purpose only, such as an email
+// confirmation link. It returns the token and its jti; callers store HashToken(jti)
+// and clear it when the token is redeemed, which makes the token single-use.
+func SignPurposeToken(purpose string, userID, tenantID int, ttl time.Duration) (string, string, error) {
+	jti, err := RandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	claims := &Claims{
+		TenantID: tenantID,
+		UserID:   userID,
+		Purpose:  purpose,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   strconv.Itoa(userID),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+	// Not an access token: no typ, iss or aud
+	token, err := signToken(claims)
+	if err != nil {
+		return "", "", err
+	}
+	return token, jti, nil
+}
+
+// ParsePurposeToken verifies a token signed by SignPurposeToken for the given purpose
+func ParsePurposeToken(tokenStr, purpose string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keyFunc)
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidPurposeToken
+	}
+	if purpose == "" || claims.Purpose != purpose || claims.UserID == 0 || claims.Id == "" {
+		return nil, ErrInvalidPurposeToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurposeToken(t *testing.T) {
+	useKeyRing(t, SigningKey{ID: "k1", Secret: "secret-1"})
+	noBlacklist(t)
+
+	token, jti, err := SignPurposeToken(PurposeEmailConfirmation, 7, 3, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	claims, err := ParsePurposeToken(token, PurposeEmailConfirmation)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if claims.UserID != 7 || claims.TenantID != 3 || claims.Id != jti {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := ParsePurposeToken(token, "other"); err != ErrInvalidPurposeToken {
+		t.Errorf("expected a purpose mismatch to be rejected, got %v", err)
+	}
+	if _, err := ValidateToken(token); err == nil {
+		t.Error("expected a purpose token to be rejected as an access token")
+	}
+
+	expired, _, _ := SignPurposeToken(PurposeEmailConfirmation, 7, 3, -time.Minute)
+	if _, err := ParsePurposeToken(expired, PurposeEmailConfirmation); err != ErrInvalidPurposeToken {
+		t.Errorf("expected an expired token to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is the server-side record behind an opaque refresh token.
+// Every rotation adds a row to the same family; replaying a rotated token revokes the family.
+type RefreshToken struct {
+	ID        int
+	FamilyID  string
+	UserID    int
+	TenantID  int
+	ExpiresAt time.Time
+}
+
+// AccessTokenTTL is the lifetime of access tokens, ACCESS_TOKEN_TTL or 15 minutes
+func AccessTokenTTL() time.Duration {
+	return durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// RefreshTokenTTL is the lifetime of each refresh token, REFRESH_TOKEN_TTL or 30 days
+func RefreshTokenTTL() time.Duration {
+	return durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(name); ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Ignoring invalid %s=%q", name, v)
+	}
+	return fallback
+}
+
+// RandomToken returns a URL safe random string with n bytes of entropy
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 of a high entropy token for storage
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueRefreshToken stores a new refresh token for the user and returns it.
+// An empty familyID starts a new family.
+func IssueRefreshToken(dbInstance *sql.DB, userID, tenantID int, familyID string) (string, error) {
+	if familyID == "" {
+		var err error
+		if familyID, err = RandomToken(16); err != nil {
+			return "", err
+		}
+	}
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = dbInstance.Exec(`
+		INSERT INTO refresh_tokens (token_hash, family_id, user_id, tenant_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		HashToken(token), familyID, userID, tenantID, time.Now().Add(RefreshTokenTTL()))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken consumes a refresh token and returns its record together with its replacement.
+// Presenting a token that was already rotated is treated as theft: the whole family and its
+// session are revoked.
+func RotateRefreshToken(dbInstance *sql.DB, token string) (*RefreshToken, string, error) {
+	tx, err := dbInstance.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		rt        RefreshToken
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRow(`
+		SELECT id, family_id, user_id, tenant_id, expires_at, used_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE`, HashToken(token)).Scan(&rt.ID, &rt.FamilyID, &rt.UserID, &rt.TenantID, &rt.ExpiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if revokedAt.Valid {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	if usedAt.Valid {
+		log.Printf("Refresh token reuse detected for user %d, revoking family %s", rt.UserID, rt.FamilyID)
+		if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, rt.FamilyID); err != nil {
+			return nil, "", err
+		}
+		// The family is the session, so its access tokens stop working too, like RevokeSession
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE jti = $1 AND user_id = $2 AND revoked_at IS NULL`, rt.FamilyID, rt.UserID); err != nil {
+			return nil, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRefreshTokenReused
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	next, err := RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, rt.ID); err != nil {
+		return nil, "", err
+	}
+	rt.ExpiresAt = time.Now().Add(RefreshTokenTTL())
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (token_hash, family_id, user_id, tenant_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		HashToken(next), rt.FamilyID, rt.UserID, rt.TenantID, rt.ExpiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return &rt, next, nil
+}
+
+// RevokeRefreshFamily revokes every refresh token of a family
+func RevokeRefreshFamily(dbInstance *sql.DB, familyID string) error {
+	_, err := dbInstance.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, familyID)
+	return err
+}
+
+// FindRefreshToken returns the record of a refresh token that is neither used, revoked nor expired
+func FindRefreshToken(dbInstance *sql.DB, token string) (*RefreshToken, error) {
+	var rt RefreshToken
+	err := dbInstance.QueryRow(`
+		SELECT id, family_id, user_id, tenant_id, expires_at
+		FROM refresh_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()`, HashToken(token)).
+		Scan(&rt.ID, &rt.FamilyID, &rt.UserID, &rt.TenantID, &rt.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
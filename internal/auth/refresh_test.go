@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var refreshColumns = []string{"id", "family_id", "user_id", "tenant_id", "expires_at", "used_at", "revoked_at"}
+
+const selectRefreshToken = `SELECT id, family_id, user_id, tenant_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = \$1 FOR UPDATE`
+
+func TestIssueRefreshToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO refresh_tokens").
+		WithArgs(sqlmock.AnyArg(), "family-1", 7, 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	token, err := IssueRefreshToken(db, 7, 3, "family-1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(token) < 40 {
+		t.Errorf("expected a high entropy token, got %q", token)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectRefreshToken).
+		WithArgs(HashToken("current")).
+		WillReturnRows(sqlmock.NewRows(refreshColumns).
+			AddRow(5, "family-1", 7, 3, time.Now().Add(time.Hour), nil, nil))
+	mock.ExpectExec(`UPDATE refresh_tokens SET used_at = NOW\(\) WHERE id = \$1`).
+		WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").
+		WithArgs(sqlmock.AnyArg(), "family-1", 7, 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(6, 1))
+	mock.ExpectCommit()
+
+	rt, next, err := RotateRefreshToken(db, "current")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rt.UserID != 7 || rt.FamilyID != "family-1" {
+		t.Errorf("unexpected refresh token record: %+v", rt)
+	}
+	if next == "" || next == "current" {
+		t.Errorf("expected a new refresh token, got %q", next)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestRotateRefreshToken_ReuseRevokesFamily(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectRefreshToken).
+		WithArgs(HashToken("stolen")).
+		WillReturnRows(sqlmock.NewRows(refreshColumns).
+			AddRow(5, "family-1", 7, 3, time.Now().Add(time.Hour), time.Now().Add(-time.Minute), nil))
+	mock.ExpectExec(`UPDATE refresh_tokens SET revoked_at = NOW\(\) WHERE family_id = \$1 AND revoked_at IS NULL`).
+		WithArgs("family-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE sessions SET revoked_at = NOW\(\) WHERE jti = \$1 AND user_id = \$2 AND revoked_at IS NULL`).
+		WithArgs("family-1", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, _, err = RotateRefreshToken(db, "stolen")
+	if err != ErrRefreshTokenReused {
+		t.Errorf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestRotateRefreshToken_Rejected(t *testing.T) {
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+	}{
+		{"unknown", sqlmock.NewRows(refreshColumns)},
+		{"revoked", sqlmock.NewRows(refreshColumns).
+			AddRow(5, "family-1", 7, 3, time.Now().Add(time.Hour), nil, time.Now())},
+		{"expired", sqlmock.NewRows(refreshColumns).
+			AddRow(5, "family-1", 7, 3, time.Now().Add(-time.Hour), nil, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock database: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(selectRefreshToken).WillReturnRows(tt.rows)
+			mock.ExpectRollback()
+
+			if _, _, err := RotateRefreshToken(db, "token"); err != ErrInvalidRefreshToken {
+				t.Errorf("expected ErrInvalidRefreshToken, got %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+// Patch point for the token version lookup done by AuthMiddleware
+var currentTokenVersion = func(dbInstance *sql.DB, userID int) (int, error) {
+	var version int
+	err := dbInstance.QueryRow(`SELECT token_version FROM users WHERE id = $1`, userID).Scan(&version)
+	return version, err
+}
+
+// checkTokenVersion rejects tokens issued before the user's last security-relevant change.
+// A deleted user has no row left, so their tokens are rejected as well.
+func checkTokenVersion(dbInstance *sql.DB, claims *Claims) error {
+	version, err := currentTokenVersion(dbInstance, claims.UserID)
+	if err == sql.ErrNoRows {
+		return ErrTokenRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if version != claims.TokenVersion {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// RevokeUserTokens invalidates every access and refresh token issued to the user, and their
+// API keys. Call it after a password change, a role change, or before deleting the user.
+func RevokeUserTokens(dbInstance *sql.DB, userID int) error {
+	_, err := dbInstance.Exec(`UPDATE users SET token_version = token_version + 1 WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return RevokeUserSessions(dbInstance, userID, "")
+}
+
+// RevokeAccessToken blacklists an access token until it expires and ends the session it
+// belongs to, along with the session's refresh tokens
+func RevokeAccessToken(dbInstance *sql.DB, tokenStr string, claims *Claims) error {
+	_, err := dbInstance.Exec(`INSERT INTO token_blacklist (token, expiration) VALUES ($1, $2) ON CONFLICT (token) DO NOTHING`,
+		tokenStr, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return err
+	}
+	if claims.Id != "" {
+		if err := RevokeSession(dbInstance, claims.UserID, claims.Id); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeRefreshToken ends the session of a refresh token together with every token of its family
+func RevokeRefreshToken(dbInstance *sql.DB, rt *RefreshToken) error {
+	err := RevokeSession(dbInstance, rt.UserID, rt.FamilyID)
+	if err == sql.ErrNoRows {
+		// The session is already gone; its refresh tokens may still be live
+		return RevokeRefreshFamily(dbInstance, rt.FamilyID)
+	}
+	return err
+}
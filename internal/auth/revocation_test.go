@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuthMiddleware_TokenVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		rows           *sqlmock.Rows
+		queryErr       error
+		expectedStatus int
+	}{
+		{"current version", sqlmock.NewRows([]string{"token_version"}).AddRow(3), nil, http.StatusOK},
+		{"bumped version", sqlmock.NewRows([]string{"token_version"}).AddRow(4), nil, http.StatusUnauthorized},
+		{"deleted user", nil, sql.ErrNoRows, http.StatusUnauthorized},
+	}
+
+	origValidateToken := ValidateToken
+	defer func() { ValidateToken = origValidateToken }()
+	ValidateToken = func(token string) (*Claims, error) {
+		return &Claims{Email: "test@example.com", TenantID: 42, UserID: 7, TokenVersion: 3}, nil
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock database: %v", err)
+			}
+			defer db.Close()
+
+			query := mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(7)
+			if tt.queryErr != nil {
+				query.WillReturnError(tt.queryErr)
+			} else {
+				query.WillReturnRows(tt.rows)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer versioned")
+			rr := httptest.NewRecorder()
+
+			handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), db)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE users SET token_version = token_version \\+ 1 WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").
+		WithArgs(7, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs(7, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := RevokeUserTokens(db, 7); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuthMiddleware_ServiceAccountToken(t *testing.T) {
+	noBlacklist(t)
+	token, err := SignServiceAccountToken(5, 42, 1, "admin", ScopeRead)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		version        interface{} // token_version in the database, nil for a deleted account
+		expectedStatus int
+	}{
+		{"Read within scope", "GET", 1, http.StatusOK},
+		{"Write outside scope", "POST", 1, http.StatusForbidden},
+		{"Secret rotated", "GET", 2, http.StatusUnauthorized},
+		{"Account deleted", "GET", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock database: %v", err)
+			}
+			defer db.Close()
+
+			rows := sqlmock.NewRows([]string{"token_version"})
+			if tt.version != nil {
+				rows.AddRow(tt.version)
+			}
+			mock.ExpectQuery("SELECT token_version FROM service_accounts WHERE id = \\$1 AND tenant_id = \\$2").
+				WithArgs(5, 42).
+				WillReturnRows(rows)
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				if GetPrincipalType(ctx) != PrincipalServiceAccount || GetServiceAccountID(ctx) != 5 {
+					t.Errorf("expected service account 5 in context, got %q %d", GetPrincipalType(ctx), GetServiceAccountID(ctx))
+				}
+				if tenantID, _ := GetTenantID(ctx); tenantID != 42 {
+					t.Errorf("expected tenantID 42, got %d", tenantID)
+				}
+				if _, err := GetUserID(ctx); err == nil {
+					t.Error("expected no user ID for a service account")
+				}
+			}), db).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetPrincipalType_DefaultsToUser(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if got := GetPrincipalType(req.Context()); got != PrincipalUser {
+		t.Errorf("expected %q, got %q", PrincipalUser, got)
+	}
+}
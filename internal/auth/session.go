@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrSessionRevoked = errors.New("session revoked")
+
+// Session is a signed-in device. Its ID is the jti of every access token issued
+// for it and the family ID of its refresh tokens.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	TenantID   int       `json:"tenant_id"`
+	Device     string    `json:"device"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+// Authentication is when and how the user of a session last proved who they are. It
+// becomes the auth_time and amr claims of the session's access tokens.
+type Authentication struct {
+	Time    time.Time
+	Methods []string // Values of the amr claim, see stepup.go
+}
+
+// Authenticated is an authentication with the given methods, now
+func Authenticated(methods ...string) Authentication {
+	return Authentication{Time: time.Now(), Methods: methods}
+}
+
+// CreateSession records a new session for the user signing in with the request. Sessions
+// started without an authentication, such as device logins, have no auth_time.
+func CreateSession(dbInstance *sql.DB, r *http.Request, userID, tenantID int, device string, authn Authentication) (string, error) {
+	sessionID, err := RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	userAgent := r.UserAgent()
+	if device == "" {
+		device = DeviceLabel(userAgent)
+	}
+	_, err = dbInstance.Exec(`
+		INSERT INTO sessions (jti, user_id, tenant_id, device, ip_address, user_agent, auth_time, amr, created_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW())`,
+		sessionID, userID, tenantID, device, ClientIP(r), userAgent, authTime(authn), amrJSON(authn))
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// SessionAuthentication returns the last authentication of a session, for the access
+// tokens issued when its refresh token is used
+func SessionAuthentication(dbInstance *sql.DB, sessionID string) (Authentication, error) {
+	var (
+		authn Authentication
+		at    sql.NullTime
+		amr   []byte
+	)
+	err := dbInstance.QueryRow(`SELECT auth_time, amr FROM sessions WHERE jti = $1`, sessionID).Scan(&at, &amr)
+	if err != nil {
+		return authn, err
+	}
+	authn.Time = at.Time
+	if len(amr) > 0 {
+		if err := json.Unmarshal(amr, &authn.Methods); err != nil {
+			return authn, err
+		}
+	}
+	return authn, nil
+}
+
+// Reauthenticate records that the user of an active session proved who they are again.
+// It returns ErrSessionRevoked when the session is gone.
+func Reauthenticate(dbInstance *sql.DB, sessionID string, authn Authentication) error {
+	res, err := dbInstance.Exec(`UPDATE sessions SET auth_time = $1, amr = $2 WHERE jti = $3 AND revoked_at IS NULL`,
+		authTime(authn), amrJSON(authn), sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+func authTime(authn Authentication) sql.NullTime {
+	return sql.NullTime{Time: authn.Time, Valid: !authn.Time.IsZero()}
+}
+
+func amrJSON(authn Authentication) []byte {
+	if len(authn.Methods) == 0 {
+		return []byte("[]")
+	}
+	methods, _ := json.Marshal(authn.Methods)
+	return methods
+}
+
+// Patch point for the session check done by AuthMiddleware.
+// It fails when the session was revoked and refreshes last_seen_at otherwise.
+var touchSession = func(dbInstance *sql.DB, sessionID string) error {
+	res, err := dbInstance.Exec(`UPDATE sessions SET last_seen_at = NOW() WHERE jti = $1 AND revoked_at IS NULL`, sessionID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of a user, most recently used first
+func ListSessions(dbInstance *sql.DB, userID int) ([]Session, error) {
+	rows, err := dbInstance.Query(`
+		SELECT jti, user_id, tenant_id, COALESCE(device, ''), COALESCE(ip_address, ''), COALESCE(user_agent, ''), created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND last_seen_at > $2
+		ORDER BY last_seen_at DESC`, userID, time.Now().Add(-RefreshTokenTTL()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.TenantID, &s.Device, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession signs a single session of the user out, including its refresh tokens.
+// It returns sql.ErrNoRows when the user has no such active session.
+func RevokeSession(dbInstance *sql.DB, userID int, sessionID string) error {
+	res, err := dbInstance.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE jti = $1 AND user_id = $2 AND revoked_at IS NULL`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return RevokeRefreshFamily(dbInstance, sessionID)
+}
+
+// RevokeUserSessions signs every session of the user out except keepSessionID (may be empty)
+func RevokeUserSessions(dbInstance *sql.DB, userID int, keepSessionID string) error {
+	_, err := dbInstance.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND jti <> $2 AND revoked_at IS NULL`, userID, keepSessionID)
+	if err != nil {
+		return err
+	}
+	_, err = dbInstance.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL`, userID, keepSessionID)
+	return err
+}
+
+// ClientIP returns the caller's address. X-Forwarded-For is only honoured
+// when TRUST_PROXY_HEADERS=true, i.e. when Sentinel runs behind the ingress.
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// DeviceLabel turns a User-Agent into a short label such as "Firefox on Windows"
+func DeviceLabel(userAgent string) string {
+	browser := "Unknown client"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"Go-http-client", "Go client"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			return browser + " on " + o.name
+		}
+	}
+	return browser
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuthMiddleware_RevokedSession(t *testing.T) {
+	origValidateToken := ValidateToken
+	defer func() { ValidateToken = origValidateToken }()
+	ValidateToken = func(token string) (*Claims, error) {
+		claims := &Claims{Email: "test@example.com", TenantID: 42, UserID: 7}
+		claims.Id = "session-1"
+		return claims, nil
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+	mock.ExpectExec("UPDATE sessions SET last_seen_at = NOW\\(\\) WHERE jti = \\$1 AND revoked_at IS NULL").
+		WithArgs("session-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer sessiontoken")
+	rr := httptest.NewRecorder()
+
+	handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Should not call next handler")
+	}), db)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAuthMiddleware_ActiveSession(t *testing.T) {
+	origValidateToken := ValidateToken
+	defer func() { ValidateToken = origValidateToken }()
+	ValidateToken = func(token string) (*Claims, error) {
+		claims := &Claims{Email: "test@example.com", TenantID: 42, UserID: 7}
+		claims.Id = "session-1"
+		return claims, nil
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+	mock.ExpectExec("UPDATE sessions SET last_seen_at").
+		WithArgs("session-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer sessiontoken")
+	rr := httptest.NewRecorder()
+
+	called := false
+	handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if userID, err := GetUserID(r.Context()); err != nil || userID != 7 {
+			t.Errorf("expected user ID 7, got %v, err: %v", userID, err)
+		}
+		if sessionID := GetSessionID(r.Context()); sessionID != "session-1" {
+			t.Errorf("expected session-1, got %q", sessionID)
+		}
+	}), db)
+	handler.ServeHTTP(rr, req)
+
+	if !called {
+		t.Error("next handler was not called")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDeviceLabel(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:126.0) Gecko/20100101 Firefox/126.0":                                                        "Firefox on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1": "Safari on iPhone",
+		"curl/8.5.0": "curl",
+		"":           "Unknown client",
+	}
+	for ua, want := range tests {
+		if got := DeviceLabel(ua); got != want {
+			t.Errorf("DeviceLabel(%q) = %q, want %q", ua, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.5:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+
+	t.Setenv("TRUST_PROXY_HEADERS", "")
+	if ip := ClientIP(req); ip != "10.0.0.5" {
+		t.Errorf("expected remote address without trusted proxy, got %q", ip)
+	}
+	t.Setenv("TRUST_PROXY_HEADERS", "true")
+	if ip := ClientIP(req); ip != "203.0.113.9" {
+		t.Errorf("expected forwarded address behind trusted proxy, got %q", ip)
+	}
+}
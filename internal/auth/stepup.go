@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Values of the amr claim. The registered ones are from RFC 8176; "email" and "fed" name
+// sign-ins it has no value for.
+const (
+	AMRPassword    = "pwd"   // Password, checked locally or against the tenant's directory
+	AMROTP         = "otp"   // TOTP or recovery code
+	AMRMFA         = "mfa"   // More than one factor, or a passkey with user verification
+	AMRHardwareKey = "hwk"   // Passkey
+	AMREmail       = "email" // Magic link sent by email
+	AMRFederated   = "fed"   // Upstream OpenID Connect or SAML provider
+)
+
+// ErrStepUpRequired is the error code of the challenge written by RequireStepUp (RFC 9470)
+const ErrStepUpRequired = "insufficient_user_authentication"
+
+// StepUpMaxAge is how recent a sign-in sensitive operations need, STEP_UP_MAX_AGE or 5 minutes
+func StepUpMaxAge() time.Duration {
+	return durationFromEnv("STEP_UP_MAX_AGE", 5*time.Minute)
+}
+
+// RequireStepUp marks the routes it wraps as sensitive: they are only served when the
+// user signed in or re-authenticated at /api/reauth within StepUpMaxAge. It must run
+// after AuthMiddleware.
+func RequireStepUp(next http.Handler, dbInstance *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if StepUpSatisfied(w, r, dbInstance) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// StepUpSatisfied checks the caller of a sensitive operation signed in recently. Otherwise
+// it writes the step-up challenge, or 403 for callers that cannot re-authenticate: API
+// keys, service accounts and impersonation tokens.
+func StepUpSatisfied(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) bool {
+	ctx := r.Context()
+	userID, err := GetUserID(ctx)
+	if err != nil || GetAPIKeyID(ctx) != 0 || GetActorID(ctx) != 0 || GetSessionID(ctx) == "" {
+		http.Error(w, "This operation requires a signed-in user", http.StatusForbidden)
+		return false
+	}
+	if authTime := GetAuthTime(ctx); !authTime.IsZero() && time.Since(authTime) <= StepUpMaxAge() {
+		return true
+	}
+
+	methods, err := reauthMethods(dbInstance, userID)
+	if err != nil {
+		log.Println("Error checking re-authentication methods:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+		return false
+	}
+	writeStepUpChallenge(w, methods)
+	return false
+}
+
+// reauthMethods lists how the user can answer a step-up challenge at /api/reauth. Users
+// with MFA confirm with their second factor, others with their password or by signing in
+// again: through the tenant's OpenID Connect or SAML provider, or with a magic link when
+// the tenant allows them. A passkey counts as both factors, so it works for everyone.
+func reauthMethods(dbInstance *sql.DB, userID int) ([]string, error) {
+	var mfaEnabled, passkey, federated, magicLink bool
+	err := dbInstance.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = u.id AND enabled_at IS NOT NULL),
+			EXISTS(SELECT 1 FROM webauthn_credentials WHERE user_id = u.id),
+			EXISTS(SELECT 1 FROM oidc_connections WHERE tenant_id = u.tenant_id) OR EXISTS(SELECT 1 FROM saml_connections WHERE tenant_id = u.tenant_id),
+			COALESCE((SELECT (settings->>'magic_link_login')::boolean FROM tenant_settings WHERE tenant_id = u.tenant_id), FALSE)
+		FROM users u WHERE u.id = $1`, userID).Scan(&mfaEnabled, &passkey, &federated, &magicLink)
+	if err != nil {
+		return nil, err
+	}
+	if mfaEnabled {
+		methods := []string{AMROTP}
+		if passkey {
+			methods = append(methods, AMRHardwareKey)
+		}
+		return methods, nil
+	}
+	methods := []string{AMRPassword}
+	if passkey {
+		methods = append(methods, AMRHardwareKey)
+	}
+	if federated {
+		methods = append(methods, AMRFederated)
+	}
+	if magicLink {
+		methods = append(methods, AMREmail)
+	}
+	return methods, nil
+}
+
+// writeStepUpChallenge answers 401 with an RFC 9470 challenge in WWW-Authenticate and in
+// the body, which also names the endpoint and the methods the frontend should prompt for
+func writeStepUpChallenge(w http.ResponseWriter, methods []string) {
+	maxAge := int(StepUpMaxAge().Seconds())
+	description := "A recent sign-in is required for this operation"
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="%s", error_description="%s", max_age=%d`,
+		ErrStepUpRequired, description, maxAge))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":             ErrStepUpRequired,
+		"error_description": description,
+		"max_age":           maxAge,
+		"methods":           methods,
+		"reauth_endpoint":   "/api/reauth",
+	})
+}
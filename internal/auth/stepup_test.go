@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRequireStepUp(t *testing.T) {
+	signedIn := func(authTime time.Time) context.Context {
+		ctx := context.WithValue(context.Background(), UserIDKey, 7)
+		ctx = context.WithValue(ctx, SessionIDKey, "s1")
+		if !authTime.IsZero() {
+			ctx = context.WithValue(ctx, AuthTimeKey, authTime.Unix())
+		}
+		return ctx
+	}
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		methods        []bool // MFA, passkey, federation and magic links; nil when no lookup is expected
+		expectedStatus int
+		expectMethods  []string
+	}{
+		{"Recent sign-in", signedIn(time.Now().Add(-time.Minute)), nil, http.StatusOK, nil},
+		{"Old sign-in", signedIn(time.Now().Add(-time.Hour)), []bool{false, false, false, false}, http.StatusUnauthorized, []string{AMRPassword}},
+		{"Old sign-in of a user with MFA", signedIn(time.Now().Add(-time.Hour)), []bool{true, false, true, true}, http.StatusUnauthorized, []string{AMROTP}},
+		{"User with MFA and a passkey", signedIn(time.Now().Add(-time.Hour)), []bool{true, true, false, false}, http.StatusUnauthorized, []string{AMROTP, AMRHardwareKey}},
+		{"Federated tenant", signedIn(time.Now().Add(-time.Hour)), []bool{false, false, true, false}, http.StatusUnauthorized, []string{AMRPassword, AMRFederated}},
+		{"Every way to sign in", signedIn(time.Now().Add(-time.Hour)), []bool{false, true, true, true}, http.StatusUnauthorized, []string{AMRPassword, AMRHardwareKey, AMRFederated, AMREmail}},
+		{"Token without auth_time", signedIn(time.Time{}), []bool{false, false, false, false}, http.StatusUnauthorized, []string{AMRPassword}},
+		{"API key", context.WithValue(signedIn(time.Now()), APIKeyIDKey, 2), nil, http.StatusForbidden, nil},
+		{"Impersonation token", context.WithValue(signedIn(time.Now()), ActorIDKey, 3), nil, http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock database: %v", err)
+			}
+			defer db.Close()
+			if tt.methods != nil {
+				mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM user_totp WHERE user_id = u.id AND enabled_at IS NOT NULL\)`).WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"mfa", "passkey", "federated", "magic_link"}).
+						AddRow(tt.methods[0], tt.methods[1], tt.methods[2], tt.methods[3]))
+			}
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/user/9", nil).WithContext(tt.ctx)
+			rr := httptest.NewRecorder()
+			RequireStepUp(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), db).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusUnauthorized {
+				if header := rr.Header().Get("WWW-Authenticate"); !strings.Contains(header, `error="insufficient_user_authentication"`) ||
+					!strings.Contains(header, "max_age=300") {
+					t.Errorf("unexpected WWW-Authenticate header: %s", header)
+				}
+				var challenge struct {
+					Error   string   `json:"error"`
+					MaxAge  int      `json:"max_age"`
+					Methods []string `json:"methods"`
+				}
+				json.Unmarshal(rr.Body.Bytes(), &challenge)
+				if challenge.Error != ErrStepUpRequired || challenge.MaxAge != 300 ||
+					strings.Join(challenge.Methods, " ") != strings.Join(tt.expectMethods, " ") {
+					t.Errorf("unexpected challenge: %s", rr.Body.String())
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
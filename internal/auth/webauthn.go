@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// PasskeyUser adapts a user and their registered passkeys to the webauthn.User interface
+type PasskeyUser struct {
+	ID          int
+	Email       string
+	Name        string
+	Credentials []webauthn.Credential
+}
+
+// PasskeyUserHandle is the WebAuthn user handle stored on the authenticator for a user.
+// Discoverable logins return it, so it must identify the user on its own.
+func PasskeyUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+func (u *PasskeyUser) WebAuthnID() []byte                         { return PasskeyUserHandle(u.ID) }
+func (u *PasskeyUser) WebAuthnName() string                       { return u.Email }
+func (u *PasskeyUser) WebAuthnDisplayName() string                { return u.Name }
+func (u *PasskeyUser) WebAuthnCredentials() []webauthn.Credential { return u.Credentials }
+
+var (
+	relyingParty   *webauthn.WebAuthn
+	relyingPartyMu sync.Mutex
+)
+
+// RelyingParty returns the WebAuthn relying party, configured from the environment:
+//   - WEBAUTHN_RP_ID: the domain passkeys are bound to, by default the host of PUBLIC_URL
+//   - WEBAUTHN_RP_ORIGINS: comma separated origins allowed to run ceremonies, by default PUBLIC_URL
+//   - WEBAUTHN_RP_NAME: the name shown by the browser, "Sentinel" by default
+func RelyingParty() (*webauthn.WebAuthn, error) {
+	relyingPartyMu.Lock()
+	defer relyingPartyMu.Unlock()
+	if relyingParty != nil {
+		return relyingParty, nil
+	}
+
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:5173"
+	}
+	publicURL = strings.TrimRight(publicURL, "/")
+
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		u, err := url.Parse(publicURL)
+		if err != nil {
+			return nil, err
+		}
+		rpID = u.Hostname()
+	}
+	origins := []string{publicURL}
+	if v := os.Getenv("WEBAUTHN_RP_ORIGINS"); v != "" {
+		origins = strings.Split(v, ",")
+	}
+	name := os.Getenv("WEBAUTHN_RP_NAME")
+	if name == "" {
+		name = "Sentinel"
+	}
+
+	rp, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: name,
+		RPOrigins:     origins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	relyingParty = rp
+	return rp, nil
+}
@@ -0,0 +1,209 @@
+// Package extauthz is Sentinel's Envoy external authorization server. Envoy calls Check
+// over gRPC for every request of the mesh; the request is authenticated the way the /api
+// routes authenticate theirs, and allowed requests are forwarded with identity headers.
+package extauthz
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sentinel/internal/auth"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Context extensions a route sets in its ext_authz per-route config to require more than
+// a valid token. They come from the Envoy config, so clients cannot supply them.
+const (
+	RequiredRoleExtension   = "required_role"   // Comma-separated roles, one of which the caller must have
+	RequiredModuleExtension = "required_module" // Name of a module of the tenant the user must have access to
+)
+
+// identityHeaders are set on allowed requests. Any value the client sent is removed from
+// every checked request, so upstreams can trust them.
+var identityHeaders = []string{
+	"x-user-email", "x-user-id", "x-tenant-id", "x-role", "x-principal-type", "x-service-account-id",
+	"x-impersonator-id",
+}
+
+// Server implements envoy.service.auth.v3.Authorization
+type Server struct {
+	authv3.UnimplementedAuthorizationServer
+	db *sql.DB
+}
+
+func NewServer(dbInstance *sql.DB) *Server {
+	return &Server{db: dbInstance}
+}
+
+// Register adds the authorization service to a gRPC server
+func Register(s *grpc.Server, dbInstance *sql.DB) {
+	authv3.RegisterAuthorizationServer(s, NewServer(dbInstance))
+}
+
+// identity is the principal a checked request acts for
+type identity struct {
+	email            string
+	tenantID         int
+	role             string
+	userID           int
+	serviceAccountID int
+	claims           *auth.Claims // Claims of the token, nil for API keys
+}
+
+// Check authenticates the bearer token, API key or token cookie of the request. Tokens
+// go through auth.Authenticate: ValidateToken, the blacklist, token versions and sessions.
+// Errors of the database are returned as gRPC errors, which Envoy treats as a failed check.
+func (s *Server) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	httpReq := req.GetAttributes().GetRequest().GetHttp()
+	headers := httpReq.GetHeaders()
+	method := strings.ToUpper(httpReq.GetMethod())
+
+	id, denied, err := s.authenticate(headers, method)
+	if err != nil {
+		log.Println("ext_authz check failed:", err)
+		return nil, status.Error(codes.Internal, "authorization check failed")
+	}
+	if denied != nil {
+		return denied, nil
+	}
+	// Every request made while impersonating a user is audited
+	if id.claims != nil && id.claims.Actor != nil {
+		ip := req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress()
+		if err := auth.RecordImpersonatedRequest(s.db, id.claims, method, httpReq.GetPath(), ip); err != nil {
+			log.Println("Error auditing impersonated request:", err)
+			return nil, status.Error(codes.Internal, "authorization check failed")
+		}
+	}
+
+	extensions := req.GetAttributes().GetContextExtensions()
+	if required := extensions[RequiredRoleExtension]; required != "" && !auth.RoleAllowed(id.role, required) {
+		return deny(codes.PermissionDenied, typev3.StatusCode_Forbidden, "Role not allowed"), nil
+	}
+	if module := extensions[RequiredModuleExtension]; module != "" {
+		// Module access is granted to users; service accounts have none
+		allowed := false
+		if id.userID != 0 {
+			if allowed, err = auth.HasModuleAccess(s.db, id.userID, id.tenantID, module); err != nil {
+				log.Println("Error checking module access:", err)
+				return nil, status.Error(codes.Internal, "authorization check failed")
+			}
+		}
+		if !allowed {
+			return deny(codes.PermissionDenied, typev3.StatusCode_Forbidden, "No access to this module"), nil
+		}
+	}
+	return allow(id), nil
+}
+
+// authenticate returns the identity of the request, or the response denying it
+func (s *Server) authenticate(headers map[string]string, method string) (identity, *authv3.CheckResponse, error) {
+	credential := headers["authorization"]
+	if credential == "" {
+		credential = "Bearer " + tokenCookie(headers["cookie"])
+	}
+
+	if key, ok := strings.CutPrefix(credential, "ApiKey "); ok {
+		principal, err := auth.AuthenticateAPIKey(s.db, key)
+		if err == auth.ErrInvalidAPIKey {
+			return identity{}, deny(codes.Unauthenticated, typev3.StatusCode_Unauthorized, "Invalid or expired API key"), nil
+		}
+		if err != nil {
+			return identity{}, nil, err
+		}
+		if !principal.Allows(method) {
+			return identity{}, deny(codes.PermissionDenied, typev3.StatusCode_Forbidden, "API key scope does not allow this request"), nil
+		}
+		return identity{email: principal.Email, tenantID: principal.TenantID, role: principal.Role, userID: principal.UserID}, nil, nil
+	}
+
+	tokenStr := strings.TrimPrefix(credential, "Bearer ")
+	if tokenStr == "" {
+		return identity{}, deny(codes.Unauthenticated, typev3.StatusCode_Unauthorized, "Authorization header required"), nil
+	}
+	claims, err := auth.Authenticate(s.db, tokenStr)
+	if err != nil {
+		return identity{}, deny(codes.Unauthenticated, typev3.StatusCode_Unauthorized, "Invalid or expired token"), nil
+	}
+	if !claims.Allows(method) {
+		return identity{}, deny(codes.PermissionDenied, typev3.StatusCode_Forbidden, "Token scope does not allow this request"), nil
+	}
+	return identity{email: claims.Email, tenantID: claims.TenantID, role: claims.Role,
+		userID: claims.UserID, serviceAccountID: claims.ServiceAccountID, claims: claims}, nil, nil
+}
+
+// tokenCookie extracts the "token" cookie from a Cookie header
+func tokenCookie(cookieHeader string) string {
+	if cookieHeader == "" {
+		return ""
+	}
+	req := http.Request{Header: http.Header{"Cookie": {cookieHeader}}}
+	if cookie, err := req.Cookie("token"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func allow(id identity) *authv3.CheckResponse {
+	principalType := auth.PrincipalUser
+	if id.serviceAccountID != 0 {
+		principalType = auth.PrincipalServiceAccount
+	}
+	values := map[string]string{
+		"x-user-email":     id.email,
+		"x-tenant-id":      strconv.Itoa(id.tenantID),
+		"x-role":           id.role,
+		"x-principal-type": principalType,
+	}
+	if id.userID != 0 {
+		values["x-user-id"] = strconv.Itoa(id.userID)
+	}
+	if id.serviceAccountID != 0 {
+		values["x-service-account-id"] = strconv.Itoa(id.serviceAccountID)
+	}
+	if id.claims != nil && id.claims.Actor != nil {
+		values["x-impersonator-id"] = strconv.Itoa(id.claims.Actor.UserID)
+	}
+
+	var set []*corev3.HeaderValueOption
+	var remove []string
+	for _, name := range identityHeaders {
+		value, ok := values[name]
+		if !ok {
+			remove = append(remove, name)
+			continue
+		}
+		set = append(set, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: name, Value: value},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{Headers: set, HeadersToRemove: remove},
+		},
+	}
+}
+
+func deny(code codes.Code, httpStatus typev3.StatusCode, message string) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code), Message: message},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status: &typev3.HttpStatus{Code: httpStatus},
+				Body:   message,
+			},
+		},
+	}
+}
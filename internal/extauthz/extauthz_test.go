@@ -0,0 +1,175 @@
+package extauthz
+
+import (
+	"context"
+	"testing"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+)
+
+// stubToken accepts "member-token" as user 7 of tenant 1 and "reader-token" as a
+// read-only service account of tenant 1
+func stubToken(t *testing.T) {
+	orig := auth.ValidateToken
+	auth.ValidateToken = func(tokenStr string) (*auth.Claims, error) {
+		switch tokenStr {
+		case "member-token":
+			return &auth.Claims{UserID: 7, TenantID: 1, Email: "user@example.com", Role: "member"}, nil
+		case "reader-token":
+			return &auth.Claims{ServiceAccountID: 5, TenantID: 1, Role: "member",
+				PrincipalType: auth.PrincipalServiceAccount, Scope: auth.ScopeRead}, nil
+		}
+		return nil, auth.ErrInvalidToken
+	}
+	t.Cleanup(func() { auth.ValidateToken = orig })
+}
+
+func checkRequest(method string, headers, extensions map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+		Request: &authv3.AttributeContext_Request{
+			Http: &authv3.AttributeContext_HttpRequest{Method: method, Path: "/orders", Headers: headers},
+		},
+		ContextExtensions: extensions,
+	}}
+}
+
+func responseHeaders(resp *authv3.CheckResponse) map[string]string {
+	headers := map[string]string{}
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		headers[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	return headers
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		extensions   map[string]string
+		expectUser   bool
+		expectModule interface{} // nil when no module lookup is expected
+		expectedCode codes.Code
+		expectedHTTP typev3.StatusCode
+	}{
+		{"Bearer token", "GET", map[string]string{"authorization": "Bearer member-token"}, nil, true, nil, codes.OK, 0},
+		{"Token cookie", "GET", map[string]string{"cookie": "theme=dark; token=member-token"}, nil, true, nil, codes.OK, 0},
+		{"No credentials", "GET", map[string]string{}, nil, false, nil, codes.Unauthenticated, typev3.StatusCode_Unauthorized},
+		{"Invalid token", "GET", map[string]string{"authorization": "Bearer forged"}, nil, false, nil, codes.Unauthenticated, typev3.StatusCode_Unauthorized},
+		{"Role not allowed", "GET", map[string]string{"authorization": "Bearer member-token"}, map[string]string{RequiredRoleExtension: "admin"}, true, nil, codes.PermissionDenied, typev3.StatusCode_Forbidden},
+		{"Module access", "GET", map[string]string{"authorization": "Bearer member-token"}, map[string]string{RequiredModuleExtension: "billing"}, true, true, codes.OK, 0},
+		{"No module access", "GET", map[string]string{"authorization": "Bearer member-token"}, map[string]string{RequiredModuleExtension: "billing"}, true, false, codes.PermissionDenied, typev3.StatusCode_Forbidden},
+		{"Service account within scope", "GET", map[string]string{"authorization": "Bearer reader-token"}, nil, false, nil, codes.OK, 0},
+		{"Service account outside scope", "POST", map[string]string{"authorization": "Bearer reader-token"}, nil, false, nil, codes.PermissionDenied, typev3.StatusCode_Forbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			stubToken(t)
+
+			if tt.expectUser || tt.headers["authorization"] == "Bearer reader-token" {
+			}
+			if tt.expectUser {
+				mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+			}
+			if tt.headers["authorization"] == "Bearer reader-token" {
+				mock.ExpectQuery("SELECT token_version FROM service_accounts").WithArgs(5, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+			}
+			if tt.expectModule != nil {
+				mock.ExpectQuery("SELECT 1 FROM user_modules um JOIN modules m ON m.id = um.module_id").
+					WithArgs(7, 1, "billing").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.expectModule))
+			}
+
+			resp, err := NewServer(db).Check(context.Background(), checkRequest(tt.method, tt.headers, tt.extensions))
+			if err != nil {
+				t.Fatalf("Check returned an error: %v", err)
+			}
+			if code := codes.Code(resp.GetStatus().GetCode()); code != tt.expectedCode {
+				t.Fatalf("expected code %v, got %v (%s)", tt.expectedCode, code, resp.GetStatus().GetMessage())
+			}
+			if tt.expectedCode != codes.OK {
+				if got := resp.GetDeniedResponse().GetStatus().GetCode(); got != tt.expectedHTTP {
+					t.Errorf("expected HTTP status %v, got %v", tt.expectedHTTP, got)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheck_IdentityHeaders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	stubToken(t)
+
+	mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+
+	// A spoofed identity header is overwritten, and one that does not apply is removed
+	headers := map[string]string{"authorization": "Bearer member-token", "x-role": "admin", "x-service-account-id": "1"}
+	resp, err := NewServer(db).Check(context.Background(), checkRequest("GET", headers, nil))
+	if err != nil {
+		t.Fatalf("Check returned an error: %v", err)
+	}
+	got := responseHeaders(resp)
+	if got["x-user-email"] != "user@example.com" || got["x-user-id"] != "7" || got["x-tenant-id"] != "1" ||
+		got["x-role"] != "member" || got["x-principal-type"] != auth.PrincipalUser {
+		t.Errorf("unexpected identity headers: %v", got)
+	}
+	removed := resp.GetOkResponse().GetHeadersToRemove()
+	if len(removed) != 2 || removed[0] != "x-service-account-id" || removed[1] != "x-impersonator-id" {
+		t.Errorf("expected x-service-account-id and x-impersonator-id to be removed, got %v", removed)
+	}
+}
+
+func TestCheck_Impersonation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	orig := auth.ValidateToken
+	auth.ValidateToken = func(tokenStr string) (*auth.Claims, error) {
+		return &auth.Claims{UserID: 7, TenantID: 1, Email: "user@example.com", Role: "member",
+			Actor: &auth.Actor{Subject: "3", UserID: 3, TokenVersion: 2}}, nil
+	}
+	t.Cleanup(func() { auth.ValidateToken = orig })
+
+	mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+	mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(2))
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "impersonated_request", "user@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	headers := map[string]string{"authorization": "Bearer impersonation-token"}
+	resp, err := NewServer(db).Check(context.Background(), checkRequest("GET", headers, nil))
+	if err != nil {
+		t.Fatalf("Check returned an error: %v", err)
+	}
+	if got := responseHeaders(resp); got["x-user-id"] != "7" || got["x-impersonator-id"] != "3" {
+		t.Errorf("unexpected identity headers: %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package federation
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"sentinel/internal/federation/federationtest"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const redirectURI = "http://localhost:8080/login/federated/callback"
+
+func TestDiscoverAndSignIn(t *testing.T) {
+	idp := federationtest.NewIdP("sentinel", "upstream-secret")
+	defer idp.Close()
+	idp.SetUser(jwt.MapClaims{"sub": "u-1", "email": "jane@example.com", "email_verified": "true", "name": "Jane"})
+
+	ctx := context.Background()
+	p, err := Discover(ctx, idp.Issuer()+"/")
+	if err != nil {
+		t.Fatalf("Expected discovery to succeed, got %v", err)
+	}
+
+	// Follow the browser to the provider, which signs the user in and redirects back
+	verifier := "0123456789012345678901234567890123456789abc"
+	authURL := p.AuthCodeURL(AuthRequest{ClientID: "sentinel", RedirectURI: redirectURI, Scope: "openid email",
+		State: "state-1", Nonce: "nonce-1", CodeChallenge: S256Challenge(verifier)})
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+	back, _ := url.Parse(resp.Header.Get("Location"))
+	if back.Query().Get("state") != "state-1" {
+		t.Fatalf("expected the state back, got %s", back)
+	}
+
+	raw, err := p.Exchange(ctx, "sentinel", "upstream-secret", back.Query().Get("code"), redirectURI, verifier)
+	if err != nil {
+		t.Fatalf("Expected the code exchange to succeed, got %v", err)
+	}
+	claims, err := p.VerifyIDToken(ctx, raw, "sentinel", "nonce-1")
+	if err != nil {
+		t.Fatalf("Expected a valid ID token, got %v", err)
+	}
+	if claims.Subject != "u-1" || claims.Email != "jane@example.com" || !bool(claims.EmailVerified) {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := p.Exchange(ctx, "sentinel", "upstream-secret", back.Query().Get("code"), redirectURI, verifier); err == nil {
+		t.Error("expected a used code to be refused")
+	}
+}
+
+func TestVerifyIDToken_Rejects(t *testing.T) {
+	idp := federationtest.NewIdP("sentinel", "upstream-secret")
+	defer idp.Close()
+	p, err := Discover(context.Background(), idp.Issuer())
+	if err != nil {
+		t.Fatalf("Expected discovery to succeed, got %v", err)
+	}
+
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": idp.Issuer(), "aud": "sentinel", "sub": "u-1",
+		"nonce": "n", "exp": time.Now().Add(time.Minute).Unix()})
+	hmacToken, _ := hmac.SignedString([]byte("upstream-secret"))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Wrong nonce", idp.SignIDToken(jwt.MapClaims{"sub": "u-1", "nonce": "other"})},
+		{"Wrong audience", idp.SignIDToken(jwt.MapClaims{"sub": "u-1", "nonce": "n", "aud": "someone-else"})},
+		{"Wrong issuer", idp.SignIDToken(jwt.MapClaims{"sub": "u-1", "nonce": "n", "iss": "https://evil.example.com"})},
+		{"Expired", idp.SignIDToken(jwt.MapClaims{"sub": "u-1", "nonce": "n", "exp": time.Now().Add(-time.Hour).Unix()})},
+		{"Several audiences without azp", idp.SignIDToken(jwt.MapClaims{"sub": "u-1", "nonce": "n", "aud": []string{"sentinel", "other"}})},
+		{"No subject", idp.SignIDToken(jwt.MapClaims{"nonce": "n"})},
+		{"Signed with the client secret", hmacToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.VerifyIDToken(context.Background(), tt.token, "sentinel", "n"); err == nil {
+				t.Error("expected the ID token to be rejected")
+			}
+		})
+	}
+
+	ok := idp.SignIDToken(jwt.MapClaims{"sub": "u-1", "nonce": "n", "aud": []string{"sentinel", "other"}, "azp": "sentinel"})
+	if _, err := p.VerifyIDToken(context.Background(), ok, "sentinel", "n"); err != nil {
+		t.Errorf("expected an audience list with azp to be accepted, got %v", err)
+	}
+}
+
+func TestDiscover_IssuerMismatch(t *testing.T) {
+	idp := federationtest.NewIdP("sentinel", "upstream-secret")
+	defer idp.Close()
+
+	// The document at this URL names another issuer
+	if _, err := Discover(context.Background(), idp.Issuer()+"/tenant-a"); err == nil {
+		t.Error("expected discovery of a different issuer to fail")
+	}
+}
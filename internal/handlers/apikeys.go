@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Lifetime of API keys created without expires_in_days
+	defaultAPIKeyDays = 90
+	// Longest lifetime an API key can have
+	maxAPIKeyDays = 365
+)
+
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	listAPIKeys(w, r, db.DB)
+}
+
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	createAPIKey(w, r, db.DB)
+}
+
+func DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	deleteAPIKey(w, r, db.DB)
+}
+
+// listAPIKeys returns the caller's own API keys, newest first
+func listAPIKeys(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	rows, err := dbInstance.Query(`
+		SELECT id, name, prefix, scopes, expires_at, last_used_at, created_at
+		FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		log.Println("Error listing API keys:", err)
+		http.Error(w, "Error retrieving API keys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var (
+			k          models.APIKey
+			scopes     []byte
+			lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.ExpiresAt, &lastUsedAt, &k.CreatedAt); err != nil {
+			log.Println("Error scanning API key:", err)
+			http.Error(w, "Error retrieving API keys", http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(scopes, &k.Scopes)
+		if lastUsedAt.Valid {
+			k.LastUsedAt = &lastUsedAt.Time
+		}
+		keys = append(keys, k)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// createAPIKey issues a new API key to the caller. The key is only returned here;
+// Sentinel keeps its hash. Keys cannot be used to create more keys, and are bound to
+// the user's token version so that revoking the user's tokens revokes them too.
+func createAPIKey(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	ctx := r.Context()
+	userID, err := auth.GetUserID(ctx)
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if auth.GetAPIKeyID(ctx) != 0 {
+		http.Error(w, "API keys cannot create API keys", http.StatusForbidden)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays *int     `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	errs := []models.FieldError{}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		errs = append(errs, models.FieldError{Field: "name", Code: "required", Message: "is required"})
+	}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, models.FieldError{Field: "scopes", Code: "required", Message: "needs at least one scope"})
+	}
+	for _, s := range req.Scopes {
+		if !auth.ValidScope(s) {
+			errs = append(errs, models.FieldError{Field: "scopes", Code: "invalid", Message: "unknown scope " + strconv.Quote(s)})
+		}
+	}
+	days := defaultAPIKeyDays
+	if req.ExpiresInDays != nil {
+		days = *req.ExpiresInDays
+	}
+	if days < 1 || days > maxAPIKeyDays {
+		errs = append(errs, models.FieldError{Field: "expires_in_days", Code: "invalid", Message: "must be between 1 and " + strconv.Itoa(maxAPIKeyDays)})
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, "Invalid API key", errs)
+		return
+	}
+
+	key, prefix, err := auth.NewAPIKey()
+	if err != nil {
+		http.Error(w, "Error creating API key", http.StatusInternalServerError)
+		return
+	}
+	apiKey := models.APIKey{Name: req.Name, Prefix: prefix, Scopes: req.Scopes, ExpiresAt: time.Now().Add(time.Duration(days) * 24 * time.Hour)}
+	scopes, _ := json.Marshal(req.Scopes)
+	err = dbInstance.QueryRow(`
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at, token_version, created_at)
+		SELECT $1, $2, $3, $4, $5, $6, token_version, NOW() FROM users WHERE id = $1
+		RETURNING id, created_at`, userID, apiKey.Name, prefix, auth.HashToken(key), scopes, apiKey.ExpiresAt).
+		Scan(&apiKey.ID, &apiKey.CreatedAt)
+	if err != nil {
+		log.Println("Error creating API key:", err)
+		http.Error(w, "Error creating API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"api_key": apiKey, "key": key})
+}
+
+// deleteAPIKey revokes one of the caller's own API keys
+func deleteAPIKey(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+	res, err := dbInstance.Exec(`DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, keyID, userID)
+	if err != nil {
+		log.Println("Error deleting API key:", err)
+		http.Error(w, "Error deleting API key", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key deleted successfully"})
+}
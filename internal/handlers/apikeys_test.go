@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sentinel/internal/auth"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           map[string]interface{}
+		viaAPIKey      bool
+		expectInsert   bool
+		expectedStatus int
+	}{
+		{"Read-write key", map[string]interface{}{"name": "CI", "scopes": []string{"read", "write"}}, false, true, http.StatusCreated},
+		{"Custom expiry", map[string]interface{}{"name": "CI", "scopes": []string{"read"}, "expires_in_days": 7}, false, true, http.StatusCreated},
+		{"Missing name", map[string]interface{}{"scopes": []string{"read"}}, false, false, http.StatusBadRequest},
+		{"No scopes", map[string]interface{}{"name": "CI"}, false, false, http.StatusBadRequest},
+		{"Unknown scope", map[string]interface{}{"name": "CI", "scopes": []string{"admin"}}, false, false, http.StatusBadRequest},
+		{"Expiry too long", map[string]interface{}{"name": "CI", "scopes": []string{"read"}, "expires_in_days": 1000}, false, false, http.StatusBadRequest},
+		{"Created with an API key", map[string]interface{}{"name": "CI", "scopes": []string{"read"}}, true, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectInsert {
+				mock.ExpectQuery("INSERT INTO api_keys .* token_version, NOW\\(\\) FROM users WHERE id = \\$1").
+					WithArgs(1, "CI", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+			}
+
+			ctx := sessionContext(1, 1, "member", "s1")
+			if tt.viaAPIKey {
+				ctx = context.WithValue(ctx, auth.APIKeyIDKey, 2)
+			}
+			raw, _ := json.Marshal(tt.body)
+			req := httptest.NewRequest(http.MethodPost, "/api/keys", bytes.NewReader(raw)).WithContext(ctx)
+			rr := httptest.NewRecorder()
+			createAPIKey(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectInsert {
+				var response struct {
+					Key    string `json:"key"`
+					APIKey struct {
+						ID     int    `json:"id"`
+						Prefix string `json:"prefix"`
+					} `json:"api_key"`
+				}
+				json.Unmarshal(rr.Body.Bytes(), &response)
+				if !strings.HasPrefix(response.Key, auth.APIKeyPrefix) || !strings.HasPrefix(response.Key, response.APIKey.Prefix) || response.APIKey.ID != 5 {
+					t.Errorf("unexpected response: %s", rr.Body.String())
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestListAPIKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, name, prefix, scopes, expires_at, last_used_at, created_at").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "prefix", "scopes", "expires_at", "last_used_at", "created_at"}).
+			AddRow(5, "CI", "snt_abcdef", `["read"]`, time.Now().Add(time.Hour), nil, time.Now()))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/keys", nil).WithContext(sessionContext(1, 1, "member", "s1"))
+	rr := httptest.NewRecorder()
+	listAPIKeys(rr, req, db)
+
+	var keys []map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &keys)
+	if rr.Code != http.StatusOK || len(keys) != 1 || keys[0]["prefix"] != "snt_abcdef" || keys[0]["last_used_at"] != nil {
+		t.Errorf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestDeleteAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM api_keys WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(9, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/keys/9", nil)
+	req = mux.SetURLVars(req.WithContext(sessionContext(1, 1, "member", "s1")), map[string]string{"id": "9"})
+	rr := httptest.NewRecorder()
+	deleteAPIKey(rr, req, db)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for another user's key, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/mail"
+	"strings"
+	"time"
+)
+
+// Resend requests are limited per account and per client IP
+var (
+	confirmEmailLimiter = auth.NewKeyedLimiter(20*time.Minute, 3)
+	confirmIPLimiter    = auth.NewKeyedLimiter(time.Minute, 10)
+)
+
+// emailConfirmationTTL is how long a confirmation link stays valid, EMAIL_CONFIRMATION_TTL or 24 hours
+func emailConfirmationTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("EMAIL_CONFIRMATION_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// sendConfirmationEmail emails a signed confirmation link to the user.
+// Only the hash of the link's jti is stored, so sending a new link invalidates the previous one.
+func sendConfirmationEmail(dbInstance *sql.DB, userID, tenantID int, email, name string) error {
+	ttl := emailConfirmationTTL()
+	token, jti, err := auth.SignPurposeToken(auth.PurposeEmailConfirmation, userID, tenantID, ttl)
+	if err != nil {
+		return err
+	}
+	_, err = dbInstance.Exec(`UPDATE users SET confirmation_token = $1 WHERE id = $2`, auth.HashToken(jti), userID)
+	if err != nil {
+		return err
+	}
+
+	link := publicURL("/confirm-email", url.Values{"token": {token}})
+	return mail.Send(mail.Message{
+		To:      email,
+		Subject: "Confirm your Sentinel email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address with the link below. It expires in %s.\n\n%s\n\nIf you did not create an account, you can ignore this email.\n",
+			name, ttl, link),
+	})
+}
+
+func ConfirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	confirmEmail(w, r, db.DB)
+}
+
+func ResendConfirmationHandler(w http.ResponseWriter, r *http.Request) {
+	resendConfirmation(w, r, db.DB)
+}
+
+// confirmEmail marks the user's email as confirmed with the token from the confirmation link
+func confirmEmail(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := auth.ParsePurposeToken(req.Token, auth.PurposeEmailConfirmation)
+	if err != nil {
+		http.Error(w, "Invalid or expired confirmation token", http.StatusBadRequest)
+		return
+	}
+
+	// The stored hash only matches the latest link, and is cleared once used
+	res, err := dbInstance.Exec(`
+		UPDATE users SET email_confirmed = TRUE, confirmation_token = NULL, updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 AND confirmation_token = $3`,
+		claims.UserID, claims.TenantID, auth.HashToken(claims.Id))
+	if err != nil {
+		log.Println("Error confirming email:", err)
+		http.Error(w, "Error confirming email", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Invalid or expired confirmation token", http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email confirmed successfully"})
+}
+
+// resendConfirmation emails a new confirmation link. The response is the same whether
+// or not the account exists or is already confirmed.
+func resendConfirmation(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		Email    string `json:"email"`
+		TenantID int    `json:"tenant_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !confirmIPLimiter.Allow(auth.ClientIP(r)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+
+	accepted := func() {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists and is not confirmed, a confirmation link has been sent"})
+	}
+
+	if !confirmEmailLimiter.Allow(strings.ToLower(strings.TrimSpace(req.Email))) {
+		log.Println("Confirmation email rate limit reached for an account")
+		accepted()
+		return
+	}
+
+	var (
+		userID    int
+		name      string
+		confirmed bool
+	)
+	err := dbInstance.QueryRow(`SELECT id, name, COALESCE(email_confirmed, FALSE) FROM users WHERE email = $1 AND tenant_id = $2`,
+		req.Email, req.TenantID).Scan(&userID, &name, &confirmed)
+	if err == sql.ErrNoRows || (err == nil && confirmed) {
+		accepted()
+		return
+	}
+	if err != nil {
+		log.Println("Error fetching user for email confirmation:", err)
+		http.Error(w, "Error sending confirmation email", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendConfirmationEmail(dbInstance, userID, req.TenantID, req.Email, name); err != nil {
+		log.Println("Error sending confirmation email:", err)
+	}
+	accepted()
+}
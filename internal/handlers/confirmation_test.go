@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestConfirmEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	sender := useRecordingSender(t)
+
+	mock.ExpectQuery("SELECT id, name, COALESCE\\(email_confirmed, FALSE\\) FROM users WHERE email = \\$1 AND tenant_id = \\$2").
+		WithArgs("new@test.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email_confirmed"}).AddRow(7, "New User", false))
+	mock.ExpectExec("UPDATE users SET confirmation_token = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body, _ := json.Marshal(map[string]interface{}{"email": "new@test.com", "tenant_id": 1})
+	rr := httptest.NewRecorder()
+	resendConfirmation(rr, httptest.NewRequest(http.MethodPost, "/email/confirm/resend", bytes.NewReader(body)), db)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", rr.Code)
+	}
+	if len(sender.messages) != 1 {
+		t.Fatalf("expected one confirmation email, got %d", len(sender.messages))
+	}
+
+	token := linkToken(t, sender.messages[0].Body)
+	claims, err := auth.ParsePurposeToken(token, auth.PurposeEmailConfirmation)
+	if err != nil {
+		t.Fatalf("expected a valid confirmation token, got %v", err)
+	}
+
+	mock.ExpectExec("UPDATE users SET email_confirmed = TRUE, confirmation_token = NULL").
+		WithArgs(7, 1, auth.HashToken(claims.Id)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// A second use finds the token already cleared
+	mock.ExpectExec("UPDATE users SET email_confirmed = TRUE, confirmation_token = NULL").
+		WithArgs(7, 1, auth.HashToken(claims.Id)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, expected := range []int{http.StatusOK, http.StatusBadRequest} {
+		body, _ := json.Marshal(map[string]string{"token": token})
+		rr := httptest.NewRecorder()
+		confirmEmail(rr, httptest.NewRequest(http.MethodPost, "/email/confirm", bytes.NewReader(body)), db)
+		if rr.Code != expected {
+			t.Errorf("expected status %d, got %d", expected, rr.Code)
+		}
+	}
+
+	// Malformed tokens are refused without touching the database
+	body, _ = json.Marshal(map[string]string{"token": "not-a-token"})
+	rr = httptest.NewRecorder()
+	confirmEmail(rr, httptest.NewRequest(http.MethodPost, "/email/confirm", bytes.NewReader(body)), db)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestLoginHandler_UnconfirmedEmail(t *testing.T) {
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	tests := []struct {
+		name           string
+		settings       string
+		expectedStatus int
+	}{
+		{"Confirmation required", `{"require_email_confirmation": true}`, http.StatusForbidden},
+		{"Confirmation optional", `{}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			expectLoginAllowed(mock)
+			mock.ExpectQuery("SELECT u.id, u.name, u.password").
+				WithArgs("new@test.com", 1).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password", "tenant_id", "role", "token_version", "email_confirmed", "mfa_enabled"}).
+					AddRow(7, "New User", string(hashedPassword), 1, "member", 0, false, false))
+			expectLoginSuccess(mock)
+			mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow([]byte(tt.settings)))
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			body, _ := json.Marshal(map[string]interface{}{"email": "new@test.com", "password": "password123", "tenant_id": 1})
+			rr := httptest.NewRecorder()
+			LoginHandler(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body)), db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// deviceCodeGrantType is the grant_type a device polls /oauth/token with
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// deviceCodeTTL is how long the user has to approve a device
+	deviceCodeTTL = 10 * time.Minute
+	// devicePollInterval is the minimum number of seconds between two polls of a device;
+	// polling faster adds 5 seconds (slow_down)
+	devicePollInterval = 5
+)
+
+// User codes are short, so looking them up and answering them is limited per user, like
+// second factor attempts (RFC 8628 section 5.1)
+var deviceCodeLimiter = auth.NewKeyedLimiter(12*time.Second, 5)
+
+func DeviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	deviceAuthorization(w, r, db.DB)
+}
+
+func GetDeviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	getDeviceAuthorization(w, r, db.DB)
+}
+
+func ApproveDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	approveDevice(w, r, db.DB)
+}
+
+// deviceVerificationURI is the frontend page where users enter the code shown by a device
+func deviceVerificationURI(query url.Values) string {
+	return strings.TrimSuffix(publicURL("/device", query), "?")
+}
+
+// deviceAuthorization is the device authorization endpoint (RFC 8628 section 3.1). A
+// registered client of a tenant, typically a CLI on a machine without a browser, gets a
+// device code to poll /oauth/token with and a user code for the user to approve.
+func deviceAuthorization(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+	client, ok := authenticateOAuthClient(r, dbInstance)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	deviceCode, err := auth.RandomToken(32)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not issue a device code")
+		return
+	}
+	userCode, err := auth.NewUserCode()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not issue a device code")
+		return
+	}
+	_, err = dbInstance.Exec(`
+		WITH expired AS (DELETE FROM device_codes WHERE expires_at < NOW())
+		INSERT INTO device_codes (device_code_hash, user_code_hash, client_id, tenant_id, poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		auth.HashToken(deviceCode), auth.HashToken(auth.NormalizeUserCode(userCode)), client.ClientID, client.TenantID,
+		devicePollInterval, time.Now().Add(deviceCodeTTL))
+	if err != nil {
+		log.Println("Error storing device code:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not issue a device code")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          deviceVerificationURI(nil),
+		"verification_uri_complete": deviceVerificationURI(url.Values{"user_code": {userCode}}),
+		"expires_in":                int(deviceCodeTTL.Seconds()),
+		"interval":                  devicePollInterval,
+	})
+}
+
+// deviceApprover returns the signed-in user who answers a device login. API keys, service
+// accounts and impersonation tokens cannot approve devices, so they cannot be turned into
+// user sessions.
+func deviceApprover(w http.ResponseWriter, r *http.Request) (userID, tenantID int, ok bool) {
+	ctx := r.Context()
+	userID, err := auth.GetUserID(ctx)
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	if auth.GetAPIKeyID(ctx) != 0 {
+		http.Error(w, "Devices can only be approved by a signed-in user", http.StatusForbidden)
+		return 0, 0, false
+	}
+	if impersonating(w, r) {
+		return 0, 0, false
+	}
+	tenantID, err = auth.GetTenantID(ctx)
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	return userID, tenantID, true
+}
+
+// getDeviceAuthorization shows the verification page which client asks to sign in with
+// the user code. Codes of other tenants, expired and answered codes are not found.
+func getDeviceAuthorization(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, tenantID, ok := deviceApprover(w, r)
+	if !ok {
+		return
+	}
+	if !deviceCodeLimiter.Allow(strconv.Itoa(userID)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+	userCode := r.URL.Query().Get("user_code")
+
+	d := models.DeviceAuthorization{UserCode: userCode}
+	err := dbInstance.QueryRow(`
+		SELECT d.client_id, c.name, d.expires_at
+		FROM device_codes d JOIN oauth_clients c ON c.client_id = d.client_id
+		WHERE d.user_code_hash = $1 AND d.tenant_id = $2 AND d.status = 'pending' AND d.expires_at > NOW()`,
+		auth.HashToken(auth.NormalizeUserCode(userCode)), tenantID).
+		Scan(&d.ClientID, &d.ClientName, &d.ExpiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error loading device code:", err)
+		http.Error(w, "Error loading device code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// approveDevice approves or denies a pending device login for the signed-in user. The
+// device gets its tokens, or access_denied, on its next poll.
+func approveDevice(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, tenantID, ok := deviceApprover(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserCode string `json:"user_code"`
+		Approve  *bool  `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	errs := []models.FieldError{}
+	if auth.NormalizeUserCode(req.UserCode) == "" {
+		errs = append(errs, models.FieldError{Field: "user_code", Message: "User code is required"})
+	}
+	if req.Approve == nil {
+		errs = append(errs, models.FieldError{Field: "approve", Message: "Approve must be true or false"})
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, "Invalid device approval", errs)
+		return
+	}
+	if !deviceCodeLimiter.Allow(strconv.Itoa(userID)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+
+	status := "denied"
+	if *req.Approve {
+		status = "approved"
+	}
+	res, err := dbInstance.Exec(`
+		UPDATE device_codes SET status = $1, user_id = $2
+		WHERE user_code_hash = $3 AND tenant_id = $4 AND status = 'pending' AND expires_at > NOW()`,
+		status, userID, auth.HashToken(auth.NormalizeUserCode(req.UserCode)), tenantID)
+	if err != nil {
+		log.Println("Error answering device code:", err)
+		http.Error(w, "Error answering device code", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Invalid or expired code", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// deviceCodeGrant answers a device polling /oauth/token (RFC 8628 section 3.4). Until the
+// user answers, the device is told to keep polling; once approved it gets an access and a
+// refresh token on a new session of the user, exactly once.
+func deviceCodeGrant(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	client, ok := authenticateOAuthClient(r, dbInstance)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+	codeHash := auth.HashToken(r.PostForm.Get("device_code"))
+
+	var (
+		clientID, status string
+		tenantID         int
+		userID           sql.NullInt64
+		interval         int
+		lastPolledAt     sql.NullTime
+		expiresAt        time.Time
+	)
+	err := dbInstance.QueryRow(`
+		SELECT client_id, tenant_id, status, user_id, poll_interval, last_polled_at, expires_at
+		FROM device_codes WHERE device_code_hash = $1`, codeHash).
+		Scan(&clientID, &tenantID, &status, &userID, &interval, &lastPolledAt, &expiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error loading device code:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not check the device code")
+		return
+	}
+	if err == sql.ErrNoRows || clientID != client.ClientID {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	}
+
+	consume := func() bool {
+		res, err := dbInstance.Exec(`DELETE FROM device_codes WHERE device_code_hash = $1 AND status = $2`, codeHash, status)
+		if err != nil {
+			log.Println("Error consuming device code:", err)
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not check the device code")
+			return false
+		}
+		// Another poll got here first
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+			return false
+		}
+		return true
+	}
+
+	switch {
+	case time.Now().After(expiresAt):
+		dbInstance.Exec(`DELETE FROM device_codes WHERE device_code_hash = $1`, codeHash)
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "The device code has expired")
+		return
+	case status == "denied":
+		if consume() {
+			writeOAuthError(w, http.StatusBadRequest, "access_denied", "The user denied the request")
+		}
+		return
+	case status != "approved":
+		code, description := "authorization_pending", "The user has not answered yet"
+		next := interval
+		if lastPolledAt.Valid && time.Since(lastPolledAt.Time) < time.Duration(interval)*time.Second {
+			code, description = "slow_down", "Polling too fast"
+			next += devicePollInterval
+		}
+		if _, err := dbInstance.Exec(`UPDATE device_codes SET last_polled_at = NOW(), poll_interval = $1 WHERE device_code_hash = $2`,
+			next, codeHash); err != nil {
+			log.Println("Error recording device poll:", err)
+		}
+		writeOAuthError(w, http.StatusBadRequest, code, description)
+		return
+	}
+	if !consume() {
+		return
+	}
+
+	// The access token carries the user's current role and token version
+	user := models.User{ID: int(userID.Int64), TenantID: tenantID}
+	err = dbInstance.QueryRow(`SELECT email, role, token_version FROM users WHERE id = $1 AND tenant_id = $2`, user.ID, tenantID).
+		Scan(&user.Email, &user.Role, &user.TokenVersion)
+	if err != nil {
+		log.Println("Error loading user for device login:", err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user no longer exists")
+		return
+	}
+	// Approving a device is not a sign-in on it, so its session has no auth_time
+	sessionID, err := auth.CreateSession(dbInstance, r, user.ID, tenantID, client.Name, auth.Authentication{})
+	if err != nil {
+		log.Println("Error creating session:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create tokens")
+		return
+	}
+	accessToken, err := auth.GenerateSessionJWT(user, sessionID, auth.Authentication{})
+	if err != nil {
+		log.Println("Error generating JWT token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create tokens")
+		return
+	}
+	refreshToken, err := auth.IssueRefreshToken(dbInstance, user.ID, tenantID, sessionID)
+	if err != nil {
+		log.Println("Error issuing refresh token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create tokens")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(auth.AccessTokenTTL().Seconds()),
+		"refresh_token": refreshToken,
+	})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testUserCode = "WDJB-MJHT"
+
+func TestDeviceAuthorization(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectOAuthClient(mock, nil)
+	mock.ExpectExec("INSERT INTO device_codes").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), testClientID, 1, devicePollInterval, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth/device/code", strings.NewReader(url.Values{"client_id": {testClientID}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	deviceAuthorization(rr, req, db)
+
+	var response map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	userCode, _ := response["user_code"].(string)
+	if rr.Code != http.StatusOK || response["device_code"] == "" || len(userCode) != 9 ||
+		!strings.HasSuffix(response["verification_uri_complete"].(string), "/device?user_code="+userCode) {
+		t.Errorf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestApproveDevice(t *testing.T) {
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		body           string
+		expectUpdate   string // Status written, if any
+		rowsAffected   int64
+		expectedStatus int
+	}{
+		{"Approve", sessionContext(7, 1, "member", "s1"), `{"user_code": "wdjb-mjht", "approve": true}`, "approved", 1, http.StatusOK},
+		{"Deny", sessionContext(7, 1, "member", "s1"), `{"user_code": "WDJBMJHT", "approve": false}`, "denied", 1, http.StatusOK},
+		{"Unknown or expired code", sessionContext(7, 1, "member", "s1"), `{"user_code": "WDJB-MJHT", "approve": true}`, "approved", 0, http.StatusNotFound},
+		{"Missing answer", sessionContext(7, 1, "member", "s1"), `{"user_code": "WDJB-MJHT"}`, "", 0, http.StatusBadRequest},
+		{"API key cannot approve", context.WithValue(sessionContext(7, 1, "member", ""), auth.APIKeyIDKey, 3), `{"user_code": "WDJB-MJHT", "approve": true}`, "", 0, http.StatusForbidden},
+		{"Service account cannot approve", serviceAccountContext(5, 1, "admin"), `{"user_code": "WDJB-MJHT", "approve": true}`, "", 0, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectUpdate != "" {
+				mock.ExpectExec("UPDATE device_codes SET status = \\$1, user_id = \\$2").
+					WithArgs(tt.expectUpdate, 7, auth.HashToken("WDJBMJHT"), 1).
+					WillReturnResult(sqlmock.NewResult(0, tt.rowsAffected))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/device", bytes.NewBufferString(tt.body)).WithContext(tt.ctx)
+			rr := httptest.NewRecorder()
+			approveDevice(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetDeviceAuthorization(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT d.client_id, c.name, d.expires_at\\s+FROM device_codes d JOIN oauth_clients c").
+		WithArgs(auth.HashToken("WDJBMJHT"), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id", "name", "expires_at"}).AddRow(testClientID, "Deploy CLI", time.Now().Add(time.Minute)))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/device?user_code="+testUserCode, nil).WithContext(sessionContext(7, 1, "member", "s1"))
+	rr := httptest.NewRecorder()
+	getDeviceAuthorization(rr, req, db)
+
+	var response map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if rr.Code != http.StatusOK || response["client_name"] != "Deploy CLI" || response["user_code"] != testUserCode {
+		t.Errorf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDeviceCode_Limited(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	limiter := deviceCodeLimiter
+	deviceCodeLimiter = auth.NewKeyedLimiter(time.Hour, 5)
+	defer func() { deviceCodeLimiter = limiter }()
+
+	// Guessing user codes: lookups and answers count against the same limit
+	ctx := sessionContext(8, 1, "member", "s1")
+	for i := 0; i < 4; i++ {
+		mock.ExpectQuery("SELECT d.client_id, c.name, d.expires_at\\s+FROM device_codes d JOIN oauth_clients c").
+			WillReturnError(sql.ErrNoRows)
+		req := httptest.NewRequest(http.MethodGet, "/api/device?user_code="+testUserCode, nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		getDeviceAuthorization(rr, req, db)
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("lookup %d: expected status 404, got %d: %s", i+1, rr.Code, rr.Body.String())
+		}
+	}
+	mock.ExpectExec("UPDATE device_codes SET status = \\$1, user_id = \\$2").WillReturnResult(sqlmock.NewResult(0, 0))
+	approve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/device", bytes.NewBufferString(`{"user_code": "WDJB-MJHT", "approve": true}`)).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		approveDevice(rr, req, db)
+		return rr
+	}
+	if rr := approve(); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := approve(); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestDeviceCodeGrant(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name          string
+		clientID      string
+		status        string
+		lastPolledAt  interface{}
+		expiresAt     time.Time
+		expectedError string
+	}{
+		{"Waiting for the user", testClientID, "pending", nil, now.Add(time.Minute), "authorization_pending"},
+		{"Polling too fast", testClientID, "pending", now.Add(-time.Second), now.Add(time.Minute), "slow_down"},
+		{"Denied", testClientID, "denied", nil, now.Add(time.Minute), "access_denied"},
+		{"Expired", testClientID, "pending", nil, now.Add(-time.Second), "expired_token"},
+		{"Code of another client", "client-2", "approved", nil, now.Add(time.Minute), "invalid_grant"},
+		{"Approved", testClientID, "approved", nil, now.Add(time.Minute), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			codeHash := auth.HashToken("device-code")
+			expectOAuthClient(mock, nil)
+			mock.ExpectQuery("SELECT client_id, tenant_id, status, user_id, poll_interval, last_polled_at, expires_at\\s+FROM device_codes").
+				WithArgs(codeHash).
+				WillReturnRows(sqlmock.NewRows([]string{"client_id", "tenant_id", "status", "user_id", "poll_interval", "last_polled_at", "expires_at"}).
+					AddRow(tt.clientID, 1, tt.status, 7, devicePollInterval, tt.lastPolledAt, tt.expiresAt))
+			switch tt.expectedError {
+			case "authorization_pending":
+				mock.ExpectExec("UPDATE device_codes SET last_polled_at = NOW\\(\\), poll_interval = \\$1").
+					WithArgs(devicePollInterval, codeHash).WillReturnResult(sqlmock.NewResult(0, 1))
+			case "slow_down":
+				mock.ExpectExec("UPDATE device_codes SET last_polled_at = NOW\\(\\), poll_interval = \\$1").
+					WithArgs(2*devicePollInterval, codeHash).WillReturnResult(sqlmock.NewResult(0, 1))
+			case "expired_token":
+				mock.ExpectExec("DELETE FROM device_codes WHERE device_code_hash = \\$1").
+					WithArgs(codeHash).WillReturnResult(sqlmock.NewResult(0, 1))
+			case "access_denied", "":
+				mock.ExpectExec("DELETE FROM device_codes WHERE device_code_hash = \\$1 AND status = \\$2").
+					WithArgs(codeHash, tt.status).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			if tt.expectedError == "" {
+				mock.ExpectQuery("SELECT email, role, token_version FROM users WHERE id = \\$1 AND tenant_id = \\$2").
+					WithArgs(7, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"email", "role", "token_version"}).AddRow("user@example.com", "member", 0))
+				mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			form := url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {"device-code"}, "client_id": {testClientID}}
+			req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			oauthToken(rr, req, db)
+
+			var response map[string]interface{}
+			json.Unmarshal(rr.Body.Bytes(), &response)
+			if tt.expectedError != "" {
+				if rr.Code != http.StatusBadRequest || response["error"] != tt.expectedError {
+					t.Errorf("expected error %q, got %d: %s", tt.expectedError, rr.Code, rr.Body.String())
+				}
+			} else if rr.Code != http.StatusOK || response["access_token"] == nil || response["refresh_token"] == nil {
+				t.Errorf("unexpected response %d: %s", rr.Code, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
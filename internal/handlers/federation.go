@@ -0,0 +1,534 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sentinel/internal/audit"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/federation"
+	"sentinel/internal/models"
+	"sentinel/internal/password"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long the user has to sign in at the upstream provider
+	federatedStateTTL = 10 * time.Minute
+	// How long the frontend has to redeem the login code of a finished federated login
+	federatedLoginCodeTTL = 2 * time.Minute
+)
+
+// Reasons a federated login failed, sent to the login page as ?error=
+const (
+	federatedErrFailed       = "federated_login_failed"
+	federatedErrUnverified   = "email_not_verified"
+	federatedErrNoAccount    = "account_not_found"
+	federatedErrMissingEmail = "email_missing"
+)
+
+func ListFederatedConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	listFederatedConnections(w, r, db.DB)
+}
+
+func StartFederatedLoginHandler(w http.ResponseWriter, r *http.Request) {
+	startFederatedLogin(w, r, db.DB)
+}
+
+func FederatedCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	federatedCallback(w, r, db.DB)
+}
+
+func CompleteFederatedLoginHandler(w http.ResponseWriter, r *http.Request) {
+	completeFederatedLogin(w, r, db.DB)
+}
+
+// federatedStateCookie binds a federated login to the browser that started it
+const federatedStateCookie = "federated_state"
+
+// setLoginStateCookie binds an external login to this browser with a cookie holding the
+// hash of its state, sent only to the callback at path. Without it, a callback URL
+// opened in another browser would sign that browser in to the account (login CSRF).
+func setLoginStateCookie(w http.ResponseWriter, name, path, state string, ttl time.Duration, sameSite http.SameSite) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    auth.HashToken(state),
+		Path:     path,
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		// Browsers drop SameSite=None cookies that are not Secure
+		Secure:   sameSite == http.SameSiteNoneMode || strings.HasPrefix(auth.Issuer(), "https://"),
+		SameSite: sameSite,
+	})
+}
+
+// checkLoginStateCookie reports whether this browser started the login with the state,
+// and clears the cookie
+func checkLoginStateCookie(w http.ResponseWriter, r *http.Request, name, path, state string) bool {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, HttpOnly: true})
+	cookie, err := r.Cookie(name)
+	return err == nil && state != "" &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(auth.HashToken(state))) == 1
+}
+
+func federatedRedirectURI() string {
+	return auth.Issuer() + "/login/federated/callback"
+}
+
+// safeReturnTo keeps return_to values that lead back to the frontend or to Sentinel itself,
+// so the login flow cannot be used as an open redirect
+func safeReturnTo(raw string) string {
+	switch {
+	case raw == "":
+		return ""
+	case strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//") && !strings.HasPrefix(raw, "/\\"):
+		return raw
+	case strings.HasPrefix(raw, strings.TrimSuffix(publicURL("/", nil), "?")),
+		strings.HasPrefix(raw, auth.Issuer()+"/"):
+		return raw
+	}
+	return ""
+}
+
+func loadOIDCConnection(dbInstance *sql.DB, id int) (models.OIDCConnection, error) {
+	c := models.OIDCConnection{ID: id}
+	err := dbInstance.QueryRow(`
+		SELECT tenant_id, name, issuer, client_id, client_secret, scopes, default_role, auto_provision
+		FROM oidc_connections WHERE id = $1`, id).
+		Scan(&c.TenantID, &c.Name, &c.Issuer, &c.ClientID, &c.ClientSecret, &c.Scopes, &c.DefaultRole, &c.AutoProvision)
+	return c, err
+}
+
+// listFederatedConnections tells the login page which providers a tenant offers
+func listFederatedConnections(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, err := strconv.Atoi(r.URL.Query().Get("tenant_id"))
+	if err != nil {
+		http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+		return
+	}
+	rows, err := dbInstance.Query(`SELECT id, name FROM oidc_connections WHERE tenant_id = $1 ORDER BY name`, tenantID)
+	if err != nil {
+		log.Println("Error listing OIDC connections:", err)
+		http.Error(w, "Error retrieving connections", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type connection struct {
+		ID       int    `json:"id"`
+		Name     string `json:"name"`
+		LoginURL string `json:"login_url"`
+	}
+	connections := []connection{}
+	for rows.Next() {
+		var c connection
+		if err := rows.Scan(&c.ID, &c.Name); err != nil {
+			log.Println("Error reading OIDC connection:", err)
+			http.Error(w, "Error retrieving connections", http.StatusInternalServerError)
+			return
+		}
+		c.LoginURL = auth.Issuer() + "/login/federated/start?connection_id=" + strconv.Itoa(c.ID)
+		connections = append(connections, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connections)
+}
+
+// startFederatedLogin sends the browser to the upstream provider. State, nonce and the
+// PKCE verifier are kept server side, keyed by the hash of the state, which is also set
+// as a cookie for the callback.
+func startFederatedLogin(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	id, err := strconv.Atoi(r.URL.Query().Get("connection_id"))
+	if err != nil {
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	conn, err := loadOIDCConnection(dbInstance, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error loading OIDC connection:", err)
+		http.Error(w, "Error loading connection", http.StatusInternalServerError)
+		return
+	}
+	provider, err := federation.Discover(r.Context(), conn.Issuer)
+	if err != nil {
+		log.Println("Error discovering upstream provider:", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		if *v, err = auth.RandomToken(32); err != nil {
+			http.Error(w, "Error starting login", http.StatusInternalServerError)
+			return
+		}
+	}
+	_, err = dbInstance.Exec(`
+		WITH expired AS (DELETE FROM federated_logins WHERE expires_at < NOW())
+		INSERT INTO federated_logins (id_hash, connection_id, tenant_id, nonce, code_verifier, return_to, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		auth.HashToken(state), conn.ID, conn.TenantID, nonce, verifier,
+		safeReturnTo(r.URL.Query().Get("return_to")), time.Now().Add(federatedStateTTL))
+	if err != nil {
+		log.Println("Error storing federated login state:", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+
+	setLoginStateCookie(w, federatedStateCookie, "/login/federated/callback", state, federatedStateTTL, http.SameSiteLaxMode)
+	http.Redirect(w, r, provider.AuthCodeURL(federation.AuthRequest{
+		ClientID:      conn.ClientID,
+		RedirectURI:   federatedRedirectURI(),
+		Scope:         conn.Scopes,
+		State:         state,
+		Nonce:         nonce,
+		CodeChallenge: federation.S256Challenge(verifier),
+	}), http.StatusFound)
+}
+
+// federatedCallback receives the browser back from the upstream provider, exchanges the
+// code and verifies the ID token, then finds, links or provisions the Sentinel user. The
+// browser is sent on to the frontend with a single-use login code for /login/federated/complete.
+func federatedCallback(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	fail := func(reason string) {
+		http.Redirect(w, r, publicURL("/login", url.Values{"error": {reason}}), http.StatusFound)
+	}
+	q := r.URL.Query()
+
+	// Only the browser that started the login may finish it
+	if !checkLoginStateCookie(w, r, federatedStateCookie, "/login/federated/callback", q.Get("state")) {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+
+	// The state is consumed whatever happens next
+	var (
+		connectionID, tenantID    int
+		nonce, verifier, returnTo string
+		expiresAt                 time.Time
+	)
+	err := dbInstance.QueryRow(`
+		DELETE FROM federated_logins WHERE id_hash = $1 AND user_id IS NULL
+		RETURNING connection_id, tenant_id, nonce, code_verifier, COALESCE(return_to, ''), expires_at`,
+		auth.HashToken(q.Get("state"))).
+		Scan(&connectionID, &tenantID, &nonce, &verifier, &returnTo, &expiresAt)
+	if err != nil || time.Now().After(expiresAt) {
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("Error loading federated login state:", err)
+		}
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	if upstreamErr := q.Get("error"); upstreamErr != "" {
+		log.Printf("Upstream provider refused the login for connection %d: %s %s", connectionID, upstreamErr, q.Get("error_description"))
+		fail(federatedErrFailed)
+		return
+	}
+
+	conn, err := loadOIDCConnection(dbInstance, connectionID)
+	if err != nil {
+		log.Println("Error loading OIDC connection:", err)
+		fail(federatedErrFailed)
+		return
+	}
+	provider, err := federation.Discover(r.Context(), conn.Issuer)
+	if err != nil {
+		log.Println("Error discovering upstream provider:", err)
+		fail(federatedErrFailed)
+		return
+	}
+	rawIDToken, err := provider.Exchange(r.Context(), conn.ClientID, conn.ClientSecret, q.Get("code"), federatedRedirectURI(), verifier)
+	if err != nil {
+		log.Println("Error exchanging upstream code:", err)
+		fail(federatedErrFailed)
+		return
+	}
+	idToken, err := provider.VerifyIDToken(r.Context(), rawIDToken, conn.ClientID, nonce)
+	if err != nil {
+		log.Println("Error verifying upstream ID token:", err)
+		fail(federatedErrFailed)
+		return
+	}
+
+	user, reason := resolveFederatedUser(dbInstance, r, conn, idToken)
+	if reason != "" {
+		fail(reason)
+		return
+	}
+
+	code, err := storeFederatedLoginCode(dbInstance, sql.NullInt64{Int64: int64(conn.ID), Valid: true}, user, returnTo)
+	if err != nil {
+		log.Println("Error storing federated login code:", err)
+		fail(federatedErrFailed)
+		return
+	}
+	http.Redirect(w, r, publicURL("/login/federated", url.Values{"login_code": {code}}), http.StatusFound)
+}
+
+// storeFederatedLoginCode records a finished external login and returns the single-use
+// code the frontend redeems at /login/federated/complete. SAML logins have no connection ID.
+func storeFederatedLoginCode(dbInstance *sql.DB, connectionID sql.NullInt64, user models.User, returnTo string) (string, error) {
+	code, err := auth.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = dbInstance.Exec(`
+		INSERT INTO federated_logins (id_hash, connection_id, tenant_id, user_id, return_to, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		auth.HashToken(code), connectionID, user.TenantID, user.ID, returnTo, time.Now().Add(federatedLoginCodeTTL))
+	return code, err
+}
+
+// resolveFederatedUser maps an upstream identity to a user of the connection's tenant:
+//   - an identity signed in before goes to the user it was linked to
+//   - otherwise a user with the same verified email address is linked to it
+//   - otherwise a new user is provisioned, when the connection allows it
+//
+// It returns a failure reason for the login page when none applies.
+func resolveFederatedUser(dbInstance *sql.DB, r *http.Request, conn models.OIDCConnection, idToken *federation.IDToken) (models.User, string) {
+	user := models.User{TenantID: conn.TenantID}
+	err := dbInstance.QueryRow(`
+		SELECT u.id, u.name, u.email, u.role, u.token_version
+		FROM federated_identities f JOIN users u ON u.id = f.user_id
+		WHERE f.connection_id = $1 AND f.subject = $2 AND u.tenant_id = $3`, conn.ID, idToken.Subject, conn.TenantID).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.TokenVersion)
+	if err == nil {
+		dbInstance.Exec(`UPDATE federated_identities SET last_login_at = NOW() WHERE connection_id = $1 AND subject = $2`, conn.ID, idToken.Subject)
+		return user, ""
+	}
+	if err != sql.ErrNoRows {
+		log.Println("Error looking up federated identity:", err)
+		return user, federatedErrFailed
+	}
+
+	email := strings.TrimSpace(idToken.Email)
+	if email == "" {
+		return user, federatedErrMissingEmail
+	}
+	err = dbInstance.QueryRow(`SELECT id, name, email, role, token_version FROM users WHERE LOWER(email) = LOWER($1) AND tenant_id = $2`, email, conn.TenantID).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.TokenVersion)
+	switch {
+	case err == nil && !bool(idToken.EmailVerified):
+		// Linking on an address the provider did not verify would hand the account to whoever typed it
+		return user, federatedErrUnverified
+	case err == nil:
+		if !linkFederatedIdentity(dbInstance, conn, idToken.Subject, email, user.ID) {
+			return user, federatedErrFailed
+		}
+		recordAudit(dbInstance, r, audit.Entry{TenantID: conn.TenantID, ActorID: user.ID, Event: audit.EventFederatedLinked,
+			Subject: user.Email, Details: map[string]interface{}{"connection_id": conn.ID}})
+		return user, ""
+	case err != sql.ErrNoRows:
+		log.Println("Error looking up user by email:", err)
+		return user, federatedErrFailed
+	case !conn.AutoProvision:
+		return user, federatedErrNoAccount
+	}
+
+	// Just-in-time provisioning
+	name := idToken.Name
+	if name == "" {
+		name = idToken.PreferredUsername
+	}
+	if name == "" {
+		name = email
+	}
+	user.Name, user.Email, user.Role = name, email, conn.DefaultRole
+	if err := provisionExternalUser(dbInstance, &user, bool(idToken.EmailVerified)); err != nil {
+		log.Println("Error provisioning federated user:", err)
+		return user, federatedErrFailed
+	}
+	if !linkFederatedIdentity(dbInstance, conn, idToken.Subject, email, user.ID) {
+		return user, federatedErrFailed
+	}
+	recordAudit(dbInstance, r, audit.Entry{TenantID: conn.TenantID, ActorID: user.ID, Event: audit.EventFederatedJIT,
+		Subject: user.Email, Details: map[string]interface{}{"connection_id": conn.ID}})
+	return user, ""
+}
+
+// provisionExternalUser creates a user signed in through an external identity provider.
+// The random password is never shown, so the account can only be used through the
+// provider until the user resets it.
+func provisionExternalUser(dbInstance *sql.DB, user *models.User, emailConfirmed bool) error {
+	random, err := auth.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	hashed, err := password.Hash(random)
+	if err != nil {
+		return err
+	}
+	return dbInstance.QueryRow(`
+		INSERT INTO users (tenant_id, name, email, password, role, email_confirmed, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+		RETURNING id, token_version`, user.TenantID, user.Name, user.Email, hashed, user.Role, emailConfirmed).
+		Scan(&user.ID, &user.TokenVersion)
+}
+
+// mappedRole maps the groups or attribute values an identity provider sent to a role.
+// Admin wins when any value maps to it, otherwise the first mapped value does; "" means
+// no value is mapped.
+func mappedRole(roles map[string]string, values []string) string {
+	role := ""
+	for _, v := range values {
+		mapped := roles[v]
+		if mapped == "admin" {
+			return mapped
+		}
+		if role == "" {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// syncMappedRole applies the role an identity provider maps the user to. A role change
+// revokes the tokens issued under the old role and is written to the audit log.
+func syncMappedRole(dbInstance *sql.DB, r *http.Request, user *models.User, role, event string) bool {
+	if role == "" || role == user.Role {
+		return true
+	}
+	previous := user.Role
+	err := dbInstance.QueryRow(`
+		UPDATE users SET role = $1, token_version = token_version + 1, updated_at = NOW()
+		WHERE id = $2 RETURNING token_version`, role, user.ID).Scan(&user.TokenVersion)
+	if err != nil {
+		log.Println("Error syncing mapped role:", err)
+		return false
+	}
+	user.Role = role
+	recordAudit(dbInstance, r, audit.Entry{TenantID: user.TenantID, ActorID: user.ID, Event: event,
+		Subject: user.Email, Details: map[string]interface{}{"from": previous, "to": role}})
+	return true
+}
+
+// addMappedTeams adds the user to the tenant's teams the values map to. Teams that do
+// not exist are skipped; memberships are never removed.
+func addMappedTeams(dbInstance *sql.DB, user models.User, teams map[string]string, values []string) {
+	for _, v := range values {
+		team, ok := teams[v]
+		if !ok {
+			continue
+		}
+		_, err := dbInstance.Exec(`
+			INSERT INTO user_teams (user_id, team_id, role, created_at, updated_at)
+			SELECT $1, id, 'member', NOW(), NOW() FROM teams WHERE tenant_id = $2 AND name = $3
+			ON CONFLICT (user_id, team_id) DO NOTHING`, user.ID, user.TenantID, team)
+		if err != nil {
+			log.Println("Error adding user to mapped team:", err)
+		}
+	}
+}
+
+func linkFederatedIdentity(dbInstance *sql.DB, conn models.OIDCConnection, subject, email string, userID int) bool {
+	_, err := dbInstance.Exec(`
+		INSERT INTO federated_identities (connection_id, subject, user_id, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, NOW(), NOW())`, conn.ID, subject, userID, email)
+	if err != nil {
+		log.Println("Error linking federated identity:", err)
+		return false
+	}
+	return true
+}
+
+func recordAudit(dbInstance *sql.DB, r *http.Request, e audit.Entry) {
+	e.IP = auth.ClientIP(r)
+	if err := audit.Record(dbInstance, e); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+var errLoginCodeInvalid = errors.New("invalid or expired login code")
+
+// redeemLoginCode consumes the login code of a finished federated login and returns its
+// user and return_to. Unknown, used and expired codes give errLoginCodeInvalid.
+func redeemLoginCode(dbInstance *sql.DB, code string) (models.User, string, error) {
+	var (
+		user      models.User
+		returnTo  string
+		expiresAt time.Time
+	)
+	err := dbInstance.QueryRow(`
+		DELETE FROM federated_logins WHERE id_hash = $1 AND user_id IS NOT NULL
+		RETURNING user_id, tenant_id, COALESCE(return_to, ''), expires_at`, auth.HashToken(code)).
+		Scan(&user.ID, &user.TenantID, &returnTo, &expiresAt)
+	if err == nil && time.Now().After(expiresAt) {
+		err = errLoginCodeInvalid
+	}
+	if err == nil {
+		err = dbInstance.QueryRow(`SELECT name, email, role, token_version FROM users WHERE id = $1 AND tenant_id = $2`,
+			user.ID, user.TenantID).Scan(&user.Name, &user.Email, &user.Role, &user.TokenVersion)
+	}
+	if err == sql.ErrNoRows {
+		err = errLoginCodeInvalid
+	}
+	return user, returnTo, err
+}
+
+// completeFederatedLogin trades the login code of a finished federated login for the
+// same tokens and cookie as /login. The upstream provider replaces the password, not
+// Sentinel's second factor: users with MFA, and users of tenants that require it, get
+// the same challenge as at /login.
+func completeFederatedLogin(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		LoginCode string `json:"login_code"`
+		Device    string `json:"device,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LoginCode == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	user, returnTo, err := redeemLoginCode(dbInstance, req.LoginCode)
+	if err != nil {
+		if err != errLoginCodeInvalid {
+			log.Println("Error redeeming federated login code:", err)
+		}
+		http.Error(w, "Invalid or expired login code", http.StatusUnauthorized)
+		return
+	}
+
+	var extra map[string]interface{}
+	if returnTo != "" {
+		extra = map[string]interface{}{"return_to": returnTo}
+	}
+
+	var mfaEnabled bool
+	err = dbInstance.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)`, user.ID).Scan(&mfaEnabled)
+	if err != nil {
+		log.Println("Error checking MFA status:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+		return
+	}
+	if mfaEnabled {
+		writeMFAChallengeWith(w, user, auth.PurposeMFAChallenge, extra)
+		return
+	}
+	settings, err := loadTenantSettings(dbInstance, user.TenantID)
+	if err != nil {
+		log.Println("Error loading tenant settings:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+		return
+	}
+	if settings.RequireMFA {
+		writeMFAChallengeWith(w, user, auth.PurposeMFAEnrollment, extra)
+		return
+	}
+
+	tokenString, refreshToken, ok := startSession(w, r, dbInstance, user, req.Device, auth.Authenticated(auth.AMRFederated))
+	if !ok {
+		return
+	}
+	writeTokensWith(w, tokenString, refreshToken, extra)
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+	"sentinel/internal/federation/federationtest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+)
+
+// captureString is a sqlmock argument that matches any string and remembers it
+type captureString struct{ value *string }
+
+func (c captureString) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	if ok {
+		*c.value = s
+	}
+	return ok
+}
+
+var connectionColumns = []string{"tenant_id", "name", "issuer", "client_id", "client_secret", "scopes", "default_role", "auto_provision"}
+
+func expectOIDCConnection(mock sqlmock.Sqlmock, idp *federationtest.IdP) {
+	mock.ExpectQuery("SELECT tenant_id, name, issuer, client_id, client_secret, scopes, default_role, auto_provision FROM oidc_connections").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(connectionColumns).
+			AddRow(1, "Corporate SSO", idp.Issuer(), idp.ClientID, idp.ClientSecret, "openid email profile", "member", true))
+}
+
+// federatedCallbackRequest starts a federated login and follows the browser through the
+// mock provider. It returns the request the provider sends back to the callback.
+func federatedCallbackRequest(t *testing.T, mock sqlmock.Sqlmock, idp *federationtest.IdP, start func(w http.ResponseWriter, r *http.Request)) *http.Request {
+	t.Helper()
+	var nonce, verifier string
+	expectOIDCConnection(mock, idp)
+	mock.ExpectExec("INSERT INTO federated_logins").
+		WithArgs(sqlmock.AnyArg(), 3, 1, captureString{&nonce}, captureString{&verifier}, "/dashboard", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	start(rr, httptest.NewRequest(http.MethodGet, "/login/federated/start?connection_id=3&return_to=/dashboard", nil))
+	if rr.Code != http.StatusFound || !strings.HasPrefix(rr.Header().Get("Location"), idp.URL+"/authorize?") {
+		t.Fatalf("expected a redirect to the provider, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+	back, _ := url.Parse(resp.Header.Get("Location"))
+	if back.Path != "/login/federated/callback" {
+		t.Fatalf("expected the provider to redirect to the callback, got %s", back)
+	}
+
+	mock.ExpectQuery("DELETE FROM federated_logins WHERE id_hash = \\$1 AND user_id IS NULL").
+		WithArgs(auth.HashToken(back.Query().Get("state"))).
+		WillReturnRows(sqlmock.NewRows([]string{"connection_id", "tenant_id", "nonce", "code_verifier", "return_to", "expires_at"}).
+			AddRow(3, 1, nonce, verifier, "/dashboard", time.Now().Add(time.Minute)))
+	expectOIDCConnection(mock, idp)
+	callback := httptest.NewRequest(http.MethodGet, back.RequestURI(), nil)
+	for _, c := range rr.Result().Cookies() {
+		callback.AddCookie(c)
+	}
+	return callback
+}
+
+func TestFederatedLogin(t *testing.T) {
+	userColumns := []string{"id", "name", "email", "role", "token_version"}
+	tests := []struct {
+		name          string
+		emailVerified interface{}
+		expect        func(mock sqlmock.Sqlmock)
+		wantError     string
+	}{
+		{
+			name:          "Returning identity",
+			emailVerified: true,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM federated_identities f JOIN users u").
+					WithArgs(3, "idp-user-1", 1).
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "Jane", "jane@example.com", "member", 0))
+				mock.ExpectExec("UPDATE federated_identities SET last_login_at").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name:          "Links an existing user by verified email",
+			emailVerified: true,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM federated_identities f JOIN users u").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectQuery("SELECT id, name, email, role, token_version FROM users WHERE LOWER\\(email\\) = LOWER\\(\\$1\\)").
+					WithArgs("jane@example.com", 1).
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "Jane", "jane@example.com", "member", 0))
+				mock.ExpectExec("INSERT INTO federated_identities").
+					WithArgs(3, "idp-user-1", 7, "jane@example.com").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 7, "federated_identity_linked", "jane@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+		},
+		{
+			name:          "Unverified email is not linked",
+			emailVerified: false,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM federated_identities f JOIN users u").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectQuery("SELECT id, name, email, role, token_version FROM users").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "Jane", "jane@example.com", "admin", 0))
+			},
+			wantError: "email_not_verified",
+		},
+		{
+			name:          "Provisions a new user",
+			emailVerified: "true",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM federated_identities f JOIN users u").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectQuery("SELECT id, name, email, role, token_version FROM users").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectQuery("INSERT INTO users").
+					WithArgs(1, "Jane", "jane@example.com", sqlmock.AnyArg(), "member", true).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "token_version"}).AddRow(8, 0))
+				mock.ExpectExec("INSERT INTO federated_identities").
+					WithArgs(3, "idp-user-1", 8, "jane@example.com").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 8, "federated_user_provisioned", "jane@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			idp := federationtest.NewIdP("sentinel-client", "upstream-secret")
+			defer idp.Close()
+			idp.SetUser(jwt.MapClaims{"sub": "idp-user-1", "email": "jane@example.com", "email_verified": tt.emailVerified, "name": "Jane"})
+
+			callback := federatedCallbackRequest(t, mock, idp, func(w http.ResponseWriter, r *http.Request) { startFederatedLogin(w, r, db) })
+			tt.expect(mock)
+			if tt.wantError == "" {
+				mock.ExpectExec("INSERT INTO federated_logins").
+					WithArgs(sqlmock.AnyArg(), 3, 1, sqlmock.AnyArg(), "/dashboard", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			rr := httptest.NewRecorder()
+			federatedCallback(rr, callback, db)
+
+			if rr.Code != http.StatusFound {
+				t.Fatalf("expected status 302, got %d: %s", rr.Code, rr.Body.String())
+			}
+			location, _ := url.Parse(rr.Header().Get("Location"))
+			if tt.wantError != "" {
+				if location.Path != "/login" || location.Query().Get("error") != tt.wantError {
+					t.Errorf("expected the login page with error %s, got %s", tt.wantError, location)
+				}
+			} else if location.Path != "/login/federated" || location.Query().Get("login_code") == "" {
+				t.Errorf("expected a login code for the frontend, got %s", location)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestFederatedCallback_UnknownState(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("DELETE FROM federated_logins").
+		WithArgs(auth.HashToken("forged")).
+		WillReturnRows(sqlmock.NewRows([]string{"connection_id", "tenant_id", "nonce", "code_verifier", "return_to", "expires_at"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/login/federated/callback?state=forged&code=abc", nil)
+	req.AddCookie(&http.Cookie{Name: federatedStateCookie, Value: auth.HashToken("forged")})
+	rr := httptest.NewRecorder()
+	federatedCallback(rr, req, db)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestFederatedCallback_OtherBrowser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	idp := federationtest.NewIdP("sentinel-client", "upstream-secret")
+	defer idp.Close()
+
+	expectOIDCConnection(mock, idp)
+	mock.ExpectExec("INSERT INTO federated_logins").WillReturnResult(sqlmock.NewResult(1, 1))
+	rr := httptest.NewRecorder()
+	startFederatedLogin(rr, httptest.NewRequest(http.MethodGet, "/login/federated/start?connection_id=3", nil), db)
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	state := location.Query().Get("state")
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != auth.HashToken(state) || cookies[0].Path != "/login/federated/callback" ||
+		!cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected the state to be bound to the browser, got %+v", cookies)
+	}
+
+	// An attacker hands the callback URL of their own login to a victim, whose browser has
+	// no state cookie, or the one of another login. The state is refused without being consumed.
+	for _, cookie := range []*http.Cookie{nil, {Name: federatedStateCookie, Value: auth.HashToken("other-state")}} {
+		req := httptest.NewRequest(http.MethodGet, "/login/federated/callback?code=abc&state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		federatedCallback(rr, req, db)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestCompleteFederatedLogin(t *testing.T) {
+	tests := []struct {
+		name           string
+		expiresAt      time.Time
+		mfaEnabled     bool
+		settings       string
+		expectedStatus int
+		wantChallenge  string // "" when tokens are expected
+	}{
+		{"Valid login code", time.Now().Add(time.Minute), false, `{}`, http.StatusOK, ""},
+		{"Expired login code", time.Now().Add(-time.Second), false, `{}`, http.StatusUnauthorized, ""},
+		{"User with MFA", time.Now().Add(time.Minute), true, `{}`, http.StatusOK, "mfa_required"},
+		{"Tenant requires MFA", time.Now().Add(time.Minute), false, `{"require_mfa": true}`, http.StatusOK, "mfa_enrollment_required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery("DELETE FROM federated_logins WHERE id_hash = \\$1 AND user_id IS NOT NULL").
+				WithArgs(auth.HashToken("login-code")).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "tenant_id", "return_to", "expires_at"}).
+					AddRow(7, 1, "/dashboard", tt.expiresAt))
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectQuery("SELECT name, email, role, token_version FROM users WHERE id = \\$1 AND tenant_id = \\$2").
+					WithArgs(7, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "email", "role", "token_version"}).AddRow("Jane", "jane@example.com", "member", 0))
+				mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM user_totp WHERE user_id = \\$1 AND enabled_at IS NOT NULL\\)").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.mfaEnabled))
+				if !tt.mfaEnabled {
+					mock.ExpectQuery("SELECT settings FROM tenant_settings").
+						WithArgs(1).
+						WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow([]byte(tt.settings)))
+				}
+				if tt.wantChallenge == "" {
+					expectNewSession(mock)
+				}
+			}
+
+			rr, response := postJSON(t, func(w http.ResponseWriter, r *http.Request) { completeFederatedLogin(w, r, db) },
+				map[string]string{"login_code": "login-code"})
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			switch {
+			case tt.wantChallenge != "":
+				// The upstream provider does not stand in for Sentinel's second factor
+				if response[tt.wantChallenge] != true || response["mfa_token"] == nil || response["token"] != nil ||
+					response["return_to"] != "/dashboard" {
+					t.Errorf("expected a %s challenge, got %v", tt.wantChallenge, response)
+				}
+			case tt.expectedStatus == http.StatusOK:
+				if response["token"] == "" || response["refresh_token"] == "" || response["return_to"] != "/dashboard" {
+					t.Errorf("unexpected response: %v", response)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	tests := map[string]string{
+		"/dashboard":                          "/dashboard",
+		"//evil.example.com":                  "",
+		"https://evil.example.com/":           "",
+		"http://localhost:5173/apps":          "http://localhost:5173/apps",
+		auth.Issuer() + "/authorize?x=1":      auth.Issuer() + "/authorize?x=1",
+		"http://localhost:8080.evil.com/path": "",
+	}
+	for in, want := range tests {
+		if got := safeReturnTo(in); got != want {
+			t.Errorf("safeReturnTo(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
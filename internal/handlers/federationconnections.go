@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/db"
+	"sentinel/internal/federation"
+	"sentinel/internal/models"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func CreateOIDCConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	createOIDCConnection(w, r, db.DB)
+}
+
+func ListOIDCConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	listOIDCConnections(w, r, db.DB)
+}
+
+func DeleteOIDCConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	deleteOIDCConnection(w, r, db.DB)
+}
+
+// createOIDCConnection adds an upstream provider to the admin's tenant. The issuer is
+// checked through its discovery document before anything is stored.
+func createOIDCConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name          string `json:"name"`
+		Issuer        string `json:"issuer"`
+		ClientID      string `json:"client_id"`
+		ClientSecret  string `json:"client_secret"`
+		Scopes        string `json:"scopes"`
+		DefaultRole   string `json:"default_role"`
+		AutoProvision *bool  `json:"auto_provision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.ClientID == "" || req.ClientSecret == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	conn := models.OIDCConnection{
+		TenantID:      tenantID,
+		Name:          req.Name,
+		Issuer:        strings.TrimRight(req.Issuer, "/"),
+		ClientID:      req.ClientID,
+		ClientSecret:  req.ClientSecret,
+		Scopes:        req.Scopes,
+		DefaultRole:   req.DefaultRole,
+		AutoProvision: req.AutoProvision == nil || *req.AutoProvision,
+	}
+	if conn.Scopes == "" {
+		conn.Scopes = "openid email profile"
+	}
+	if conn.DefaultRole == "" {
+		conn.DefaultRole = "member"
+	}
+	if !hasScope(conn.Scopes, "openid") {
+		writeFieldErrors(w, "Invalid connection", []models.FieldError{{Field: "scopes", Code: "invalid", Message: "must include openid"}})
+		return
+	}
+	// Same rule as for redirect URIs: https, or plain http on localhost only
+	if !validRedirectURI(conn.Issuer) {
+		writeFieldErrors(w, "Invalid connection", []models.FieldError{{Field: "issuer", Code: "invalid", Message: "must be an https URL"}})
+		return
+	}
+	if _, err := federation.Discover(r.Context(), conn.Issuer); err != nil {
+		log.Println("Error discovering upstream provider:", err)
+		writeFieldErrors(w, "Invalid connection", []models.FieldError{{Field: "issuer", Code: "discovery_failed", Message: "no valid OpenID configuration found"}})
+		return
+	}
+
+	err := dbInstance.QueryRow(`
+		INSERT INTO oidc_connections (tenant_id, name, issuer, client_id, client_secret, scopes, default_role, auto_provision, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
+		RETURNING id, created_at`,
+		tenantID, conn.Name, conn.Issuer, conn.ClientID, conn.ClientSecret, conn.Scopes, conn.DefaultRole, conn.AutoProvision).
+		Scan(&conn.ID, &conn.CreatedAt)
+	if err != nil {
+		log.Println("Error creating OIDC connection:", err)
+		http.Error(w, "Error creating connection", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"connection": conn, "redirect_uri": federatedRedirectURI()})
+}
+
+// listOIDCConnections returns the upstream providers of the admin's tenant, without their secrets
+func listOIDCConnections(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	rows, err := dbInstance.Query(`
+		SELECT id, name, issuer, client_id, scopes, default_role, auto_provision, created_at
+		FROM oidc_connections WHERE tenant_id = $1 ORDER BY name`, tenantID)
+	if err != nil {
+		log.Println("Error listing OIDC connections:", err)
+		http.Error(w, "Error retrieving connections", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	connections := []models.OIDCConnection{}
+	for rows.Next() {
+		c := models.OIDCConnection{TenantID: tenantID}
+		if err := rows.Scan(&c.ID, &c.Name, &c.Issuer, &c.ClientID, &c.Scopes, &c.DefaultRole, &c.AutoProvision, &c.CreatedAt); err != nil {
+			log.Println("Error reading OIDC connection:", err)
+			http.Error(w, "Error retrieving connections", http.StatusInternalServerError)
+			return
+		}
+		connections = append(connections, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connections)
+}
+
+// deleteOIDCConnection removes an upstream provider. Users it provisioned keep their
+// accounts; only the links to the provider are dropped.
+func deleteOIDCConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	res, err := dbInstance.Exec(`DELETE FROM oidc_connections WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err != nil {
+		log.Println("Error deleting OIDC connection:", err)
+		http.Error(w, "Error deleting connection", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Connection deleted successfully"})
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/federation/federationtest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateOIDCConnection(t *testing.T) {
+	idp := federationtest.NewIdP("sentinel-client", "upstream-secret")
+	defer idp.Close()
+
+	tests := []struct {
+		name           string
+		role           string
+		issuer         string
+		expectInsert   bool
+		expectedStatus int
+	}{
+		{"Admin adds a provider", "admin", idp.Issuer(), true, http.StatusCreated},
+		{"Issuer without discovery", "admin", idp.Issuer() + "/missing", false, http.StatusBadRequest},
+		{"Plain http issuer", "admin", "http://idp.example.com", false, http.StatusBadRequest},
+		{"Member cannot add providers", "member", idp.Issuer(), false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectInsert {
+				mock.ExpectQuery("INSERT INTO oidc_connections").
+					WithArgs(1, "Corporate SSO", tt.issuer, "sentinel-client", "upstream-secret", "openid email profile", "member", true).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+			}
+
+			raw, _ := json.Marshal(map[string]string{"name": "Corporate SSO", "issuer": tt.issuer,
+				"client_id": "sentinel-client", "client_secret": "upstream-secret"})
+			req := httptest.NewRequest(http.MethodPost, "/api/federation/connections", bytes.NewReader(raw))
+			req = req.WithContext(sessionContext(1, 1, tt.role, "s1"))
+			rr := httptest.NewRecorder()
+			createOIDCConnection(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if bytes.Contains(rr.Body.Bytes(), []byte("upstream-secret")) {
+				t.Error("client secret must not be returned")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
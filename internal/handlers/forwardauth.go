@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"strconv"
+	"strings"
+)
+
+// Headers a reverse proxy sets on the /auth/verify subrequest to require more than a valid token.
+// The proxy must set them itself, overwriting any the client sent.
+const (
+	requiredRoleHeader   = "X-Required-Role"   // Comma-separated roles, one of which the caller must have
+	requiredModuleHeader = "X-Required-Module" // Name of a module of the tenant the user must have access to
+)
+
+func VerifyForwardAuthHandler(w http.ResponseWriter, r *http.Request) {
+	verifyForwardAuth(w, r, db.DB)
+}
+
+// originalMethod is the method of the request the proxy is checking. Traefik sends it as
+// X-Forwarded-Method and ingress-nginx as X-Original-Method; API key and service account
+// scopes are checked against it. The subrequest's own method says nothing about the
+// original one, so without either header the method is unknown and checked as a write.
+func originalMethod(r *http.Request) string {
+	for _, header := range []string{"X-Forwarded-Method", "X-Original-Method"} {
+		if method := r.Header.Get(header); method != "" {
+			return strings.ToUpper(method)
+		}
+	}
+	return ""
+}
+
+// originalPath is the path of the request the proxy is checking, from X-Forwarded-Uri
+// (Traefik) or X-Original-URI (ingress-nginx). It is what impersonated requests are
+// audited with.
+func originalPath(r *http.Request) string {
+	for _, header := range []string{"X-Forwarded-Uri", "X-Original-URI"} {
+		if uri := r.Header.Get(header); uri != "" {
+			if u, err := url.ParseRequestURI(uri); err == nil {
+				return u.Path
+			}
+		}
+	}
+	return r.URL.Path
+}
+
+// verifyForwardAuth is the forward-auth endpoint for nginx auth_request and Traefik
+// ForwardAuth. It authenticates the bearer token, API key or token cookie exactly as the
+// /api routes do, applies the required role and module headers, and answers 200 with
+// identity headers the proxy copies onto the upstream request.
+func verifyForwardAuth(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	req := r.Clone(r.Context())
+	req.Method = originalMethod(r)
+	req.URL.Path = originalPath(r)
+	if req.Header.Get("Authorization") == "" {
+		if cookie, err := r.Cookie("token"); err == nil && cookie.Value != "" {
+			req.Header.Set("Authorization", "Bearer "+cookie.Value)
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	auth.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		email, _ := auth.GetEmail(ctx)
+		tenantID, _ := auth.GetTenantID(ctx)
+		role, _ := auth.GetRole(ctx)
+		userID, _ := auth.GetUserID(ctx)
+		principalType := auth.GetPrincipalType(ctx)
+
+		if required := r.Header.Get(requiredRoleHeader); required != "" && !auth.RoleAllowed(role, required) {
+			http.Error(w, "Role not allowed", http.StatusForbidden)
+			return
+		}
+		if module := r.Header.Get(requiredModuleHeader); module != "" {
+			// Module access is granted to users; service accounts have none
+			allowed := false
+			if userID != 0 {
+				var err error
+				if allowed, err = auth.HasModuleAccess(dbInstance, userID, tenantID, module); err != nil {
+					log.Println("Error checking module access:", err)
+					http.Error(w, "Error checking module access", http.StatusInternalServerError)
+					return
+				}
+			}
+			if !allowed {
+				http.Error(w, "No access to this module", http.StatusForbidden)
+				return
+			}
+		}
+
+		w.Header().Set("X-User-Email", email)
+		w.Header().Set("X-Tenant-ID", strconv.Itoa(tenantID))
+		w.Header().Set("X-Role", role)
+		w.Header().Set("X-Principal-Type", principalType)
+		if userID != 0 {
+			w.Header().Set("X-User-ID", strconv.Itoa(userID))
+		}
+		if accountID := auth.GetServiceAccountID(ctx); accountID != 0 {
+			w.Header().Set("X-Service-Account-ID", strconv.Itoa(accountID))
+		}
+		if actorID := auth.GetActorID(ctx); actorID != 0 {
+			w.Header().Set("X-Impersonator-ID", strconv.Itoa(actorID))
+		}
+		w.WriteHeader(http.StatusOK)
+	}), dbInstance).ServeHTTP(w, req)
+}
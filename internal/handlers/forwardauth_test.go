@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestVerifyForwardAuth(t *testing.T) {
+	tests := []struct {
+		name           string
+		cookie         bool
+		headers        map[string]string
+		moduleAccess   interface{} // nil when no module lookup is expected
+		expectedStatus int
+	}{
+		{"Bearer token", false, nil, nil, http.StatusOK},
+		{"Token cookie", true, nil, nil, http.StatusOK},
+		{"Allowed role", false, map[string]string{"X-Required-Role": "admin, member"}, nil, http.StatusOK},
+		{"Role not allowed", false, map[string]string{"X-Required-Role": "admin"}, nil, http.StatusForbidden},
+		{"Module access", false, map[string]string{"X-Required-Module": "billing"}, true, http.StatusOK},
+		{"No module access", false, map[string]string{"X-Required-Module": "billing"}, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			stubSessionCookie(t, time.Now())
+			expectSessionCookie(mock)
+			if tt.moduleAccess != nil {
+				mock.ExpectQuery("SELECT 1 FROM user_modules um JOIN modules m ON m.id = um.module_id").
+					WithArgs(7, 1, "billing").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.moduleAccess))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/auth/verify", nil)
+			if tt.cookie {
+				req.AddCookie(&http.Cookie{Name: "token", Value: "session-token"})
+			} else {
+				req.Header.Set("Authorization", "Bearer session-token")
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			rr := httptest.NewRecorder()
+			verifyForwardAuth(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusOK &&
+				(rr.Header().Get("X-User-ID") != "7" || rr.Header().Get("X-Tenant-ID") != "1" || rr.Header().Get("X-Role") != "member") {
+				t.Errorf("unexpected identity headers: %v", rr.Header())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyForwardAuth_Unauthenticated(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	rr := httptest.NewRecorder()
+	verifyForwardAuth(rr, httptest.NewRequest(http.MethodGet, "/auth/verify", nil), db)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rr.Code)
+	}
+	if rr.Header().Get("X-User-Email") != "" {
+		t.Errorf("expected no identity headers, got %v", rr.Header())
+	}
+}
+
+func TestVerifyForwardAuth_APIKeyScopes(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{name: "Read from Traefik", headers: map[string]string{"X-Forwarded-Method": "GET"}, expectedStatus: http.StatusOK},
+		{name: "Read from ingress-nginx", headers: map[string]string{"X-Original-Method": "head"}, expectedStatus: http.StatusOK},
+		{name: "Write", headers: map[string]string{"X-Forwarded-Method": "DELETE"}, expectedStatus: http.StatusForbidden},
+		{name: "Unknown method counts as a write", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			key := auth.APIKeyPrefix + "readonly"
+			mock.ExpectQuery("UPDATE api_keys").WithArgs(auth.HashToken(key)).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "tenant_id", "email", "role", "scopes"}).
+					AddRow(3, 7, 1, "ci@example.com", "member", `["read"]`))
+
+			req := httptest.NewRequest(http.MethodGet, "/auth/verify", nil)
+			req.Header.Set("Authorization", "ApiKey "+key)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			rr := httptest.NewRecorder()
+			verifyForwardAuth(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
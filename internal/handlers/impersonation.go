@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/audit"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func ImpersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	impersonateUser(w, r, db.DB)
+}
+
+// impersonating refuses requests made with an impersonation token. It guards everything
+// that would outlive the token, such as new credentials or sessions of the user.
+func impersonating(w http.ResponseWriter, r *http.Request) bool {
+	if auth.GetActorID(r.Context()) != 0 {
+		http.Error(w, "Not allowed while impersonating a user", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// impersonateUser lets a signed-in admin act as a member of their tenant, for support. The
+// token is short-lived, bound to the admin's session, carries the admin in its act claim
+// and cannot be refreshed; every request made with it is audited. Admins cannot be
+// impersonated, and users of other tenants are out of reach.
+func impersonateUser(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	actorID, err := auth.GetUserID(ctx)
+	sessionID := auth.GetSessionID(ctx)
+	if err != nil || sessionID == "" || auth.GetPrincipalType(ctx) != auth.PrincipalUser || auth.GetAPIKeyID(ctx) != 0 {
+		http.Error(w, "Users can only be impersonated by a signed-in admin", http.StatusForbidden)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+
+	targetID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if targetID == actorID {
+		http.Error(w, "You cannot impersonate yourself", http.StatusBadRequest)
+		return
+	}
+
+	target := models.User{ID: targetID}
+	err = dbInstance.QueryRow(`SELECT email, role, tenant_id, token_version FROM users WHERE id = $1`, targetID).
+		Scan(&target.Email, &target.Role, &target.TenantID, &target.TokenVersion)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error fetching user to impersonate:", err)
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return
+	}
+	if target.TenantID != tenantID {
+		http.Error(w, "Users of other tenants cannot be impersonated", http.StatusForbidden)
+		return
+	}
+	if target.Role == "admin" {
+		http.Error(w, "Admins cannot be impersonated", http.StatusForbidden)
+		return
+	}
+
+	actor := auth.Actor{Subject: strconv.Itoa(actorID), UserID: actorID}
+	actor.Email, _ = auth.GetEmail(ctx)
+	err = dbInstance.QueryRow(`SELECT token_version FROM users WHERE id = $1`, actorID).Scan(&actor.TokenVersion)
+	if err != nil {
+		log.Println("Error fetching impersonating admin:", err)
+		http.Error(w, "Error starting impersonation", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := auth.SignImpersonationToken(target, actor, sessionID)
+	if err != nil {
+		log.Println("Error signing impersonation token:", err)
+		http.Error(w, "Error starting impersonation", http.StatusInternalServerError)
+		return
+	}
+	ttl := auth.ImpersonationTTL()
+	err = audit.Record(dbInstance, audit.Entry{
+		TenantID: tenantID,
+		ActorID:  actorID,
+		Event:    audit.EventImpersonationStarted,
+		Subject:  target.Email,
+		IP:       auth.ClientIP(r),
+		Details:  map[string]interface{}{"impersonated_user_id": target.ID, "expires_in": int(ttl.Seconds())},
+	})
+	if err != nil {
+		// No token is handed out without its audit record
+		log.Println("Error writing audit log:", err)
+		http.Error(w, "Error starting impersonation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_in": int(ttl.Seconds()),
+		"user":       map[string]interface{}{"id": target.ID, "email": target.Email, "role": target.Role},
+	})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestImpersonateUser(t *testing.T) {
+	admin := sessionContext(3, 1, "admin", "s1")
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		userID         string
+		target         [][]driver.Value // users row of the target, nil when no lookup is expected
+		expectedStatus int
+	}{
+		{"Admin impersonates a member of the tenant", admin, "7", [][]driver.Value{{"user@example.com", "member", 1, 4}}, http.StatusOK},
+		{"Member cannot impersonate", sessionContext(3, 1, "member", "s1"), "7", nil, http.StatusForbidden},
+		{"API key cannot impersonate", context.WithValue(admin, auth.APIKeyIDKey, 2), "7", nil, http.StatusForbidden},
+		{"Service account cannot impersonate", serviceAccountContext(5, 1, "admin"), "7", nil, http.StatusForbidden},
+		{"No nested impersonation", context.WithValue(admin, auth.ActorIDKey, 9), "7", nil, http.StatusForbidden},
+		{"Admin cannot impersonate themselves", admin, "3", nil, http.StatusBadRequest},
+		{"Unknown user", admin, "8", [][]driver.Value{}, http.StatusNotFound},
+		{"User of another tenant", admin, "7", [][]driver.Value{{"user@example.com", "member", 2, 4}}, http.StatusForbidden},
+		{"Another admin", admin, "7", [][]driver.Value{{"boss@example.com", "admin", 1, 0}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.target != nil {
+				rows := sqlmock.NewRows([]string{"email", "role", "tenant_id", "token_version"})
+				for _, row := range tt.target {
+					rows.AddRow(row...)
+				}
+				mock.ExpectQuery("SELECT email, role, tenant_id, token_version FROM users WHERE id = \\$1").
+					WithArgs(sqlmock.AnyArg()).WillReturnRows(rows)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(2))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 3, "impersonation_started", "user@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/impersonate/"+tt.userID, nil)
+			req = mux.SetURLVars(req.WithContext(tt.ctx), map[string]string{"user_id": tt.userID})
+			rr := httptest.NewRecorder()
+			impersonateUser(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusOK {
+				var response struct {
+					Token string `json:"token"`
+				}
+				json.Unmarshal(rr.Body.Bytes(), &response)
+				claims, err := auth.ParseAccessToken(response.Token)
+				if err != nil {
+					t.Fatalf("expected a valid access token, got %v", err)
+				}
+				if claims.UserID != 7 || claims.TokenVersion != 4 || claims.Id != "s1" ||
+					claims.Actor == nil || claims.Actor.UserID != 3 || claims.Actor.TokenVersion != 2 {
+					t.Errorf("unexpected claims: %+v, act %+v", claims, claims.Actor)
+				}
+				if len(rr.Result().Cookies()) != 0 {
+					t.Error("expected no cookie to be set")
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestImpersonationCannotChangeCredentials(t *testing.T) {
+	ctx := context.WithValue(sessionContext(7, 1, "member", "s1"), auth.ActorIDKey, 3)
+	tests := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request, *sql.DB)
+	}{
+		{"API key", createAPIKey},
+		{"Device approval", approveDevice},
+		{"Passkey", beginPasskeyRegistration},
+		{"TOTP enrollment", enrollTOTPForUser},
+		{"Passkey deletion", deletePasskey},
+		{"Signing out other sessions", revokeOtherSessions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req, db)
+
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("expected status 403, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
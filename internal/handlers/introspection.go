@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"slices"
+	"strings"
+)
+
+func IntrospectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	introspectToken(w, r, db.DB)
+}
+
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	revokeToken(w, r, db.DB)
+}
+
+// oauthCaller is the authenticated caller of /oauth/introspect and /oauth/revoke
+type oauthCaller struct {
+	tenantID         int
+	userID           int
+	serviceAccountID int
+	role             string
+	canWrite         bool // Holds the write scope; only service accounts can lack it
+}
+
+// authenticateOAuthCaller accepts a Sentinel access token ("Authorization: Bearer ...")
+// or the client credentials of a service account. The form must already be parsed.
+func authenticateOAuthCaller(r *http.Request, dbInstance *sql.DB) (oauthCaller, error) {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		claims, err := auth.Authenticate(dbInstance, bearer)
+		if err != nil {
+			return oauthCaller{}, errInvalidClient
+		}
+		return oauthCaller{tenantID: claims.TenantID, userID: claims.UserID, serviceAccountID: claims.ServiceAccountID, role: claims.Role, canWrite: claims.Allows(http.MethodPost)}, nil
+	}
+	account, err := authenticateServiceAccount(r, dbInstance)
+	if err != nil {
+		return oauthCaller{}, err
+	}
+	return oauthCaller{tenantID: account.TenantID, serviceAccountID: account.ID, role: account.Role, canWrite: slices.Contains(account.Scopes, auth.ScopeWrite)}, nil
+}
+
+// oauthCallerOrFail authenticates the caller or answers with an RFC 6749 error
+func oauthCallerOrFail(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) (oauthCaller, bool) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return oauthCaller{}, false
+	}
+	caller, err := authenticateOAuthCaller(r, dbInstance)
+	if err == errInvalidClient {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Caller authentication failed")
+		return caller, false
+	}
+	if err != nil {
+		log.Println("Error authenticating OAuth caller:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not authenticate the caller")
+		return caller, false
+	}
+	if r.PostForm.Get("token") == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return caller, false
+	}
+	return caller, true
+}
+
+// owns reports whether the token was issued to the caller itself
+func (c oauthCaller) owns(userID, serviceAccountID int) bool {
+	return (c.userID != 0 && c.userID == userID) || (c.serviceAccountID != 0 && c.serviceAccountID == serviceAccountID)
+}
+
+// introspectToken is the token introspection endpoint (RFC 7662). Service accounts and
+// admins can look up the access tokens of their own tenant; tokens of other tenants,
+// refresh tokens and anything unknown are reported as inactive.
+func introspectToken(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	caller, ok := oauthCallerOrFail(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	if caller.serviceAccountID == 0 && caller.role != "admin" {
+		writeOAuthError(w, http.StatusForbidden, "access_denied", "Only service accounts and admins can introspect tokens")
+		return
+	}
+
+	info, err := auth.IntrospectToken(dbInstance, r.PostForm.Get("token"))
+	if err != nil {
+		log.Println("Error introspecting token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not introspect the token")
+		return
+	}
+
+	response := map[string]interface{}{"active": false}
+	if c := info.Claims; c != nil && c.TenantID == caller.tenantID {
+		response["revoked"] = info.Revoked
+		if info.Active {
+			principalType := c.PrincipalType
+			if principalType == "" {
+				principalType = auth.PrincipalUser
+			}
+			response["active"] = true
+			response["token_type"] = "Bearer"
+			response["sub"] = c.SubjectID()
+			response["exp"] = c.ExpiresAt
+			response["iat"] = c.IssuedAt
+			response["tenant_id"] = c.TenantID
+			response["role"] = c.Role
+			response["principal_type"] = principalType
+			for name, value := range map[string]string{"scope": c.Scope, "iss": c.Issuer, "jti": c.Id, "username": c.Email} {
+				if value != "" {
+					response[name] = value
+				}
+			}
+			if c.UserID != 0 {
+				response["user_id"] = c.UserID
+			}
+			if c.ServiceAccountID != 0 {
+				response["service_account_id"] = c.ServiceAccountID
+			}
+			if c.Actor != nil {
+				response["act"] = map[string]string{"sub": c.Actor.Subject, "username": c.Actor.Email}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// revokeToken is the token revocation endpoint (RFC 7009). Callers revoke their own access
+// and refresh tokens; admins and admin service accounts can revoke any token of their
+// tenant. Service accounts need the write scope. Revoking an access token ends its
+// session, like /logout. As the RFC asks, unknown tokens and tokens the caller may not
+// revoke are answered with 200 as well.
+func revokeToken(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	caller, ok := oauthCallerOrFail(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	if !caller.canWrite {
+		writeOAuthError(w, http.StatusForbidden, "insufficient_scope", "Revoking tokens needs the write scope")
+		return
+	}
+	token := r.PostForm.Get("token")
+	allowed := func(tenantID, userID, serviceAccountID int) bool {
+		return tenantID == caller.tenantID && (caller.role == "admin" || caller.owns(userID, serviceAccountID))
+	}
+
+	var err error
+	if claims, parseErr := auth.ParseAccessToken(token); parseErr == nil {
+		if allowed(claims.TenantID, claims.UserID, claims.ServiceAccountID) {
+			err = auth.RevokeAccessToken(dbInstance, token, claims)
+		}
+	} else if rt, findErr := auth.FindRefreshToken(dbInstance, token); findErr == nil {
+		if allowed(rt.TenantID, rt.UserID, 0) {
+			err = auth.RevokeRefreshToken(dbInstance, rt)
+		}
+	} else if findErr != auth.ErrInvalidRefreshToken {
+		err = findErr
+	}
+	if err != nil {
+		log.Println("Error revoking token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not revoke the token")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
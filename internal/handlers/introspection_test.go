@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+	"sentinel/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const gatewaySecret = "gateway-secret"
+
+// expectGatewayAccount answers the client credentials lookup of the "sa_gateway" service account of tenant 1
+func expectGatewayAccount(mock sqlmock.Sqlmock, role, scopes string) {
+	mock.ExpectQuery("SELECT id, tenant_id, role, scopes, client_secret_hash, token_version\\s+FROM service_accounts WHERE client_id = \\$1").
+		WithArgs("sa_gateway").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "role", "scopes", "client_secret_hash", "token_version"}).
+			AddRow(9, 1, role, scopes, auth.HashToken(gatewaySecret), 0))
+}
+
+func oauthFormRequest(path, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func userToken(t *testing.T, userID, tenantID int, sessionID string) string {
+	t.Helper()
+	token, err := auth.GenerateSessionJWT(models.User{ID: userID, TenantID: tenantID, Email: "user@example.com", Role: "member"}, sessionID, auth.Authentication{})
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func TestIntrospectToken(t *testing.T) {
+	token := userToken(t, 7, 1, "s1")
+
+	t.Run("Active token of the caller's tenant", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		expectGatewayAccount(mock, "member", `["read"]`)
+		mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM token_blacklist WHERE token=\\$1\\)").WithArgs(token).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+		mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM sessions WHERE jti = \\$1 AND revoked_at IS NULL\\)").WithArgs("s1").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		req := oauthFormRequest("/oauth/introspect", token)
+		req.SetBasicAuth("sa_gateway", gatewaySecret)
+		rr := httptest.NewRecorder()
+		introspectToken(rr, req, db)
+
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		if rr.Code != http.StatusOK || response["active"] != true || response["revoked"] != false ||
+			response["sub"] != "7" || response["username"] != "user@example.com" || response["principal_type"] != auth.PrincipalUser {
+			t.Errorf("unexpected response %d: %s", rr.Code, rr.Body.String())
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet sqlmock expectations: %v", err)
+		}
+	})
+
+	t.Run("Blacklisted token", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		expectGatewayAccount(mock, "member", `["read"]`)
+		mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM token_blacklist WHERE token=\\$1\\)").WithArgs(token).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		req := oauthFormRequest("/oauth/introspect", token)
+		req.SetBasicAuth("sa_gateway", gatewaySecret)
+		rr := httptest.NewRecorder()
+		introspectToken(rr, req, db)
+
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		if response["active"] != false || response["revoked"] != true || response["sub"] != nil {
+			t.Errorf("unexpected response: %s", rr.Body.String())
+		}
+	})
+
+	t.Run("Token of another tenant", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		other := userToken(t, 8, 2, "")
+		expectGatewayAccount(mock, "member", `["read"]`)
+		mock.ExpectQuery("SELECT EXISTS").WithArgs(other).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery("SELECT token_version FROM users").WithArgs(8).
+			WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+
+		req := oauthFormRequest("/oauth/introspect", other)
+		req.SetBasicAuth("sa_gateway", gatewaySecret)
+		rr := httptest.NewRecorder()
+		introspectToken(rr, req, db)
+
+		if strings.TrimSpace(rr.Body.String()) != `{"active":false}` {
+			t.Errorf("expected an inactive answer, got %s", rr.Body.String())
+		}
+	})
+
+	t.Run("Unauthenticated caller", func(t *testing.T) {
+		db, _, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		rr := httptest.NewRecorder()
+		introspectToken(rr, oauthFormRequest("/oauth/introspect", token), db)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", rr.Code)
+		}
+	})
+}
+
+func TestRevokeToken(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          func(t *testing.T) string
+		callerRole     string
+		callerScopes   string
+		expectRevoke   bool
+		expectedStatus int
+	}{
+		{"Admin account revokes a token of its tenant", func(t *testing.T) string { return userToken(t, 7, 1, "s1") }, "admin", `["read", "write"]`, true, http.StatusOK},
+		{"Member account cannot revoke another principal's token", func(t *testing.T) string { return userToken(t, 7, 1, "s1") }, "member", `["write"]`, false, http.StatusOK},
+		{"Token of another tenant", func(t *testing.T) string { return userToken(t, 8, 2, "s2") }, "admin", `["write"]`, false, http.StatusOK},
+		{"Read-only account cannot revoke", func(t *testing.T) string { return userToken(t, 7, 1, "s1") }, "admin", `["read"]`, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			token := tt.token(t)
+			expectGatewayAccount(mock, tt.callerRole, tt.callerScopes)
+			if tt.expectRevoke {
+				mock.ExpectExec("INSERT INTO token_blacklist \\(token, expiration\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT \\(token\\) DO NOTHING").
+					WithArgs(token, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE sessions SET revoked_at = NOW\\(\\) WHERE jti = \\$1 AND user_id = \\$2").
+					WithArgs("s1", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW\\(\\) WHERE family_id = \\$1").
+					WithArgs("s1").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req := oauthFormRequest("/oauth/revoke", token)
+			req.SetBasicAuth("sa_gateway", gatewaySecret)
+			rr := httptest.NewRecorder()
+			revokeToken(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestRevokeToken_OwnRefreshToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// The caller signs in with its own access token
+	stubSessionCookie(t, time.Now())
+	expectSessionCookie(mock)
+	mock.ExpectQuery("SELECT id, family_id, user_id, tenant_id, expires_at\\s+FROM refresh_tokens").
+		WithArgs(auth.HashToken("refresh-token")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "family_id", "user_id", "tenant_id", "expires_at"}).
+			AddRow(3, "family-1", 7, 1, time.Now().Add(time.Hour)))
+	mock.ExpectExec("UPDATE sessions SET revoked_at = NOW\\(\\) WHERE jti = \\$1 AND user_id = \\$2").
+		WithArgs("family-1", 7).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW\\(\\) WHERE family_id = \\$1").
+		WithArgs("family-1").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	req := oauthFormRequest("/oauth/revoke", "refresh-token")
+	req.Header.Set("Authorization", "Bearer session-token")
+	rr := httptest.NewRecorder()
+	revokeToken(rr, req, db)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+)
+
+// JWKSHandler publishes the public signing keys so other services can verify tokens offline
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	set, err := auth.PublicJWKS()
+	if err != nil {
+		log.Println("Error loading signing keys:", err)
+		http.Error(w, "Could not load signing keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set)
+}
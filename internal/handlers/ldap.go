@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/audit"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strings"
+)
+
+func GetLDAPConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	getLDAPConnection(w, r, db.DB)
+}
+
+func UpdateLDAPConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	updateLDAPConnection(w, r, db.DB)
+}
+
+func DeleteLDAPConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	deleteLDAPConnection(w, r, db.DB)
+}
+
+// loadLDAPConnection returns the directory of a tenant, or sql.ErrNoRows when it has none
+func loadLDAPConnection(dbInstance *sql.DB, tenantID int) (models.LDAPConnection, error) {
+	c := models.LDAPConnection{TenantID: tenantID}
+	var roles, teams []byte
+	err := dbInstance.QueryRow(`
+		SELECT url, start_tls, COALESCE(bind_dn, ''), COALESCE(bind_password, ''), base_dn, user_filter, name_attribute, group_attribute,
+			roles, teams, default_role, auto_provision, created_at, updated_at
+		FROM ldap_connections WHERE tenant_id = $1`, tenantID).
+		Scan(&c.URL, &c.StartTLS, &c.BindDN, &c.BindPassword, &c.BaseDN, &c.UserFilter, &c.NameAttribute, &c.GroupAttribute,
+			&roles, &teams, &c.DefaultRole, &c.AutoProvision, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return c, err
+	}
+	if len(roles) > 0 {
+		if err := json.Unmarshal(roles, &c.Roles); err != nil {
+			return c, err
+		}
+	}
+	if len(teams) > 0 {
+		err = json.Unmarshal(teams, &c.Teams)
+	}
+	return c, err
+}
+
+// localFallbackAllowed reports whether a user the directory does not return may sign in
+// with their Sentinel password instead. Only admins can, as break-glass accounts for when
+// the directory is misconfigured; anyone else removed from the directory is locked out.
+func localFallbackAllowed(user models.User) bool {
+	return user.Role == auth.RoleAdmin && user.Password != ""
+}
+
+// auditLocalFallback records a sign-in that bypassed the tenant's directory
+func auditLocalFallback(dbInstance *sql.DB, r *http.Request, user models.User) {
+	recordAudit(dbInstance, r, audit.Entry{TenantID: user.TenantID, ActorID: user.ID, Event: audit.EventLDAPFallback, Subject: user.Email})
+}
+
+// directoryUser finds or provisions the Sentinel user for a directory login, then applies
+// the role and teams the user's groups map to. It returns false on database errors.
+func directoryUser(dbInstance *sql.DB, r *http.Request, conn models.LDAPConnection, identity *auth.Identity, user *models.User, known bool) bool {
+	role := mappedRole(conn.Roles, identity.Groups)
+	if known {
+		if !syncMappedRole(dbInstance, r, user, role, audit.EventLDAPRoleSynced) {
+			return false
+		}
+	} else {
+		user.TenantID, user.Email, user.Name, user.Role = conn.TenantID, identity.Email, identity.Name, role
+		if user.Name == "" {
+			user.Name = identity.Email
+		}
+		if user.Role == "" {
+			user.Role = conn.DefaultRole
+		}
+		if err := provisionExternalUser(dbInstance, user, true); err != nil {
+			log.Println("Error provisioning directory user:", err)
+			return false
+		}
+		recordAudit(dbInstance, r, audit.Entry{TenantID: conn.TenantID, ActorID: user.ID, Event: audit.EventFederatedJIT,
+			Subject: user.Email, Details: map[string]interface{}{"protocol": "ldap"}})
+	}
+	addMappedTeams(dbInstance, *user, conn.Teams, identity.Groups)
+	return true
+}
+
+// getLDAPConnection returns the directory of the admin's tenant, without the service account password
+func getLDAPConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	conn, err := loadLDAPConnection(dbInstance, tenantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "LDAP is not configured for this tenant", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error loading LDAP connection:", err)
+		http.Error(w, "Error loading LDAP connection", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conn)
+}
+
+// updateLDAPConnection creates or replaces the directory of the admin's tenant. The
+// service account password is kept when the request leaves it out.
+func updateLDAPConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		models.LDAPConnection
+		BindPassword  *string `json:"bind_password"`
+		AutoProvision *bool   `json:"auto_provision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	conn := req.LDAPConnection
+	conn.TenantID = tenantID
+	conn.AutoProvision = req.AutoProvision == nil || *req.AutoProvision
+	if conn.UserFilter == "" {
+		conn.UserFilter = auth.DefaultLDAPUserFilter
+	}
+	if conn.NameAttribute == "" {
+		conn.NameAttribute = auth.DefaultLDAPNameAttribute
+	}
+	if conn.GroupAttribute == "" {
+		conn.GroupAttribute = auth.DefaultLDAPGroupAttribute
+	}
+	if conn.DefaultRole == "" {
+		conn.DefaultRole = "member"
+	}
+	if errs := validateLDAPConnection(conn); len(errs) > 0 {
+		writeFieldErrors(w, "Invalid LDAP connection", errs)
+		return
+	}
+
+	roles, err := json.Marshal(conn.Roles)
+	if err != nil {
+		http.Error(w, "Error updating LDAP connection", http.StatusInternalServerError)
+		return
+	}
+	teams, err := json.Marshal(conn.Teams)
+	if err != nil {
+		http.Error(w, "Error updating LDAP connection", http.StatusInternalServerError)
+		return
+	}
+	err = dbInstance.QueryRow(`
+		INSERT INTO ldap_connections (tenant_id, url, start_tls, bind_dn, bind_password, base_dn, user_filter, name_attribute, group_attribute,
+			roles, teams, default_role, auto_provision, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NOW(), NOW())
+		ON CONFLICT (tenant_id) DO UPDATE SET
+			url = EXCLUDED.url, start_tls = EXCLUDED.start_tls, bind_dn = EXCLUDED.bind_dn,
+			bind_password = COALESCE(EXCLUDED.bind_password, ldap_connections.bind_password),
+			base_dn = EXCLUDED.base_dn, user_filter = EXCLUDED.user_filter, name_attribute = EXCLUDED.name_attribute,
+			group_attribute = EXCLUDED.group_attribute, roles = EXCLUDED.roles, teams = EXCLUDED.teams,
+			default_role = EXCLUDED.default_role, auto_provision = EXCLUDED.auto_provision, updated_at = NOW()
+		RETURNING created_at, updated_at`,
+		tenantID, conn.URL, conn.StartTLS, conn.BindDN, req.BindPassword, conn.BaseDN, conn.UserFilter, conn.NameAttribute, conn.GroupAttribute,
+		roles, teams, conn.DefaultRole, conn.AutoProvision).
+		Scan(&conn.CreatedAt, &conn.UpdatedAt)
+	if err != nil {
+		log.Println("Error updating LDAP connection:", err)
+		http.Error(w, "Error updating LDAP connection", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conn)
+}
+
+// validateLDAPConnection rejects settings that cannot work
+func validateLDAPConnection(conn models.LDAPConnection) []models.FieldError {
+	errs := []models.FieldError{}
+	if !auth.ValidLDAPURL(conn.URL) {
+		errs = append(errs, models.FieldError{Field: "url", Code: "invalid", Message: "must be an ldap:// or ldaps:// URL"})
+	}
+	if conn.StartTLS && strings.HasPrefix(conn.URL, "ldaps://") {
+		errs = append(errs, models.FieldError{Field: "start_tls", Code: "invalid", Message: "only applies to ldap:// URLs"})
+	}
+	if strings.TrimSpace(conn.BaseDN) == "" {
+		errs = append(errs, models.FieldError{Field: "base_dn", Code: "required", Message: "is required"})
+	}
+	if !strings.Contains(conn.UserFilter, "{email}") || !strings.HasPrefix(conn.UserFilter, "(") {
+		errs = append(errs, models.FieldError{Field: "user_filter", Code: "invalid", Message: "must be a filter containing {email}"})
+	}
+	return errs
+}
+
+// deleteLDAPConnection turns directory logins off for the admin's tenant. Users it
+// provisioned keep their accounts and can set a password through the reset flow.
+func deleteLDAPConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	res, err := dbInstance.Exec(`DELETE FROM ldap_connections WHERE tenant_id = $1`, tenantID)
+	if err != nil {
+		log.Println("Error deleting LDAP connection:", err)
+		http.Error(w, "Error deleting LDAP connection", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "LDAP is not configured for this tenant", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "LDAP connection deleted successfully"})
+}
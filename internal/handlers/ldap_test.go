@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth/ldaptest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ldapColumns = []string{"url", "start_tls", "bind_dn", "bind_password", "base_dn", "user_filter", "name_attribute", "group_attribute",
+	"roles", "teams", "default_role", "auto_provision", "created_at", "updated_at"}
+
+const (
+	ldapServiceDN = "cn=sentinel,ou=services,dc=example,dc=com"
+	ldapAdminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+	ldapEngDN     = "cn=engineering,ou=groups,dc=example,dc=com"
+)
+
+func expectDirectory(mock sqlmock.Sqlmock, url string, autoProvision bool) {
+	roles, _ := json.Marshal(map[string]string{ldapAdminsDN: "admin"})
+	teams, _ := json.Marshal(map[string]string{ldapEngDN: "Engineering"})
+	mock.ExpectQuery("SELECT key, failures, last_failure_at, locked_until FROM login_attempts").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "failures", "last_failure_at", "locked_until"}))
+	mock.ExpectQuery("FROM ldap_connections WHERE tenant_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(ldapColumns).AddRow(url, false, ldapServiceDN, "service-secret", "ou=people,dc=example,dc=com",
+			"(mail={email})", "displayName", "memberOf", roles, teams, "member", autoProvision, time.Now(), time.Now()))
+}
+
+func TestLoginHandler_LDAP(t *testing.T) {
+	server := ldaptest.NewServer(
+		ldaptest.Entry{DN: ldapServiceDN, Password: "service-secret"},
+		ldaptest.Entry{DN: "cn=Jane Doe,ou=people,dc=example,dc=com", Password: "jane-secret", Attributes: map[string][]string{
+			"mail":        {"jane@example.com"},
+			"displayName": {"Jane Doe"},
+			"memberOf":    {ldapAdminsDN, ldapEngDN},
+		}},
+	)
+	defer server.Close()
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("local-secret"), bcrypt.MinCost)
+
+	expectSignedIn := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec("INSERT INTO user_teams").WithArgs(7, 1, "Engineering").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("SELECT settings FROM tenant_settings").WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+		expectNewSession(mock)
+	}
+
+	tests := []struct {
+		name           string
+		email          string
+		password       string
+		url            string
+		autoProvision  bool
+		mockSetup      func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Known user gets the mapped role", email: "jane@example.com", password: "jane-secret", autoProvision: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT u.id, u.name, u.password").
+					WillReturnRows(sqlmock.NewRows(loginColumns).AddRow(7, "Jane Doe", string(hashedPassword), 1, "member", 0, true, false))
+				mock.ExpectExec("DELETE FROM login_attempts").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("UPDATE users SET role = \\$1").WithArgs("admin", 7).
+					WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(1))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 7, "ldap_role_synced", "jane@example.com", "192.0.2.1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSignedIn(mock)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "New user is provisioned", email: "jane@example.com", password: "jane-secret", autoProvision: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT u.id, u.name, u.password").WillReturnRows(sqlmock.NewRows(loginColumns))
+				mock.ExpectExec("DELETE FROM login_attempts").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("INSERT INTO users").
+					WithArgs(1, "Jane Doe", "jane@example.com", sqlmock.AnyArg(), "admin", true).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "token_version"}).AddRow(7, 0))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 7, "federated_user_provisioned", "jane@example.com", "192.0.2.1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSignedIn(mock)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Address typed in another case", email: "Jane@Example.com", password: "jane-secret", autoProvision: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("WHERE LOWER\\(u.email\\)=LOWER\\(\\$1\\)").WithArgs("Jane@Example.com", 1).
+					WillReturnRows(sqlmock.NewRows(loginColumns))
+				mock.ExpectExec("DELETE FROM login_attempts").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("INSERT INTO users").
+					WithArgs(1, "Jane Doe", "jane@example.com", sqlmock.AnyArg(), "admin", true).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "token_version"}).AddRow(7, 0))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 7, "federated_user_provisioned", "jane@example.com", "192.0.2.1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSignedIn(mock)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "New user without auto-provisioning", email: "jane@example.com", password: "jane-secret",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT u.id, u.name, u.password").WillReturnRows(sqlmock.NewRows(loginColumns))
+				mock.ExpectExec("DELETE FROM login_attempts").WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "Wrong password", email: "jane@example.com", password: "wrong", autoProvision: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT u.id, u.name, u.password").WillReturnRows(sqlmock.NewRows(loginColumns))
+				expectLoginFailure(mock)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "Local account missing from the directory", email: "breakglass@example.com", password: "local-secret", autoProvision: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT u.id, u.name, u.password").
+					WillReturnRows(sqlmock.NewRows(loginColumns).AddRow(8, "Break Glass", string(hashedPassword), 1, "admin", 0, true, false))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(1, 8, "ldap_local_fallback", "breakglass@example.com", "192.0.2.1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("DELETE FROM login_attempts").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE users SET password").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT settings FROM tenant_settings").WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+				expectNewSession(mock)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Member missing from the directory", email: "former@example.com", password: "local-secret", autoProvision: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT u.id, u.name, u.password").
+					WillReturnRows(sqlmock.NewRows(loginColumns).AddRow(9, "Former Staff", string(hashedPassword), 1, "member", 0, true, false))
+				expectLoginFailure(mock)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "Directory unavailable", email: "jane@example.com", password: "jane-secret", url: "ldap://127.0.0.1:1", autoProvision: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT u.id, u.name, u.password").WillReturnRows(sqlmock.NewRows(loginColumns))
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			url := tt.url
+			if url == "" {
+				url = server.URL
+			}
+			expectDirectory(mock, url, tt.autoProvision)
+			tt.mockSetup(mock)
+
+			login := func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, db) }
+			rr, response := postJSON(t, login, map[string]interface{}{"email": tt.email, "password": tt.password, "tenant_id": 1})
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusOK && response["token"] == nil {
+				t.Errorf("expected a token, got %v", response)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateLDAPConnection(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           map[string]interface{}
+		expectedStatus int
+	}{
+		{"Valid connection", map[string]interface{}{"url": "ldaps://dc.example.com", "base_dn": "dc=example,dc=com"}, http.StatusOK},
+		{"Invalid URL", map[string]interface{}{"url": "http://dc.example.com", "base_dn": "dc=example,dc=com"}, http.StatusBadRequest},
+		{"Missing base DN", map[string]interface{}{"url": "ldap://dc.example.com"}, http.StatusBadRequest},
+		{"Filter without email", map[string]interface{}{"url": "ldap://dc.example.com", "base_dn": "dc=example,dc=com", "user_filter": "(uid=*)"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectedStatus == http.StatusOK {
+				// Leaving bind_password out keeps the stored one
+				mock.ExpectQuery("INSERT INTO ldap_connections").
+					WithArgs(4, "ldaps://dc.example.com", false, "", nil, "dc=example,dc=com", "(mail={email})", "displayName", "memberOf",
+						[]byte("null"), []byte("null"), "member", true).
+					WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at"}).AddRow(time.Now(), time.Now()))
+			}
+
+			raw, _ := json.Marshal(tt.body)
+			req := httptest.NewRequest(http.MethodPut, "/api/ldap", bytes.NewReader(raw)).WithContext(sessionContext(1, 4, "admin", "s1"))
+			rr := httptest.NewRecorder()
+			updateLDAPConnection(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetLDAPConnection_HidesBindPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("FROM ldap_connections WHERE tenant_id = \\$1").
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(ldapColumns).AddRow("ldaps://dc.example.com", false, ldapServiceDN, "service-secret", "dc=example,dc=com",
+			"(mail={email})", "displayName", "memberOf", []byte("{}"), []byte("{}"), "member", true, time.Now(), time.Now()))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/ldap", nil).WithContext(sessionContext(1, 4, "admin", "s1"))
+	rr := httptest.NewRecorder()
+	getLDAPConnection(rr, req, db)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if bytes.Contains(rr.Body.Bytes(), []byte("service-secret")) {
+		t.Errorf("the bind password must not be returned: %s", rr.Body.String())
+	}
+
+	mock.ExpectQuery("FROM ldap_connections").WillReturnError(errors.New("connection refused"))
+	rr = httptest.NewRecorder()
+	getLDAPConnection(rr, req, db)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", rr.Code)
+	}
+}
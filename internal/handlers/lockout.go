@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/audit"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"strconv"
+	"time"
+)
+
+// loginThrottled refuses the attempt while the account or the client IP is locked or backing off.
+// It writes the error response and returns true when the attempt must not go ahead.
+func loginThrottled(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB, tenantID int, email string) bool {
+	wait, err := auth.LoginRetryAfter(dbInstance, auth.AccountLockKey(tenantID, email), auth.IPLockKey(auth.ClientIP(r)))
+	if err != nil {
+		log.Println("Error checking login attempts:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+		return true
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second)/time.Second)+1))
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return true
+	}
+	return false
+}
+
+// recordFailedLogin counts a failed login against the account and the client IP,
+// and writes an audit entry when either gets locked
+func recordFailedLogin(r *http.Request, dbInstance *sql.DB, tenantID int, email string) {
+	ip := auth.ClientIP(r)
+	for _, target := range []struct {
+		key     string
+		policy  auth.LockoutPolicy
+		event   string
+		subject string
+	}{
+		{auth.AccountLockKey(tenantID, email), auth.AccountLockoutPolicy(), audit.EventAccountLocked, email},
+		{auth.IPLockKey(ip), auth.IPLockoutPolicy(), audit.EventIPLocked, ip},
+	} {
+		locked, err := auth.RecordLoginFailure(dbInstance, target.key, target.policy)
+		if err != nil {
+			log.Println("Error recording failed login:", err)
+			continue
+		}
+		if !locked {
+			continue
+		}
+		err = audit.Record(dbInstance, audit.Entry{
+			TenantID: tenantID,
+			Event:    target.event,
+			Subject:  target.subject,
+			IP:       ip,
+			Details: map[string]interface{}{
+				"failures": target.policy.Threshold,
+				"duration": target.policy.Duration.String(),
+			},
+		})
+		if err != nil {
+			log.Println("Error writing audit log:", err)
+		}
+	}
+}
+
+// clearFailedLogins forgets the failed logins of the account after a successful login.
+// Failures are only logged since the login itself succeeded.
+func clearFailedLogins(dbInstance *sql.DB, tenantID int, email string) {
+	if _, err := auth.ClearLoginFailures(dbInstance, auth.AccountLockKey(tenantID, email)); err != nil {
+		log.Println("Error clearing failed logins:", err)
+	}
+}
+
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	unlockUser(w, r, db.DB)
+}
+
+// unlockUser lets a tenant admin clear the failed logins and lockout of a user in the tenant
+func unlockUser(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, ok := tenantAdminTarget(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	var (
+		email    string
+		tenantID int
+	)
+	if err := dbInstance.QueryRow(`SELECT email, tenant_id FROM users WHERE id = $1`, userID).Scan(&email, &tenantID); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return
+	}
+
+	cleared, err := auth.ClearLoginFailures(dbInstance, auth.AccountLockKey(tenantID, email))
+	if err != nil {
+		log.Println("Error unlocking user:", err)
+		http.Error(w, "Error unlocking user", http.StatusInternalServerError)
+		return
+	}
+	if cleared {
+		adminID, _ := auth.GetUserID(r.Context())
+		err = audit.Record(dbInstance, audit.Entry{
+			TenantID: tenantID,
+			ActorID:  adminID,
+			Event:    audit.EventAccountUnlocked,
+			Subject:  email,
+			IP:       auth.ClientIP(r),
+		})
+		if err != nil {
+			log.Println("Error writing audit log:", err)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "User unlocked successfully"})
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestLoginHandler_LockedOut(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT key, failures, last_failure_at, locked_until FROM login_attempts").
+		WithArgs("account:1:locked@test.com", "ip:192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "failures", "last_failure_at", "locked_until"}).
+			AddRow("account:1:locked@test.com", 10, time.Now(), time.Now().Add(10*time.Minute)))
+
+	body, _ := json.Marshal(map[string]interface{}{"email": "locked@test.com", "password": "password123", "tenant_id": 1})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body)), db)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rr.Code)
+	}
+	if secs, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || secs < 590 || secs > 601 {
+		t.Errorf("expected Retry-After of about 600 seconds, got %q", rr.Header().Get("Retry-After"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestLoginHandler_FailureLocksAccount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectLoginAllowed(mock)
+	mock.ExpectQuery("SELECT u.id, u.name, u.password").WillReturnRows(sqlmock.NewRows(loginColumns))
+	mock.ExpectQuery("INSERT INTO login_attempts").
+		WithArgs("account:1:ghost@test.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(10))
+	mock.ExpectExec("UPDATE login_attempts SET locked_until").
+		WithArgs(sqlmock.AnyArg(), "account:1:ghost@test.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(1, nil, "account_locked", "ghost@test.com", "192.0.2.1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("INSERT INTO login_attempts").
+		WithArgs("ip:192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(10))
+
+	body, _ := json.Marshal(map[string]interface{}{"email": "ghost@test.com", "password": "guess", "tenant_id": 1})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body)), db)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	tests := []struct {
+		name           string
+		role           string
+		cleared        int64
+		expectedStatus int
+	}{
+		{"Admin unlocks a locked user", "admin", 1, http.StatusOK},
+		{"Admin unlocks a user without failures", "admin", 0, http.StatusOK},
+		{"Member cannot unlock", "member", 0, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectQuery("SELECT tenant_id FROM users WHERE id = \\$1").
+					WithArgs(9).
+					WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT email, tenant_id FROM users WHERE id = \\$1").
+					WithArgs(9).
+					WillReturnRows(sqlmock.NewRows([]string{"email", "tenant_id"}).AddRow("Locked@Test.com", 1))
+				mock.ExpectExec("DELETE FROM login_attempts WHERE key = \\$1").
+					WithArgs("account:1:locked@test.com").
+					WillReturnResult(sqlmock.NewResult(0, tt.cleared))
+				if tt.cleared > 0 {
+					mock.ExpectExec("INSERT INTO audit_log").
+						WithArgs(1, 1, "account_unlocked", "Locked@Test.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/9/unlock", nil)
+			req = mux.SetURLVars(req.WithContext(sessionContext(1, 1, tt.role, "s1")), map[string]string{"id": "9"})
+			rr := httptest.NewRecorder()
+
+			unlockUser(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoginMFA_LockedOut(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// Wrong codes locked the account: no code is checked until the lock ends
+	mfaToken, _, err := auth.SignPurposeToken(auth.PurposeMFAChallenge, 8, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to sign challenge: %v", err)
+	}
+	mock.ExpectQuery("SELECT name, email, role, token_version FROM users WHERE id = \\$1 AND tenant_id = \\$2").
+		WithArgs(8, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "role", "token_version"}).AddRow("Locked", "locked@test.com", "member", 0))
+	mock.ExpectQuery("SELECT key, failures, last_failure_at, locked_until FROM login_attempts").
+		WithArgs("account:1:locked@test.com", "ip:192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "failures", "last_failure_at", "locked_until"}).
+			AddRow("account:1:locked@test.com", 10, time.Now(), time.Now().Add(10*time.Minute)))
+
+	rr, _ := postJSON(t, func(w http.ResponseWriter, r *http.Request) { loginMFA(w, r, db) },
+		map[string]string{"mfa_token": mfaToken, "recovery_code": "abcde-fghij"})
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestRegenerateRecoveryCodes_WrongCodeCounts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT email, tenant_id FROM users WHERE id = \\$1").
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "tenant_id"}).AddRow("user9@test.com", 1))
+	expectNotLockedOut(mock)
+	mock.ExpectExec("UPDATE mfa_recovery_codes SET used_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectLoginFailure(mock)
+
+	body, _ := json.Marshal(map[string]string{"recovery_code": "abcde-fghij"})
+	req := httptest.NewRequest(http.MethodPost, "/api/mfa/recovery-codes", bytes.NewReader(body)).WithContext(sessionContext(9, 1, "member", "s1"))
+	rr := httptest.NewRecorder()
+	regenerateRecoveryCodes(rr, req, db)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
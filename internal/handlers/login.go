@@ -5,19 +5,22 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"sentinel/internal/auth"
 	"sentinel/internal/models"
-	"time"
-
-	"golang.org/x/crypto/bcrypt"
+	"sentinel/internal/password"
 )
 
 // LoginHandler verifies the user's credentials and returns a JWT with tenant support
+// along with a refresh token that can be exchanged at /token/refresh
+// Users with MFA get a challenge token instead, to be completed at /login/mfa
+// Users whose password expired get a token for /login/password instead
 // It also sets the JWT token in a cookie for the client
 // The function expects the request body to contain email, password, and tenant_id
-// The function also checks if the user exists in the database and if the password matches
+// The function also checks if the user exists in the database and if the password matches,
+// or for tenants with an LDAP directory, binds as the user and applies their mapped groups
 // If the user is valid, it generates a JWT token and sets it in a cookie
 // If the user is invalid, it returns an error response
 func LoginHandler(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
@@ -28,6 +31,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 		TenantID int    `json:"tenant_id"`
+		Device   string `json:"device,omitempty"` // Optional label shown in the session list
 	}
 
 	// Decode request body to get email, password, and tenant_id
@@ -37,43 +41,151 @@ func LoginHandler(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
 		return
 	}
 
-	// Fetch the user and tenant ID from the database
+	// Refuse attempts while the account or IP is locked out or backing off
+	if loginThrottled(w, r, dbInstance, loginRequest.TenantID, loginRequest.Email) {
+		return
+	}
+
+	// Tenants with a directory check passwords against it instead
+	directory, err := loadLDAPConnection(dbInstance, loginRequest.TenantID)
+	viaDirectory := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error loading LDAP connection:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the user and tenant ID from the database. Directory searches ignore case, so
+	// directory users are matched the same way.
+	emailMatch := "u.email=$1"
+	if viaDirectory {
+		emailMatch = "LOWER(u.email)=LOWER($1)"
+	}
+	var emailConfirmed, mfaEnabled bool
 	err = dbInstance.QueryRow(`
-		SELECT u.id, u.name, u.password, u.tenant_id , u.role
+		SELECT u.id, u.name, u.password, u.tenant_id , u.role, u.token_version, COALESCE(u.email_confirmed, FALSE), t.enabled_at IS NOT NULL
 		FROM users u 
-		WHERE u.email=$1 AND u.tenant_id=$2`, loginRequest.Email, loginRequest.TenantID).Scan(&dbUser.ID, &dbUser.Name, &dbUser.Password, &dbUser.TenantID, &dbUser.Role)
+		LEFT JOIN user_totp t ON t.user_id = u.id
+		WHERE `+emailMatch+` AND u.tenant_id=$2`, loginRequest.Email, loginRequest.TenantID).Scan(&dbUser.ID, &dbUser.Name, &dbUser.Password, &dbUser.TenantID, &dbUser.Role, &dbUser.TokenVersion, &emailConfirmed, &mfaEnabled)
+	dbUser.Email = loginRequest.Email
+	known := err == nil
 
-	if err != nil {
+	// Directory users may not have logged in before
+	if err != nil && !(err == sql.ErrNoRows && viaDirectory) {
+		recordFailedLogin(r, dbInstance, loginRequest.TenantID, loginRequest.Email)
 		http.Error(w, "Invalid username, password, or tenant", http.StatusUnauthorized)
 		return
 	}
 
-	// Compare provided password with the hashed password in the database
-	err = bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(loginRequest.Password))
+	var authenticator auth.Authenticator = auth.PasswordAuthenticator{Hash: dbUser.Password}
+	if viaDirectory {
+		authenticator = auth.LDAPAuthenticator{Conn: directory}
+	}
+	identity, err := authenticator.Authenticate(r.Context(), loginRequest.Email, loginRequest.Password)
+	// Break-glass admins missing from the directory keep their password
+	fellBack := false
+	if viaDirectory && known && err == auth.ErrUnknownUser && localFallbackAllowed(dbUser) {
+		viaDirectory, fellBack = false, true
+		identity, err = auth.PasswordAuthenticator{Hash: dbUser.Password}.Authenticate(r.Context(), loginRequest.Email, loginRequest.Password)
+	}
+	if errors.Is(err, auth.ErrDirectoryUnavailable) {
+		// Not the user's fault, so it does not count towards a lockout
+		log.Println("Error authenticating against LDAP:", err)
+		http.Error(w, "Directory unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
+		if err != auth.ErrInvalidCredentials && err != auth.ErrUnknownUser {
+			log.Println("Error verifying password:", err)
+		}
+		recordFailedLogin(r, dbInstance, loginRequest.TenantID, loginRequest.Email)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
+	if fellBack {
+		auditLocalFallback(dbInstance, r, dbUser)
+	}
+	// With MFA the failures are cleared once the second factor passes at /login/mfa, or
+	// fetching a new challenge would reset the count of wrong codes
+	if !mfaEnabled {
+		clearFailedLogins(dbInstance, loginRequest.TenantID, loginRequest.Email)
+	}
+
+	if viaDirectory {
+		if !known && !directory.AutoProvision {
+			http.Error(w, "Invalid username, password, or tenant", http.StatusUnauthorized)
+			return
+		}
+		dbUser.Email = identity.Email
+		if !directoryUser(dbInstance, r, directory, identity, &dbUser, known) {
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+		// The directory vouches for the addresses of the users it provisions
+		emailConfirmed = emailConfirmed || !known
+	} else if identity.NeedsRehash {
+		// Hashes made with an older algorithm or cost are upgraded while the password is at hand
+		rehashPassword(dbInstance, dbUser, loginRequest.Password)
+	}
 
-	// Create JWT token with email and tenant_id
-	tokenString, err := auth.GenerateJWT(loginRequest.Email, loginRequest.TenantID, dbUser.Role)
+	settings, err := loadTenantSettings(dbInstance, dbUser.TenantID)
 	if err != nil {
-		log.Println("Error generating JWT token:", err)
-		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		log.Println("Error loading tenant settings:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
 		return
 	}
 
-	// Set token expiration time (24 hours)
-	expirationTime := time.Now().Add(24 * time.Hour)
+	// Tenants can refuse logins until the email address is confirmed
+	if !emailConfirmed && settings.RequireEmailConfirmation {
+		http.Error(w, "Email address not confirmed", http.StatusForbidden)
+		return
+	}
 
-	// Set JWT token in the response as a cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "token",
-		Value:   tokenString,
-		Expires: expirationTime,
-	})
+	// Passwords past the tenant's maximum age must be changed at /login/password first.
+	// Directory passwords expire in the directory.
+	if maxAge := settings.PasswordPolicy.MaxAgeDays; maxAge > 0 && !viaDirectory {
+		expired, err := passwordExpired(dbInstance, dbUser.ID, maxAge)
+		if err != nil {
+			log.Println("Error checking password age:", err)
+			http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+			return
+		}
+		if expired {
+			writePasswordChangeChallenge(w, dbUser)
+			return
+		}
+	}
 
-	// Return token in JSON response
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	// With MFA the password only earns a challenge token for /login/mfa
+	if mfaEnabled {
+		writeMFAChallenge(w, dbUser, auth.PurposeMFAChallenge)
+		return
+	}
+	if settings.RequireMFA {
+		writeMFAChallenge(w, dbUser, auth.PurposeMFAEnrollment)
+		return
+	}
+
+	tokenString, refreshToken, ok := startSession(w, r, dbInstance, dbUser, loginRequest.Device, auth.Authenticated(auth.AMRPassword))
+	if !ok {
+		return
+	}
+
+	// Set the access token cookie and return both tokens
+	writeTokens(w, tokenString, refreshToken)
+}
+
+// rehashPassword replaces the user's stored hash with one from the current hasher.
+// It only applies if the hash did not change in the meantime, and failures are only logged
+// since the login itself succeeded.
+func rehashPassword(dbInstance *sql.DB, user models.User, pw string) {
+	hash, err := password.Hash(pw)
+	if err != nil {
+		log.Println("Error rehashing password:", err)
+		return
+	}
+	_, err = dbInstance.Exec(`UPDATE users SET password = $1 WHERE id = $2 AND password = $3`, hash, user.ID, user.Password)
+	if err != nil {
+		log.Println("Error storing rehashed password:", err)
+	}
 }
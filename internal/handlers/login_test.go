@@ -2,17 +2,68 @@ package handlers
 
 import (
 	"bytes"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"sentinel/internal/password"
+
 	"github.com/DATA-DOG/go-sqlmock"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// expectLoginAllowed expects the lockout check of a login attempt to find no earlier failures,
+// and the tenant to check passwords itself rather than against a directory
+func expectLoginAllowed(mock sqlmock.Sqlmock) {
+	expectNotLockedOut(mock)
+	mock.ExpectQuery("FROM ldap_connections WHERE tenant_id = \\$1").WillReturnRows(sqlmock.NewRows(ldapColumns))
+}
+
+// expectNotLockedOut expects the lockout check of an attempt to find no earlier failures
+func expectNotLockedOut(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT key, failures, last_failure_at, locked_until FROM login_attempts WHERE key IN \\(\\$1, \\$2\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "failures", "last_failure_at", "locked_until"}))
+}
+
+// expectLoginFailure expects a failed login to be counted against the account and the IP
+func expectLoginFailure(mock sqlmock.Sqlmock) {
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("INSERT INTO login_attempts").WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	}
+}
+
+// expectLoginSuccess expects a correct password to clear the account's failures, and the
+// bcrypt hash of the test user to be upgraded to the default Argon2id hasher
+func expectLoginSuccess(mock sqlmock.Sqlmock) {
+	expectFailuresCleared(mock)
+	expectRehash(mock)
+}
+
+// expectFailuresCleared expects a successful login to clear the account's failures
+func expectFailuresCleared(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("DELETE FROM login_attempts WHERE key = \\$1").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// expectRehash expects the bcrypt hash of the test user to be upgraded to Argon2id
+func expectRehash(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("UPDATE users SET password = \\$1 WHERE id = \\$2 AND password = \\$3").
+		WithArgs(argon2idHash{}, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// argon2idHash matches an Argon2id PHC string argument
+type argon2idHash struct{}
+
+func (argon2idHash) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, "$argon2id$v=19$")
+}
+
 func TestLoginHandler(t *testing.T) {
 	// Mock database and dependencies
 	db, mock, err := sqlmock.New()
@@ -86,26 +137,46 @@ func TestLoginHandler(t *testing.T) {
 			// Set up mock expectations
 			if tt.name == "Valid login" {
 				hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
-				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role FROM users u WHERE u.email=\\$1 AND u.tenant_id=\\$2").
+				expectLoginAllowed(mock)
+				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role, u.token_version, COALESCE\\(u.email_confirmed, FALSE\\), t.enabled_at IS NOT NULL FROM users u LEFT JOIN user_totp t ON t.user_id = u.id WHERE u.email=\\$1 AND u.tenant_id=\\$2").
 					WithArgs("valid@test.com", 1).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password", "tenant_id", "role"}).
-						AddRow(1, "Test User", string(hashedPassword), 1, "user"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password", "tenant_id", "role", "token_version", "email_confirmed", "mfa_enabled"}).
+						AddRow(1, "Test User", string(hashedPassword), 1, "user", 0, true, false))
+				expectLoginSuccess(mock)
+				mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+				mock.ExpectExec("INSERT INTO sessions").
+					WithArgs(sqlmock.AnyArg(), 1, 1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), []byte(`["pwd"]`)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO refresh_tokens").
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 1, 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
 			} else if tt.name == "Invalid password" {
 				hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
-				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role FROM users u WHERE u.email=\\$1 AND u.tenant_id=\\$2").
+				expectLoginAllowed(mock)
+				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role, u.token_version, COALESCE\\(u.email_confirmed, FALSE\\), t.enabled_at IS NOT NULL FROM users u LEFT JOIN user_totp t ON t.user_id = u.id WHERE u.email=\\$1 AND u.tenant_id=\\$2").
 					WithArgs("valid@test.com", 1).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password", "tenant_id", "role"}).
-						AddRow(1, "Test User", string(hashedPassword), 1, "user"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password", "tenant_id", "role", "token_version", "email_confirmed", "mfa_enabled"}).
+						AddRow(1, "Test User", string(hashedPassword), 1, "user", 0, true, false))
+				expectLoginFailure(mock)
 			} else if tt.name == "Invalid tenant" {
-				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role FROM users u WHERE u.email=\\$1 AND u.tenant_id=\\$2").
+				expectLoginAllowed(mock)
+				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role, u.token_version, COALESCE\\(u.email_confirmed, FALSE\\), t.enabled_at IS NOT NULL FROM users u LEFT JOIN user_totp t ON t.user_id = u.id WHERE u.email=\\$1 AND u.tenant_id=\\$2").
 					WithArgs("valid@test.com", 2).
 					WillReturnError(errors.New("no rows found"))
+				expectLoginFailure(mock)
 			} else if tt.name == "Error generating token" {
 				hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
-				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role FROM users u WHERE u.email=\\$1 AND u.tenant_id=\\$2").
+				expectLoginAllowed(mock)
+				mock.ExpectQuery("SELECT u.id, u.name, u.password, u.tenant_id , u.role, u.token_version, COALESCE\\(u.email_confirmed, FALSE\\), t.enabled_at IS NOT NULL FROM users u LEFT JOIN user_totp t ON t.user_id = u.id WHERE u.email=\\$1 AND u.tenant_id=\\$2").
 					WithArgs("error@test.com", 1).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password", "tenant_id", "role"}).
-						AddRow(1, "Test User", string(hashedPassword), 1, "user"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password", "tenant_id", "role", "token_version", "email_confirmed", "mfa_enabled"}).
+						AddRow(1, "Test User", string(hashedPassword), 1, "user", 0, true, false))
+				expectLoginSuccess(mock)
+				mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"settings"}))
 			} else if tt.name == "Invalid request body" {
 				// No database interaction expected
 			}
@@ -125,8 +196,43 @@ func TestLoginHandler(t *testing.T) {
 					t.Fatalf("failed to decode response: %v", err)
 				}
 				log.Printf("Response: %v", response["token"])
+				if response["refresh_token"] == "" {
+					t.Error("expected a refresh token in the response")
+				}
 
 			}
 		})
 	}
 }
+
+func TestLoginHandler_CurrentHashNotRehashed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	hash, err := password.Hash("password123")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	expectLoginAllowed(mock)
+	mock.ExpectQuery("SELECT u.id, u.name, u.password").
+		WillReturnRows(sqlmock.NewRows(loginColumns).AddRow(1, "Test User", hash, 1, "user", 0, true, false))
+	mock.ExpectExec("DELETE FROM login_attempts WHERE key = \\$1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+	mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	body, _ := json.Marshal(map[string]interface{}{"email": "valid@test.com", "password": "password123", "tenant_id": 1})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body)), db)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -1,12 +1,14 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
+	"sentinel/internal/auth"
 	"sentinel/internal/db"
 	"strings"
 )
 
-// LogoutHandler handles user logout and adds token to blacklist
+// LogoutHandler handles user logout: it revokes the token and clears the token cookie
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the JWT token from the Authorization header
 	token := r.Header.Get("Authorization")
@@ -16,21 +18,20 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save the token to the blacklist (db or cache)
-	_, err := db.DB.Exec("INSERT INTO token_blacklist (token) VALUES ($1)", strings.TrimPrefix(token, "Bearer "))
-	if err != nil {
-		http.Error(w, "Error logging out", http.StatusInternalServerError)
-		return
+	// Blacklist the token and end its session, as /oauth/revoke does
+	tokenStr := strings.TrimPrefix(token, "Bearer ")
+	if claims, err := auth.ParseAccessToken(tokenStr); err == nil {
+		if err := auth.RevokeAccessToken(db.DB, tokenStr, claims); err != nil {
+			log.Println("Error revoking token on logout:", err)
+			http.Error(w, "Error logging out", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	// Optionally, clear any cookies (if you use them)
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-	})
+	cookie := tokenCookie("")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Logged out successfully"))
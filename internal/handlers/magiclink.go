@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/mail"
+	"sentinel/internal/models"
+	"strings"
+	"time"
+)
+
+// Login link requests are limited per account and per client IP
+var (
+	magicLinkEmailLimiter = auth.NewKeyedLimiter(20*time.Minute, 3)
+	magicLinkIPLimiter    = auth.NewKeyedLimiter(time.Minute, 10)
+)
+
+// magicLinkTTL is how long a login link stays valid, MAGIC_LINK_TTL or 15 minutes
+func magicLinkTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("MAGIC_LINK_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+func RequestMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	requestMagicLink(w, r, db.DB)
+}
+
+func RedeemMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	redeemMagicLink(w, r, db.DB)
+}
+
+// magicLinkSettings loads the settings of a tenant that allows passwordless login. It
+// writes the error response when the tenant does not, or when they cannot be loaded.
+func magicLinkSettings(w http.ResponseWriter, dbInstance *sql.DB, tenantID int) (models.TenantSettings, bool) {
+	settings, err := loadTenantSettings(dbInstance, tenantID)
+	if err != nil {
+		log.Println("Error loading tenant settings:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+		return settings, false
+	}
+	if !settings.MagicLinkLogin {
+		http.Error(w, "Magic link login is not enabled for this tenant", http.StatusForbidden)
+		return settings, false
+	}
+	return settings, true
+}
+
+// requestMagicLink emails a single-use login link to a user of a tenant that allows
+// passwordless login. The response is the same whether or not the account exists so
+// the endpoint cannot be used to enumerate users.
+func requestMagicLink(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		Email    string `json:"email"`
+		TenantID int    `json:"tenant_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !magicLinkIPLimiter.Allow(auth.ClientIP(r)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+	if _, ok := magicLinkSettings(w, dbInstance, req.TenantID); !ok {
+		return
+	}
+
+	accepted := func() {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a login link has been sent"})
+	}
+
+	if !magicLinkEmailLimiter.Allow(strings.ToLower(strings.TrimSpace(req.Email))) {
+		log.Println("Magic link rate limit reached for an account")
+		accepted()
+		return
+	}
+
+	var (
+		userID int
+		name   string
+	)
+	err := dbInstance.QueryRow(`SELECT id, name FROM users WHERE email = $1 AND tenant_id = $2`, req.Email, req.TenantID).Scan(&userID, &name)
+	if err == sql.ErrNoRows {
+		accepted()
+		return
+	}
+	if err != nil {
+		log.Println("Error fetching user for magic link:", err)
+		http.Error(w, "Error sending login link", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the hash of the link's jti is stored, so requesting a new link invalidates the previous one
+	ttl := magicLinkTTL()
+	token, jti, err := auth.SignPurposeToken(auth.PurposeMagicLink, userID, req.TenantID, ttl)
+	if err != nil {
+		log.Println("Error signing magic link:", err)
+		http.Error(w, "Error sending login link", http.StatusInternalServerError)
+		return
+	}
+	if _, err := dbInstance.Exec(`UPDATE users SET magic_link_token = $1 WHERE id = $2`, auth.HashToken(jti), userID); err != nil {
+		log.Println("Error storing magic link:", err)
+		http.Error(w, "Error sending login link", http.StatusInternalServerError)
+		return
+	}
+
+	link := publicURL("/login/magic", url.Values{"token": {token}})
+	err = mail.Send(mail.Message{
+		To:      req.Email,
+		Subject: "Your Sentinel login link",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to sign in. It expires in %s and works once.\n\n%s\n\nIf you did not ask for this, you can ignore this email.\n",
+			name, ttl, link),
+	})
+	if err != nil {
+		log.Println("Error sending magic link email:", err)
+	}
+	accepted()
+}
+
+// consumeMagicLink marks the link of the claims as used and returns its user. The stored
+// hash only matches the latest link, and is cleared once used; other links give
+// sql.ErrNoRows.
+func consumeMagicLink(dbInstance *sql.DB, claims *auth.Claims) (models.User, error) {
+	user := models.User{ID: claims.UserID, TenantID: claims.TenantID}
+	err := dbInstance.QueryRow(`
+		UPDATE users SET magic_link_token = NULL, email_confirmed = TRUE, updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 AND magic_link_token = $3
+		RETURNING name, email, role, token_version`,
+		claims.UserID, claims.TenantID, auth.HashToken(claims.Id)).
+		Scan(&user.Name, &user.Email, &user.Role, &user.TokenVersion)
+	return user, err
+}
+
+// redeemMagicLink signs the user in with the token from a login link and answers like
+// LoginHandler: tokens and the token cookie, or an MFA challenge for users with MFA and
+// tenants requiring it. The link proves the user owns the address, so it also confirms it.
+func redeemMagicLink(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		Token  string `json:"token"`
+		Device string `json:"device,omitempty"` // Optional label shown in the session list
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !magicLinkIPLimiter.Allow(auth.ClientIP(r)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+
+	claims, err := auth.ParsePurposeToken(req.Token, auth.PurposeMagicLink)
+	if err != nil {
+		http.Error(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	// Links sent before the tenant turned magic links off stop working
+	settings, ok := magicLinkSettings(w, dbInstance, claims.TenantID)
+	if !ok {
+		return
+	}
+
+	user, err := consumeMagicLink(dbInstance, claims)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Error redeeming magic link:", err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	// The link replaces the password, not the second factor
+	var mfaEnabled bool
+	err = dbInstance.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)`, user.ID).Scan(&mfaEnabled)
+	if err != nil {
+		log.Println("Error checking MFA status:", err)
+		http.Error(w, "Could not verify account status", http.StatusInternalServerError)
+		return
+	}
+	if mfaEnabled {
+		writeMFAChallenge(w, user, auth.PurposeMFAChallenge)
+		return
+	}
+	if settings.RequireMFA {
+		writeMFAChallenge(w, user, auth.PurposeMFAEnrollment)
+		return
+	}
+
+	tokenString, refreshToken, ok := startSession(w, r, dbInstance, user, req.Device, auth.Authenticated(auth.AMREmail))
+	if !ok {
+		return
+	}
+	writeTokens(w, tokenString, refreshToken)
+}
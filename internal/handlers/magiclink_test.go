@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectMagicLinkSettings(mock sqlmock.Sqlmock, enabled bool) {
+	settings := `{"magic_link_login": false}`
+	if enabled {
+		settings = `{"magic_link_login": true}`
+	}
+	mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow([]byte(settings)))
+}
+
+func TestRequestMagicLink(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	sender := useRecordingSender(t)
+
+	expectMagicLinkSettings(mock, true)
+	mock.ExpectQuery("SELECT id, name FROM users WHERE email = \\$1 AND tenant_id = \\$2").
+		WithArgs("known@test.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(7, "Known User"))
+	mock.ExpectExec("UPDATE users SET magic_link_token = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectMagicLinkSettings(mock, true)
+	mock.ExpectQuery("SELECT id, name FROM users WHERE email = \\$1 AND tenant_id = \\$2").
+		WithArgs("unknown@test.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+
+	var bodies []string
+	for _, email := range []string{"known@test.com", "unknown@test.com"} {
+		body, _ := json.Marshal(map[string]interface{}{"email": email, "tenant_id": 1})
+		rr := httptest.NewRecorder()
+		requestMagicLink(rr, httptest.NewRequest(http.MethodPost, "/login/magic", bytes.NewReader(body)), db)
+
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("expected status 202 for %s, got %d", email, rr.Code)
+		}
+		bodies = append(bodies, rr.Body.String())
+	}
+
+	if bodies[0] != bodies[1] {
+		t.Errorf("responses must not reveal whether the account exists: %q vs %q", bodies[0], bodies[1])
+	}
+	if len(sender.messages) != 1 || sender.messages[0].To != "known@test.com" {
+		t.Fatalf("expected one login email to the known user, got %+v", sender.messages)
+	}
+	claims, err := auth.ParsePurposeToken(linkToken(t, sender.messages[0].Body), auth.PurposeMagicLink)
+	if err != nil || claims.UserID != 7 || claims.TenantID != 1 {
+		t.Errorf("expected a magic link token for user 7, got %+v (%v)", claims, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestRequestMagicLink_Disabled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	sender := useRecordingSender(t)
+
+	expectMagicLinkSettings(mock, false)
+
+	body, _ := json.Marshal(map[string]interface{}{"email": "known@test.com", "tenant_id": 1})
+	rr := httptest.NewRecorder()
+	requestMagicLink(rr, httptest.NewRequest(http.MethodPost, "/login/magic", bytes.NewReader(body)), db)
+
+	if rr.Code != http.StatusForbidden || len(sender.messages) != 0 {
+		t.Errorf("expected status 403 and no email, got %d and %d emails", rr.Code, len(sender.messages))
+	}
+}
+
+func TestRedeemMagicLink(t *testing.T) {
+	link, jti, err := auth.SignPurposeToken(auth.PurposeMagicLink, 7, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to sign link: %v", err)
+	}
+	other, _, _ := auth.SignPurposeToken(auth.PurposeEmailConfirmation, 7, 1, time.Minute)
+
+	tests := []struct {
+		name           string
+		token          string
+		enabled        bool
+		redeemed       bool // Whether the stored hash still matches
+		mfaEnabled     bool
+		expectedStatus int
+		expectSession  bool
+	}{
+		{"Signs in", link, true, true, false, http.StatusOK, true},
+		{"MFA still required", link, true, true, true, http.StatusOK, false},
+		{"Link already used", link, true, false, false, http.StatusBadRequest, false},
+		{"Tenant turned magic links off", link, false, false, false, http.StatusForbidden, false},
+		{"Token for another purpose", other, true, false, false, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.token == link {
+				expectMagicLinkSettings(mock, tt.enabled)
+			}
+			if tt.token == link && tt.enabled {
+				rows := sqlmock.NewRows([]string{"name", "email", "role", "token_version"})
+				if tt.redeemed {
+					rows.AddRow("Known User", "known@test.com", "member", 0)
+				}
+				mock.ExpectQuery("UPDATE users SET magic_link_token = NULL, email_confirmed = TRUE").
+					WithArgs(7, 1, auth.HashToken(jti)).WillReturnRows(rows)
+			}
+			if tt.redeemed {
+				mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM user_totp WHERE user_id = \\$1 AND enabled_at IS NOT NULL\\)").
+					WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.mfaEnabled))
+			}
+			if tt.expectSession {
+				mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			body, _ := json.Marshal(map[string]string{"token": tt.token})
+			rr := httptest.NewRecorder()
+			redeemMagicLink(rr, httptest.NewRequest(http.MethodPost, "/login/magic/redeem", bytes.NewReader(body)), db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			var response map[string]interface{}
+			json.Unmarshal(rr.Body.Bytes(), &response)
+			if tt.expectSession && (response["token"] == nil || response["refresh_token"] == nil || len(rr.Result().Cookies()) == 0) {
+				t.Errorf("expected tokens and the token cookie, got %s", rr.Body.String())
+			}
+			if tt.mfaEnabled && response["mfa_required"] != true {
+				t.Errorf("expected an MFA challenge, got %s", rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,532 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// mfaChallengeTTL is how long the user has to enter the second factor after the password
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// Second factor attempts are limited per user, so a challenge token cannot be used to brute force codes
+var mfaAttemptLimiter = auth.NewKeyedLimiter(12*time.Second, 5)
+
+var errMFAAlreadyEnabled = errors.New("MFA is already enabled")
+
+// mfaIssuer names the account in authenticator apps, MFA_ISSUER or "Sentinel"
+func mfaIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Sentinel"
+}
+
+// writeMFAChallenge answers a correct password with a challenge token instead of a session
+func writeMFAChallenge(w http.ResponseWriter, user models.User, purpose string) {
+	writeMFAChallengeWith(w, user, purpose, nil)
+}
+
+// writeMFAChallengeWith is writeMFAChallenge with extra fields in the JSON body
+func writeMFAChallengeWith(w http.ResponseWriter, user models.User, purpose string, extra map[string]interface{}) {
+	token, _, err := auth.SignPurposeToken(purpose, user.ID, user.TenantID, mfaChallengeTTL)
+	if err != nil {
+		log.Println("Error generating MFA challenge:", err)
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+
+	body := map[string]interface{}{"mfa_token": token}
+	if purpose == auth.PurposeMFAEnrollment {
+		body["mfa_enrollment_required"] = true
+	} else {
+		body["mfa_required"] = true
+		body["methods"] = []string{"totp", "recovery_code"}
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// enrollTOTP stores a new pending TOTP secret for the user, replacing any earlier pending one
+func enrollTOTP(dbInstance *sql.DB, userID int, email string) (string, string, error) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	res, err := dbInstance.Exec(`
+		INSERT INTO user_totp (user_id, secret, last_used_step, created_at)
+		VALUES ($1, $2, 0, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+		WHERE user_totp.enabled_at IS NULL`, userID, secret)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", "", err
+	} else if n == 0 {
+		return "", "", errMFAAlreadyEnabled
+	}
+	return secret, auth.TOTPProvisioningURI(mfaIssuer(), email, secret), nil
+}
+
+// checkTOTP verifies a code against the user's enabled (or pending) secret.
+// A code is accepted once: the matched time step is recorded and older steps are refused.
+func checkTOTP(dbInstance *sql.DB, userID int, code string, enabled bool) (bool, error) {
+	var (
+		secret   string
+		lastStep int64
+	)
+	err := dbInstance.QueryRow(`SELECT secret, last_used_step FROM user_totp WHERE user_id = $1 AND (enabled_at IS NOT NULL) = $2`,
+		userID, enabled).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+	res, err := dbInstance.Exec(`UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes
+func useRecoveryCode(dbInstance *sql.DB, userID int, code string) (bool, error) {
+	res, err := dbInstance.Exec(`UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, auth.HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// verifySecondFactor checks a TOTP code or, failing that, a recovery code
+func verifySecondFactor(dbInstance *sql.DB, userID int, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		return checkTOTP(dbInstance, userID, code, true)
+	}
+	if recoveryCode != "" {
+		return useRecoveryCode(dbInstance, userID, recoveryCode)
+	}
+	return false, nil
+}
+
+// activateTOTP turns the pending secret on and returns a fresh set of recovery codes
+func activateTOTP(dbInstance *sql.DB, userID int) ([]string, error) {
+	if _, err := dbInstance.Exec(`UPDATE user_totp SET enabled_at = NOW() WHERE user_id = $1 AND enabled_at IS NULL`, userID); err != nil {
+		return nil, err
+	}
+	return replaceRecoveryCodes(dbInstance, userID)
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and stores the hashes of new ones
+func replaceRecoveryCodes(dbInstance *sql.DB, userID int) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := dbInstance.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	values := make([]string, len(codes))
+	args := []interface{}{userID}
+	for i, code := range codes {
+		values[i] = fmt.Sprintf("($1, $%d)", i+2)
+		args = append(args, auth.HashRecoveryCode(code))
+	}
+	if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES `+strings.Join(values, ", "), args...); err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// disableMFA removes the user's TOTP secret and recovery codes
+func disableMFA(dbInstance *sql.DB, userID int) error {
+	if _, err := dbInstance.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	_, err := dbInstance.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	return err
+}
+
+func LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	loginMFA(w, r, db.DB)
+}
+
+func LoginMFAEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	loginMFAEnroll(w, r, db.DB)
+}
+
+func GetMFAStatusHandler(w http.ResponseWriter, r *http.Request) {
+	getMFAStatus(w, r, db.DB)
+}
+
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	enrollTOTPForUser(w, r, db.DB)
+}
+
+func VerifyTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	verifyTOTPEnrollment(w, r, db.DB)
+}
+
+func DisableMFAHandler(w http.ResponseWriter, r *http.Request) {
+	disableMFAForUser(w, r, db.DB)
+}
+
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	regenerateRecoveryCodes(w, r, db.DB)
+}
+
+func ResetUserMFAHandler(w http.ResponseWriter, r *http.Request) {
+	resetUserMFA(w, r, db.DB)
+}
+
+// loginMFA completes a login with the challenge token from /login and a second factor.
+// With an enrollment token it verifies the first code of a new authenticator instead,
+// and the response also carries the user's recovery codes.
+func loginMFA(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		Device       string `json:"device,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	enrolling := false
+	claims, err := auth.ParsePurposeToken(req.MFAToken, auth.PurposeMFAChallenge)
+	if err != nil {
+		claims, err = auth.ParsePurposeToken(req.MFAToken, auth.PurposeMFAEnrollment)
+		enrolling = true
+	}
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+	if !mfaAttemptLimiter.Allow(strconv.Itoa(claims.UserID)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+
+	user := models.User{ID: claims.UserID, TenantID: claims.TenantID}
+	err = dbInstance.QueryRow(`SELECT name, email, role, token_version FROM users WHERE id = $1 AND tenant_id = $2`,
+		user.ID, user.TenantID).Scan(&user.Name, &user.Email, &user.Role, &user.TokenVersion)
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		ok            bool
+		recoveryCodes []string
+	)
+	if enrolling {
+		ok, err = checkTOTP(dbInstance, user.ID, req.Code, false)
+		if ok && err == nil {
+			recoveryCodes, err = activateTOTP(dbInstance, user.ID)
+		}
+	} else {
+		// Wrong codes count towards the account lockout like wrong passwords
+		if loginThrottled(w, r, dbInstance, user.TenantID, user.Email) {
+			return
+		}
+		ok, err = verifySecondFactor(dbInstance, user.ID, req.Code, req.RecoveryCode)
+	}
+	if err != nil {
+		log.Println("Error verifying second factor:", err)
+		http.Error(w, "Error verifying MFA code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if !enrolling {
+			recordFailedLogin(r, dbInstance, user.TenantID, user.Email)
+		}
+		http.Error(w, "Invalid MFA code", http.StatusUnauthorized)
+		return
+	}
+	if !enrolling {
+		clearFailedLogins(dbInstance, user.TenantID, user.Email)
+	}
+
+	tokenString, refreshToken, ok := startSession(w, r, dbInstance, user, req.Device, auth.Authenticated(auth.AMROTP, auth.AMRMFA))
+	if !ok {
+		return
+	}
+	if recoveryCodes != nil {
+		writeTokensWith(w, tokenString, refreshToken, map[string]interface{}{"recovery_codes": recoveryCodes})
+		return
+	}
+	writeTokens(w, tokenString, refreshToken)
+}
+
+// loginMFAEnroll starts authenticator enrollment for a user whose tenant requires MFA,
+// using the enrollment token returned by /login
+func loginMFAEnroll(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	claims, err := auth.ParsePurposeToken(req.MFAToken, auth.PurposeMFAEnrollment)
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	err = dbInstance.QueryRow(`SELECT email FROM users WHERE id = $1 AND tenant_id = $2`, claims.UserID, claims.TenantID).Scan(&email)
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+	writeEnrollment(w, dbInstance, claims.UserID, email)
+}
+
+// getMFAStatus reports whether the caller has MFA and how many recovery codes are left
+func getMFAStatus(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	tenantID, _ := auth.GetTenantID(r.Context())
+
+	var (
+		enabled   bool
+		remaining int
+	)
+	err = dbInstance.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL),
+		       (SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL)`,
+		userID).Scan(&enabled, &remaining)
+	if err != nil {
+		log.Println("Error fetching MFA status:", err)
+		http.Error(w, "Error fetching MFA status", http.StatusInternalServerError)
+		return
+	}
+	settings, err := loadTenantSettings(dbInstance, tenantID)
+	if err != nil {
+		log.Println("Error loading tenant settings:", err)
+		http.Error(w, "Error fetching MFA status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"totp_enabled":             enabled,
+		"recovery_codes_remaining": remaining,
+		"required":                 settings.RequireMFA,
+	})
+}
+
+// enrollTOTPForUser starts authenticator enrollment for the signed-in caller
+func enrollTOTPForUser(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	email, _ := auth.GetEmail(r.Context())
+	writeEnrollment(w, dbInstance, userID, email)
+}
+
+func writeEnrollment(w http.ResponseWriter, dbInstance *sql.DB, userID int, email string) {
+	secret, uri, err := enrollTOTP(dbInstance, userID, email)
+	if err == errMFAAlreadyEnabled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Error enrolling TOTP:", err)
+		http.Error(w, "Error enrolling authenticator", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           secret,
+		"provisioning_uri": uri,
+	})
+}
+
+// verifyTOTPEnrollment turns MFA on once the caller proves their authenticator works
+func verifyTOTPEnrollment(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !mfaAttemptLimiter.Allow(strconv.Itoa(userID)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+
+	ok, err := checkTOTP(dbInstance, userID, req.Code, false)
+	if err != nil {
+		log.Println("Error verifying TOTP:", err)
+		http.Error(w, "Error verifying MFA code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid MFA code", http.StatusBadRequest)
+		return
+	}
+	codes, err := activateTOTP(dbInstance, userID)
+	if err != nil {
+		log.Println("Error enabling TOTP:", err)
+		http.Error(w, "Error enabling MFA", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "MFA enabled successfully",
+		"recovery_codes": codes,
+	})
+}
+
+// mfaConfirmed checks the second factor in a request body before a sensitive MFA change.
+// It writes the error response when the check fails.
+func mfaConfirmed(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB, userID int) bool {
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return false
+	}
+	if !mfaAttemptLimiter.Allow(strconv.Itoa(userID)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return false
+	}
+
+	// Wrong codes count towards the account lockout, as at /login/mfa
+	var (
+		email    string
+		tenantID int
+	)
+	if err := dbInstance.QueryRow(`SELECT email, tenant_id FROM users WHERE id = $1`, userID).Scan(&email, &tenantID); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Error verifying MFA code", http.StatusInternalServerError)
+		return false
+	}
+	if loginThrottled(w, r, dbInstance, tenantID, email) {
+		return false
+	}
+	ok, err := verifySecondFactor(dbInstance, userID, req.Code, req.RecoveryCode)
+	if err != nil {
+		log.Println("Error verifying second factor:", err)
+		http.Error(w, "Error verifying MFA code", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		recordFailedLogin(r, dbInstance, tenantID, email)
+		http.Error(w, "Invalid MFA code", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// disableMFAForUser turns the caller's MFA off, given a current code or a recovery code
+func disableMFAForUser(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	if !mfaConfirmed(w, r, dbInstance, userID) {
+		return
+	}
+	if err := disableMFA(dbInstance, userID); err != nil {
+		log.Println("Error disabling MFA:", err)
+		http.Error(w, "Error disabling MFA", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "MFA disabled successfully"})
+}
+
+// regenerateRecoveryCodes replaces the caller's recovery codes, given a current code
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	if !mfaConfirmed(w, r, dbInstance, userID) {
+		return
+	}
+	codes, err := replaceRecoveryCodes(dbInstance, userID)
+	if err != nil {
+		log.Println("Error generating recovery codes:", err)
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// resetUserMFA lets a tenant admin remove the MFA of a user who lost their authenticator
+func resetUserMFA(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, ok := tenantAdminTarget(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	if err := disableMFA(dbInstance, userID); err != nil {
+		log.Println("Error resetting MFA:", err)
+		http.Error(w, "Error resetting MFA", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "MFA reset successfully"})
+}
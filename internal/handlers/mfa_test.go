@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+var loginColumns = []string{"id", "name", "password", "tenant_id", "role", "token_version", "email_confirmed", "mfa_enabled"}
+
+// postJSON calls a handler with a JSON body and decodes the JSON response
+func postJSON(t *testing.T, handler func(http.ResponseWriter, *http.Request), body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	raw, _ := json.Marshal(body)
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw)))
+	var response map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	return rr, response
+}
+
+func expectMFALogin(mock sqlmock.Sqlmock, mfaEnabled bool, settings string) {
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	expectLoginAllowed(mock)
+	mock.ExpectQuery("SELECT u.id, u.name, u.password").
+		WithArgs("mfa@test.com", 1).
+		WillReturnRows(sqlmock.NewRows(loginColumns).AddRow(7, "MFA User", string(hashedPassword), 1, "member", 0, true, mfaEnabled))
+	// With MFA the failures are only cleared by a correct second factor
+	if !mfaEnabled {
+		expectFailuresCleared(mock)
+	}
+	expectRehash(mock)
+	mock.ExpectQuery("SELECT settings FROM tenant_settings").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow([]byte(settings)))
+}
+
+func expectMFAUser(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT name, email, role, token_version FROM users WHERE id = \\$1 AND tenant_id = \\$2").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "role", "token_version"}).AddRow("MFA User", "mfa@test.com", "member", 0))
+}
+
+func expectNewSession(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestLoginMFA(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	login := func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, db) }
+	complete := func(w http.ResponseWriter, r *http.Request) { loginMFA(w, r, db) }
+
+	// The password alone only earns a challenge
+	expectMFALogin(mock, true, `{}`)
+	rr, response := postJSON(t, login, map[string]interface{}{"email": "mfa@test.com", "password": "password123", "tenant_id": 1})
+	if rr.Code != http.StatusOK || response["mfa_required"] != true || response["token"] != nil {
+		t.Fatalf("expected an MFA challenge, got %d %v", rr.Code, response)
+	}
+	mfaToken := response["mfa_token"].(string)
+	if _, err := auth.ValidateToken(mfaToken); err == nil {
+		t.Error("expected the challenge token to be useless as an access token")
+	}
+
+	code, _ := auth.TOTPCode(testTOTPSecret, time.Now())
+	step := time.Now().Unix() / 30
+
+	expectMFAUser(mock)
+	expectNotLockedOut(mock)
+	mock.ExpectQuery("SELECT secret, last_used_step FROM user_totp WHERE user_id = \\$1").
+		WithArgs(7, true).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_used_step"}).AddRow(testTOTPSecret, 0))
+	mock.ExpectExec("UPDATE user_totp SET last_used_step = \\$1 WHERE user_id = \\$2 AND last_used_step < \\$1").
+		WithArgs(step, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectFailuresCleared(mock)
+	expectNewSession(mock)
+
+	rr, response = postJSON(t, complete, map[string]string{"mfa_token": mfaToken, "code": code})
+	if rr.Code != http.StatusOK || response["token"] == nil || response["refresh_token"] == nil {
+		t.Fatalf("expected tokens, got %d %v", rr.Code, response)
+	}
+	// The cookie is sent to every path, not just /login, and scripts cannot read it
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].Path != "/" || !cookies[0].HttpOnly ||
+		cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].Value != response["token"] {
+		t.Errorf("unexpected token cookie: %+v", cookies)
+	}
+
+	// Replaying the same code is refused, and counts towards the account lockout
+	expectMFAUser(mock)
+	expectNotLockedOut(mock)
+	mock.ExpectQuery("SELECT secret, last_used_step FROM user_totp").
+		WithArgs(7, true).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_used_step"}).AddRow(testTOTPSecret, step))
+	expectLoginFailure(mock)
+
+	rr, _ = postJSON(t, complete, map[string]string{"mfa_token": mfaToken, "code": code})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a replayed code, got %d", rr.Code)
+	}
+
+	// A recovery code works once in place of a TOTP code
+	expectMFAUser(mock)
+	expectNotLockedOut(mock)
+	mock.ExpectExec("UPDATE mfa_recovery_codes SET used_at = NOW\\(\\) WHERE user_id = \\$1 AND code_hash = \\$2 AND used_at IS NULL").
+		WithArgs(7, auth.HashRecoveryCode("abcde-fghij")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectFailuresCleared(mock)
+	expectNewSession(mock)
+
+	rr, _ = postJSON(t, complete, map[string]string{"mfa_token": mfaToken, "recovery_code": "ABCDE FGHIJ"})
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 for a recovery code, got %d", rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestLoginMFA_TenantRequiresEnrollment(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	login := func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, db) }
+
+	expectMFALogin(mock, false, `{"require_mfa": true}`)
+	rr, response := postJSON(t, login, map[string]interface{}{"email": "mfa@test.com", "password": "password123", "tenant_id": 1})
+	if rr.Code != http.StatusOK || response["mfa_enrollment_required"] != true {
+		t.Fatalf("expected an enrollment challenge, got %d %v", rr.Code, response)
+	}
+	mfaToken := response["mfa_token"].(string)
+
+	// The enrollment token fetches a secret for the authenticator app
+	mock.ExpectQuery("SELECT email FROM users WHERE id = \\$1 AND tenant_id = \\$2").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("mfa@test.com"))
+	mock.ExpectExec("INSERT INTO user_totp").
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr, response = postJSON(t, func(w http.ResponseWriter, r *http.Request) { loginMFAEnroll(w, r, db) }, map[string]string{"mfa_token": mfaToken})
+	if rr.Code != http.StatusOK || response["secret"] == nil || response["provisioning_uri"] == nil {
+		t.Fatalf("expected a new secret, got %d %v", rr.Code, response)
+	}
+	secret := response["secret"].(string)
+	code, _ := auth.TOTPCode(secret, time.Now())
+
+	expectMFAUser(mock)
+	mock.ExpectQuery("SELECT secret, last_used_step FROM user_totp").
+		WithArgs(7, false).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_used_step"}).AddRow(secret, 0))
+	mock.ExpectExec("UPDATE user_totp SET last_used_step").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE user_totp SET enabled_at = NOW\\(\\)").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM mfa_recovery_codes WHERE user_id = \\$1").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO mfa_recovery_codes \\(user_id, code_hash\\) VALUES \\(\\$1, \\$2\\)").WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectCommit()
+	expectNewSession(mock)
+
+	rr, response = postJSON(t, func(w http.ResponseWriter, r *http.Request) { loginMFA(w, r, db) }, map[string]string{"mfa_token": mfaToken, "code": code})
+	if rr.Code != http.StatusOK || response["token"] == nil {
+		t.Fatalf("expected tokens, got %d %v", rr.Code, response)
+	}
+	if codes, _ := response["recovery_codes"].([]interface{}); len(codes) != 10 {
+		t.Errorf("expected 10 recovery codes, got %v", response["recovery_codes"])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestEnrollTOTP_AlreadyEnabled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO user_totp").
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/mfa/totp", nil).WithContext(sessionContext(7, 1, "member", "s1"))
+	rr := httptest.NewRecorder()
+	enrollTOTPForUser(rr, req, db)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+func CreateOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	createOAuthClient(w, r, db.DB)
+}
+
+func ListOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	listOAuthClients(w, r, db.DB)
+}
+
+func DeleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	deleteOAuthClient(w, r, db.DB)
+}
+
+// validRedirectURI accepts absolute https URIs without a fragment, and plain http on the loopback interface for local development
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// createOAuthClient registers an OIDC client in the admin's tenant. The secret of a
+// confidential client is only returned here; Sentinel keeps its hash.
+func createOAuthClient(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || len(req.RedirectURIs) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			writeFieldErrors(w, "Invalid client", []models.FieldError{{
+				Field: "redirect_uris", Code: "invalid", Message: "must be https URLs without a fragment, or http on localhost: " + uri,
+			}})
+			return
+		}
+	}
+
+	client := models.OAuthClient{TenantID: tenantID, Name: req.Name, RedirectURIs: req.RedirectURIs, Public: req.Public}
+	clientID, err := auth.RandomToken(16)
+	if err != nil {
+		http.Error(w, "Error creating client", http.StatusInternalServerError)
+		return
+	}
+	client.ClientID = clientID
+	var secret string
+	secretHash := sql.NullString{}
+	if !req.Public {
+		if secret, err = auth.RandomToken(32); err != nil {
+			http.Error(w, "Error creating client", http.StatusInternalServerError)
+			return
+		}
+		secretHash = sql.NullString{String: auth.HashToken(secret), Valid: true}
+	}
+	uris, _ := json.Marshal(req.RedirectURIs)
+
+	err = dbInstance.QueryRow(`
+		INSERT INTO oauth_clients (tenant_id, client_id, client_secret_hash, name, redirect_uris, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING created_at`, tenantID, client.ClientID, secretHash, client.Name, uris).Scan(&client.CreatedAt)
+	if err != nil {
+		log.Println("Error creating OAuth client:", err)
+		http.Error(w, "Error creating client", http.StatusInternalServerError)
+		return
+	}
+
+	body := map[string]interface{}{"client": client}
+	if secret != "" {
+		body["client_secret"] = secret
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(body)
+}
+
+// listOAuthClients returns the OIDC clients of the admin's tenant
+func listOAuthClients(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	rows, err := dbInstance.Query(`
+		SELECT client_id, name, redirect_uris, client_secret_hash IS NULL, created_at
+		FROM oauth_clients WHERE tenant_id = $1 ORDER BY created_at`, tenantID)
+	if err != nil {
+		log.Println("Error listing OAuth clients:", err)
+		http.Error(w, "Error retrieving clients", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	clients := []models.OAuthClient{}
+	for rows.Next() {
+		c := models.OAuthClient{TenantID: tenantID}
+		var uris []byte
+		if err := rows.Scan(&c.ClientID, &c.Name, &uris, &c.Public, &c.CreatedAt); err != nil {
+			log.Println("Error reading OAuth client:", err)
+			http.Error(w, "Error retrieving clients", http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(uris, &c.RedirectURIs)
+		clients = append(clients, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clients)
+}
+
+// deleteOAuthClient removes an OIDC client of the admin's tenant, along with its pending codes
+func deleteOAuthClient(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	res, err := dbInstance.Exec(`DELETE FROM oauth_clients WHERE client_id = $1 AND tenant_id = $2`, mux.Vars(r)["client_id"], tenantID)
+	if err != nil {
+		log.Println("Error deleting OAuth client:", err)
+		http.Error(w, "Error deleting client", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Client deleted successfully"})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestCreateOAuthClient(t *testing.T) {
+	tests := []struct {
+		name           string
+		role           string
+		body           map[string]interface{}
+		expectInsert   bool
+		expectedStatus int
+		expectSecret   bool
+	}{
+		{"Confidential client", "admin", map[string]interface{}{"name": "Dashboard", "redirect_uris": []string{"https://app.example.com/cb"}}, true, http.StatusCreated, true},
+		{"Public client", "admin", map[string]interface{}{"name": "CLI", "redirect_uris": []string{"http://127.0.0.1:8400/cb"}, "public": true}, true, http.StatusCreated, false},
+		{"Plain http redirect", "admin", map[string]interface{}{"name": "Bad", "redirect_uris": []string{"http://app.example.com/cb"}}, false, http.StatusBadRequest, false},
+		{"Redirect with fragment", "admin", map[string]interface{}{"name": "Bad", "redirect_uris": []string{"https://app.example.com/cb#x"}}, false, http.StatusBadRequest, false},
+		{"Member cannot register", "member", map[string]interface{}{"name": "Dashboard", "redirect_uris": []string{"https://app.example.com/cb"}}, false, http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectInsert {
+				mock.ExpectQuery("INSERT INTO oauth_clients").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), tt.body["name"], sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+			}
+
+			raw, _ := json.Marshal(tt.body)
+			req := httptest.NewRequest(http.MethodPost, "/api/oauth/clients", bytes.NewReader(raw))
+			req = req.WithContext(sessionContext(1, 1, tt.role, "s1"))
+			rr := httptest.NewRecorder()
+			createOAuthClient(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			var response map[string]interface{}
+			json.Unmarshal(rr.Body.Bytes(), &response)
+			if _, ok := response["client_secret"]; ok != tt.expectSecret {
+				t.Errorf("expected client_secret present = %v, got %v", tt.expectSecret, response)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestListOAuthClients(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT client_id, name, redirect_uris, client_secret_hash IS NULL, created_at").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id", "name", "redirect_uris", "public", "created_at"}).
+			AddRow("client-1", "Dashboard", `["https://app.example.com/cb"]`, false, time.Now()))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/oauth/clients", nil)
+	req = req.WithContext(sessionContext(1, 1, "admin", "s1"))
+	rr := httptest.NewRecorder()
+	listOAuthClients(rr, req, db)
+
+	var clients []map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &clients)
+	if rr.Code != http.StatusOK || len(clients) != 1 || clients[0]["client_id"] != "client-1" {
+		t.Errorf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := clients[0]["client_secret_hash"]; ok {
+		t.Errorf("client secret hash must not be listed")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestDeleteOAuthClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM oauth_clients WHERE client_id = \\$1 AND tenant_id = \\$2").
+		WithArgs("other-tenant-client", 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/oauth/clients/other-tenant-client", nil)
+	req = mux.SetURLVars(req.WithContext(sessionContext(1, 1, "admin", "s1")), map[string]string{"client_id": "other-tenant-client"})
+	rr := httptest.NewRecorder()
+	deleteOAuthClient(rr, req, db)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
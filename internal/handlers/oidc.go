@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// oidcCodeTTL is how long an authorization code can be exchanged at /token
+const oidcCodeTTL = 2 * time.Minute
+
+// oidcScopes are the scopes Sentinel grants; others in a request are ignored
+var oidcScopes = []string{"openid", "email", "profile"}
+
+// oidcSigningAlgorithms returns the algorithms ID tokens are verified with. It answers 503
+// when the signing key is a shared secret, which relying parties could not verify ID
+// tokens with, see auth.ErrNoOIDCSigningKey.
+func oidcSigningAlgorithms(w http.ResponseWriter) ([]string, bool) {
+	algs, err := auth.IDTokenSigningAlgorithms()
+	if err == auth.ErrNoOIDCSigningKey {
+		http.Error(w, "OpenID Connect is not available: "+err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		log.Println("Error loading signing keys:", err)
+		http.Error(w, "Could not load signing keys", http.StatusInternalServerError)
+		return nil, false
+	}
+	return algs, true
+}
+
+func OpenIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	algs, ok := oidcSigningAlgorithms(w)
+	if !ok {
+		return
+	}
+	issuer := auth.Issuer()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algs,
+		"scopes_supported":                      oidcScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"email", "email_verified", "name", "tenant_id", "tenant_name", "role"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+func AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	authorize(w, r, db.DB)
+}
+
+func OIDCTokenHandler(w http.ResponseWriter, r *http.Request) {
+	oidcToken(w, r, db.DB)
+}
+
+func OIDCUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	oidcUserInfo(w, r, db.DB)
+}
+
+// oauthClient is a registered client as needed by the authorization and token endpoints
+type oauthClient struct {
+	models.OAuthClient
+	secretHash sql.NullString
+}
+
+func loadOAuthClient(dbInstance *sql.DB, clientID string) (oauthClient, error) {
+	var c oauthClient
+	var uris []byte
+	err := dbInstance.QueryRow(`SELECT tenant_id, name, redirect_uris, client_secret_hash FROM oauth_clients WHERE client_id = $1`, clientID).
+		Scan(&c.TenantID, &c.Name, &uris, &c.secretHash)
+	if err != nil {
+		return c, err
+	}
+	c.ClientID = clientID
+	c.Public = !c.secretHash.Valid
+	err = json.Unmarshal(uris, &c.RedirectURIs)
+	return c, err
+}
+
+// grantedScope keeps the supported scopes of a request, in the order Sentinel lists them
+func grantedScope(requested string) string {
+	asked := map[string]bool{}
+	for _, s := range strings.Fields(requested) {
+		asked[s] = true
+	}
+	var granted []string
+	for _, s := range oidcScopes {
+		if asked[s] {
+			granted = append(granted, s)
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionFromCookie authenticates the browser's Sentinel session from the token cookie set at login
+func sessionFromCookie(r *http.Request, dbInstance *sql.DB) (*auth.Claims, bool) {
+	cookie, err := r.Cookie("token")
+	if err != nil || cookie.Value == "" {
+		return nil, false
+	}
+	// Impersonation tokens do not sign in to other applications
+	claims, err := auth.Authenticate(dbInstance, cookie.Value)
+	if err != nil || claims.UserID == 0 || claims.Actor != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// sessionAuthTime is when the user of a session token last authenticated. Tokens issued
+// before sessions recorded it fall back to their issue time.
+func sessionAuthTime(claims *auth.Claims) time.Time {
+	if claims.AuthTime != 0 {
+		return time.Unix(claims.AuthTime, 0)
+	}
+	return time.Unix(claims.IssuedAt, 0)
+}
+
+// authorize is the OIDC authorization endpoint (authorization code flow with PKCE).
+// It answers for the Sentinel session of the browser; users without one are sent to
+// the login page first and come back here afterwards. Clients are first-party
+// applications of the tenant, so no consent screen is shown.
+func authorize(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	// Users are not sent through the login for a code that cannot be exchanged
+	if _, ok := oidcSigningAlgorithms(w); !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+
+	// Without a known client and redirect URI errors cannot be sent back to the client
+	client, err := loadOAuthClient(dbInstance, q.Get("client_id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Error loading OAuth client:", err)
+		http.Error(w, "Error loading client", http.StatusInternalServerError)
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, uri := range client.RedirectURIs {
+		registered = registered || uri == redirectURI
+	}
+	if !registered {
+		http.Error(w, "Redirect URI is not registered for this client", http.StatusBadRequest)
+		return
+	}
+
+	redirect := func(params url.Values) {
+		params.Set("iss", auth.Issuer())
+		if state := q.Get("state"); state != "" {
+			params.Set("state", state)
+		}
+		target, _ := url.Parse(redirectURI)
+		query := target.Query()
+		for k, v := range params {
+			query[k] = v
+		}
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+	fail := func(code, description string) {
+		redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+
+	scope := grantedScope(q.Get("scope"))
+	switch {
+	case q.Get("response_type") != "code":
+		fail("unsupported_response_type", "Only the authorization code flow is supported")
+		return
+	case !hasScope(scope, "openid"):
+		fail("invalid_scope", "The openid scope is required")
+		return
+	case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+		fail("invalid_request", "PKCE with code_challenge_method S256 is required")
+		return
+	}
+
+	claims, ok := sessionFromCookie(r, dbInstance)
+	if !ok {
+		if q.Get("prompt") == "none" {
+			fail("login_required", "The user is not signed in")
+			return
+		}
+		// Come back to this request once the user has signed in
+		returnTo := auth.Issuer() + "/authorize?" + q.Encode()
+		http.Redirect(w, r, publicURL("/login", url.Values{"return_to": {returnTo}}), http.StatusFound)
+		return
+	}
+	if claims.TenantID != client.TenantID {
+		fail("access_denied", "The user does not belong to the client's tenant")
+		return
+	}
+
+	code, err := auth.RandomToken(32)
+	if err != nil {
+		fail("server_error", "Could not issue a code")
+		return
+	}
+	_, err = dbInstance.Exec(`
+		WITH expired AS (DELETE FROM oauth_codes WHERE expires_at < NOW())
+		INSERT INTO oauth_codes (code_hash, client_id, user_id, tenant_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		auth.HashToken(code), client.ClientID, claims.UserID, claims.TenantID, redirectURI, scope, q.Get("nonce"),
+		q.Get("code_challenge"), sessionAuthTime(claims), time.Now().Add(oidcCodeTTL))
+	if err != nil {
+		log.Println("Error storing authorization code:", err)
+		fail("server_error", "Could not issue a code")
+		return
+	}
+	redirect(url.Values{"code": {code}})
+}
+
+// writeOAuthError answers a token endpoint request with an RFC 6749 error
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="sentinel"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// clientCredentials reads the client ID and secret of a token request from HTTP Basic
+// authentication or, failing that, the form
+func clientCredentials(r *http.Request) (clientID, secret string) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+		return clientID, secret
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+// authenticateOAuthClient checks the client credentials of a token request, from HTTP Basic
+// authentication or the form. Public clients only send their client_id.
+func authenticateOAuthClient(r *http.Request, dbInstance *sql.DB) (oauthClient, bool) {
+	clientID, secret := clientCredentials(r)
+	if clientID == "" {
+		return oauthClient{}, false
+	}
+	client, err := loadOAuthClient(dbInstance, clientID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Error loading OAuth client:", err)
+		}
+		return oauthClient{}, false
+	}
+	if client.Public {
+		return client, secret == ""
+	}
+	return client, subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.secretHash.String)) == 1
+}
+
+// oidcUser is what ID tokens and /userinfo say about a user
+type oidcUser struct {
+	models.User
+	EmailConfirmed bool
+	TenantName     string
+}
+
+func loadOIDCUser(dbInstance *sql.DB, userID, tenantID int) (oidcUser, error) {
+	u := oidcUser{User: models.User{ID: userID, TenantID: tenantID}}
+	err := dbInstance.QueryRow(`
+		SELECT u.name, u.email, COALESCE(u.email_confirmed, FALSE), u.role, u.token_version, t.name
+		FROM users u JOIN tenants t ON t.id = u.tenant_id
+		WHERE u.id = $1 AND u.tenant_id = $2`, userID, tenantID).
+		Scan(&u.Name, &u.Email, &u.EmailConfirmed, &u.Role, &u.TokenVersion, &u.TenantName)
+	return u, err
+}
+
+// idTokenClaims fills in the claims the granted scope allows
+func (u oidcUser) idTokenClaims(scope string) *auth.IDTokenClaims {
+	claims := &auth.IDTokenClaims{TenantID: u.TenantID, TenantName: u.TenantName, Role: u.Role}
+	claims.Subject = strconv.Itoa(u.ID)
+	if hasScope(scope, "email") {
+		verified := u.EmailConfirmed
+		claims.Email, claims.EmailVerified = u.Email, &verified
+	}
+	if hasScope(scope, "profile") {
+		claims.Name = u.Name
+	}
+	return claims
+}
+
+// oidcToken is the OIDC token endpoint: it exchanges an authorization code and its
+// PKCE verifier for an ID token and an access token for /userinfo
+func oidcToken(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported")
+		return
+	}
+	client, ok := authenticateOAuthClient(r, dbInstance)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	// Deleting the code on first use makes it single-use, whether or not the exchange succeeds
+	var (
+		clientID, redirectURI, scope, nonce, challenge string
+		userID, tenantID                               int
+		authTime, expiresAt                            time.Time
+	)
+	err := dbInstance.QueryRow(`
+		DELETE FROM oauth_codes WHERE code_hash = $1
+		RETURNING client_id, user_id, tenant_id, redirect_uri, scope, COALESCE(nonce, ''), code_challenge, auth_time, expires_at`,
+		auth.HashToken(r.PostForm.Get("code"))).
+		Scan(&clientID, &userID, &tenantID, &redirectURI, &scope, &nonce, &challenge, &authTime, &expiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error redeeming authorization code:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not redeem the code")
+		return
+	}
+	switch {
+	case err == sql.ErrNoRows, time.Now().After(expiresAt), clientID != client.ClientID:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	case r.PostForm.Get("redirect_uri") != redirectURI:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	case !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), challenge):
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+		return
+	}
+
+	user, err := loadOIDCUser(dbInstance, userID, tenantID)
+	if err != nil {
+		log.Println("Error loading user for ID token:", err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user no longer exists")
+		return
+	}
+	idClaims := user.idTokenClaims(scope)
+	idClaims.Nonce = nonce
+	idClaims.AuthTime = authTime.Unix()
+	idToken, err := auth.SignIDToken(idClaims, client.ClientID)
+	if err != nil {
+		log.Println("Error signing ID token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create tokens")
+		return
+	}
+	accessToken, err := auth.SignOIDCAccessToken(user.ID, user.TenantID, user.TokenVersion, client.ClientID, scope)
+	if err != nil {
+		log.Println("Error signing OIDC access token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create tokens")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(auth.AccessTokenTTL().Seconds()),
+		"id_token":     idToken,
+		"scope":        scope,
+	})
+}
+
+// oidcUserInfo returns the claims of the user an OIDC access token was issued for
+func oidcUserInfo(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	invalid := func() {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+	}
+	tokenStr := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims, err := auth.ParseOIDCAccessToken(tokenStr)
+	if err != nil {
+		invalid()
+		return
+	}
+	user, err := loadOIDCUser(dbInstance, claims.UserID, claims.TenantID)
+	if err != nil || user.TokenVersion != claims.TokenVersion {
+		// Deleted users and tokens issued before a password or role change are refused
+		invalid()
+		return
+	}
+
+	c := user.idTokenClaims(claims.Scope)
+	info := map[string]interface{}{
+		"sub":         c.Subject,
+		"tenant_id":   c.TenantID,
+		"tenant_name": c.TenantName,
+		"role":        c.Role,
+	}
+	if c.EmailVerified != nil {
+		info["email"], info["email_verified"] = c.Email, *c.EmailVerified
+	}
+	if c.Name != "" {
+		info["name"] = c.Name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	testClientID    = "client-1"
+	testRedirectURI = "https://app.example.com/callback"
+	testVerifier    = "dBjftJeZ4CVP-mJ92K1e5J4a2K9TtYgWzBa4gNlZq7EXAMPLEverifier"
+)
+
+func testChallenge() string {
+	sum := sha256.Sum256([]byte(testVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// useKeyRing signs and verifies tokens with the given keys for the duration of a test
+func useKeyRing(t *testing.T, keys ...auth.SigningKey) {
+	t.Helper()
+	kr, err := auth.NewKeyRing(keys)
+	if err != nil {
+		t.Fatalf("failed to build key ring: %v", err)
+	}
+	auth.SetKeyRing(kr)
+	// The next token reloads the key ring from the environment
+	t.Cleanup(func() { auth.SetKeyRing(nil) })
+}
+
+// useOIDCSigningKey signs with an ES256 key, as ID tokens are never signed with a shared secret
+func useOIDCSigningKey(t *testing.T) {
+	t.Helper()
+	useKeyRing(t, auth.SigningKey{ID: "oidc", Algorithm: auth.AlgES256, Generate: true})
+}
+
+// stubSessionCookie makes auth.ValidateToken accept the cookie of a signed-in user of tenant 1
+func stubSessionCookie(t *testing.T, issuedAt time.Time) {
+	orig := auth.ValidateToken
+	auth.ValidateToken = func(tokenStr string) (*auth.Claims, error) {
+		if tokenStr != "session-token" {
+			return nil, auth.ErrInvalidToken
+		}
+		return &auth.Claims{UserID: 7, TenantID: 1, Role: "member",
+			StandardClaims: jwt.StandardClaims{IssuedAt: issuedAt.Unix()}}, nil
+	}
+	t.Cleanup(func() { auth.ValidateToken = orig })
+}
+
+func expectOAuthClient(mock sqlmock.Sqlmock, secretHash interface{}) {
+	mock.ExpectQuery("SELECT tenant_id, name, redirect_uris, client_secret_hash FROM oauth_clients WHERE client_id = \\$1").
+		WithArgs(testClientID).
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id", "name", "redirect_uris", "client_secret_hash"}).
+			AddRow(1, "Dashboard", `["`+testRedirectURI+`"]`, secretHash))
+}
+
+func expectSessionCookie(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+}
+
+func authorizeRequest(params url.Values, withSession bool) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	if withSession {
+		req.AddCookie(&http.Cookie{Name: "token", Value: "session-token"})
+	}
+	return req
+}
+
+func authorizeParams() url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {testClientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"openid email profile offline_access"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {testChallenge()},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func TestAuthorizeAndExchangeCode(t *testing.T) {
+	useOIDCSigningKey(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	stubSessionCookie(t, authTime)
+
+	// /authorize issues a code for the signed-in user
+	var codeHash string
+	expectOAuthClient(mock, nil)
+	expectSessionCookie(mock)
+	mock.ExpectExec("INSERT INTO oauth_codes").
+		WithArgs(sqlmock.AnyArg(), testClientID, 7, 1, testRedirectURI, "openid email profile", "n-0S6",
+			testChallenge(), authTime, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	authorize(rr, authorizeRequest(authorizeParams(), true), db)
+
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected status 302, got %d: %s", rr.Code, rr.Body.String())
+	}
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	if !strings.HasPrefix(location.String(), testRedirectURI+"?") {
+		t.Fatalf("expected a redirect to the client, got %s", location)
+	}
+	code := location.Query().Get("code")
+	if code == "" || location.Query().Get("state") != "xyz" || location.Query().Get("iss") != auth.Issuer() {
+		t.Fatalf("expected code, state and iss in the redirect, got %s", location.RawQuery)
+	}
+	codeHash = auth.HashToken(code)
+
+	// /token exchanges it for an ID token and an access token
+	expectOAuthClient(mock, auth.HashToken("s3cret"))
+	mock.ExpectQuery("DELETE FROM oauth_codes WHERE code_hash = \\$1").
+		WithArgs(codeHash).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id", "user_id", "tenant_id", "redirect_uri", "scope", "nonce", "code_challenge", "auth_time", "expires_at"}).
+			AddRow(testClientID, 7, 1, testRedirectURI, "openid email profile", "n-0S6", testChallenge(), authTime, time.Now().Add(time.Minute)))
+	mock.ExpectQuery("SELECT u.name, u.email").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "email_confirmed", "role", "token_version", "name"}).
+			AddRow("Jane", "jane@test.com", true, "member", 0, "Acme"))
+
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code},
+		"redirect_uri": {testRedirectURI}, "code_verifier": {testVerifier}}
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testClientID, "s3cret")
+	rr = httptest.NewRecorder()
+	oidcToken(rr, req, db)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if tokens["token_type"] != "Bearer" || tokens["scope"] != "openid email profile" {
+		t.Errorf("unexpected token response: %v", tokens)
+	}
+
+	idClaims := &auth.IDTokenClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokens["id_token"].(string), idClaims); err != nil {
+		t.Fatalf("failed to parse ID token: %v", err)
+	}
+	if idClaims.Subject != "7" || idClaims.Audience != testClientID || idClaims.Nonce != "n-0S6" ||
+		idClaims.AuthTime != authTime.Unix() || idClaims.Email != "jane@test.com" || idClaims.TenantName != "Acme" {
+		t.Errorf("unexpected ID token claims: %+v", idClaims)
+	}
+	if _, err := auth.ParseOIDCAccessToken(tokens["access_token"].(string)); err != nil {
+		t.Errorf("expected a valid OIDC access token, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestAuthorize_AfterMFALogin(t *testing.T) {
+	useOIDCSigningKey(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	// The token blacklist is read from the global database
+	orig := db.DB
+	db.DB = mockDB
+	defer func() { db.DB = orig }()
+
+	// Sign in with a password and a TOTP code
+	expectMFALogin(mock, true, `{}`)
+	_, response := postJSON(t, func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, mockDB) },
+		map[string]interface{}{"email": "mfa@test.com", "password": "password123", "tenant_id": 1})
+	code, _ := auth.TOTPCode(testTOTPSecret, time.Now())
+	expectMFAUser(mock)
+	expectNotLockedOut(mock)
+	mock.ExpectQuery("SELECT secret, last_used_step FROM user_totp WHERE user_id = \\$1").
+		WithArgs(7, true).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_used_step"}).AddRow(testTOTPSecret, 0))
+	mock.ExpectExec("UPDATE user_totp SET last_used_step").WillReturnResult(sqlmock.NewResult(0, 1))
+	expectFailuresCleared(mock)
+	expectNewSession(mock)
+
+	body, _ := json.Marshal(map[string]interface{}{"mfa_token": response["mfa_token"], "code": code})
+	rr := httptest.NewRecorder()
+	loginMFA(rr, httptest.NewRequest(http.MethodPost, auth.Issuer()+"/login/mfa", bytes.NewReader(body)), mockDB)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 from /login/mfa, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The browser sends the cookie it got at /login/mfa to /authorize
+	jar, _ := cookiejar.New(nil)
+	loginURL, _ := url.Parse(auth.Issuer() + "/login/mfa")
+	jar.SetCookies(loginURL, rr.Result().Cookies())
+	req := httptest.NewRequest(http.MethodGet, auth.Issuer()+"/authorize?"+authorizeParams().Encode(), nil)
+	for _, c := range jar.Cookies(req.URL) {
+		req.AddCookie(c)
+	}
+
+	expectOAuthClient(mock, nil)
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM token_blacklist").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT token_version FROM users WHERE id = \\$1").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(0))
+	mock.ExpectExec("UPDATE sessions SET last_seen_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO oauth_codes").
+		WithArgs(sqlmock.AnyArg(), testClientID, 7, 1, testRedirectURI, "openid email profile", "n-0S6",
+			testChallenge(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr = httptest.NewRecorder()
+	authorize(rr, req, mockDB)
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	if rr.Code != http.StatusFound || location.Query().Get("code") == "" {
+		t.Fatalf("expected a code for the signed-in user, got %d %s", rr.Code, location)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestAuthorize_Errors(t *testing.T) {
+	useOIDCSigningKey(t)
+	tests := []struct {
+		name        string
+		modify      func(url.Values)
+		withSession bool
+		wantError   string
+		wantLogin   bool
+	}{
+		{"Implicit flow is refused", func(q url.Values) { q.Set("response_type", "token") }, true, "unsupported_response_type", false},
+		{"openid scope is required", func(q url.Values) { q.Set("scope", "email") }, true, "invalid_scope", false},
+		{"PKCE is required", func(q url.Values) { q.Del("code_challenge") }, true, "invalid_request", false},
+		{"plain PKCE is refused", func(q url.Values) { q.Set("code_challenge_method", "plain") }, true, "invalid_request", false},
+		{"No session with prompt=none", func(q url.Values) { q.Set("prompt", "none") }, false, "login_required", false},
+		{"No session goes to login", func(q url.Values) {}, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			stubSessionCookie(t, time.Now())
+
+			expectOAuthClient(mock, nil)
+			params := authorizeParams()
+			tt.modify(params)
+			rr := httptest.NewRecorder()
+			authorize(rr, authorizeRequest(params, tt.withSession), db)
+
+			if rr.Code != http.StatusFound {
+				t.Fatalf("expected status 302, got %d", rr.Code)
+			}
+			location, _ := url.Parse(rr.Header().Get("Location"))
+			if tt.wantLogin {
+				if location.Path != "/login" || !strings.HasPrefix(location.Query().Get("return_to"), auth.Issuer()+"/authorize?") {
+					t.Errorf("expected a redirect to the login page, got %s", location)
+				}
+			} else if got := location.Query().Get("error"); got != tt.wantError || location.Query().Get("state") != "xyz" {
+				t.Errorf("expected error %q with state, got %s", tt.wantError, location.RawQuery)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthorize_UnregisteredRedirectURI(t *testing.T) {
+	useOIDCSigningKey(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectOAuthClient(mock, nil)
+	params := authorizeParams()
+	params.Set("redirect_uri", "https://evil.example.com/callback")
+	rr := httptest.NewRecorder()
+	authorize(rr, authorizeRequest(params, true), db)
+
+	// Never redirect to a URI the client did not register
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+		t.Errorf("expected status 400 without a redirect, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestOIDCToken_Rejected(t *testing.T) {
+	codeRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"client_id", "user_id", "tenant_id", "redirect_uri", "scope", "nonce", "code_challenge", "auth_time", "expires_at"}).
+			AddRow(testClientID, 7, 1, testRedirectURI, "openid", "", testChallenge(), time.Now(), time.Now().Add(time.Minute))
+	}
+	tests := []struct {
+		name           string
+		secret         string
+		verifier       string
+		redeem         bool
+		expectedStatus int
+		expectedError  string
+	}{
+		{"Wrong client secret", "wrong", testVerifier, false, http.StatusUnauthorized, "invalid_client"},
+		{"PKCE verifier mismatch", "s3cret", strings.Repeat("a", 43), true, http.StatusBadRequest, "invalid_grant"},
+		{"Missing verifier", "s3cret", "", true, http.StatusBadRequest, "invalid_grant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			expectOAuthClient(mock, auth.HashToken("s3cret"))
+			if tt.redeem {
+				mock.ExpectQuery("DELETE FROM oauth_codes").WithArgs(auth.HashToken("code-1")).WillReturnRows(codeRows())
+			}
+
+			form := url.Values{"grant_type": {"authorization_code"}, "code": {"code-1"}, "redirect_uri": {testRedirectURI},
+				"code_verifier": {tt.verifier}, "client_id": {testClientID}, "client_secret": {tt.secret}}
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			oidcToken(rr, req, db)
+
+			var response map[string]string
+			json.Unmarshal(rr.Body.Bytes(), &response)
+			if rr.Code != tt.expectedStatus || response["error"] != tt.expectedError {
+				t.Errorf("expected %d %s, got %d %v", tt.expectedStatus, tt.expectedError, rr.Code, response)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestOIDCUserInfo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	accessToken, err := auth.SignOIDCAccessToken(7, 1, 0, testClientID, "openid email")
+	if err != nil {
+		t.Fatalf("failed to sign access token: %v", err)
+	}
+	mock.ExpectQuery("SELECT u.name, u.email").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "email_confirmed", "role", "token_version", "name"}).
+			AddRow("Jane", "jane@test.com", true, "member", 0, "Acme"))
+
+	req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rr := httptest.NewRecorder()
+	oidcUserInfo(rr, req, db)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	var info map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &info)
+	if info["sub"] != "7" || info["email"] != "jane@test.com" || info["tenant_name"] != "Acme" {
+		t.Errorf("unexpected userinfo: %v", info)
+	}
+	if _, ok := info["name"]; ok {
+		t.Errorf("expected no name without the profile scope, got %v", info)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestOIDCUserInfo_SessionTokenRejected(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	sessionToken, _ := auth.GenerateJWT("jane@test.com", 1, "member")
+	req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+sessionToken)
+	rr := httptest.NewRecorder()
+	oidcUserInfo(rr, req, db)
+
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("expected 401 with an invalid_token challenge, got %d %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestOpenIDConfiguration(t *testing.T) {
+	useOIDCSigningKey(t)
+	rr := httptest.NewRecorder()
+	OpenIDConfigurationHandler(rr, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	var config map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &config)
+	if config["issuer"] != auth.Issuer() || config["token_endpoint"] != auth.Issuer()+"/token" ||
+		config["jwks_uri"] != auth.Issuer()+"/.well-known/jwks.json" {
+		t.Errorf("unexpected discovery document: %v", config)
+	}
+	methods, _ := config["code_challenge_methods_supported"].([]interface{})
+	if len(methods) != 1 || methods[0] != "S256" {
+		t.Errorf("expected only S256 PKCE, got %v", methods)
+	}
+}
+
+func TestOpenIDConfiguration_SharedSecret(t *testing.T) {
+	// Only keys published in the JWKS are advertised, never the HS256 secret next to them
+	useKeyRing(t, auth.SigningKey{ID: "oidc", Algorithm: auth.AlgEdDSA, Generate: true}, auth.SigningKey{ID: "old", Secret: "test-secret"})
+	rr := httptest.NewRecorder()
+	OpenIDConfigurationHandler(rr, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+	var config map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &config)
+	algs, _ := config["id_token_signing_alg_values_supported"].([]interface{})
+	if rr.Code != http.StatusOK || len(algs) != 1 || algs[0] != auth.AlgEdDSA {
+		t.Errorf("expected only EdDSA to be advertised, got %d %v", rr.Code, algs)
+	}
+
+	// With a shared secret signing, there is no OpenID provider
+	useKeyRing(t, auth.SigningKey{ID: "default", Secret: "test-secret"})
+	rr = httptest.NewRecorder()
+	OpenIDConfigurationHandler(rr, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	authorize(rr, authorizeRequest(authorizeParams(), true), nil)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 from /authorize, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+)
+
+// ceremonyTTL is how long a started registration or login ceremony can be finished
+const ceremonyTTL = 5 * time.Minute
+
+// Passkey login ceremonies are public, so starting them is limited per client IP
+var passkeyIPLimiter = auth.NewKeyedLimiter(time.Second, 20)
+
+var (
+	errCeremonyNotFound       = errors.New("unknown or expired ceremony")
+	errPasskeyResponseInvalid = errors.New("invalid passkey response")
+	errPasskeyRejected        = errors.New("passkey verification failed")
+)
+
+// saveCeremony stores the state of a started WebAuthn ceremony and returns its ID.
+// userID is 0 for login ceremonies, where the user is not known yet.
+func saveCeremony(dbInstance *sql.DB, userID int, session *webauthn.SessionData) (string, error) {
+	id, err := auth.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	owner := sql.NullInt64{Int64: int64(userID), Valid: userID != 0}
+	// Expired ceremonies are purged on the way
+	_, err = dbInstance.Exec(`
+		WITH expired AS (DELETE FROM webauthn_ceremonies WHERE expires_at < NOW())
+		INSERT INTO webauthn_ceremonies (id, user_id, session_data, expires_at) VALUES ($1, $2, $3, $4)`,
+		id, owner, data, time.Now().Add(ceremonyTTL))
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// takeCeremony consumes a ceremony started by the same user (0 for login), so each challenge is answered once
+func takeCeremony(dbInstance *sql.DB, id string, userID int) (webauthn.SessionData, error) {
+	var session webauthn.SessionData
+	var data []byte
+	err := dbInstance.QueryRow(`
+		DELETE FROM webauthn_ceremonies
+		WHERE id = $1 AND COALESCE(user_id, 0) = $2 AND expires_at > NOW()
+		RETURNING session_data`, id, userID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return session, errCeremonyNotFound
+	}
+	if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal(data, &session)
+	return session, err
+}
+
+// loadPasskeyUser loads a user with all of their registered passkeys
+func loadPasskeyUser(dbInstance *sql.DB, userID int) (*auth.PasskeyUser, error) {
+	user := &auth.PasskeyUser{ID: userID}
+	err := dbInstance.QueryRow(`SELECT email, name FROM users WHERE id = $1`, userID).Scan(&user.Email, &user.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := dbInstance.Query(`SELECT credential FROM webauthn_credentials WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		var credential webauthn.Credential
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &credential); err != nil {
+			return nil, err
+		}
+		user.Credentials = append(user.Credentials, credential)
+	}
+	return user, rows.Err()
+}
+
+func BeginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	beginPasskeyRegistration(w, r, db.DB)
+}
+
+func FinishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	finishPasskeyRegistration(w, r, db.DB)
+}
+
+func ListPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	listPasskeys(w, r, db.DB)
+}
+
+func DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	deletePasskey(w, r, db.DB)
+}
+
+func BeginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	beginPasskeyLogin(w, r, db.DB)
+}
+
+func FinishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	finishPasskeyLogin(w, r, db.DB)
+}
+
+func writeCeremony(w http.ResponseWriter, ceremonyID string, options interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ceremony_id": ceremonyID,
+		"options":     options,
+	})
+}
+
+// beginPasskeyRegistration returns the options for navigator.credentials.create().
+// Passkeys must be discoverable and verify the user, so they can replace the password and a second factor.
+func beginPasskeyRegistration(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	rp, err := auth.RelyingParty()
+	if err != nil {
+		log.Println("Error configuring WebAuthn:", err)
+		http.Error(w, "Passkeys are not available", http.StatusInternalServerError)
+		return
+	}
+	user, err := loadPasskeyUser(dbInstance, userID)
+	if err != nil {
+		log.Println("Error loading passkey user:", err)
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return
+	}
+
+	creation, session, err := rp.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.Credentials).CredentialDescriptors()),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		}))
+	if err != nil {
+		log.Println("Error starting passkey registration:", err)
+		http.Error(w, "Error starting passkey registration", http.StatusInternalServerError)
+		return
+	}
+	ceremonyID, err := saveCeremony(dbInstance, userID, session)
+	if err != nil {
+		log.Println("Error saving WebAuthn ceremony:", err)
+		http.Error(w, "Error starting passkey registration", http.StatusInternalServerError)
+		return
+	}
+	writeCeremony(w, ceremonyID, creation)
+}
+
+// finishPasskeyRegistration verifies the authenticator's response and stores the new passkey
+func finishPasskeyRegistration(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	tenantID, _ := auth.GetTenantID(r.Context())
+
+	var req struct {
+		CeremonyID string          `json:"ceremony_id"`
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CeremonyID == "" || len(req.Credential) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		req.Name = auth.DeviceLabel(r.UserAgent())
+	}
+
+	rp, err := auth.RelyingParty()
+	if err != nil {
+		log.Println("Error configuring WebAuthn:", err)
+		http.Error(w, "Passkeys are not available", http.StatusInternalServerError)
+		return
+	}
+	session, err := takeCeremony(dbInstance, req.CeremonyID, userID)
+	if err == errCeremonyNotFound {
+		http.Error(w, "Unknown or expired registration", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Error loading WebAuthn ceremony:", err)
+		http.Error(w, "Error registering passkey", http.StatusInternalServerError)
+		return
+	}
+	user, err := loadPasskeyUser(dbInstance, userID)
+	if err != nil {
+		log.Println("Error loading passkey user:", err)
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, "Invalid passkey response", http.StatusBadRequest)
+		return
+	}
+	credential, err := rp.CreateCredential(user, session, parsed)
+	if err != nil {
+		log.Println("Passkey registration failed:", err)
+		http.Error(w, "Passkey verification failed", http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(credential)
+	if err != nil {
+		http.Error(w, "Error registering passkey", http.StatusInternalServerError)
+		return
+	}
+	var id int
+	err = dbInstance.QueryRow(`
+		INSERT INTO webauthn_credentials (user_id, tenant_id, credential_id, name, credential, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING id`, userID, tenantID, credential.ID, req.Name, data).Scan(&id)
+	if err != nil {
+		log.Println("Error storing passkey:", err)
+		http.Error(w, "Error registering passkey", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   id,
+		"name": req.Name,
+	})
+}
+
+// listPasskeys returns the caller's passkeys
+func listPasskeys(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	rows, err := dbInstance.Query(`
+		SELECT id, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at`, userID)
+	if err != nil {
+		log.Println("Error listing passkeys:", err)
+		http.Error(w, "Error retrieving passkeys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type passkey struct {
+		ID         int        `json:"id"`
+		Name       string     `json:"name"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+	}
+	passkeys := []passkey{}
+	for rows.Next() {
+		var p passkey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &lastUsed); err != nil {
+			log.Println("Error scanning passkey:", err)
+			http.Error(w, "Error retrieving passkeys", http.StatusInternalServerError)
+			return
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.Time
+		}
+		passkeys = append(passkeys, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+// deletePasskey removes one of the caller's passkeys
+func deletePasskey(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+	res, err := dbInstance.Exec(`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		log.Println("Error deleting passkey:", err)
+		http.Error(w, "Error deleting passkey", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Passkey deleted successfully"})
+}
+
+// beginPasskeyLogin returns the options for navigator.credentials.get(). No email is
+// needed: the authenticator offers the user's passkeys and returns the user handle.
+func beginPasskeyLogin(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	if !passkeyIPLimiter.Allow(auth.ClientIP(r)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+	rp, err := auth.RelyingParty()
+	if err != nil {
+		log.Println("Error configuring WebAuthn:", err)
+		http.Error(w, "Passkeys are not available", http.StatusInternalServerError)
+		return
+	}
+	assertion, session, err := rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		log.Println("Error starting passkey login:", err)
+		http.Error(w, "Error starting passkey login", http.StatusInternalServerError)
+		return
+	}
+	ceremonyID, err := saveCeremony(dbInstance, 0, session)
+	if err != nil {
+		log.Println("Error saving WebAuthn ceremony:", err)
+		http.Error(w, "Error starting passkey login", http.StatusInternalServerError)
+		return
+	}
+	writeCeremony(w, ceremonyID, assertion)
+}
+
+// verifyPasskeyLogin answers a login ceremony started at /login/passkey/begin and returns
+// the passkey's owner. It gives errCeremonyNotFound, errPasskeyResponseInvalid or
+// errPasskeyRejected for answers that do not sign the user in.
+func verifyPasskeyLogin(dbInstance *sql.DB, rp *webauthn.WebAuthn, ceremonyID string, response []byte) (models.User, error) {
+	var user models.User
+	session, err := takeCeremony(dbInstance, ceremonyID, 0)
+	if err != nil {
+		return user, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return user, errPasskeyResponseInvalid
+	}
+
+	// Resolve the passkey from its ID and check it belongs to the user named by the handle
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		var data []byte
+		var credential webauthn.Credential
+		err := dbInstance.QueryRow(`SELECT user_id, credential FROM webauthn_credentials WHERE credential_id = $1`, rawID).Scan(&user.ID, &data)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(userHandle, auth.PasskeyUserHandle(user.ID)) {
+			return nil, errors.New("user handle does not match the passkey")
+		}
+		if err := json.Unmarshal(data, &credential); err != nil {
+			return nil, err
+		}
+		err = dbInstance.QueryRow(`SELECT name, email, tenant_id, role, token_version FROM users WHERE id = $1`, user.ID).
+			Scan(&user.Name, &user.Email, &user.TenantID, &user.Role, &user.TokenVersion)
+		if err != nil {
+			return nil, err
+		}
+		return &auth.PasskeyUser{ID: user.ID, Email: user.Email, Name: user.Name, Credentials: []webauthn.Credential{credential}}, nil
+	}
+
+	_, credential, err := rp.ValidatePasskeyLogin(findUser, session, parsed)
+	if err != nil {
+		log.Println("Passkey login failed:", err)
+		return user, errPasskeyRejected
+	}
+	// A signature counter going backwards means the passkey may have been cloned
+	if credential.Authenticator.CloneWarning {
+		log.Printf("Passkey clone warning for user %d, refusing login", user.ID)
+		return user, errPasskeyRejected
+	}
+
+	data, err := json.Marshal(credential)
+	if err == nil {
+		_, err = dbInstance.Exec(`UPDATE webauthn_credentials SET credential = $1, last_used_at = NOW() WHERE credential_id = $2`, data, credential.ID)
+	}
+	if err != nil {
+		return user, fmt.Errorf("updating passkey: %w", err)
+	}
+	return user, nil
+}
+
+// finishPasskeyLogin verifies the assertion and signs the passkey's owner in.
+// A passkey verifies the user on the device, so it also counts as the second factor.
+func finishPasskeyLogin(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		CeremonyID string          `json:"ceremony_id"`
+		Credential json.RawMessage `json:"credential"`
+		Device     string          `json:"device,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CeremonyID == "" || len(req.Credential) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	rp, err := auth.RelyingParty()
+	if err != nil {
+		log.Println("Error configuring WebAuthn:", err)
+		http.Error(w, "Passkeys are not available", http.StatusInternalServerError)
+		return
+	}
+	user, err := verifyPasskeyLogin(dbInstance, rp, req.CeremonyID, req.Credential)
+	switch err {
+	case nil:
+	case errCeremonyNotFound:
+		http.Error(w, "Unknown or expired login", http.StatusBadRequest)
+		return
+	case errPasskeyResponseInvalid:
+		http.Error(w, "Invalid passkey response", http.StatusBadRequest)
+		return
+	case errPasskeyRejected:
+		http.Error(w, "Passkey verification failed", http.StatusUnauthorized)
+		return
+	default:
+		log.Println("Error verifying passkey:", err)
+		http.Error(w, "Error verifying passkey", http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, refreshToken, ok := startSession(w, r, dbInstance, user, req.Device, auth.Authenticated(auth.AMRHardwareKey, auth.AMRMFA))
+	if !ok {
+		return
+	}
+	writeTokens(w, tokenString, refreshToken)
+}
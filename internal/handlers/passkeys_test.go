@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// softAuthenticator is a software passkey: an ES256 key pair behind the WebAuthn
+// create() and get() ceremonies, with "none" attestation and user verification
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	counter      uint32
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T, origin string) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id, origin: origin}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge.String(),
+		"origin":    a.origin,
+	})
+	return data
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+// create answers navigator.credentials.create()
+func (a *softAuthenticator) create(t *testing.T, options protocol.CredentialCreation) []byte {
+	t.Helper()
+	a.userHandle, _ = base64.RawURLEncoding.DecodeString(options.Response.User.ID.(string))
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode COSE key: %v", err)
+	}
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, coseKey...)
+
+	a.counter++
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(options.Response.RelyingParty.ID, 0x45, attested), // UP | UV | AT
+	})
+	if err != nil {
+		t.Fatalf("failed to encode attestation: %v", err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credentialID),
+		"rawId": b64(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", options.Response.Challenge)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	return credential
+}
+
+// get answers navigator.credentials.get() with a signed assertion
+func (a *softAuthenticator) get(t *testing.T, options protocol.CredentialAssertion) []byte {
+	t.Helper()
+	a.counter++
+	authData := a.authData(options.Response.RelyingPartyID, 0x05, nil) // UP | UV
+	clientData := a.clientData("webauthn.get", options.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign assertion: %v", err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credentialID),
+		"rawId": b64(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	return credential
+}
+
+// capture is a sqlmock argument that matches any []byte and remembers it
+type capture struct{ value *[]byte }
+
+func (c capture) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	if ok {
+		*c.value = b
+	}
+	return ok
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	ctx := sessionContext(7, 1, "member", "s1")
+	authenticator := newSoftAuthenticator(t, "http://localhost:5173")
+
+	expectPasskeyUser := func(credentials ...[]byte) {
+		mock.ExpectQuery("SELECT email, name FROM users WHERE id = \\$1").
+			WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"email", "name"}).AddRow("passkey@test.com", "Passkey User"))
+		rows := sqlmock.NewRows([]string{"credential"})
+		for _, c := range credentials {
+			rows.AddRow(c)
+		}
+		mock.ExpectQuery("SELECT credential FROM webauthn_credentials WHERE user_id = \\$1").WithArgs(7).WillReturnRows(rows)
+	}
+	var ceremony, stored []byte
+
+	// Registration
+	expectPasskeyUser()
+	mock.ExpectExec("INSERT INTO webauthn_ceremonies").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), capture{&ceremony}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	beginPasskeyRegistration(rr, httptest.NewRequest(http.MethodPost, "/api/passkeys/register/begin", nil).WithContext(ctx), db)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var begin struct {
+		CeremonyID string                      `json:"ceremony_id"`
+		Options    protocol.CredentialCreation `json:"options"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&begin); err != nil {
+		t.Fatalf("failed to decode options: %v", err)
+	}
+	if begin.Options.Response.AuthenticatorSelection.ResidentKey != protocol.ResidentKeyRequirementRequired {
+		t.Errorf("expected a discoverable credential to be required, got %+v", begin.Options.Response.AuthenticatorSelection)
+	}
+
+	mock.ExpectQuery("DELETE FROM webauthn_ceremonies").
+		WithArgs(begin.CeremonyID, 7).
+		WillReturnRows(sqlmock.NewRows([]string{"session_data"}).AddRow(ceremony))
+	expectPasskeyUser()
+	mock.ExpectQuery("INSERT INTO webauthn_credentials").
+		WithArgs(7, 1, authenticator.credentialID, "YubiKey", capture{&stored}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"ceremony_id": begin.CeremonyID,
+		"name":        "YubiKey",
+		"credential":  json.RawMessage(authenticator.create(t, begin.Options)),
+	})
+	rr = httptest.NewRecorder()
+	finishPasskeyRegistration(rr, httptest.NewRequest(http.MethodPost, "/api/passkeys/register/finish", bytes.NewReader(body)).WithContext(ctx), db)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Login
+	mock.ExpectExec("INSERT INTO webauthn_ceremonies").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), capture{&ceremony}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr = httptest.NewRecorder()
+	beginPasskeyLogin(rr, httptest.NewRequest(http.MethodPost, "/login/passkey/begin", nil), db)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var beginLogin struct {
+		CeremonyID string                       `json:"ceremony_id"`
+		Options    protocol.CredentialAssertion `json:"options"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&beginLogin); err != nil {
+		t.Fatalf("failed to decode options: %v", err)
+	}
+
+	mock.ExpectQuery("DELETE FROM webauthn_ceremonies").
+		WithArgs(beginLogin.CeremonyID, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"session_data"}).AddRow(ceremony))
+	mock.ExpectQuery("SELECT user_id, credential FROM webauthn_credentials WHERE credential_id = \\$1").
+		WithArgs(authenticator.credentialID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "credential"}).AddRow(7, stored))
+	mock.ExpectQuery("SELECT name, email, tenant_id, role, token_version FROM users WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "tenant_id", "role", "token_version"}).AddRow("Passkey User", "passkey@test.com", 1, "member", 0))
+	mock.ExpectExec("UPDATE webauthn_credentials SET credential = \\$1, last_used_at = NOW\\(\\)").
+		WithArgs(sqlmock.AnyArg(), authenticator.credentialID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectNewSession(mock)
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"ceremony_id": beginLogin.CeremonyID,
+		"credential":  json.RawMessage(authenticator.get(t, beginLogin.Options)),
+	})
+	rr = httptest.NewRecorder()
+	finishPasskeyLogin(rr, httptest.NewRequest(http.MethodPost, "/login/passkey/finish", bytes.NewReader(body)), db)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens map[string]string
+	json.NewDecoder(rr.Body).Decode(&tokens)
+	if tokens["token"] == "" || tokens["refresh_token"] == "" {
+		t.Errorf("expected the same tokens as /login, got %v", tokens)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestFinishPasskeyLogin_WrongKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	ctx := sessionContext(7, 1, "member", "s1")
+	registered := newSoftAuthenticator(t, "http://localhost:5173")
+	var ceremony, stored []byte
+
+	mock.ExpectQuery("SELECT email, name FROM users").WillReturnRows(sqlmock.NewRows([]string{"email", "name"}).AddRow("passkey@test.com", "Passkey User"))
+	mock.ExpectQuery("SELECT credential FROM webauthn_credentials").WillReturnRows(sqlmock.NewRows([]string{"credential"}))
+	mock.ExpectExec("INSERT INTO webauthn_ceremonies").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), capture{&ceremony}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rr := httptest.NewRecorder()
+	beginPasskeyRegistration(rr, httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx), db)
+	var begin struct {
+		CeremonyID string                      `json:"ceremony_id"`
+		Options    protocol.CredentialCreation `json:"options"`
+	}
+	json.NewDecoder(rr.Body).Decode(&begin)
+
+	mock.ExpectQuery("DELETE FROM webauthn_ceremonies").WillReturnRows(sqlmock.NewRows([]string{"session_data"}).AddRow(ceremony))
+	mock.ExpectQuery("SELECT email, name FROM users").WillReturnRows(sqlmock.NewRows([]string{"email", "name"}).AddRow("passkey@test.com", "Passkey User"))
+	mock.ExpectQuery("SELECT credential FROM webauthn_credentials").WillReturnRows(sqlmock.NewRows([]string{"credential"}))
+	mock.ExpectQuery("INSERT INTO webauthn_credentials").
+		WithArgs(7, 1, registered.credentialID, sqlmock.AnyArg(), capture{&stored}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	body, _ := json.Marshal(map[string]interface{}{"ceremony_id": begin.CeremonyID, "credential": json.RawMessage(registered.create(t, begin.Options))})
+	rr = httptest.NewRecorder()
+	finishPasskeyRegistration(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)).WithContext(ctx), db)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// An authenticator presenting the same credential ID with another key is refused
+	impostor := newSoftAuthenticator(t, "http://localhost:5173")
+	impostor.credentialID = registered.credentialID
+	impostor.userHandle = registered.userHandle
+
+	mock.ExpectExec("INSERT INTO webauthn_ceremonies").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), capture{&ceremony}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rr = httptest.NewRecorder()
+	beginPasskeyLogin(rr, httptest.NewRequest(http.MethodPost, "/", nil), db)
+	var beginLogin struct {
+		CeremonyID string                       `json:"ceremony_id"`
+		Options    protocol.CredentialAssertion `json:"options"`
+	}
+	json.NewDecoder(rr.Body).Decode(&beginLogin)
+
+	mock.ExpectQuery("DELETE FROM webauthn_ceremonies").WillReturnRows(sqlmock.NewRows([]string{"session_data"}).AddRow(ceremony))
+	mock.ExpectQuery("SELECT user_id, credential FROM webauthn_credentials").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "credential"}).AddRow(7, stored))
+	mock.ExpectQuery("SELECT name, email, tenant_id, role, token_version FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "tenant_id", "role", "token_version"}).AddRow("Passkey User", "passkey@test.com", 1, "member", 0))
+
+	body, _ = json.Marshal(map[string]interface{}{"ceremony_id": beginLogin.CeremonyID, "credential": json.RawMessage(impostor.get(t, beginLogin.Options))})
+	rr = httptest.NewRecorder()
+	finishPasskeyLogin(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)), db)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
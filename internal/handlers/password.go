@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/mail"
+	"sentinel/internal/password"
+	"strings"
+	"time"
+)
+
+// Reset requests are limited per account and per client IP
+var (
+	resetEmailLimiter = auth.NewKeyedLimiter(20*time.Minute, 3)
+	resetIPLimiter    = auth.NewKeyedLimiter(time.Minute, 10)
+)
+
+// passwordResetTTL is how long a reset link stays valid, PASSWORD_RESET_TTL or 30 minutes
+func passwordResetTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * time.Minute
+}
+
+// publicURL builds a link into the frontend at PUBLIC_URL
+func publicURL(path string, query url.Values) string {
+	base := os.Getenv("PUBLIC_URL")
+	if base == "" {
+		base = "http://localhost:5173"
+	}
+	return strings.TrimRight(base, "/") + path + "?" + query.Encode()
+}
+
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	forgotPassword(w, r, db.DB)
+}
+
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	resetPassword(w, r, db.DB)
+}
+
+// forgotPassword emails a single-use reset link. The response is the same whether
+// or not the account exists so the endpoint cannot be used to enumerate users.
+func forgotPassword(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		Email    string `json:"email"`
+		TenantID int    `json:"tenant_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !resetIPLimiter.Allow(auth.ClientIP(r)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+
+	accepted := func() {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a password reset link has been sent"})
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !resetEmailLimiter.Allow(email) {
+		log.Println("Password reset rate limit reached for an account")
+		accepted()
+		return
+	}
+
+	var (
+		userID int
+		name   string
+	)
+	err := dbInstance.QueryRow(`SELECT id, name FROM users WHERE email = $1 AND tenant_id = $2`, req.Email, req.TenantID).Scan(&userID, &name)
+	if err == sql.ErrNoRows {
+		accepted()
+		return
+	}
+	if err != nil {
+		log.Println("Error fetching user for password reset:", err)
+		http.Error(w, "Error requesting password reset", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := auth.RandomToken(32)
+	if err != nil {
+		http.Error(w, "Error requesting password reset", http.StatusInternalServerError)
+		return
+	}
+	ttl := passwordResetTTL()
+
+	// Only the hash is stored; requesting a new link replaces the previous one
+	_, err = dbInstance.Exec(`UPDATE users SET reset_token = $1, reset_token_expiry = $2 WHERE id = $3`,
+		auth.HashToken(token), time.Now().Add(ttl), userID)
+	if err != nil {
+		log.Println("Error storing password reset token:", err)
+		http.Error(w, "Error requesting password reset", http.StatusInternalServerError)
+		return
+	}
+
+	link := publicURL("/reset-password", url.Values{"token": {token}})
+	err = mail.Send(mail.Message{
+		To:      req.Email,
+		Subject: "Reset your Sentinel password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s and works once.\n\n%s\n\nIf you did not ask for this, you can ignore this email.\n",
+			name, ttl, link),
+	})
+	if err != nil {
+		log.Println("Error sending password reset email:", err)
+	}
+	accepted()
+}
+
+// resetPassword sets a new password with a reset token. The password must meet the
+// tenant's policy. The token is consumed, and every session and token of the user is revoked.
+func resetPassword(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !resetIPLimiter.Allow(auth.ClientIP(r)) {
+		http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+		return
+	}
+
+	var userID, tenantID int
+	err := dbInstance.QueryRow(`SELECT id, tenant_id FROM users WHERE reset_token = $1 AND reset_token_expiry > NOW()`,
+		auth.HashToken(req.Token)).Scan(&userID, &tenantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Error fetching user for password reset:", err)
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	policy, ok := checkNewPassword(w, dbInstance, tenantID, userID, req.Password)
+	if !ok {
+		return
+	}
+	hashedPassword, err := password.Hash(req.Password)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	// Setting the password and clearing the token in one statement makes the token single-use
+	res, err := dbInstance.Exec(`
+		UPDATE users SET password = $1, password_changed_at = NOW(), reset_token = NULL, reset_token_expiry = NULL, updated_at = NOW()
+		WHERE id = $2 AND reset_token = $3 AND reset_token_expiry > NOW()`,
+		hashedPassword, userID, auth.HashToken(req.Token))
+	if err != nil {
+		log.Println("Error resetting password:", err)
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err := recordPassword(dbInstance, userID, hashedPassword, policy); err != nil {
+		log.Println("Error recording password history:", err)
+	}
+
+	if err := auth.RevokeUserTokens(dbInstance, userID); err != nil {
+		log.Println("Error revoking tokens after password reset:", err)
+		http.Error(w, "Error revoking user tokens", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"sentinel/internal/auth"
+	"sentinel/internal/mail"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// recordingSender captures outgoing mail in tests
+type recordingSender struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (s *recordingSender) Send(msg mail.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+func useRecordingSender(t *testing.T) *recordingSender {
+	t.Helper()
+	s := &recordingSender{}
+	mail.SetSender(s)
+	t.Cleanup(func() { mail.SetSender(mail.LogSender{}) })
+	return s
+}
+
+// linkToken extracts the token query parameter from the link in a message body
+func linkToken(t *testing.T, body string) string {
+	t.Helper()
+	for _, field := range strings.Fields(body) {
+		if u, err := url.Parse(field); err == nil && u.Query().Get("token") != "" {
+			return u.Query().Get("token")
+		}
+	}
+	t.Fatalf("no link with a token in %q", body)
+	return ""
+}
+
+func TestForgotPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	sender := useRecordingSender(t)
+
+	mock.ExpectQuery("SELECT id, name FROM users WHERE email = \\$1 AND tenant_id = \\$2").
+		WithArgs("known@test.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(7, "Known User"))
+	mock.ExpectExec("UPDATE users SET reset_token = \\$1, reset_token_expiry = \\$2 WHERE id = \\$3").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT id, name FROM users WHERE email = \\$1 AND tenant_id = \\$2").
+		WithArgs("unknown@test.com", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+
+	var bodies []string
+	for _, email := range []string{"known@test.com", "unknown@test.com"} {
+		body, _ := json.Marshal(map[string]interface{}{"email": email, "tenant_id": 1})
+		req := httptest.NewRequest(http.MethodPost, "/password/forgot", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		forgotPassword(rr, req, db)
+
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("expected status 202 for %s, got %d", email, rr.Code)
+		}
+		bodies = append(bodies, rr.Body.String())
+	}
+
+	if bodies[0] != bodies[1] {
+		t.Errorf("responses must not reveal whether the account exists: %q vs %q", bodies[0], bodies[1])
+	}
+	if len(sender.messages) != 1 || sender.messages[0].To != "known@test.com" {
+		t.Fatalf("expected one reset email to the known user, got %+v", sender.messages)
+	}
+	linkToken(t, sender.messages[0].Body)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, tenant_id FROM users WHERE reset_token = \\$1 AND reset_token_expiry > NOW\\(\\)").
+		WithArgs(auth.HashToken("valid-token")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id"}).AddRow(7, 1))
+	mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+	mock.ExpectExec("UPDATE users SET password = \\$1, password_changed_at = NOW\\(\\), reset_token = NULL, reset_token_expiry = NULL").
+		WithArgs(sqlmock.AnyArg(), 7, auth.HashToken("valid-token")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET token_version = token_version \\+ 1 WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(7, "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").WithArgs(7, "").WillReturnResult(sqlmock.NewResult(0, 1))
+	// A consumed or expired token no longer matches
+	mock.ExpectQuery("SELECT id, tenant_id FROM users WHERE reset_token = \\$1").
+		WithArgs(auth.HashToken("valid-token")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id"}))
+
+	for _, expected := range []int{http.StatusOK, http.StatusBadRequest} {
+		body, _ := json.Marshal(map[string]string{"token": "valid-token", "password": "n3w-Passw0rd"})
+		req := httptest.NewRequest(http.MethodPost, "/password/reset", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		resetPassword(rr, req, db)
+
+		if rr.Code != expected {
+			t.Errorf("expected status %d, got %d", expected, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"sentinel/internal/password"
+	"time"
+)
+
+// writeFieldErrors rejects a request with the list of fields that failed validation
+func writeFieldErrors(w http.ResponseWriter, message string, errs []models.FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": message, "fields": errs})
+}
+
+// checkNewPassword checks a password about to be set against the tenant's policy, the
+// breached-password list and, for an existing user (userID > 0), their recent passwords.
+// It writes the error response and returns false when the password is refused.
+func checkNewPassword(w http.ResponseWriter, dbInstance *sql.DB, tenantID, userID int, pw string) (models.PasswordPolicy, bool) {
+	settings, err := loadTenantSettings(dbInstance, tenantID)
+	if err != nil {
+		log.Println("Error loading tenant settings:", err)
+		http.Error(w, "Error checking password policy", http.StatusInternalServerError)
+		return models.PasswordPolicy{}, false
+	}
+	policy := settings.PasswordPolicy
+
+	errs := password.Validate(policy, pw)
+	if n := password.HistorySize(policy); n > 0 && userID > 0 {
+		reused, err := passwordReused(dbInstance, userID, pw, n)
+		if err != nil {
+			log.Println("Error checking password history:", err)
+			http.Error(w, "Error checking password policy", http.StatusInternalServerError)
+			return policy, false
+		}
+		if reused {
+			errs = append(errs, password.ReusedError(n))
+		}
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, "Password does not meet the password policy", errs)
+		return policy, false
+	}
+	return policy, true
+}
+
+// passwordReused reports whether the password matches the user's current password or one of the last n stored ones
+func passwordReused(dbInstance *sql.DB, userID int, pw string, n int) (bool, error) {
+	rows, err := dbInstance.Query(`
+		SELECT password FROM users WHERE id = $1
+		UNION ALL
+		(SELECT password_hash FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2)`, userID, n)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return false, err
+		}
+		if ok, _, err := password.Verify(pw, hash); err == nil && ok {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// recordPassword remembers a newly set password hash when the policy keeps a history,
+// dropping entries beyond the last HistorySize
+func recordPassword(dbInstance *sql.DB, userID int, hash string, policy models.PasswordPolicy) error {
+	n := password.HistorySize(policy)
+	if n == 0 {
+		return nil
+	}
+	_, err := dbInstance.Exec(`INSERT INTO password_history (user_id, password_hash, created_at) VALUES ($1, $2, NOW())`, userID, hash)
+	if err != nil {
+		return err
+	}
+	_, err = dbInstance.Exec(`
+		DELETE FROM password_history WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2)`, userID, n)
+	return err
+}
+
+// passwordExpired reports whether the user's password is older than maxAgeDays
+func passwordExpired(dbInstance *sql.DB, userID, maxAgeDays int) (bool, error) {
+	var changedAt sql.NullTime
+	err := dbInstance.QueryRow(`SELECT password_changed_at FROM users WHERE id = $1`, userID).Scan(&changedAt)
+	if err != nil {
+		return false, err
+	}
+	return changedAt.Valid && time.Since(changedAt.Time) > time.Duration(maxAgeDays)*24*time.Hour, nil
+}
+
+// writePasswordChangeChallenge answers a login with an expired password with a token for /login/password
+func writePasswordChangeChallenge(w http.ResponseWriter, user models.User) {
+	token, _, err := auth.SignPurposeToken(auth.PurposePasswordChange, user.ID, user.TenantID, mfaChallengeTTL)
+	if err != nil {
+		log.Println("Error generating password change token:", err)
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"password_expired":      true,
+		"password_change_token": token,
+	})
+}
+
+func LoginPasswordChangeHandler(w http.ResponseWriter, r *http.Request) {
+	loginPasswordChange(w, r, db.DB)
+}
+
+// loginPasswordChange replaces an expired password with the token handed out by /login.
+// It does not sign the user in: they log in again with the new password, MFA included.
+func loginPasswordChange(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		Token    string `json:"password_change_token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	claims, err := auth.ParsePurposeToken(req.Token, auth.PurposePasswordChange)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	policy, ok := checkNewPassword(w, dbInstance, claims.TenantID, claims.UserID, req.Password)
+	if !ok {
+		return
+	}
+	hashedPassword, err := password.Hash(req.Password)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	// The token only works while the password it was issued for is in place, which makes it single-use
+	res, err := dbInstance.Exec(`
+		UPDATE users SET password = $1, password_changed_at = NOW(), updated_at = NOW()
+		WHERE id = $2 AND tenant_id = $3 AND password_changed_at <= $4`,
+		hashedPassword, claims.UserID, claims.TenantID, time.Unix(claims.IssuedAt, 0))
+	if err != nil {
+		log.Println("Error changing password:", err)
+		http.Error(w, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if err := recordPassword(dbInstance, claims.UserID, hashedPassword, policy); err != nil {
+		log.Println("Error recording password history:", err)
+	}
+	if err := auth.RevokeUserTokens(dbInstance, claims.UserID); err != nil {
+		log.Println("Error revoking tokens after password change:", err)
+		http.Error(w, "Error revoking user tokens", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed, log in with the new password"})
+}
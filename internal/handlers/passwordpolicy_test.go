@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+	"sentinel/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fieldErrorCodes decodes a field error response into its error codes
+func fieldErrorCodes(t *testing.T, rr *httptest.ResponseRecorder) map[string]bool {
+	t.Helper()
+	var response struct {
+		Fields []models.FieldError `json:"fields"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("expected a field error response: %v", err)
+	}
+	codes := map[string]bool{}
+	for _, f := range response.Fields {
+		codes[f.Code] = true
+	}
+	return codes
+}
+
+func expectResetTarget(mock sqlmock.Sqlmock, settings string) {
+	mock.ExpectQuery("SELECT id, tenant_id FROM users WHERE reset_token = \\$1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id"}).AddRow(7, 1))
+	mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow([]byte(settings)))
+}
+
+func TestResetPassword_PolicyViolation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectResetTarget(mock, `{"password_policy": {"min_length": 12, "require_digit": true}}`)
+
+	rr, _ := postJSON(t, func(w http.ResponseWriter, r *http.Request) { resetPassword(w, r, db) },
+		map[string]string{"token": "valid-token", "password": "short"})
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rr.Code)
+	}
+	codes := fieldErrorCodes(t, rr)
+	if !codes["too_short"] || !codes["missing_digit"] || len(codes) != 2 {
+		t.Errorf("expected too_short and missing_digit, got %v", codes)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestResetPassword_History(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	current, _ := bcrypt.GenerateFromPassword([]byte("current-password"), bcrypt.MinCost)
+	previous, _ := bcrypt.GenerateFromPassword([]byte("previous-password"), bcrypt.MinCost)
+	historyRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"password"}).AddRow(string(current)).AddRow(string(previous))
+	}
+
+	// A recent password is refused
+	expectResetTarget(mock, `{"password_policy": {"history": 3}}`)
+	mock.ExpectQuery("SELECT password FROM users WHERE id = \\$1 UNION ALL").
+		WithArgs(7, 3).
+		WillReturnRows(historyRows())
+
+	// A new one is accepted and remembered
+	expectResetTarget(mock, `{"password_policy": {"history": 3}}`)
+	mock.ExpectQuery("SELECT password FROM users WHERE id = \\$1 UNION ALL").
+		WithArgs(7, 3).
+		WillReturnRows(historyRows())
+	mock.ExpectExec("UPDATE users SET password = \\$1, password_changed_at = NOW\\(\\)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO password_history").
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM password_history WHERE user_id = \\$1 AND id NOT IN").
+		WithArgs(7, 3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE users SET token_version").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	handler := func(w http.ResponseWriter, r *http.Request) { resetPassword(w, r, db) }
+	rr, _ := postJSON(t, handler, map[string]string{"token": "valid-token", "password": "previous-password"})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rr.Code)
+	}
+	if codes := fieldErrorCodes(t, rr); !codes["reused"] {
+		t.Errorf("expected a reused error, got %v", codes)
+	}
+
+	rr, _ = postJSON(t, handler, map[string]string{"token": "valid-token", "password": "brand-new-password"})
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestLoginHandler_PasswordExpired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	expectLoginAllowed(mock)
+	mock.ExpectQuery("SELECT u.id, u.name, u.password").
+		WillReturnRows(sqlmock.NewRows(loginColumns).AddRow(7, "Old User", string(hashedPassword), 1, "member", 0, true, false))
+	expectLoginSuccess(mock)
+	mock.ExpectQuery("SELECT settings FROM tenant_settings").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow([]byte(`{"password_policy": {"max_age_days": 90}}`)))
+	mock.ExpectQuery("SELECT password_changed_at FROM users WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"password_changed_at"}).AddRow(time.Now().Add(-100 * 24 * time.Hour)))
+
+	rr, response := postJSON(t, func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, db) },
+		map[string]interface{}{"email": "old@test.com", "password": "password123", "tenant_id": 1})
+
+	if rr.Code != http.StatusForbidden || response["password_expired"] != true {
+		t.Fatalf("expected a password change challenge, got %d: %v", rr.Code, response)
+	}
+	if _, ok := response["token"]; ok {
+		t.Error("no access token may be issued for an expired password")
+	}
+	token, _ := response["password_change_token"].(string)
+	if _, err := auth.ParsePurposeToken(token, auth.PurposePasswordChange); err != nil {
+		t.Fatalf("expected a password change token: %v", err)
+	}
+
+	// The token sets a new password once
+	mock.ExpectQuery("SELECT settings FROM tenant_settings").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow([]byte(`{"password_policy": {"max_age_days": 90}}`)))
+	mock.ExpectExec("UPDATE users SET password = \\$1, password_changed_at = NOW\\(\\), updated_at = NOW\\(\\)").
+		WithArgs(sqlmock.AnyArg(), 7, 1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET token_version").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT settings FROM tenant_settings").
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+	mock.ExpectExec("UPDATE users SET password = \\$1, password_changed_at = NOW\\(\\), updated_at = NOW\\(\\)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	change := func(w http.ResponseWriter, r *http.Request) { loginPasswordChange(w, r, db) }
+	for _, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		rr, _ = postJSON(t, change, map[string]string{"password_change_token": token, "password": "a-new-password"})
+		if rr.Code != expected {
+			t.Errorf("expected status %d, got %d", expected, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestUpdateTenantSettings_InvalidPolicy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+
+	body := []byte(`{"password_policy": {"history": 100, "max_age_days": -1}}`)
+	req := httptest.NewRequest(http.MethodPut, "/api/tenant/settings", bytes.NewReader(body)).
+		WithContext(sessionContext(1, 1, "admin", "s1"))
+	rr := httptest.NewRecorder()
+
+	updateTenantSettings(rr, req, db)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rr.Code)
+	}
+	if codes := fieldErrorCodes(t, rr); !codes["invalid"] {
+		t.Errorf("expected invalid field errors, got %v", codes)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
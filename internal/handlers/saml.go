@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sentinel/internal/audit"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"sentinel/internal/samlsp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How long the user has to sign in at the IdP after an SP-initiated login starts
+	samlRequestTTL = 10 * time.Minute
+	// Assertion IDs are remembered this long after the assertion expires, to refuse replays
+	samlReplayWindow = 10 * time.Minute
+)
+
+// SAML single sign-on is a feature of the enterprise tier
+const samlTier = "enterprise"
+
+// samlRelayStateCookie binds an SP-initiated login to the browser that started it. The
+// IdP posts its response from another site, so the cookie has to be SameSite=None.
+const samlRelayStateCookie = "saml_relay_state"
+
+// samlACSPath is the path of the tenant's ACS, where the relay state cookie is sent
+func samlACSPath(tenantID int) string {
+	acs, _ := url.Parse(samlsp.ACSURL(tenantID))
+	return acs.Path
+}
+
+func SAMLMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	samlMetadata(w, r, db.DB)
+}
+
+func StartSAMLLoginHandler(w http.ResponseWriter, r *http.Request) {
+	startSAMLLogin(w, r, db.DB)
+}
+
+func SAMLACSHandler(w http.ResponseWriter, r *http.Request) {
+	samlACS(w, r, db.DB)
+}
+
+func GetSAMLConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	getSAMLConnection(w, r, db.DB)
+}
+
+func UpdateSAMLConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	updateSAMLConnection(w, r, db.DB)
+}
+
+func DeleteSAMLConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	deleteSAMLConnection(w, r, db.DB)
+}
+
+// loadSAMLConnection returns the SAML connection of a tenant. Tenants that left the
+// enterprise tier keep their connection but cannot use it (sql.ErrNoRows).
+func loadSAMLConnection(dbInstance *sql.DB, tenantID int) (models.SAMLConnection, error) {
+	c := models.SAMLConnection{TenantID: tenantID}
+	var mapping []byte
+	err := dbInstance.QueryRow(`
+		SELECT s.idp_entity_id, s.idp_metadata, s.mapping, s.default_role, s.auto_provision, s.allow_idp_initiated, s.created_at, s.updated_at
+		FROM saml_connections s
+		JOIN tenants t ON t.id = s.tenant_id
+		JOIN tiers ti ON ti.id = t.tier_id
+		WHERE s.tenant_id = $1 AND ti.name = $2`, tenantID, samlTier).
+		Scan(&c.IdPEntityID, &c.IdPMetadata, &mapping, &c.DefaultRole, &c.AutoProvision, &c.AllowIdPInitiated, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return c, err
+	}
+	if len(mapping) > 0 {
+		err = json.Unmarshal(mapping, &c.Mapping)
+	}
+	return c, err
+}
+
+// samlTenant reads the tenant ID of a /saml/{tenant_id}/... route and loads its connection.
+// It writes the error response when there is none.
+func samlTenant(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) (models.SAMLConnection, bool) {
+	tenantID, err := strconv.Atoi(mux.Vars(r)["tenant_id"])
+	if err != nil {
+		http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+		return models.SAMLConnection{}, false
+	}
+	conn, err := loadSAMLConnection(dbInstance, tenantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "SAML is not configured for this tenant", http.StatusNotFound)
+		return conn, false
+	}
+	if err != nil {
+		log.Println("Error loading SAML connection:", err)
+		http.Error(w, "Error loading SAML connection", http.StatusInternalServerError)
+		return conn, false
+	}
+	return conn, true
+}
+
+// samlMetadata publishes the tenant's SP metadata for the IdP
+func samlMetadata(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	conn, ok := samlTenant(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	sp, err := samlsp.New(conn.TenantID, []byte(conn.IdPMetadata), conn.AllowIdPInitiated)
+	if err == nil {
+		var md []byte
+		if md, err = samlsp.Metadata(sp); err == nil {
+			w.Header().Set("Content-Type", "application/samlmetadata+xml")
+			w.Write(md)
+			return
+		}
+	}
+	log.Println("Error building SAML metadata:", err)
+	http.Error(w, "Error building SAML metadata", http.StatusInternalServerError)
+}
+
+// startSAMLLogin sends the browser to the IdP with an AuthnRequest. Its ID is kept server
+// side, keyed by the hash of the RelayState, so the response can be matched to it.
+func startSAMLLogin(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	conn, ok := samlTenant(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	sp, err := samlsp.New(conn.TenantID, []byte(conn.IdPMetadata), false)
+	if err != nil {
+		log.Println("Error building SAML service provider:", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	authnRequest, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		log.Println("Error creating SAML request:", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	relayState, err := auth.RandomToken(32)
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	_, err = dbInstance.Exec(`
+		WITH expired AS (DELETE FROM saml_requests WHERE expires_at < NOW())
+		INSERT INTO saml_requests (relay_state_hash, request_id, tenant_id, return_to, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		auth.HashToken(relayState), authnRequest.ID, conn.TenantID,
+		safeReturnTo(r.URL.Query().Get("return_to")), time.Now().Add(samlRequestTTL))
+	if err != nil {
+		log.Println("Error storing SAML request:", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := authnRequest.Redirect(relayState, sp)
+	if err != nil {
+		log.Println("Error encoding SAML request:", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	setLoginStateCookie(w, samlRelayStateCookie, samlACSPath(conn.TenantID), relayState, samlRequestTTL, http.SameSiteNoneMode)
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// samlACS receives the IdP's response through the HTTP-POST binding. A RelayState issued
+// by startSAMLLogin ties the response to its AuthnRequest, and is only accepted from the
+// browser that started the login; without one the response is only accepted when the
+// tenant allows IdP-initiated logins. Like federated logins, the
+// browser is sent on to the frontend with a login code for /login/federated/complete.
+func samlACS(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	fail := func(reason string) {
+		http.Redirect(w, r, publicURL("/login", url.Values{"error": {reason}}), http.StatusFound)
+	}
+	conn, ok := samlTenant(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("SAMLResponse") == "" {
+		http.Error(w, "Missing SAMLResponse", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		requestIDs []string
+		returnTo   string
+	)
+	relayState := r.PostForm.Get("RelayState")
+	if relayState != "" {
+		var (
+			requestID string
+			expiresAt time.Time
+		)
+		err := dbInstance.QueryRow(`
+			DELETE FROM saml_requests WHERE relay_state_hash = $1 AND tenant_id = $2
+			RETURNING request_id, COALESCE(return_to, ''), expires_at`, auth.HashToken(relayState), conn.TenantID).
+			Scan(&requestID, &returnTo, &expiresAt)
+		switch {
+		case err == nil && time.Now().After(expiresAt):
+			fail(federatedErrFailed)
+			return
+		case err == nil && !checkLoginStateCookie(w, r, samlRelayStateCookie, samlACSPath(conn.TenantID), relayState):
+			log.Printf("Refused SAML response for tenant %d from a browser that did not start the login", conn.TenantID)
+			fail(federatedErrFailed)
+			return
+		case err == nil:
+			requestIDs = []string{requestID}
+		case err != sql.ErrNoRows:
+			log.Println("Error loading SAML request:", err)
+			fail(federatedErrFailed)
+			return
+		}
+	}
+	idpInitiated := requestIDs == nil
+	if idpInitiated {
+		if !conn.AllowIdPInitiated {
+			log.Printf("Refused unsolicited SAML response for tenant %d", conn.TenantID)
+			fail(federatedErrFailed)
+			return
+		}
+		// IdPs commonly send the target URL as RelayState
+		returnTo = safeReturnTo(relayState)
+	}
+
+	sp, err := samlsp.New(conn.TenantID, []byte(conn.IdPMetadata), idpInitiated)
+	if err != nil {
+		log.Println("Error building SAML service provider:", err)
+		fail(federatedErrFailed)
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLResponse"))
+	if err != nil {
+		http.Error(w, "Invalid SAMLResponse", http.StatusBadRequest)
+		return
+	}
+	assertion, err := sp.ParseXMLResponse(raw, requestIDs, sp.AcsURL)
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		log.Printf("Invalid SAML response for tenant %d: %v", conn.TenantID, err)
+		fail(federatedErrFailed)
+		return
+	}
+	if !recordSAMLAssertion(dbInstance, conn.TenantID, assertion) {
+		fail(federatedErrFailed)
+		return
+	}
+
+	user, reason := resolveSAMLUser(dbInstance, r, conn, assertion)
+	if reason != "" {
+		fail(reason)
+		return
+	}
+	code, err := storeFederatedLoginCode(dbInstance, sql.NullInt64{}, user, returnTo)
+	if err != nil {
+		log.Println("Error storing federated login code:", err)
+		fail(federatedErrFailed)
+		return
+	}
+	http.Redirect(w, r, publicURL("/login/federated", url.Values{"login_code": {code}}), http.StatusFound)
+}
+
+// recordSAMLAssertion remembers the assertion's ID until it has expired, so the same
+// assertion cannot be posted twice. It returns false for a replayed assertion.
+func recordSAMLAssertion(dbInstance *sql.DB, tenantID int, assertion *saml.Assertion) bool {
+	expiresAt := time.Now()
+	if assertion.Conditions != nil && assertion.Conditions.NotOnOrAfter.After(expiresAt) {
+		expiresAt = assertion.Conditions.NotOnOrAfter
+	}
+	res, err := dbInstance.Exec(`
+		WITH expired AS (DELETE FROM saml_assertions WHERE expires_at < NOW())
+		INSERT INTO saml_assertions (tenant_id, assertion_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id, assertion_id) DO NOTHING`,
+		tenantID, assertion.ID, expiresAt.Add(samlReplayWindow))
+	if err != nil {
+		log.Println("Error recording SAML assertion:", err)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("Refused replayed SAML assertion %s for tenant %d", assertion.ID, tenantID)
+		return false
+	}
+	return true
+}
+
+// resolveSAMLUser maps an assertion to a user of the tenant. The IdP is authoritative for
+// the tenant, so users are matched by email address and their mapped role is applied on
+// every login; mapped teams are added to the user's teams.
+func resolveSAMLUser(dbInstance *sql.DB, r *http.Request, conn models.SAMLConnection, assertion *saml.Assertion) (models.User, string) {
+	attrs := samlsp.Attributes(assertion)
+	mapping := conn.Mapping
+	first := func(name string) string {
+		if values := attrs[name]; name != "" && len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+
+	email := strings.TrimSpace(samlsp.NameID(assertion))
+	if mapping.Email != "" {
+		email = first(mapping.Email)
+	}
+	if !strings.Contains(email, "@") {
+		return models.User{}, federatedErrMissingEmail
+	}
+	role := mappedRole(mapping.Roles, attrs[mapping.Role])
+
+	user := models.User{TenantID: conn.TenantID}
+	err := dbInstance.QueryRow(`SELECT id, name, email, role, token_version FROM users WHERE LOWER(email) = LOWER($1) AND tenant_id = $2`, email, conn.TenantID).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.TokenVersion)
+	switch {
+	case err == nil:
+		if !syncMappedRole(dbInstance, r, &user, role, audit.EventSAMLRoleSynced) {
+			return user, federatedErrFailed
+		}
+	case err != sql.ErrNoRows:
+		log.Println("Error looking up user by email:", err)
+		return user, federatedErrFailed
+	case !conn.AutoProvision:
+		return user, federatedErrNoAccount
+	default:
+		user.Name, user.Email, user.Role = first(mapping.Name), email, role
+		if user.Name == "" {
+			user.Name = email
+		}
+		if user.Role == "" {
+			user.Role = conn.DefaultRole
+		}
+		if err := provisionExternalUser(dbInstance, &user, true); err != nil {
+			log.Println("Error provisioning SAML user:", err)
+			return user, federatedErrFailed
+		}
+		recordAudit(dbInstance, r, audit.Entry{TenantID: conn.TenantID, ActorID: user.ID, Event: audit.EventFederatedJIT,
+			Subject: user.Email, Details: map[string]interface{}{"protocol": "saml"}})
+	}
+
+	addMappedTeams(dbInstance, user, mapping.Teams, attrs[mapping.Team])
+	return user, ""
+}
+
+// samlConnectionResponse is the admin view of a connection, with the values to enter at the IdP
+func samlConnectionResponse(conn models.SAMLConnection) map[string]interface{} {
+	return map[string]interface{}{
+		"connection":   conn,
+		"entity_id":    samlsp.MetadataURL(conn.TenantID),
+		"metadata_url": samlsp.MetadataURL(conn.TenantID),
+		"acs_url":      samlsp.ACSURL(conn.TenantID),
+		"login_url":    auth.Issuer() + "/saml/" + strconv.Itoa(conn.TenantID) + "/login",
+	}
+}
+
+// getSAMLConnection returns the SAML connection of the admin's tenant
+func getSAMLConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	conn, err := loadSAMLConnection(dbInstance, tenantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "SAML is not configured for this tenant", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error loading SAML connection:", err)
+		http.Error(w, "Error loading SAML connection", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samlConnectionResponse(conn))
+}
+
+// updateSAMLConnection creates or replaces the SAML connection of the admin's tenant.
+// Only enterprise tenants can configure one.
+func updateSAMLConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	var tier string
+	err := dbInstance.QueryRow(`SELECT ti.name FROM tenants t JOIN tiers ti ON ti.id = t.tier_id WHERE t.id = $1`, tenantID).Scan(&tier)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error loading tenant tier:", err)
+		http.Error(w, "Error updating SAML connection", http.StatusInternalServerError)
+		return
+	}
+	if tier != samlTier {
+		http.Error(w, "SAML single sign-on requires the enterprise tier", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		IdPMetadata       string                      `json:"idp_metadata"`
+		Mapping           models.SAMLAttributeMapping `json:"mapping"`
+		DefaultRole       string                      `json:"default_role"`
+		AutoProvision     *bool                       `json:"auto_provision"`
+		AllowIdPInitiated bool                        `json:"allow_idp_initiated"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	conn := models.SAMLConnection{
+		TenantID:          tenantID,
+		IdPMetadata:       req.IdPMetadata,
+		Mapping:           req.Mapping,
+		DefaultRole:       req.DefaultRole,
+		AutoProvision:     req.AutoProvision == nil || *req.AutoProvision,
+		AllowIdPInitiated: req.AllowIdPInitiated,
+	}
+	if conn.DefaultRole == "" {
+		conn.DefaultRole = "member"
+	}
+	md, err := samlsp.ParseIdPMetadata([]byte(conn.IdPMetadata))
+	if err != nil {
+		writeFieldErrors(w, "Invalid SAML connection", []models.FieldError{{Field: "idp_metadata", Code: "invalid", Message: err.Error()}})
+		return
+	}
+	conn.IdPEntityID = md.EntityID
+
+	mapping, err := json.Marshal(conn.Mapping)
+	if err != nil {
+		http.Error(w, "Error updating SAML connection", http.StatusInternalServerError)
+		return
+	}
+	err = dbInstance.QueryRow(`
+		INSERT INTO saml_connections (tenant_id, idp_entity_id, idp_metadata, mapping, default_role, auto_provision, allow_idp_initiated, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW())
+		ON CONFLICT (tenant_id) DO UPDATE SET
+			idp_entity_id = EXCLUDED.idp_entity_id, idp_metadata = EXCLUDED.idp_metadata, mapping = EXCLUDED.mapping,
+			default_role = EXCLUDED.default_role, auto_provision = EXCLUDED.auto_provision,
+			allow_idp_initiated = EXCLUDED.allow_idp_initiated, updated_at = NOW()
+		RETURNING created_at, updated_at`,
+		tenantID, conn.IdPEntityID, conn.IdPMetadata, mapping, conn.DefaultRole, conn.AutoProvision, conn.AllowIdPInitiated).
+		Scan(&conn.CreatedAt, &conn.UpdatedAt)
+	if err != nil {
+		log.Println("Error updating SAML connection:", err)
+		http.Error(w, "Error updating SAML connection", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samlConnectionResponse(conn))
+}
+
+// deleteSAMLConnection turns SAML single sign-on off for the admin's tenant. Users it
+// provisioned keep their accounts.
+func deleteSAMLConnection(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	res, err := dbInstance.Exec(`DELETE FROM saml_connections WHERE tenant_id = $1`, tenantID)
+	if err != nil {
+		log.Println("Error deleting SAML connection:", err)
+		http.Error(w, "Error deleting SAML connection", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "SAML is not configured for this tenant", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "SAML connection deleted successfully"})
+}
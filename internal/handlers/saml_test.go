@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+	"sentinel/internal/models"
+	"sentinel/internal/samlsp"
+	"sentinel/internal/samlsp/samlsptest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+const samlMapping = `{"role":"groups","roles":{"admins":"admin","staff":"member"},"team":"groups","teams":{"engineering":"Engineering"}}`
+
+func expectSAMLConnection(mock sqlmock.Sqlmock, idp *samlsptest.IdP, allowIdPInitiated bool) {
+	mock.ExpectQuery("FROM saml_connections s").
+		WithArgs(4, "enterprise").
+		WillReturnRows(sqlmock.NewRows([]string{"idp_entity_id", "idp_metadata", "mapping", "default_role", "auto_provision", "allow_idp_initiated", "created_at", "updated_at"}).
+			AddRow(idp.MetadataURL.String(), string(idp.MetadataXML()), []byte(samlMapping), "member", true, allowIdPInitiated, time.Now(), time.Now()))
+}
+
+func samlRequest(method, target string, body url.Values) *http.Request {
+	var req *http.Request
+	if body != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	return mux.SetURLVars(req, map[string]string{"tenant_id": "4"})
+}
+
+// startSAMLRequest runs an SP-initiated login up to the redirect to the IdP and returns
+// the ID of the AuthnRequest, the RelayState and the cookie binding it to the browser
+func startSAMLRequest(t *testing.T, mock sqlmock.Sqlmock, idp *samlsptest.IdP, start func(w http.ResponseWriter, r *http.Request)) (string, string, *http.Cookie) {
+	t.Helper()
+	var requestID string
+	expectSAMLConnection(mock, idp, false)
+	mock.ExpectExec("INSERT INTO saml_requests").
+		WithArgs(sqlmock.AnyArg(), captureString{&requestID}, 4, "/dashboard", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	start(rr, samlRequest(http.MethodGet, "/saml/4/login?return_to=/dashboard", nil))
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	if rr.Code != http.StatusFound || !strings.HasPrefix(location.String(), idp.SSOURL.String()) || location.Query().Get("SAMLRequest") == "" {
+		t.Fatalf("expected a redirect to the IdP, got %d %q", rr.Code, location)
+	}
+	relayState := location.Query().Get("RelayState")
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != samlRelayStateCookie || cookies[0].Value != auth.HashToken(relayState) ||
+		cookies[0].Path != "/saml/4/acs" || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].SameSite != http.SameSiteNoneMode {
+		t.Fatalf("expected the RelayState to be bound to the browser, got %+v", cookies)
+	}
+	return requestID, relayState, cookies[0]
+}
+
+func TestSAMLLogin(t *testing.T) {
+	userColumns := []string{"id", "name", "email", "role", "token_version"}
+	attrs := map[string][]string{"groups": {"engineering", "admins"}, "displayName": {"Jane"}}
+
+	t.Run("SP-initiated login syncs role and teams", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		defer db.Close()
+		idp := samlsptest.NewIdP("https://idp.example.com")
+		requestID, relayState, cookie := startSAMLRequest(t, mock, idp, func(w http.ResponseWriter, r *http.Request) { startSAMLLogin(w, r, db) })
+
+		sp, _ := samlsp.New(4, idp.MetadataXML(), false)
+		response := idp.Response(sp, requestID, "jane@example.com", attrs)
+
+		expectSAMLConnection(mock, idp, false)
+		mock.ExpectQuery("DELETE FROM saml_requests").
+			WithArgs(auth.HashToken(relayState), 4).
+			WillReturnRows(sqlmock.NewRows([]string{"request_id", "return_to", "expires_at"}).AddRow(requestID, "/dashboard", time.Now().Add(time.Minute)))
+		mock.ExpectExec("INSERT INTO saml_assertions").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("SELECT id, name, email, role, token_version FROM users").
+			WithArgs("jane@example.com", 4).
+			WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "Jane", "jane@example.com", "member", 2))
+		mock.ExpectQuery("UPDATE users SET role = \\$1, token_version = token_version \\+ 1").
+			WithArgs("admin", 7).
+			WillReturnRows(sqlmock.NewRows([]string{"token_version"}).AddRow(3))
+		mock.ExpectExec("INSERT INTO audit_log").
+			WithArgs(4, 7, "saml_role_synced", "jane@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO user_teams").
+			WithArgs(7, 4, "Engineering").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO federated_logins").
+			WithArgs(sqlmock.AnyArg(), nil, 4, 7, "/dashboard", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		req := samlRequest(http.MethodPost, "/saml/4/acs", url.Values{"SAMLResponse": {response}, "RelayState": {relayState}})
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		samlACS(rr, req, db)
+
+		location, _ := url.Parse(rr.Header().Get("Location"))
+		if rr.Code != http.StatusFound || location.Path != "/login/federated" || location.Query().Get("login_code") == "" {
+			t.Errorf("expected a login code for the frontend, got %d %s", rr.Code, location)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet sqlmock expectations: %v", err)
+		}
+	})
+
+	t.Run("SP-initiated login finished in another browser", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		defer db.Close()
+		idp := samlsptest.NewIdP("https://idp.example.com")
+		requestID, relayState, _ := startSAMLRequest(t, mock, idp, func(w http.ResponseWriter, r *http.Request) { startSAMLLogin(w, r, db) })
+
+		// The attacker's own response and RelayState, posted by the victim's browser
+		sp, _ := samlsp.New(4, idp.MetadataXML(), false)
+		response := idp.Response(sp, requestID, "attacker@example.com", nil)
+		expectSAMLConnection(mock, idp, false)
+		mock.ExpectQuery("DELETE FROM saml_requests").
+			WithArgs(auth.HashToken(relayState), 4).
+			WillReturnRows(sqlmock.NewRows([]string{"request_id", "return_to", "expires_at"}).AddRow(requestID, "/dashboard", time.Now().Add(time.Minute)))
+
+		rr := httptest.NewRecorder()
+		samlACS(rr, samlRequest(http.MethodPost, "/saml/4/acs", url.Values{"SAMLResponse": {response}, "RelayState": {relayState}}), db)
+
+		location, _ := url.Parse(rr.Header().Get("Location"))
+		if rr.Code != http.StatusFound || location.Path != "/login" || location.Query().Get("error") != "federated_login_failed" {
+			t.Errorf("expected the login to be refused, got %d %s", rr.Code, location)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet sqlmock expectations: %v", err)
+		}
+	})
+
+	tests := []struct {
+		name              string
+		allowIdPInitiated bool
+		replayed          bool
+		wantError         string
+	}{
+		{name: "IdP-initiated login provisions the user", allowIdPInitiated: true},
+		{name: "IdP-initiated login refused", allowIdPInitiated: false, wantError: "federated_login_failed"},
+		{name: "Replayed assertion", allowIdPInitiated: true, replayed: true, wantError: "federated_login_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			idp := samlsptest.NewIdP("https://idp.example.com")
+			sp, _ := samlsp.New(4, idp.MetadataXML(), true)
+			response := idp.Response(sp, "", "jane@example.com", map[string][]string{"groups": {"staff"}})
+
+			expectSAMLConnection(mock, idp, tt.allowIdPInitiated)
+			// The target URL the IdP sends as RelayState matches no SP-initiated request
+			mock.ExpectQuery("DELETE FROM saml_requests").
+				WithArgs(auth.HashToken("/apps"), 4).
+				WillReturnRows(sqlmock.NewRows([]string{"request_id", "return_to", "expires_at"}))
+			if tt.allowIdPInitiated {
+				rowsAffected := int64(1)
+				if tt.replayed {
+					rowsAffected = 0
+				}
+				mock.ExpectExec("INSERT INTO saml_assertions").WillReturnResult(sqlmock.NewResult(0, rowsAffected))
+			}
+			if tt.wantError == "" {
+				mock.ExpectQuery("SELECT id, name, email, role, token_version FROM users").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectQuery("INSERT INTO users").
+					WithArgs(4, "jane@example.com", "jane@example.com", sqlmock.AnyArg(), "member", true).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "token_version"}).AddRow(8, 0))
+				mock.ExpectExec("INSERT INTO audit_log").
+					WithArgs(4, 8, "federated_user_provisioned", "jane@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO federated_logins").
+					WithArgs(sqlmock.AnyArg(), nil, 4, 8, "/apps", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			rr := httptest.NewRecorder()
+			samlACS(rr, samlRequest(http.MethodPost, "/saml/4/acs", url.Values{"SAMLResponse": {response}, "RelayState": {"/apps"}}), db)
+
+			location, _ := url.Parse(rr.Header().Get("Location"))
+			if rr.Code != http.StatusFound {
+				t.Fatalf("expected status 302, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if tt.wantError != "" {
+				if location.Path != "/login" || location.Query().Get("error") != tt.wantError {
+					t.Errorf("expected the login page with error %s, got %s", tt.wantError, location)
+				}
+			} else if location.Path != "/login/federated" || location.Query().Get("login_code") == "" {
+				t.Errorf("expected a login code for the frontend, got %s", location)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestSAMLMetadata_NotEnterprise(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	mock.ExpectQuery("FROM saml_connections s").WithArgs(4, "enterprise").WillReturnRows(sqlmock.NewRows([]string{"idp_entity_id"}))
+
+	rr := httptest.NewRecorder()
+	samlMetadata(rr, samlRequest(http.MethodGet, "/saml/4/metadata", nil), db)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rr.Code)
+	}
+}
+
+func TestUpdateSAMLConnection(t *testing.T) {
+	idp := samlsptest.NewIdP("https://idp.example.com")
+	tests := []struct {
+		name           string
+		tier           string
+		metadata       string
+		expectedStatus int
+	}{
+		{"Enterprise tenant", "enterprise", string(idp.MetadataXML()), http.StatusOK},
+		{"Pro tenant", "pro", string(idp.MetadataXML()), http.StatusForbidden},
+		{"Invalid metadata", "enterprise", "<EntityDescriptor/>", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT ti.name FROM tenants t JOIN tiers ti").
+				WithArgs(4).
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow(tt.tier))
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectQuery("INSERT INTO saml_connections").
+					WithArgs(4, "https://idp.example.com", tt.metadata, []byte(samlMapping), "member", true, false).
+					WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at"}).AddRow(time.Now(), time.Now()))
+			}
+
+			raw, _ := json.Marshal(map[string]interface{}{"idp_metadata": tt.metadata, "mapping": json.RawMessage(samlMapping)})
+			req := httptest.NewRequest(http.MethodPut, "/api/saml", bytes.NewReader(raw)).WithContext(sessionContext(1, 4, "admin", "s1"))
+			rr := httptest.NewRecorder()
+			updateSAMLConnection(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusOK && !strings.Contains(rr.Body.String(), samlsp.ACSURL(4)) {
+				t.Errorf("expected the ACS URL in the response: %s", rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestMappedRole(t *testing.T) {
+	var mapping models.SAMLAttributeMapping
+	json.Unmarshal([]byte(samlMapping), &mapping)
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"staff", "admins"}, "admin"},
+		{[]string{"engineering", "staff"}, "member"},
+		{[]string{"engineering"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := mappedRole(mapping.Roles, tt.values); got != tt.want {
+			t.Errorf("mappedRole(%v) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
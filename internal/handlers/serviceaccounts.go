@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func ListServiceAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	listServiceAccounts(w, r, db.DB)
+}
+
+func CreateServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	createServiceAccount(w, r, db.DB)
+}
+
+func DeleteServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	deleteServiceAccount(w, r, db.DB)
+}
+
+func RotateServiceAccountSecretHandler(w http.ResponseWriter, r *http.Request) {
+	rotateServiceAccountSecret(w, r, db.DB)
+}
+
+func OAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	oauthToken(w, r, db.DB)
+}
+
+// serviceAccountScopes are the scopes a service account can hold, in the order they are granted
+var serviceAccountScopes = []string{auth.ScopeRead, auth.ScopeWrite}
+
+// humanAdmin is tenantAdmin for requests made by a signed-in admin: service accounts and
+// API keys cannot manage service accounts, so a leaked credential cannot mint new ones
+func humanAdmin(w http.ResponseWriter, r *http.Request) (int, bool) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return 0, false
+	}
+	ctx := r.Context()
+	if auth.GetPrincipalType(ctx) != auth.PrincipalUser || auth.GetAPIKeyID(ctx) != 0 {
+		http.Error(w, "Service accounts can only be managed by a signed-in admin", http.StatusForbidden)
+		return 0, false
+	}
+	return tenantID, true
+}
+
+// createServiceAccount adds a service account to the admin's tenant. Its client secret is
+// only returned here; Sentinel keeps its hash.
+func createServiceAccount(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := humanAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name   string   `json:"name"`
+		Role   string   `json:"role"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	errs := []models.FieldError{}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		errs = append(errs, models.FieldError{Field: "name", Code: "required", Message: "is required"})
+	}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, models.FieldError{Field: "scopes", Code: "required", Message: "needs at least one scope"})
+	}
+	for _, s := range req.Scopes {
+		if !auth.ValidScope(s) {
+			errs = append(errs, models.FieldError{Field: "scopes", Code: "invalid", Message: "unknown scope " + strconv.Quote(s)})
+		}
+	}
+	if req.Role == "" {
+		req.Role = "member"
+	} else if !auth.ValidRole(req.Role) {
+		errs = append(errs, models.FieldError{Field: "role", Code: "invalid", Message: "unknown role " + strconv.Quote(req.Role)})
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, "Invalid service account", errs)
+		return
+	}
+
+	account := models.ServiceAccount{TenantID: tenantID, Name: req.Name, Role: req.Role, Scopes: req.Scopes}
+	clientID, err := auth.RandomToken(16)
+	if err != nil {
+		http.Error(w, "Error creating service account", http.StatusInternalServerError)
+		return
+	}
+	account.ClientID = auth.ServiceAccountClientIDPrefix + clientID
+	secret, err := auth.RandomToken(32)
+	if err != nil {
+		http.Error(w, "Error creating service account", http.StatusInternalServerError)
+		return
+	}
+	scopes, _ := json.Marshal(req.Scopes)
+
+	err = dbInstance.QueryRow(`
+		INSERT INTO service_accounts (tenant_id, name, client_id, client_secret_hash, role, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		RETURNING id, created_at`, tenantID, account.Name, account.ClientID, auth.HashToken(secret), account.Role, scopes).
+		Scan(&account.ID, &account.CreatedAt)
+	if err != nil {
+		log.Println("Error creating service account:", err)
+		http.Error(w, "Error creating service account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"service_account": account, "client_secret": secret})
+}
+
+// listServiceAccounts returns the service accounts of the admin's tenant
+func listServiceAccounts(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	rows, err := dbInstance.Query(`
+		SELECT id, name, client_id, role, scopes, last_used_at, created_at
+		FROM service_accounts WHERE tenant_id = $1 ORDER BY created_at`, tenantID)
+	if err != nil {
+		log.Println("Error listing service accounts:", err)
+		http.Error(w, "Error retrieving service accounts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []models.ServiceAccount{}
+	for rows.Next() {
+		var (
+			a          = models.ServiceAccount{TenantID: tenantID}
+			scopes     []byte
+			lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&a.ID, &a.Name, &a.ClientID, &a.Role, &scopes, &lastUsedAt, &a.CreatedAt); err != nil {
+			log.Println("Error reading service account:", err)
+			http.Error(w, "Error retrieving service accounts", http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(scopes, &a.Scopes)
+		if lastUsedAt.Valid {
+			a.LastUsedAt = &lastUsedAt.Time
+		}
+		accounts = append(accounts, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// deleteServiceAccount removes a service account of the admin's tenant. Its tokens stop
+// working at once.
+func deleteServiceAccount(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := humanAdmin(w, r)
+	if !ok {
+		return
+	}
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid service account ID", http.StatusBadRequest)
+		return
+	}
+	res, err := dbInstance.Exec(`DELETE FROM service_accounts WHERE id = $1 AND tenant_id = $2`, accountID, tenantID)
+	if err != nil {
+		log.Println("Error deleting service account:", err)
+		http.Error(w, "Error deleting service account", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Service account not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Service account deleted successfully"})
+}
+
+// rotateServiceAccountSecret replaces the client secret of a service account and revokes
+// the tokens issued with the old one
+func rotateServiceAccountSecret(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := humanAdmin(w, r)
+	if !ok {
+		return
+	}
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid service account ID", http.StatusBadRequest)
+		return
+	}
+	secret, err := auth.RandomToken(32)
+	if err != nil {
+		http.Error(w, "Error rotating secret", http.StatusInternalServerError)
+		return
+	}
+	var clientID string
+	err = dbInstance.QueryRow(`
+		UPDATE service_accounts SET client_secret_hash = $1, token_version = token_version + 1
+		WHERE id = $2 AND tenant_id = $3
+		RETURNING client_id`, auth.HashToken(secret), accountID, tenantID).Scan(&clientID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Service account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error rotating service account secret:", err)
+		http.Error(w, "Error rotating secret", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"client_id": clientID, "client_secret": secret})
+}
+
+// serviceAccount is a service account as needed by the OAuth2 endpoints
+type serviceAccount struct {
+	models.ServiceAccount
+	tokenVersion int
+}
+
+// errInvalidClient is returned by authenticateServiceAccount for unknown or wrong credentials
+var errInvalidClient = errors.New("invalid client credentials")
+
+// authenticateServiceAccount checks the client credentials of a request made by a service
+// account, from HTTP Basic authentication or the form. The form must already be parsed.
+func authenticateServiceAccount(r *http.Request, dbInstance *sql.DB) (serviceAccount, error) {
+	var (
+		a          serviceAccount
+		secretHash string
+		scopes     []byte
+	)
+	clientID, secret := clientCredentials(r)
+	if clientID == "" || secret == "" {
+		return a, errInvalidClient
+	}
+	err := dbInstance.QueryRow(`
+		SELECT id, tenant_id, role, scopes, client_secret_hash, token_version
+		FROM service_accounts WHERE client_id = $1`, clientID).
+		Scan(&a.ID, &a.TenantID, &a.Role, &scopes, &secretHash, &a.tokenVersion)
+	if err == sql.ErrNoRows {
+		return a, errInvalidClient
+	}
+	if err != nil {
+		return a, err
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(secretHash)) != 1 {
+		return a, errInvalidClient
+	}
+	a.ClientID = clientID
+	if err := json.Unmarshal(scopes, &a.Scopes); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// serviceAccountGrant picks the scopes of a client-credentials token: the requested ones,
+// which the account must hold, or all of the account's scopes when none are requested
+func serviceAccountGrant(held []string, requested string) (string, bool) {
+	holds := map[string]bool{}
+	for _, s := range held {
+		holds[s] = true
+	}
+	asked := holds
+	if requested != "" {
+		asked = map[string]bool{}
+		for _, s := range strings.Fields(requested) {
+			if !holds[s] {
+				return "", false
+			}
+			asked[s] = true
+		}
+	}
+	var granted []string
+	for _, s := range serviceAccountScopes {
+		if asked[s] {
+			granted = append(granted, s)
+		}
+	}
+	if len(granted) == 0 {
+		return "", false
+	}
+	return strings.Join(granted, " "), true
+}
+
+// oauthToken is the OAuth2 token endpoint for service accounts (client-credentials grant)
+// and for devices polling for a user's approval (device code grant)
+func oauthToken(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+		clientCredentialsGrant(w, r, dbInstance)
+	case deviceCodeGrantType:
+		deviceCodeGrant(w, r, dbInstance)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only client_credentials and device_code are supported")
+	}
+}
+
+// clientCredentialsGrant lets a service account exchange its client credentials for an
+// access token (RFC 6749 section 4.4). No refresh token is issued; the account asks for a
+// new token when the old one expires.
+func clientCredentialsGrant(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	account, err := authenticateServiceAccount(r, dbInstance)
+	if err == errInvalidClient {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+	if err != nil {
+		log.Println("Error loading service account:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not authenticate the client")
+		return
+	}
+
+	scope, ok := serviceAccountGrant(account.Scopes, r.PostForm.Get("scope"))
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The service account does not hold the requested scope")
+		return
+	}
+
+	accessToken, err := auth.SignServiceAccountToken(account.ID, account.TenantID, account.tokenVersion, account.Role, scope)
+	if err != nil {
+		log.Println("Error signing service account token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create a token")
+		return
+	}
+	if _, err := dbInstance.Exec(`UPDATE service_accounts SET last_used_at = NOW() WHERE id = $1`, account.ID); err != nil {
+		log.Println("Error recording service account use:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(auth.AccessTokenTTL().Seconds()),
+		"scope":        scope,
+	})
+}
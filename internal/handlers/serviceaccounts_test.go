@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+// serviceAccountContext is the request context AuthMiddleware builds for a service account token
+func serviceAccountContext(accountID, tenantID int, role string) context.Context {
+	ctx := sessionContext(0, tenantID, role, "")
+	ctx = context.WithValue(ctx, auth.EmailKey, "")
+	ctx = context.WithValue(ctx, auth.PrincipalTypeKey, auth.PrincipalServiceAccount)
+	return context.WithValue(ctx, auth.ServiceAccountIDKey, accountID)
+}
+
+func TestCreateServiceAccount(t *testing.T) {
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		body           map[string]interface{}
+		expectInsert   bool
+		expectedStatus int
+	}{
+		{"Admin creates", sessionContext(1, 1, "admin", "s1"), map[string]interface{}{"name": "billing", "scopes": []string{"read"}}, true, http.StatusCreated},
+		{"Unknown role", sessionContext(1, 1, "admin", "s1"), map[string]interface{}{"name": "billing", "role": "owner", "scopes": []string{"read"}}, false, http.StatusBadRequest},
+		{"Unknown scope", sessionContext(1, 1, "admin", "s1"), map[string]interface{}{"name": "billing", "scopes": []string{"users"}}, false, http.StatusBadRequest},
+		{"Member cannot create", sessionContext(1, 1, "member", "s1"), map[string]interface{}{"name": "billing", "scopes": []string{"read"}}, false, http.StatusForbidden},
+		{"Service account cannot create", serviceAccountContext(5, 1, "admin"), map[string]interface{}{"name": "billing", "scopes": []string{"read"}}, false, http.StatusForbidden},
+		{"API key cannot create", context.WithValue(sessionContext(1, 1, "admin", ""), auth.APIKeyIDKey, 3), map[string]interface{}{"name": "billing", "scopes": []string{"read"}}, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectInsert {
+				mock.ExpectQuery("INSERT INTO service_accounts").
+					WithArgs(1, "billing", sqlmock.AnyArg(), sqlmock.AnyArg(), "member", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+			}
+
+			raw, _ := json.Marshal(tt.body)
+			req := httptest.NewRequest(http.MethodPost, "/api/service-accounts", bytes.NewReader(raw)).WithContext(tt.ctx)
+			rr := httptest.NewRecorder()
+			createServiceAccount(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectInsert {
+				var response struct {
+					Secret  string `json:"client_secret"`
+					Account struct {
+						ClientID string `json:"client_id"`
+					} `json:"service_account"`
+				}
+				json.Unmarshal(rr.Body.Bytes(), &response)
+				if response.Secret == "" || !strings.HasPrefix(response.Account.ClientID, auth.ServiceAccountClientIDPrefix) {
+					t.Errorf("unexpected response: %s", rr.Body.String())
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestRotateServiceAccountSecret(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("UPDATE service_accounts SET client_secret_hash = \\$1, token_version = token_version \\+ 1").
+		WithArgs(sqlmock.AnyArg(), 5, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id"}).AddRow("sa_abc"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/service-accounts/5/secret", nil)
+	req = mux.SetURLVars(req.WithContext(sessionContext(1, 1, "admin", "s1")), map[string]string{"id": "5"})
+	rr := httptest.NewRecorder()
+	rotateServiceAccountSecret(rr, req, db)
+
+	var response map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if rr.Code != http.StatusOK || response["client_id"] != "sa_abc" || response["client_secret"] == "" {
+		t.Errorf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestOAuthTokenClientCredentials(t *testing.T) {
+	const secret = "service-secret"
+	tests := []struct {
+		name           string
+		form           url.Values
+		basicSecret    string
+		expectLookup   bool
+		expectedStatus int
+		expectedError  string
+		expectedScope  string
+	}{
+		{"All held scopes", url.Values{"grant_type": {"client_credentials"}}, secret, true, http.StatusOK, "", "read write"},
+		{"Narrowed scope", url.Values{"grant_type": {"client_credentials"}, "scope": {"read"}}, secret, true, http.StatusOK, "", "read"},
+		{"Scope not held", url.Values{"grant_type": {"client_credentials"}, "scope": {"admin"}}, secret, true, http.StatusBadRequest, "invalid_scope", ""},
+		{"Wrong secret", url.Values{"grant_type": {"client_credentials"}}, "wrong", true, http.StatusUnauthorized, "invalid_client", ""},
+		{"Other grant", url.Values{"grant_type": {"password"}}, secret, false, http.StatusBadRequest, "unsupported_grant_type", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectLookup {
+				mock.ExpectQuery("SELECT id, tenant_id, role, scopes, client_secret_hash, token_version\\s+FROM service_accounts WHERE client_id = \\$1").
+					WithArgs("sa_billing").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "role", "scopes", "client_secret_hash", "token_version"}).
+						AddRow(5, 1, "admin", `["read", "write"]`, auth.HashToken(secret), 3))
+			}
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectExec("UPDATE service_accounts SET last_used_at = NOW\\(\\) WHERE id = \\$1").
+					WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth("sa_billing", tt.basicSecret)
+			rr := httptest.NewRecorder()
+			oauthToken(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			var response map[string]interface{}
+			json.Unmarshal(rr.Body.Bytes(), &response)
+			if tt.expectedError != "" && response["error"] != tt.expectedError {
+				t.Errorf("expected error %q, got %v", tt.expectedError, response)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				if response["scope"] != tt.expectedScope || response["refresh_token"] != nil {
+					t.Errorf("unexpected response: %v", response)
+				}
+				claims := &auth.Claims{}
+				if _, _, err := new(jwt.Parser).ParseUnverified(response["access_token"].(string), claims); err != nil {
+					t.Fatalf("failed to parse access token: %v", err)
+				}
+				if claims.PrincipalType != auth.PrincipalServiceAccount || claims.ServiceAccountID != 5 ||
+					claims.TenantID != 1 || claims.TokenVersion != 3 || claims.Scope != tt.expectedScope {
+					t.Errorf("unexpected claims: %+v", claims)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetUsersByTenant_ServiceAccount(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	orig := db.DB
+	db.DB = mockDB
+	defer func() { db.DB = orig }()
+
+	// No user lookup: the service account's tenant comes from its token
+	mock.ExpectQuery("SELECT id, name, email, role, tenant_id, created_at, updated_at\\s+FROM users").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "tenant_id", "created_at", "updated_at"}))
+	mock.ExpectQuery("SELECT id, name, description\\s+FROM tenants").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description"}).AddRow(1, "Acme", ""))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/tenant/1", nil).WithContext(serviceAccountContext(5, 1, "admin"))
+	req = mux.SetURLVars(req, map[string]string{"tenant_id": "1"})
+	rr := httptest.NewRecorder()
+	GetUsersByTenant(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+
+	// Another tenant's users stay out of reach
+	req = httptest.NewRequest(http.MethodGet, "/api/user/tenant/2", nil).WithContext(serviceAccountContext(5, 1, "admin"))
+	req = mux.SetURLVars(req, map[string]string{"tenant_id": "2"})
+	rr = httptest.NewRecorder()
+	GetUsersByTenant(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for another tenant, got %d", rr.Code)
+	}
+}
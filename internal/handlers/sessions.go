@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	listSessions(w, r, db.DB)
+}
+
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	revokeSession(w, r, db.DB)
+}
+
+func RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	revokeOtherSessions(w, r, db.DB)
+}
+
+func ListUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	listUserSessions(w, r, db.DB)
+}
+
+func RevokeUserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	revokeUserSession(w, r, db.DB)
+}
+
+func RevokeAllUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	revokeAllUserSessions(w, r, db.DB)
+}
+
+// listSessions returns the caller's own active sessions, flagging the one making the request
+func listSessions(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	writeSessions(w, dbInstance, userID, auth.GetSessionID(r.Context()))
+}
+
+// revokeSession signs out one of the caller's own sessions
+func revokeSession(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	deleteSession(w, dbInstance, userID, mux.Vars(r)["session_id"])
+}
+
+// revokeOtherSessions signs out every session of the caller except the current one
+func revokeOtherSessions(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, err := auth.GetUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	// Would sign the user out everywhere but the impersonator's session
+	if impersonating(w, r) {
+		return
+	}
+	if err := auth.RevokeUserSessions(dbInstance, userID, auth.GetSessionID(r.Context())); err != nil {
+		log.Println("Error revoking sessions:", err)
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Other sessions revoked successfully"})
+}
+
+// listUserSessions lets a tenant admin see the sessions of any user in the tenant
+func listUserSessions(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, ok := tenantAdminTarget(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	writeSessions(w, dbInstance, userID, auth.GetSessionID(r.Context()))
+}
+
+// revokeUserSession lets a tenant admin sign out one session of a user in the tenant
+func revokeUserSession(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, ok := tenantAdminTarget(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	deleteSession(w, dbInstance, userID, mux.Vars(r)["session_id"])
+}
+
+// revokeAllUserSessions lets a tenant admin sign a user in the tenant out everywhere
+func revokeAllUserSessions(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	userID, ok := tenantAdminTarget(w, r, dbInstance)
+	if !ok {
+		return
+	}
+	if err := auth.RevokeUserSessions(dbInstance, userID, ""); err != nil {
+		log.Println("Error revoking sessions:", err)
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "All sessions revoked successfully"})
+}
+
+func writeSessions(w http.ResponseWriter, dbInstance *sql.DB, userID int, currentSessionID string) {
+	sessions, err := auth.ListSessions(dbInstance, userID)
+	if err != nil {
+		log.Println("Error listing sessions:", err)
+		http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func deleteSession(w http.ResponseWriter, dbInstance *sql.DB, userID int, sessionID string) {
+	err := auth.RevokeSession(dbInstance, userID, sessionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error revoking session:", err)
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked successfully"})
+}
+
+// tenantAdminTarget resolves the {id} user of an admin route and checks the caller
+// is an admin of that user's tenant. It writes the error response when the check fails.
+func tenantAdminTarget(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) (int, bool) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var userTenantID int
+	err = dbInstance.QueryRow(`SELECT tenant_id FROM users WHERE id = $1`, userID).Scan(&userTenantID)
+	if err == sql.ErrNoRows || (err == nil && userTenantID != tenantID) {
+		// Users of other tenants are reported as missing
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return 0, false
+	}
+	return userID, true
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func sessionContext(userID, tenantID int, role, sessionID string) context.Context {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, auth.UserIDKey, userID)
+	ctx = context.WithValue(ctx, auth.TenantIDKey, tenantID)
+	ctx = context.WithValue(ctx, auth.RoleKey, role)
+	ctx = context.WithValue(ctx, auth.SessionIDKey, sessionID)
+	return ctx
+}
+
+func TestListSessions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT jti, user_id, tenant_id").
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"jti", "user_id", "tenant_id", "device", "ip_address", "user_agent", "created_at", "last_seen_at"}).
+			AddRow("s1", 7, 1, "Firefox on Linux", "10.0.0.1", "Mozilla", now, now).
+			AddRow("s2", 7, 1, "curl", "10.0.0.2", "curl/8", now, now))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+	req = req.WithContext(sessionContext(7, 1, "member", "s2"))
+	rr := httptest.NewRecorder()
+
+	listSessions(rr, req, db)
+
+	var sessions []auth.Session
+	if err := json.NewDecoder(rr.Body).Decode(&sessions); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].Current || !sessions[1].Current {
+		t.Errorf("expected only s2 to be current, got %+v", sessions)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestRevokeSession_NotOwned(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE sessions SET revoked_at = NOW\\(\\) WHERE jti = \\$1 AND user_id = \\$2").
+		WithArgs("someone-else", 7).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/sessions/someone-else", nil)
+	req = mux.SetURLVars(req.WithContext(sessionContext(7, 1, "member", "s1")), map[string]string{"session_id": "someone-else"})
+	rr := httptest.NewRecorder()
+
+	revokeSession(rr, req, db)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestRevokeAllUserSessions(t *testing.T) {
+	tests := []struct {
+		name           string
+		role           string
+		userTenant     int
+		expectedStatus int
+	}{
+		{"admin of same tenant", "admin", 1, http.StatusOK},
+		{"admin of other tenant", "admin", 2, http.StatusNotFound},
+		{"member", "member", 1, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.role == "admin" {
+				mock.ExpectQuery("SELECT tenant_id FROM users WHERE id = \\$1").
+					WithArgs(9).
+					WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(tt.userTenant))
+			}
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectExec("UPDATE sessions SET revoked_at").
+					WithArgs(9, "").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+					WithArgs(9, "").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+			}
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/user/9/sessions", nil)
+			req = mux.SetURLVars(req.WithContext(sessionContext(1, 1, tt.role, "s1")), map[string]string{"id": "9"})
+			rr := httptest.NewRecorder()
+
+			revokeAllUserSessions(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"sentinel/internal/password"
+)
+
+// loadTenantSettings reads a tenant's settings, falling back to the defaults when none are stored
+func loadTenantSettings(dbInstance *sql.DB, tenantID int) (models.TenantSettings, error) {
+	var settings models.TenantSettings
+	var raw []byte
+	err := dbInstance.QueryRow(`SELECT settings FROM tenant_settings WHERE tenant_id = $1`, tenantID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &settings); err != nil {
+			return settings, err
+		}
+	}
+	return settings, nil
+}
+
+func GetTenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	getTenantSettings(w, r, db.DB)
+}
+
+func UpdateTenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	updateTenantSettings(w, r, db.DB)
+}
+
+// getTenantSettings returns the settings of the caller's tenant (admin only)
+func getTenantSettings(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	settings, err := loadTenantSettings(dbInstance, tenantID)
+	if err != nil {
+		log.Println("Error loading tenant settings:", err)
+		http.Error(w, "Error fetching tenant settings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// updateTenantSettings changes the settings of the caller's tenant (admin only).
+// Options left out of the request body keep their current value.
+func updateTenantSettings(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	tenantID, ok := tenantAdmin(w, r)
+	if !ok {
+		return
+	}
+	settings, err := loadTenantSettings(dbInstance, tenantID)
+	if err != nil {
+		log.Println("Error loading tenant settings:", err)
+		http.Error(w, "Error fetching tenant settings", http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if errs := validateSettings(settings); len(errs) > 0 {
+		writeFieldErrors(w, "Invalid tenant settings", errs)
+		return
+	}
+
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		http.Error(w, "Error updating tenant settings", http.StatusInternalServerError)
+		return
+	}
+	_, err = dbInstance.Exec(`
+		INSERT INTO tenant_settings (tenant_id, settings, created_at, updated_at)
+		VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (tenant_id) DO UPDATE SET settings = EXCLUDED.settings, updated_at = NOW()`,
+		tenantID, raw)
+	if err != nil {
+		log.Println("Error updating tenant settings:", err)
+		http.Error(w, "Error updating tenant settings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// validateSettings rejects option values that cannot be applied
+func validateSettings(settings models.TenantSettings) []models.FieldError {
+	errs := []models.FieldError{}
+	policy := settings.PasswordPolicy
+	if policy.MinLength < 0 {
+		errs = append(errs, models.FieldError{Field: "password_policy.min_length", Code: "invalid", Message: "must not be negative"})
+	}
+	if policy.History < 0 || policy.History > password.MaxHistory {
+		errs = append(errs, models.FieldError{Field: "password_policy.history", Code: "invalid", Message: fmt.Sprintf("must be between 0 and %d", password.MaxHistory)})
+	}
+	if policy.MaxAgeDays < 0 {
+		errs = append(errs, models.FieldError{Field: "password_policy.max_age_days", Code: "invalid", Message: "must not be negative"})
+	}
+	return errs
+}
+
+// tenantAdmin returns the caller's tenant when the caller is an admin.
+// It writes the error response when the check fails.
+func tenantAdmin(w http.ResponseWriter, r *http.Request) (int, bool) {
+	ctx := r.Context()
+	role, _ := auth.GetRole(ctx)
+	if role != "admin" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	tenantID, err := auth.GetTenantID(ctx)
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return 0, false
+	}
+	return tenantID, true
+}
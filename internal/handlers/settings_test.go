@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sentinel/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUpdateTenantSettings(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// No settings stored yet, so the defaults are updated
+	mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+	mock.ExpectExec("INSERT INTO tenant_settings").
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body := []byte(`{"require_email_confirmation": true}`)
+	req := httptest.NewRequest(http.MethodPut, "/api/tenant/settings", bytes.NewReader(body)).
+		WithContext(sessionContext(1, 1, "admin", "s1"))
+	rr := httptest.NewRecorder()
+
+	updateTenantSettings(rr, req, db)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var settings models.TenantSettings
+	if err := json.NewDecoder(rr.Body).Decode(&settings); err != nil || !settings.RequireEmailConfirmation {
+		t.Errorf("expected the updated settings, got %+v (%v)", settings, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestUpdateTenantSettings_NotAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	req := httptest.NewRequest(http.MethodPut, "/api/tenant/settings", bytes.NewReader([]byte(`{}`))).
+		WithContext(sessionContext(2, 1, "member", "s2"))
+	rr := httptest.NewRecorder()
+
+	updateTenantSettings(rr, req, db)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/db"
+	"sentinel/internal/models"
+	"strconv"
+	"time"
+)
+
+// Password re-authentication attempts are limited per user, like second factor attempts
+var reauthLimiter = auth.NewKeyedLimiter(12*time.Second, 5)
+
+func ReauthenticateHandler(w http.ResponseWriter, r *http.Request) {
+	reauthenticate(w, r, db.DB)
+}
+
+// checkPassword verifies the password of a known user the way /login does: against the
+// tenant's directory when it has one, and the stored hash otherwise
+func checkPassword(r *http.Request, dbInstance *sql.DB, user models.User, pw string) (bool, error) {
+	ctx := r.Context()
+	directory, err := loadLDAPConnection(dbInstance, user.TenantID)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	viaDirectory := err == nil
+	var authenticator auth.Authenticator = auth.PasswordAuthenticator{Hash: user.Password}
+	if viaDirectory {
+		authenticator = auth.LDAPAuthenticator{Conn: directory}
+	}
+	_, err = authenticator.Authenticate(ctx, user.Email, pw)
+	// Break-glass admins missing from the directory keep their password
+	if viaDirectory && err == auth.ErrUnknownUser && localFallbackAllowed(user) {
+		_, err = auth.PasswordAuthenticator{Hash: user.Password}.Authenticate(ctx, user.Email, pw)
+		if err == nil {
+			auditLocalFallback(dbInstance, r, user)
+		}
+	}
+	if err == auth.ErrInvalidCredentials || err == auth.ErrUnknownUser {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// reauthWithPasskey checks a passkey login ceremony was answered by one of the user's passkeys
+func reauthWithPasskey(dbInstance *sql.DB, user models.User, ceremonyID string, credential []byte) (bool, error) {
+	rp, err := auth.RelyingParty()
+	if err != nil {
+		return false, err
+	}
+	owner, err := verifyPasskeyLogin(dbInstance, rp, ceremonyID, credential)
+	if err == errCeremonyNotFound || err == errPasskeyResponseInvalid || err == errPasskeyRejected {
+		return false, nil
+	}
+	return err == nil && owner.ID == user.ID, err
+}
+
+// reauthWithLoginCode checks the login code of a federated login is the user's own
+func reauthWithLoginCode(dbInstance *sql.DB, user models.User, code string) (bool, error) {
+	signedIn, _, err := redeemLoginCode(dbInstance, code)
+	if err == errLoginCodeInvalid {
+		return false, nil
+	}
+	return err == nil && signedIn.ID == user.ID, err
+}
+
+// reauthWithMagicLink checks and uses up the latest magic link sent to the user
+func reauthWithMagicLink(dbInstance *sql.DB, user models.User, token string) (bool, error) {
+	claims, err := auth.ParsePurposeToken(token, auth.PurposeMagicLink)
+	if err != nil || claims.UserID != user.ID || claims.TenantID != user.TenantID {
+		return false, nil
+	}
+	// Links sent before the tenant turned magic links off stop working
+	settings, err := loadTenantSettings(dbInstance, user.TenantID)
+	if err != nil || !settings.MagicLinkLogin {
+		return false, err
+	}
+	_, err = consumeMagicLink(dbInstance, claims)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// reauthenticate answers the step-up challenge of a sensitive operation. Users with MFA
+// confirm with a current code or a recovery code, others with their password or the
+// proof of signing in again: a federated login code or a magic link token. A passkey
+// works for everyone. The session's auth_time is renewed and the response carries a
+// new access token; the refresh token is unchanged and keeps the new auth_time.
+func reauthenticate(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	ctx := r.Context()
+	userID, err := auth.GetUserID(ctx)
+	if err != nil {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	tenantID, _ := auth.GetTenantID(ctx)
+	sessionID := auth.GetSessionID(ctx)
+	if auth.GetAPIKeyID(ctx) != 0 || sessionID == "" {
+		http.Error(w, "Only signed-in users can re-authenticate", http.StatusForbidden)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	var req struct {
+		Password     string          `json:"password"`
+		Code         string          `json:"code"`
+		RecoveryCode string          `json:"recovery_code"`
+		LoginCode    string          `json:"login_code"`  // From /login/federated/complete's redirect
+		Token        string          `json:"token"`       // From a magic link
+		CeremonyID   string          `json:"ceremony_id"` // From /login/passkey/begin
+		Credential   json.RawMessage `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	user := models.User{ID: userID, TenantID: tenantID}
+	var mfaEnabled bool
+	err = dbInstance.QueryRow(`
+		SELECT u.email, COALESCE(u.password, ''), u.role, u.token_version, t.enabled_at IS NOT NULL
+		FROM users u
+		LEFT JOIN user_totp t ON t.user_id = u.id
+		WHERE u.id = $1 AND u.tenant_id = $2`, userID, tenantID).
+		Scan(&user.Email, &user.Password, &user.Role, &user.TokenVersion, &mfaEnabled)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("Error fetching user for re-authentication:", err)
+		http.Error(w, "Error re-authenticating", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		ok      bool
+		methods []string
+	)
+	switch {
+	case req.CeremonyID != "":
+		if !reauthLimiter.Allow(strconv.Itoa(userID)) {
+			http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+			return
+		}
+		ok, err = reauthWithPasskey(dbInstance, user, req.CeremonyID, req.Credential)
+		methods = []string{auth.AMRHardwareKey, auth.AMRMFA}
+	case mfaEnabled:
+		if req.Code == "" && req.RecoveryCode == "" {
+			writeFieldErrors(w, "Invalid re-authentication", []models.FieldError{{Field: "code", Code: "required", Message: "is required"}})
+			return
+		}
+		if !mfaAttemptLimiter.Allow(strconv.Itoa(userID)) {
+			http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+			return
+		}
+		// Wrong codes count towards the account lockout, as at /login/mfa
+		if loginThrottled(w, r, dbInstance, tenantID, user.Email) {
+			return
+		}
+		ok, err = verifySecondFactor(dbInstance, userID, req.Code, req.RecoveryCode)
+		methods = []string{auth.AMROTP, auth.AMRMFA}
+	case req.LoginCode != "" || req.Token != "":
+		if !reauthLimiter.Allow(strconv.Itoa(userID)) {
+			http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+			return
+		}
+		if req.LoginCode != "" {
+			ok, err = reauthWithLoginCode(dbInstance, user, req.LoginCode)
+			methods = []string{auth.AMRFederated}
+		} else {
+			ok, err = reauthWithMagicLink(dbInstance, user, req.Token)
+			methods = []string{auth.AMREmail}
+		}
+	default:
+		if req.Password == "" {
+			writeFieldErrors(w, "Invalid re-authentication", []models.FieldError{{Field: "password", Code: "required", Message: "is required"}})
+			return
+		}
+		if !reauthLimiter.Allow(strconv.Itoa(userID)) {
+			http.Error(w, auth.ErrTooManyRequests, http.StatusTooManyRequests)
+			return
+		}
+		ok, err = checkPassword(r, dbInstance, user, req.Password)
+		methods = []string{auth.AMRPassword}
+	}
+	if errors.Is(err, auth.ErrDirectoryUnavailable) {
+		log.Println("Error authenticating against LDAP:", err)
+		http.Error(w, "Directory unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println("Error verifying re-authentication:", err)
+		http.Error(w, "Error re-authenticating", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if mfaEnabled {
+			recordFailedLogin(r, dbInstance, tenantID, user.Email)
+		}
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	authn := auth.Authenticated(methods...)
+	if err := auth.Reauthenticate(dbInstance, sessionID, authn); err == auth.ErrSessionRevoked {
+		http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("Error recording re-authentication:", err)
+		http.Error(w, "Error re-authenticating", http.StatusInternalServerError)
+		return
+	}
+	token, err := auth.GenerateSessionJWT(user, sessionID, authn)
+	if err != nil {
+		log.Println("Error generating JWT token:", err)
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+
+	setTokenCookie(w, token)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     token,
+		"auth_time": authn.Time.Unix(),
+		"amr":       authn.Methods,
+	})
+}
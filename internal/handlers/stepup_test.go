@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestReauthenticate(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		body           string
+		mfaEnabled     bool
+		sessionActive  bool
+		expectedStatus int
+	}{
+		{"Password", sessionContext(7, 1, "member", "s1"), `{"password": "password123"}`, false, true, http.StatusOK},
+		{"Wrong password", sessionContext(7, 1, "member", "s1"), `{"password": "wrong"}`, false, false, http.StatusUnauthorized},
+		{"Password without a code for a user with MFA", sessionContext(7, 1, "member", "s1"), `{"password": "password123"}`, true, false, http.StatusBadRequest},
+		{"Revoked session", sessionContext(7, 1, "member", "s1"), `{"password": "password123"}`, false, false, http.StatusUnauthorized},
+		{"API key cannot re-authenticate", context.WithValue(sessionContext(7, 1, "member", ""), auth.APIKeyIDKey, 2), `{"password": "password123"}`, false, false, http.StatusForbidden},
+		{"Impersonation token cannot re-authenticate", context.WithValue(sessionContext(7, 1, "member", "s1"), auth.ActorIDKey, 3), `{"password": "password123"}`, false, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			if tt.expectedStatus != http.StatusForbidden {
+				mock.ExpectQuery("SELECT u.email, COALESCE\\(u.password, ''\\), u.role, u.token_version, t.enabled_at IS NOT NULL").
+					WithArgs(7, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"email", "password", "role", "token_version", "mfa_enabled"}).
+						AddRow("user@example.com", string(hash), "member", 0, tt.mfaEnabled))
+			}
+			if !tt.mfaEnabled && tt.expectedStatus != http.StatusForbidden {
+				mock.ExpectQuery("FROM ldap_connections WHERE tenant_id = \\$1").WillReturnRows(sqlmock.NewRows(ldapColumns))
+			}
+			if strings.Contains(tt.body, "password123") && !tt.mfaEnabled && tt.expectedStatus != http.StatusForbidden {
+				rows := int64(0)
+				if tt.sessionActive {
+					rows = 1
+				}
+				mock.ExpectExec("UPDATE sessions SET auth_time = \\$1, amr = \\$2 WHERE jti = \\$3 AND revoked_at IS NULL").
+					WithArgs(sqlmock.AnyArg(), []byte(`["pwd"]`), "s1").
+					WillReturnResult(sqlmock.NewResult(0, rows))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/reauth", strings.NewReader(tt.body)).WithContext(tt.ctx)
+			rr := httptest.NewRecorder()
+			reauthenticate(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusOK {
+				var response struct {
+					Token string `json:"token"`
+				}
+				json.Unmarshal(rr.Body.Bytes(), &response)
+				claims, err := auth.ParseAccessToken(response.Token)
+				if err != nil {
+					t.Fatalf("expected a valid access token, got %v", err)
+				}
+				if claims.UserID != 7 || claims.Id != "s1" || time.Since(time.Unix(claims.AuthTime, 0)) > time.Minute ||
+					len(claims.AMR) != 1 || claims.AMR[0] != auth.AMRPassword {
+					t.Errorf("unexpected claims: %+v", claims)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateUserDetails_PasswordNeedsStepUp(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, email, role, tenant_id FROM users WHERE id=\\$1").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "tenant_id"}).AddRow(2, "user@example.com", "member", 1))
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM user_totp WHERE user_id = u.id AND enabled_at IS NOT NULL\\)").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"mfa", "passkey", "federated", "magic_link"}).AddRow(false, false, false, false))
+
+	// The admin signed in an hour ago
+	ctx := sessionContext(1, 1, "admin", "s1")
+	ctx = context.WithValue(ctx, auth.EmailKey, "admin@example.com")
+	ctx = context.WithValue(ctx, auth.AuthTimeKey, time.Now().Add(-time.Hour).Unix())
+	body, _ := json.Marshal(map[string]any{"user_id": 2, "name": "User", "email": "user@example.com", "password": "newpassword123"})
+	req := httptest.NewRequest(http.MethodPut, "/api/user", bytes.NewReader(body)).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	UpdateUserDetails(rr, req, db)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var challenge map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &challenge)
+	if challenge["error"] != auth.ErrStepUpRequired {
+		t.Errorf("expected a step-up challenge, got %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestReauthenticate_WrongCodeCounts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT u.email, COALESCE\\(u.password, ''\\), u.role, u.token_version, t.enabled_at IS NOT NULL").
+		WithArgs(10, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "password", "role", "token_version", "mfa_enabled"}).
+			AddRow("user10@example.com", "", "member", 0, true))
+	expectNotLockedOut(mock)
+	mock.ExpectExec("UPDATE mfa_recovery_codes SET used_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectLoginFailure(mock)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/reauth", strings.NewReader(`{"recovery_code": "abcde-fghij"}`)).
+		WithContext(sessionContext(10, 1, "member", "s1"))
+	rr := httptest.NewRecorder()
+	reauthenticate(rr, req, db)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestReauthenticate_SignInAgain(t *testing.T) {
+	link, jti, err := auth.SignPurposeToken(auth.PurposeMagicLink, 11, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to sign link: %v", err)
+	}
+	othersLink, _, _ := auth.SignPurposeToken(auth.PurposeMagicLink, 12, 1, time.Minute)
+
+	expectLoginCode := func(userID int) func(mock sqlmock.Sqlmock) {
+		return func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("DELETE FROM federated_logins WHERE id_hash = \\$1 AND user_id IS NOT NULL").
+				WithArgs(auth.HashToken("login-code")).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "tenant_id", "return_to", "expires_at"}).
+					AddRow(userID, 1, "", time.Now().Add(time.Minute)))
+			mock.ExpectQuery("SELECT name, email, role, token_version FROM users WHERE id = \\$1 AND tenant_id = \\$2").
+				WithArgs(userID, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"name", "email", "role", "token_version"}).AddRow("User", "user@example.com", "member", 0))
+		}
+	}
+	tests := []struct {
+		name           string
+		body           string
+		mfaEnabled     bool
+		mockSetup      func(mock sqlmock.Sqlmock)
+		expectedStatus int
+		expectAMR      string
+	}{
+		{"Federated login", `{"login_code": "login-code"}`, false, expectLoginCode(11), http.StatusOK, auth.AMRFederated},
+		{"Federated login of someone else", `{"login_code": "login-code"}`, false, expectLoginCode(12), http.StatusUnauthorized, ""},
+		{"Magic link", `{"token": "` + link + `"}`, false, func(mock sqlmock.Sqlmock) {
+			expectMagicLinkSettings(mock, true)
+			mock.ExpectQuery("UPDATE users SET magic_link_token = NULL, email_confirmed = TRUE").
+				WithArgs(11, 1, auth.HashToken(jti)).
+				WillReturnRows(sqlmock.NewRows([]string{"name", "email", "role", "token_version"}).AddRow("User", "user@example.com", "member", 0))
+		}, http.StatusOK, auth.AMREmail},
+		{"Magic link of someone else", `{"token": "` + othersLink + `"}`, false, func(mock sqlmock.Sqlmock) {}, http.StatusUnauthorized, ""},
+		{"Login code without the second factor", `{"login_code": "login-code"}`, true, func(mock sqlmock.Sqlmock) {}, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT u.email, COALESCE\\(u.password, ''\\), u.role, u.token_version, t.enabled_at IS NOT NULL").
+				WithArgs(11, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"email", "password", "role", "token_version", "mfa_enabled"}).
+					AddRow("user@example.com", "", "member", 0, tt.mfaEnabled))
+			tt.mockSetup(mock)
+			if tt.expectedStatus == http.StatusOK {
+				mock.ExpectExec("UPDATE sessions SET auth_time = \\$1, amr = \\$2 WHERE jti = \\$3 AND revoked_at IS NULL").
+					WithArgs(sqlmock.AnyArg(), []byte(`["`+tt.expectAMR+`"]`), "s1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/reauth", strings.NewReader(tt.body)).
+				WithContext(sessionContext(11, 1, "member", "s1"))
+			rr := httptest.NewRecorder()
+			reauthenticate(rr, req, db)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet sqlmock expectations: %v", err)
+			}
+		})
+	}
+}
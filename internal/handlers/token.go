@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sentinel/internal/auth"
+	"sentinel/internal/models"
+	"strings"
+	"time"
+)
+
+// tokenCookie is the cookie that carries the access token to every path of the site. Scripts
+// cannot read it, and it is only sent over HTTPS when Sentinel is served over HTTPS.
+func tokenCookie(value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     "token",
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(auth.Issuer(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// setTokenCookie sets the access token cookie, expiring with the token
+func setTokenCookie(w http.ResponseWriter, accessToken string) {
+	cookie := tokenCookie(accessToken)
+	cookie.Expires = time.Now().Add(auth.AccessTokenTTL())
+	http.SetCookie(w, cookie)
+}
+
+// writeTokens sets the access token cookie and returns both tokens in the JSON body
+func writeTokens(w http.ResponseWriter, accessToken, refreshToken string) {
+	writeTokensWith(w, accessToken, refreshToken, nil)
+}
+
+// writeTokensWith is writeTokens with extra fields in the JSON body
+func writeTokensWith(w http.ResponseWriter, accessToken, refreshToken string, extra map[string]interface{}) {
+	setTokenCookie(w, accessToken)
+
+	body := map[string]interface{}{
+		"token":         accessToken,
+		"refresh_token": refreshToken,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(body)
+}
+
+// startSession signs the user in on a new session and returns its access and refresh tokens.
+// Every way of logging in ends here, with the methods the user authenticated with. It
+// writes the error response when it fails.
+func startSession(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB, user models.User, device string, authn auth.Authentication) (string, string, bool) {
+	// Record the session this login starts; its ID becomes the token's jti
+	sessionID, err := auth.CreateSession(dbInstance, r, user.ID, user.TenantID, device, authn)
+	if err != nil {
+		log.Println("Error creating session:", err)
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return "", "", false
+	}
+
+	// Create JWT token with email and tenant_id
+	tokenString, err := auth.GenerateSessionJWT(user, sessionID, authn)
+	if err != nil {
+		log.Println("Error generating JWT token:", err)
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return "", "", false
+	}
+
+	// Start the session's refresh token family
+	refreshToken, err := auth.IssueRefreshToken(dbInstance, user.ID, user.TenantID, sessionID)
+	if err != nil {
+		log.Println("Error issuing refresh token:", err)
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return "", "", false
+	}
+	return tokenString, refreshToken, true
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access token and a new refresh token.
+// The presented refresh token is consumed; replaying it later revokes the whole token family.
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request, dbInstance *sql.DB) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	rt, refreshToken, err := auth.RotateRefreshToken(dbInstance, req.RefreshToken)
+	if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("Error rotating refresh token:", err)
+		http.Error(w, "Could not refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	// Re-read the user so the new access token carries the current role and token version
+	user := models.User{ID: rt.UserID, TenantID: rt.TenantID}
+	err = dbInstance.QueryRow(`SELECT email, role, token_version FROM users WHERE id = $1 AND tenant_id = $2`, rt.UserID, rt.TenantID).Scan(&user.Email, &user.Role, &user.TokenVersion)
+	if err != nil {
+		log.Println("Error fetching user for refresh:", err)
+		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// The refresh token family is the session, so the access token keeps its jti and the
+	// session's last authentication
+	authn, err := auth.SessionAuthentication(dbInstance, rt.FamilyID)
+	if err != nil {
+		log.Println("Error fetching session for refresh:", err)
+		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	}
+	tokenString, err := auth.GenerateSessionJWT(user, rt.FamilyID, authn)
+	if err != nil {
+		log.Println("Error generating JWT token:", err)
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, tokenString, refreshToken)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRefreshTokenHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, family_id, user_id, tenant_id, expires_at, used_at, revoked_at FROM refresh_tokens").
+		WithArgs(auth.HashToken("refresh-1")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "family_id", "user_id", "tenant_id", "expires_at", "used_at", "revoked_at"}).
+			AddRow(1, "family", 1, 1, time.Now().Add(time.Hour), nil, nil))
+	mock.ExpectExec("UPDATE refresh_tokens SET used_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT email, role, token_version FROM users WHERE id = \\$1 AND tenant_id = \\$2").
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "role", "token_version"}).AddRow("valid@test.com", "admin", 0))
+	authTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	mock.ExpectQuery("SELECT auth_time, amr FROM sessions WHERE jti = \\$1").
+		WithArgs("family").
+		WillReturnRows(sqlmock.NewRows([]string{"auth_time", "amr"}).AddRow(authTime, []byte(`["pwd"]`)))
+
+	body, _ := json.Marshal(map[string]string{"refresh_token": "refresh-1"})
+	req := httptest.NewRequest(http.MethodPost, "/token/refresh", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	RefreshTokenHandler(rr, req, db)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response["token"] == "" || response["refresh_token"] == "" || response["refresh_token"] == "refresh-1" {
+		t.Errorf("expected new access and refresh tokens, got %v", response)
+	}
+	// The new access token keeps the session's last authentication
+	if claims, err := auth.ParseAccessToken(response["token"]); err != nil || claims.AuthTime != authTime.Unix() ||
+		len(claims.AMR) != 1 || claims.AMR[0] != auth.AMRPassword {
+		t.Errorf("expected the session's auth_time and amr, got %+v (%v)", claims, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestRefreshTokenHandler_Reuse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, family_id, user_id, tenant_id, expires_at, used_at, revoked_at FROM refresh_tokens").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "family_id", "user_id", "tenant_id", "expires_at", "used_at", "revoked_at"}).
+			AddRow(1, "family", 1, 1, time.Now().Add(time.Hour), time.Now(), nil))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs("family").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").
+		WithArgs("family", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body, _ := json.Marshal(map[string]string{"refresh_token": "replayed"})
+	req := httptest.NewRequest(http.MethodPost, "/token/refresh", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	RefreshTokenHandler(rr, req, db)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
@@ -6,14 +6,15 @@ import (
 	"sentinel/internal/auth"
 	"sentinel/internal/db"
 	"sentinel/internal/models"
+	"sentinel/internal/password"
 
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // RegisterUser handles user registration, along with tenant and team creation if needed
@@ -25,13 +26,6 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Hash the password before storing
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, "Error hashing password", http.StatusInternalServerError)
-		return
-	}
-
 	// Set default tenant name if not provided
 	if req.TenantName == "" {
 		req.TenantName = req.UserName + "'s Organization"
@@ -59,17 +53,37 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The password must meet the policy of the tenant the user joins
+	policy, ok := checkNewPassword(w, db.DB, tenantID, 0, req.Password)
+	if !ok {
+		return
+	}
+
+	// Hash the password before storing
+	hashedPassword, err := password.Hash(req.Password)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
 	// Step 2: Create or get user
 	if req.UserRole == "" {
 		req.UserRole = "member" // default role if not provided
 	}
+	// Registering never touches an existing account: its password is changed through the
+	// reset flow, which checks the history and revokes the account's tokens
 	var userID int
+	var emailConfirmed bool
 	err = tx.QueryRow(`
 		INSERT INTO users (tenant_id, name, email, password, role, created_at, updated_at) 
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		ON CONFLICT (email) DO UPDATE SET password = EXCLUDED.password, updated_at = EXCLUDED.updated_at
-		RETURNING id
-	`, tenantID, req.UserName, req.Email, string(hashedPassword), req.UserRole, time.Now(), time.Now()).Scan(&userID)
+		ON CONFLICT (email) DO NOTHING
+		RETURNING id, COALESCE(email_confirmed, FALSE)
+	`, tenantID, req.UserName, req.Email, hashedPassword, req.UserRole, time.Now(), time.Now()).Scan(&userID, &emailConfirmed)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error creating or updating user", http.StatusInternalServerError)
 		return
@@ -118,6 +132,18 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := recordPassword(db.DB, userID, hashedPassword, policy); err != nil {
+		log.Println("Error recording password history:", err)
+	}
+
+	// Send the confirmation link; a failure here does not undo the registration,
+	// the user can ask for a new link at /email/confirm/resend
+	if !emailConfirmed {
+		if err := sendConfirmationEmail(db.DB, userID, tenantID, req.Email, req.UserName); err != nil {
+			log.Println("Error sending confirmation email:", err)
+		}
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message":   "User created successfully with tenant and team",
@@ -277,7 +303,7 @@ func UpdateUserDetails(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 	// Check if the user trying to update is the owner of the UserID
 	var currentUser models.User
-	err = db.QueryRow("SELECT id, email, role FROM users WHERE id=$1", req.UserID).Scan(&currentUser.ID, &currentUser.Email, &currentUser.Role)
+	err = db.QueryRow("SELECT id, email, role, tenant_id FROM users WHERE id=$1", req.UserID).Scan(&currentUser.ID, &currentUser.Email, &currentUser.Role, &currentUser.TenantID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -289,25 +315,48 @@ func UpdateUserDetails(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	// Hash the new password if provided
-	var hashedPassword string
+	// Check and hash the new password if provided
+	var (
+		hashedPassword string
+		policy         models.PasswordPolicy
+	)
 	if req.Password != "" {
-		passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-		if err != nil {
+		// Setting a password is sensitive, see auth.RequireStepUp
+		if !auth.StepUpSatisfied(w, r, db) {
+			return
+		}
+		var ok bool
+		if policy, ok = checkNewPassword(w, db, currentUser.TenantID, req.UserID, req.Password); !ok {
+			return
+		}
+		if hashedPassword, err = password.Hash(req.Password); err != nil {
 			http.Error(w, "Error creating password", http.StatusInternalServerError)
 			return
 		}
-		hashedPassword = string(passwordHash)
 	}
 
 	if req.Password != "" && req.Email != "" {
 		// Update user with password
-		_, err = db.Exec(`UPDATE users SET name=$1, email=$2, password=$3 WHERE id=$4`,
+		_, err = db.Exec(`UPDATE users SET name=$1, email=$2, password=$3, password_changed_at=NOW() WHERE id=$4`,
 			req.Name, req.Email, hashedPassword, req.UserID)
 		if err != nil {
 			http.Error(w, "Error inserting password", http.StatusInternalServerError)
 			return
 		}
+		if err := recordPassword(db, req.UserID, hashedPassword, policy); err != nil {
+			log.Println("Error recording password history:", err)
+		}
+		// A new address is unconfirmed until its owner follows the link sent to it
+		if !strings.EqualFold(req.Email, currentUser.Email) {
+			_, err = db.Exec(`UPDATE users SET email_confirmed = FALSE, confirmation_token = NULL WHERE id = $1`, req.UserID)
+			if err != nil {
+				http.Error(w, "Error updating user", http.StatusInternalServerError)
+				return
+			}
+			if err := sendConfirmationEmail(db, req.UserID, currentUser.TenantID, req.Email, req.Name); err != nil {
+				log.Println("Error sending confirmation email:", err)
+			}
+		}
 	} else {
 
 		if req.Name != "" {
@@ -400,6 +449,14 @@ func UpdateUserDetails(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			return
 		}
 	}
+
+	// A new password or role invalidates every token issued before the change
+	if req.Password != "" || (req.Role != "" && req.Role != currentUser.Role) {
+		if err := auth.RevokeUserTokens(db, req.UserID); err != nil {
+			http.Error(w, "Error revoking user tokens", http.StatusInternalServerError)
+			return
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User details updated successfully"})
 }
@@ -413,25 +470,32 @@ func GetUsersByTenant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve the user's email and tenant ID from the context
 	ctx := r.Context()
-	email, err := auth.GetEmail(ctx)
-	if err != nil || email == "" {
-		http.Error(w, "Unauthorized User", http.StatusUnauthorized)
-		return
-	}
+	var callerTenantID int
+	if auth.GetPrincipalType(ctx) == auth.PrincipalServiceAccount {
+		// Service accounts have no user row; their token names their tenant
+		callerTenantID, _ = auth.GetTenantID(ctx)
+	} else {
+		// Retrieve the user's email from the context
+		email, err := auth.GetEmail(ctx)
+		if err != nil || email == "" {
+			http.Error(w, "Unauthorized User", http.StatusUnauthorized)
+			return
+		}
 
-	var currentUser models.User
-	err = db.DB.QueryRow("SELECT id, email, role, tenant_id FROM users WHERE email=$1", email).Scan(&currentUser.ID, &currentUser.Email, &currentUser.Role, &currentUser.TenantID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+		var currentUser models.User
+		err = db.DB.QueryRow("SELECT id, email, role, tenant_id FROM users WHERE email=$1", email).Scan(&currentUser.ID, &currentUser.Email, &currentUser.Role, &currentUser.TenantID)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		callerTenantID = currentUser.TenantID
 	}
 
 	role, _ := auth.GetRole(ctx)
 
-	// Check if the user is an admin and belongs to the same tenant
-	if role != "admin" || currentUser.TenantID != tenantID {
+	// Check if the caller is an admin and belongs to the same tenant
+	if role != "admin" || callerTenantID != tenantID {
 		http.Error(w, "Unauthorized to access this tenant's users", http.StatusUnauthorized)
 		return
 	}
@@ -522,6 +586,13 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Invalidate the user's outstanding tokens before the account disappears
+	err = auth.RevokeUserTokens(db.DB, userID)
+	if err != nil {
+		http.Error(w, "Error revoking user tokens", http.StatusInternalServerError)
+		return
+	}
+
 	_, err = db.DB.Exec(`DELETE FROM users WHERE id = $1`, userID)
 	if err != nil {
 		http.Error(w, "Error deleting user", http.StatusInternalServerError)
@@ -532,12 +603,6 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error deleting user teams", http.StatusInternalServerError)
 		return
 	}
-	// _, err = db.DB.Exec(`DELETE FROM token_blacklist WHERE user_id = $1
-	// `, userID)
-	// if err != nil {
-	// 	http.Error(w, "Error deleting user tokens", http.StatusInternalServerError)
-	// 	return
-	// }
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
 }
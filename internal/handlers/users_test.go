@@ -7,10 +7,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"context"
 
 	"sentinel/internal/auth"
+	"sentinel/internal/db"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"golang.org/x/crypto/bcrypt"
@@ -22,15 +24,18 @@ func TestUpdateUserDetails(t *testing.T) {
 		t.Fatalf("failed to create sqlmock: %v", err)
 	}
 	defer db.Close()
+	sender := useRecordingSender(t)
 
 	tests := []struct {
 		name           string
+		role           string
 		requestBody    map[string]any
 		expectedStatus int
 		mockSetup      func()
 	}{
 		{
 			name: "Valid update with password",
+			role: "admin",
 			requestBody: map[string]any{
 				"user_id":     1,
 				"name":        "Updated Name",
@@ -43,41 +48,95 @@ func TestUpdateUserDetails(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			mockSetup: func() {
 				_, _ = bcrypt.GenerateFromPassword([]byte("newpassword123"), bcrypt.DefaultCost)
-				mock.ExpectQuery("SELECT id, email, role FROM users WHERE id=\\$1").
+				mock.ExpectQuery("SELECT id, email, role, tenant_id FROM users WHERE id=\\$1").
 					WithArgs(1).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role"}).AddRow(1, "current@test.com", "admin"))
-				mock.ExpectExec("UPDATE users SET name=\\$1, email=\\$2, password=\\$3 WHERE id=\\$4").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "tenant_id"}).AddRow(1, "current@test.com", "admin", 123))
+				mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+					WithArgs(123).
+					WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+				mock.ExpectExec("UPDATE users SET name=\\$1, email=\\$2, password=\\$3, password_changed_at=NOW\\(\\) WHERE id=\\$4").
 					WithArgs("Updated Name", "updated@test.com", sqlmock.AnyArg(), 1).
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				// The new address has to be confirmed again
+				mock.ExpectExec("UPDATE users SET email_confirmed = FALSE, confirmation_token = NULL WHERE id = \\$1").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE users SET confirmation_token = \\$1 WHERE id = \\$2").
+					WithArgs(sqlmock.AnyArg(), 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 				mock.ExpectExec("UPDATE tenants SET name=\\$1 WHERE id=\\(SELECT tenant_id FROM users WHERE id=\\$2\\)").
 					WithArgs("Updated Tenant", 1).
 					WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectQuery("SELECT id FROM teams WHERE name=\\$1 AND tenant_id=\\(SELECT tenant_id FROM users WHERE id=\\$2\\)").
-					WithArgs("Updated Team", 1).
+				mock.ExpectQuery("SELECT tenant_id FROM users WHERE id=\\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"tenant_id"}).AddRow(123))
+				mock.ExpectQuery("SELECT id FROM teams WHERE name=\\$1 AND tenant_id=\\$2").
+					WithArgs("Updated Team", 123).
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-				mock.ExpectExec("UPDATE user_teams SET team_id=\\$1 WHERE user_id=\\$2").
-					WithArgs(1, 1).
+				mock.ExpectExec("UPDATE teams SET name=\\$1, updated_at=NOW\\(\\) WHERE id=\\$2").
+					WithArgs("Updated Team", 1).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE user_teams SET role=COALESCE\\(\\$1, role\\), updated_at=NOW\\(\\), team_id=\\$3 WHERE user_id=\\$2").
+					WithArgs("admin", 1, 1).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 				mock.ExpectExec("UPDATE users SET role=\\$1 WHERE id=\\$2").
 					WithArgs("admin", 1).
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				// The password change revokes every outstanding token
+				mock.ExpectExec("UPDATE users SET token_version = token_version \\+ 1 WHERE id = \\$1").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE sessions SET revoked_at").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name: "Demotion revokes tokens",
+			role: "admin",
+			requestBody: map[string]any{
+				"user_id": 1,
+				"role":    "member",
+			},
+			expectedStatus: http.StatusOK,
+			mockSetup: func() {
+				mock.ExpectQuery("SELECT id, email, role, tenant_id FROM users WHERE id=\\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "tenant_id"}).AddRow(1, "current@test.com", "admin", 123))
+				mock.ExpectExec("UPDATE users SET role=\\$1 WHERE id=\\$2").
+					WithArgs("member", 1).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE users SET token_version = token_version \\+ 1 WHERE id = \\$1").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE sessions SET revoked_at").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 		},
 		{
 			name: "Unauthorized user",
+			role: "member",
 			requestBody: map[string]any{
 				"user_id": 2,
 				"name":    "Unauthorized Update",
 			},
 			expectedStatus: http.StatusUnauthorized,
 			mockSetup: func() {
-				mock.ExpectQuery("SELECT id, email, role FROM users WHERE id=\\$1").
+				mock.ExpectQuery("SELECT id, email, role, tenant_id FROM users WHERE id=\\$1").
 					WithArgs(2).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role"}).AddRow(2, "other@test.com", "member"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "tenant_id"}).AddRow(2, "other@test.com", "member", 123))
 			},
 		},
 		{
 			name: "Invalid user ID",
+			role: "admin",
 			requestBody: map[string]interface{}{
 				"user_id": "invalid",
 			},
@@ -86,15 +145,16 @@ func TestUpdateUserDetails(t *testing.T) {
 		},
 		{
 			name: "Error updating user",
+			role: "admin",
 			requestBody: map[string]interface{}{
 				"user_id": 1,
 				"name":    "Error Update",
 			},
 			expectedStatus: http.StatusInternalServerError,
 			mockSetup: func() {
-				mock.ExpectQuery("SELECT id, email, role FROM users WHERE id=\\$1").
+				mock.ExpectQuery("SELECT id, email, role, tenant_id FROM users WHERE id=\\$1").
 					WithArgs(1).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role"}).AddRow(1, "current@test.com", "admin"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "tenant_id"}).AddRow(1, "current@test.com", "admin", 123))
 				mock.ExpectExec("UPDATE users SET name=\\$1 WHERE id=\\$2").
 					WithArgs("Error Update", 1).
 					WillReturnError(errors.New("update error"))
@@ -110,10 +170,14 @@ func TestUpdateUserDetails(t *testing.T) {
 			req, _ := http.NewRequest(http.MethodPost, "/update-user", bytes.NewBuffer(body))
 			req.Header.Set("Content-Type", "application/json")
 
-			// Mock authentication or context setup
+			// Mock authentication or context setup: an admin who signed in a moment ago
 			ctx := context.Background()
 			ctx = context.WithValue(ctx, auth.EmailKey, "current@test.com")
 			ctx = context.WithValue(ctx, auth.TenantIDKey, 123)
+			ctx = context.WithValue(ctx, auth.RoleKey, tt.role)
+			ctx = context.WithValue(ctx, auth.UserIDKey, 1)
+			ctx = context.WithValue(ctx, auth.SessionIDKey, "s1")
+			ctx = context.WithValue(ctx, auth.AuthTimeKey, time.Now().Unix())
 			req = req.WithContext(ctx)
 			rr := httptest.NewRecorder()
 
@@ -128,4 +192,42 @@ func TestUpdateUserDetails(t *testing.T) {
 			}
 		})
 	}
+	if len(sender.messages) != 1 || sender.messages[0].To != "updated@test.com" {
+		t.Errorf("expected a confirmation link sent to the new address, got %+v", sender.messages)
+	}
+}
+
+func TestRegisterUser_ExistingEmail(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	orig := db.DB
+	db.DB = mockDB
+	defer func() { db.DB = orig }()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO tenants").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery("SELECT settings FROM tenant_settings WHERE tenant_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+	// The account exists, so nothing is inserted and its password is left alone
+	mock.ExpectQuery("INSERT INTO users .* ON CONFLICT \\(email\\) DO NOTHING").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email_confirmed"}))
+	mock.ExpectRollback()
+
+	body, _ := json.Marshal(map[string]string{"name": "Mallory", "email": "victim@example.com",
+		"password": "newpassword123", "tenant_name": "Acme"})
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	RegisterUser(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
 }
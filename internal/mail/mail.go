@@ -0,0 +1,143 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages. Implementations must be safe for concurrent use.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// LogSender writes messages to the application log. It is the local stand-in
+// used when no mail transport is configured; never use it in production.
+type LogSender struct{}
+
+func (LogSender) Send(msg Message) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileSender writes every message as an .eml file into Dir, handy for local development and tests
+type FileSender struct {
+	Dir string
+}
+
+func (s FileSender) Send(msg Message) error {
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(msg.To))
+	return os.WriteFile(filepath.Join(s.Dir, name), []byte(format("", msg)), 0o600)
+}
+
+// SMTPSender delivers messages through an SMTP relay
+type SMTPSender struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (s SMTPSender) Send(msg Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := strings.Cut(s.Addr, ":")
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, []byte(format(s.From, msg)))
+}
+
+func format(from string, msg Message) string {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", msg.To, msg.Subject, msg.Body)
+	return b.String()
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// NewSenderFromEnv picks the transport from MAIL_SENDER:
+//   - "log" (default): LogSender
+//   - "file": FileSender writing into MAIL_DIR
+//   - "smtp": SMTPSender using SMTP_ADDR, MAIL_FROM, SMTP_USERNAME and SMTP_PASSWORD
+func NewSenderFromEnv() (Sender, error) {
+	switch os.Getenv("MAIL_SENDER") {
+	case "", "log":
+		return LogSender{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			return nil, errors.New("MAIL_DIR is required for the file mail sender")
+		}
+		return FileSender{Dir: dir}, nil
+	case "smtp":
+		s := SMTPSender{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			From:     os.Getenv("MAIL_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+		if s.Addr == "" || s.From == "" {
+			return nil, errors.New("SMTP_ADDR and MAIL_FROM are required for the smtp mail sender")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_SENDER %q", os.Getenv("MAIL_SENDER"))
+	}
+}
+
+// Process wide sender, the log stand-in until Init is called
+var (
+	current   Sender = LogSender{}
+	currentMu sync.RWMutex
+)
+
+// Init configures the process wide sender from the environment
+func Init() error {
+	s, err := NewSenderFromEnv()
+	if err != nil {
+		return err
+	}
+	SetSender(s)
+	return nil
+}
+
+// SetSender replaces the process wide sender
+func SetSender(s Sender) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = s
+}
+
+// Send delivers a message with the process wide sender
+func Send(msg Message) error {
+	currentMu.RLock()
+	s := current
+	currentMu.RUnlock()
+	return s.Send(msg)
+}
@@ -0,0 +1,55 @@
+package mail
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileSender(t *testing.T) {
+	dir := t.TempDir()
+	s := FileSender{Dir: dir}
+	if err := s.Send(Message{To: "user@example.com", Subject: "Hello", Body: "Body text"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one message file, got %v, err: %v", entries, err)
+	}
+	data, _ := os.ReadFile(dir + "/" + entries[0].Name())
+	if !strings.Contains(string(data), "Subject: Hello") || !strings.Contains(string(data), "Body text") {
+		t.Errorf("unexpected message file:\n%s", data)
+	}
+}
+
+func TestNewSenderFromEnv(t *testing.T) {
+	t.Setenv("MAIL_SENDER", "")
+	if s, err := NewSenderFromEnv(); err != nil || s != (LogSender{}) {
+		t.Errorf("expected LogSender by default, got %T, err: %v", s, err)
+	}
+
+	t.Setenv("MAIL_SENDER", "file")
+	t.Setenv("MAIL_DIR", "")
+	if _, err := NewSenderFromEnv(); err == nil {
+		t.Error("expected error without MAIL_DIR")
+	}
+	t.Setenv("MAIL_DIR", "/tmp/mail")
+	if s, err := NewSenderFromEnv(); err != nil || s != (FileSender{Dir: "/tmp/mail"}) {
+		t.Errorf("expected FileSender, got %#v, err: %v", s, err)
+	}
+
+	t.Setenv("MAIL_SENDER", "smtp")
+	t.Setenv("SMTP_ADDR", "smtp.example.com:587")
+	t.Setenv("MAIL_FROM", "sentinel@example.com")
+	if s, err := NewSenderFromEnv(); err != nil {
+		t.Errorf("expected SMTPSender, got error: %v", err)
+	} else if _, ok := s.(SMTPSender); !ok {
+		t.Errorf("expected SMTPSender, got %T", s)
+	}
+
+	t.Setenv("MAIL_SENDER", "pigeon")
+	if _, err := NewSenderFromEnv(); err == nil {
+		t.Error("expected error for unknown sender")
+	}
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// LDAPConnection is the LDAP or Active Directory server a tenant's users sign in against
+type LDAPConnection struct {
+	TenantID       int               `json:"tenant_id"`
+	URL            string            `json:"url"`       // ldap://host:389 or ldaps://host:636
+	StartTLS       bool              `json:"start_tls"` // Upgrade ldap:// connections with StartTLS
+	BindDN         string            `json:"bind_dn"`   // Service account used to search for users; anonymous when empty
+	BindPassword   string            `json:"-"`
+	BaseDN         string            `json:"base_dn"`
+	UserFilter     string            `json:"user_filter"`     // {email} is replaced with the escaped login email
+	NameAttribute  string            `json:"name_attribute"`  // Attribute with the display name
+	GroupAttribute string            `json:"group_attribute"` // Attribute listing the user's group DNs
+	Roles          map[string]string `json:"roles"`           // Group DN to Sentinel role
+	Teams          map[string]string `json:"teams"`           // Group DN to the name of a team of the tenant
+	DefaultRole    string            `json:"default_role"`    // Role of provisioned users when no mapped role applies
+	AutoProvision  bool              `json:"auto_provision"`  // Create directory users on their first login
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
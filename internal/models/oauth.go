@@ -0,0 +1,49 @@
+package models
+
+import "time"
+
+// OAuthClient is an application registered with a tenant to sign its users in through Sentinel's OpenID provider
+type OAuthClient struct {
+	TenantID     int       `json:"tenant_id"`
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Public       bool      `json:"public"` // Public clients (SPAs, native apps) have no secret and rely on PKCE alone
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// OIDCConnection is an upstream OpenID provider the users of a tenant can sign in with
+type OIDCConnection struct {
+	ID            int       `json:"id"`
+	TenantID      int       `json:"tenant_id"`
+	Name          string    `json:"name"`
+	Issuer        string    `json:"issuer"`
+	ClientID      string    `json:"client_id"`
+	ClientSecret  string    `json:"-"`
+	Scopes        string    `json:"scopes"`
+	DefaultRole   string    `json:"default_role"`   // Role of users provisioned on their first login
+	AutoProvision bool      `json:"auto_provision"` // Create unknown users on their first login
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ServiceAccount is a non-human principal of a tenant. It gets access tokens from /oauth/token
+// with the client-credentials grant; Sentinel only keeps the hash of its secret.
+type ServiceAccount struct {
+	ID         int        `json:"id"`
+	TenantID   int        `json:"tenant_id"`
+	Name       string     `json:"name"`
+	ClientID   string     `json:"client_id"`
+	Role       string     `json:"role"`
+	Scopes     []string   `json:"scopes"` // Scopes its tokens can be granted
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// DeviceAuthorization is a pending device flow login (RFC 8628), as shown to the user
+// who is asked to approve it
+type DeviceAuthorization struct {
+	UserCode   string    `json:"user_code"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// SAMLConnection is the SAML identity provider of an enterprise tenant
+type SAMLConnection struct {
+	TenantID          int                  `json:"tenant_id"`
+	IdPEntityID       string               `json:"idp_entity_id"`
+	IdPMetadata       string               `json:"idp_metadata"` // Metadata XML uploaded by the tenant's admin
+	Mapping           SAMLAttributeMapping `json:"mapping"`
+	DefaultRole       string               `json:"default_role"`        // Role of provisioned users when no mapped role applies
+	AutoProvision     bool                 `json:"auto_provision"`      // Create unknown users on their first login
+	AllowIdPInitiated bool                 `json:"allow_idp_initiated"` // Accept responses the IdP sends without a request from Sentinel
+	CreatedAt         time.Time            `json:"created_at"`
+	UpdatedAt         time.Time            `json:"updated_at"`
+}
+
+// SAMLAttributeMapping says which assertion attributes fill in a user. Empty attribute
+// names leave the field alone; role and team values only count when listed in the maps.
+type SAMLAttributeMapping struct {
+	Email string            `json:"email,omitempty"` // Attribute with the email address; the NameID is used when empty
+	Name  string            `json:"name,omitempty"`  // Attribute with the display name
+	Role  string            `json:"role,omitempty"`  // Attribute whose values are looked up in Roles
+	Roles map[string]string `json:"roles,omitempty"` // Attribute value to Sentinel role
+	Team  string            `json:"team,omitempty"`  // Attribute whose values are looked up in Teams
+	Teams map[string]string `json:"teams,omitempty"` // Attribute value to the name of a team of the tenant
+}
@@ -0,0 +1,28 @@
+package models
+
+// TenantSettings holds the per-tenant options stored in tenant_settings.settings.
+// Missing keys take their zero value, so new options default to off.
+type TenantSettings struct {
+	RequireEmailConfirmation bool           `json:"require_email_confirmation"` // Login refuses accounts whose email is not confirmed
+	RequireMFA               bool           `json:"require_mfa"`                // Users without MFA must enroll before their first token is issued
+	MagicLinkLogin           bool           `json:"magic_link_login"`           // Users can sign in with a link emailed to them instead of a password
+	PasswordPolicy           PasswordPolicy `json:"password_policy"`            // Rules for passwords set in the tenant
+}
+
+// PasswordPolicy lists the rules a new password must follow. Zero values disable a rule.
+type PasswordPolicy struct {
+	MinLength     int  `json:"min_length"`     // Minimum number of characters
+	RequireUpper  bool `json:"require_upper"`  // At least one upper case letter
+	RequireLower  bool `json:"require_lower"`  // At least one lower case letter
+	RequireDigit  bool `json:"require_digit"`  // At least one digit
+	RequireSymbol bool `json:"require_symbol"` // At least one character that is not a letter or digit
+	History       int  `json:"history"`        // The password may not match any of the user's last N passwords
+	MaxAgeDays    int  `json:"max_age_days"`   // Passwords older than this must be changed at the next login
+}
+
+// FieldError describes why one field of a request was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
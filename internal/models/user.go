@@ -14,15 +14,16 @@ type Tenant struct {
 }
 
 type User struct {
-	ID        int       `json:"id"`
-	TenantID  int       `json:"tenant_id"` // Reference to the tenant
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"` // do not expose password in API responses
-	Role      string    `json:"role"`
-	Team      Team      `json:"team,omitempty"` // Optional team association
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           int       `json:"id"`
+	TenantID     int       `json:"tenant_id"` // Reference to the tenant
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Password     string    `json:"-"` // do not expose password in API responses
+	Role         string    `json:"role"`
+	Team         Team      `json:"team,omitempty"` // Optional team association
+	TokenVersion int       `json:"-"`              // Bumped to invalidate every token issued to the user
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type Team struct {
@@ -68,3 +69,15 @@ type Req_User_Login struct {
 // func (u *User) CheckPassword(password string) error {
 // 	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 // }
+
+// APIKey is a personal key a user's scripts authenticate with. Only its hash is stored;
+// the key itself is shown once, when it is created.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // First characters of the key, to tell keys apart
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
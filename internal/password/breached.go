@@ -0,0 +1,116 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// prefixLen is the length of the hash prefix sent in a range query (as in the Pwned Passwords API)
+const prefixLen = 5
+
+// BreachedList answers k-anonymity range queries: given the first five hex characters
+// of a password's SHA-1 hash it returns the remaining characters of every breached hash
+// with that prefix, so a lookup never hands over the full hash of the password.
+type BreachedList interface {
+	Range(prefix string) []string
+}
+
+// FileList is a BreachedList loaded from a file in the format of the Pwned Passwords
+// downloads: one hex SHA-1 hash per line, optionally followed by ":<count>".
+// Blank lines and lines starting with # are ignored.
+type FileList struct {
+	ranges map[string][]string
+}
+
+// LoadFile reads a breached-password file into memory
+func LoadFile(path string) (*FileList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := &FileList{ranges: map[string][]string{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		list.ranges[hash[:prefixLen]] = append(list.ranges[hash[:prefixLen]], hash[prefixLen:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Range returns the hash suffixes of the breached passwords whose hash starts with prefix
+func (l *FileList) Range(prefix string) []string {
+	return l.ranges[strings.ToUpper(prefix)]
+}
+
+// IsBreached looks the password up in the list with a range query on its hash prefix
+func IsBreached(list BreachedList, password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	for _, suffix := range list.Range(hash[:prefixLen]) {
+		if suffix == hash[prefixLen:] {
+			return true
+		}
+	}
+	return false
+}
+
+// Process wide list, none until Init or SetBreachedList is called.
+// currentMu also guards the process wide hasher.
+var (
+	current   BreachedList
+	currentMu sync.RWMutex
+)
+
+// Init configures the process wide hasher from the environment and loads the
+// breached-password list named by BREACHED_PASSWORDS_FILE, if set
+func Init() error {
+	h, err := NewHasherFromEnv()
+	if err != nil {
+		return err
+	}
+	SetHasher(h)
+
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		return nil
+	}
+	list, err := LoadFile(path)
+	if err != nil {
+		return err
+	}
+	SetBreachedList(list)
+	return nil
+}
+
+// SetBreachedList replaces the process wide list; nil turns screening off
+func SetBreachedList(list BreachedList) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = list
+}
+
+// Breached reports whether the password is in the process wide list
+func Breached(password string) bool {
+	currentMu.RLock()
+	list := current
+	currentMu.RUnlock()
+	return list != nil && IsBreached(list, password)
+}
@@ -0,0 +1,66 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// staticList is an in-memory BreachedList of plain text passwords
+type staticList []string
+
+func (l staticList) Range(prefix string) []string {
+	var suffixes []string
+	for _, pw := range l {
+		hash := sha1Hex(pw)
+		if strings.HasPrefix(hash, prefix) {
+			suffixes = append(suffixes, hash[prefixLen:])
+		}
+	}
+	return suffixes
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	content := "# Pwned Passwords sample\n" +
+		sha1Hex("password123") + ":251682\n" +
+		"\n" +
+		strings.ToLower(sha1Hex("letmein")) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, pw := range []string{"password123", "letmein"} {
+		if !IsBreached(list, pw) {
+			t.Errorf("expected %q to be breached", pw)
+		}
+	}
+	if IsBreached(list, "Password123") {
+		t.Error("expected lookups to be case sensitive on the password")
+	}
+	if got := list.Range(sha1Hex("password123")[:prefixLen]); len(got) != 1 || len(got[0]) != 35 {
+		t.Errorf("expected one 35 character suffix in the range, got %v", got)
+	}
+}
+
+func TestLoadFile_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(sha1Hex("ok")+"\nnot-a-hash\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("expected an error pointing at line 2, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned for a stored hash no Hasher understands
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher turns passwords into self-describing hash strings: PHC strings for Argon2id
+// and the usual $2a$/$2b$ crypt strings for bcrypt, so stored hashes carry their own
+// algorithm and parameters and can be verified after the configuration changes.
+type Hasher interface {
+	// Hash returns the encoded hash of a password
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches an encoded hash of this algorithm
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether an encoded hash was made with another algorithm
+	// or other parameters than the hasher's
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2id hashes with Argon2id. Memory is in KiB.
+type Argon2id struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}
+
+// DefaultArgon2id follows the OWASP recommendation of 19 MiB, 2 passes and 1 thread
+var DefaultArgon2id = Argon2id{Memory: 19 * 1024, Time: 2, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2id) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2id) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.Memory || params.Time != h.Time || params.Threads != h.Threads ||
+		len(salt) != h.SaltLen || uint32(len(key)) != h.KeyLen
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>
+func decodeArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	return params, salt, key, nil
+}
+
+// Bcrypt hashes with bcrypt at the given cost
+type Bcrypt struct {
+	Cost int
+}
+
+func (h Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h Bcrypt) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// hasherFor picks the algorithm of an encoded hash. Parameters come from the hash itself.
+func hasherFor(encoded string) (Hasher, error) {
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return Argon2id{}, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return Bcrypt{}, nil
+	}
+	return nil, ErrUnknownHash
+}
+
+// NewHasherFromEnv picks the hasher for new passwords from PASSWORD_HASHER:
+//   - "argon2id" (default): ARGON2_MEMORY_KIB, ARGON2_TIME and ARGON2_THREADS override DefaultArgon2id
+//   - "bcrypt": BCRYPT_COST, bcrypt.DefaultCost when unset
+func NewHasherFromEnv() (Hasher, error) {
+	switch os.Getenv("PASSWORD_HASHER") {
+	case "", "argon2id":
+		h := DefaultArgon2id
+		var err error
+		if h.Memory, err = uintFromEnv("ARGON2_MEMORY_KIB", h.Memory, 8); err != nil {
+			return nil, err
+		}
+		if h.Time, err = uintFromEnv("ARGON2_TIME", h.Time, 1); err != nil {
+			return nil, err
+		}
+		threads, err := uintFromEnv("ARGON2_THREADS", uint32(h.Threads), 1)
+		if err != nil || threads > 255 {
+			return nil, fmt.Errorf("invalid ARGON2_THREADS %q", os.Getenv("ARGON2_THREADS"))
+		}
+		h.Threads = uint8(threads)
+		return h, nil
+	case "bcrypt":
+		cost := bcrypt.DefaultCost
+		if v := os.Getenv("BCRYPT_COST"); v != "" {
+			c, err := strconv.Atoi(v)
+			if err != nil || c < bcrypt.MinCost || c > bcrypt.MaxCost {
+				return nil, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+			}
+			cost = c
+		}
+		return Bcrypt{Cost: cost}, nil
+	default:
+		return nil, fmt.Errorf("unknown PASSWORD_HASHER %q", os.Getenv("PASSWORD_HASHER"))
+	}
+}
+
+func uintFromEnv(name string, fallback, min uint32) (uint32, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || uint32(n) < min {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return uint32(n), nil
+}
+
+// Process wide hasher for new passwords, DefaultArgon2id until Init or SetHasher is called
+var hasher Hasher = DefaultArgon2id
+
+// SetHasher replaces the process wide hasher
+func SetHasher(h Hasher) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	hasher = h
+}
+
+func currentHasher() Hasher {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return hasher
+}
+
+// Hash hashes a new password with the process wide hasher
+func Hash(password string) (string, error) {
+	return currentHasher().Hash(password)
+}
+
+// Verify checks a password against a stored hash of any supported algorithm.
+// outdated is true when the password matched but the hash should be replaced
+// with Hash(password), because the hasher or its parameters changed since.
+func Verify(password, encoded string) (ok, outdated bool, err error) {
+	h, err := hasherFor(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	if ok, err = h.Verify(password, encoded); !ok || err != nil {
+		return false, false, err
+	}
+	return true, currentHasher().NeedsRehash(encoded), nil
+}
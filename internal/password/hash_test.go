@@ -0,0 +1,131 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id keeps the tests fast
+var testArgon2id = Argon2id{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func useHasher(t *testing.T, h Hasher) {
+	t.Helper()
+	SetHasher(h)
+	t.Cleanup(func() { SetHasher(DefaultArgon2id) })
+}
+
+func TestArgon2id(t *testing.T) {
+	encoded, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") || strings.Count(encoded, "$") != 5 {
+		t.Fatalf("expected a PHC string, got %q", encoded)
+	}
+	if again, _ := testArgon2id.Hash("correct horse"); again == encoded {
+		t.Error("expected a random salt per hash")
+	}
+
+	for pw, want := range map[string]bool{"correct horse": true, "Correct horse": false, "": false} {
+		if ok, err := testArgon2id.Verify(pw, encoded); err != nil || ok != want {
+			t.Errorf("Verify(%q) = %v, %v, want %v", pw, ok, err, want)
+		}
+	}
+
+	if testArgon2id.NeedsRehash(encoded) {
+		t.Error("expected a hash with the current parameters to be up to date")
+	}
+	stronger := testArgon2id
+	stronger.Time = 2
+	if !stronger.NeedsRehash(encoded) {
+		t.Error("expected a parameter change to require a rehash")
+	}
+}
+
+func TestArgon2id_Malformed(t *testing.T) {
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+	} {
+		if ok, err := testArgon2id.Verify("pw", encoded); ok || err == nil {
+			t.Errorf("expected %q to be rejected, got %v, %v", encoded, ok, err)
+		}
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	h := Bcrypt{Cost: bcrypt.MinCost}
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if ok, err := h.Verify("correct horse", encoded); !ok || err != nil {
+		t.Errorf("expected the password to match, got %v, %v", ok, err)
+	}
+	if ok, err := h.Verify("wrong", encoded); ok || err != nil {
+		t.Errorf("expected a mismatch without error, got %v, %v", ok, err)
+	}
+	if h.NeedsRehash(encoded) || !(Bcrypt{Cost: bcrypt.MinCost + 1}).NeedsRehash(encoded) {
+		t.Error("expected only a cost change to require a rehash")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	useHasher(t, testArgon2id)
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	current, _ := Hash("correct horse")
+
+	tests := []struct {
+		name         string
+		password     string
+		encoded      string
+		ok, outdated bool
+	}{
+		{"current hash", "correct horse", current, true, false},
+		{"legacy bcrypt hash is outdated", "correct horse", string(legacy), true, true},
+		{"wrong password is never outdated", "wrong", string(legacy), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, outdated, err := Verify(tt.password, tt.encoded)
+			if err != nil || ok != tt.ok || outdated != tt.outdated {
+				t.Errorf("Verify = %v, %v, %v, want %v, %v", ok, outdated, err, tt.ok, tt.outdated)
+			}
+		})
+	}
+
+	if _, _, err := Verify("pw", "plaintext"); err != ErrUnknownHash {
+		t.Errorf("expected ErrUnknownHash, got %v", err)
+	}
+}
+
+func TestNewHasherFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_HASHER", "")
+	t.Setenv("ARGON2_MEMORY_KIB", "65536")
+	h, err := NewHasherFromEnv()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if a, ok := h.(Argon2id); !ok || a.Memory != 65536 || a.Time != DefaultArgon2id.Time {
+		t.Errorf("expected Argon2id with 64 MiB, got %+v", h)
+	}
+
+	t.Setenv("PASSWORD_HASHER", "bcrypt")
+	t.Setenv("BCRYPT_COST", "12")
+	if h, err := NewHasherFromEnv(); err != nil || h != (Bcrypt{Cost: 12}) {
+		t.Errorf("expected bcrypt with cost 12, got %+v, %v", h, err)
+	}
+
+	t.Setenv("BCRYPT_COST", "99")
+	if _, err := NewHasherFromEnv(); err == nil {
+		t.Error("expected an out of range cost to be rejected")
+	}
+	t.Setenv("PASSWORD_HASHER", "md5")
+	if _, err := NewHasherFromEnv(); err == nil {
+		t.Error("expected an unknown hasher to be rejected")
+	}
+}
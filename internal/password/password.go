@@ -0,0 +1,84 @@
+// Package password checks new passwords against a tenant's policy and a list of breached passwords
+package password
+
+import (
+	"fmt"
+	"sentinel/internal/models"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxHistory caps PasswordPolicy.History, since every remembered hash costs a hash comparison
+const MaxHistory = 24
+
+// Field error codes of a rejected password
+const (
+	CodeTooShort      = "too_short"
+	CodeMissingUpper  = "missing_upper"
+	CodeMissingLower  = "missing_lower"
+	CodeMissingDigit  = "missing_digit"
+	CodeMissingSymbol = "missing_symbol"
+	CodeBreached      = "breached"
+	CodeReused        = "reused"
+)
+
+// Validate returns every rule of the policy the password breaks, plus a breached
+// error when it appears in the breached-password list. Reuse is checked by the caller,
+// which has the user's previous hashes.
+func Validate(policy models.PasswordPolicy, password string) []models.FieldError {
+	errs := []models.FieldError{}
+	if n := utf8.RuneCountInString(password); n < policy.MinLength {
+		errs = append(errs, fieldError(CodeTooShort, fmt.Sprintf("must be at least %d characters long", policy.MinLength)))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+	if policy.RequireUpper && !upper {
+		errs = append(errs, fieldError(CodeMissingUpper, "must contain an upper case letter"))
+	}
+	if policy.RequireLower && !lower {
+		errs = append(errs, fieldError(CodeMissingLower, "must contain a lower case letter"))
+	}
+	if policy.RequireDigit && !digit {
+		errs = append(errs, fieldError(CodeMissingDigit, "must contain a digit"))
+	}
+	if policy.RequireSymbol && !symbol {
+		errs = append(errs, fieldError(CodeMissingSymbol, "must contain a symbol"))
+	}
+
+	if Breached(password) {
+		errs = append(errs, fieldError(CodeBreached, "appears in a list of breached passwords, choose another one"))
+	}
+	return errs
+}
+
+// ReusedError is the field error for a password that matches one of the last n passwords
+func ReusedError(n int) models.FieldError {
+	return fieldError(CodeReused, fmt.Sprintf("must differ from your last %d passwords", n))
+}
+
+// HistorySize is how many previous passwords the policy remembers, capped at MaxHistory
+func HistorySize(policy models.PasswordPolicy) int {
+	if policy.History > MaxHistory {
+		return MaxHistory
+	}
+	if policy.History < 0 {
+		return 0
+	}
+	return policy.History
+}
+
+func fieldError(code, message string) models.FieldError {
+	return models.FieldError{Field: "password", Code: code, Message: message}
+}
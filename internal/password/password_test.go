@@ -0,0 +1,67 @@
+package password
+
+import (
+	"sentinel/internal/models"
+	"testing"
+)
+
+func codes(errs []models.FieldError) map[string]bool {
+	m := map[string]bool{}
+	for _, e := range errs {
+		if e.Field != "password" {
+			panic("unexpected field " + e.Field)
+		}
+		m[e.Code] = true
+	}
+	return m
+}
+
+func TestValidate(t *testing.T) {
+	strict := models.PasswordPolicy{MinLength: 12, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+	tests := []struct {
+		name     string
+		policy   models.PasswordPolicy
+		password string
+		want     []string
+	}{
+		{"empty policy accepts anything", models.PasswordPolicy{}, "a", nil},
+		{"meets strict policy", strict, "Correct-Horse-9", nil},
+		{"too short", strict, "Sh0rt!", []string{CodeTooShort}},
+		{"length counts characters not bytes", models.PasswordPolicy{MinLength: 4}, "ñññ", []string{CodeTooShort}},
+		{"missing classes", strict, "alllowercaseletters", []string{CodeMissingUpper, CodeMissingDigit, CodeMissingSymbol}},
+		{"spaces count as symbols", models.PasswordPolicy{RequireSymbol: true}, "two words", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := codes(Validate(tt.policy, tt.password))
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+			for _, c := range tt.want {
+				if !got[c] {
+					t.Errorf("expected %s in %v", c, got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate_Breached(t *testing.T) {
+	SetBreachedList(staticList{"password123"})
+	t.Cleanup(func() { SetBreachedList(nil) })
+
+	if got := codes(Validate(models.PasswordPolicy{}, "password123")); !got[CodeBreached] {
+		t.Errorf("expected a breached error, got %v", got)
+	}
+	if got := Validate(models.PasswordPolicy{}, "a fresh passphrase"); len(got) != 0 {
+		t.Errorf("expected no errors, got %v", got)
+	}
+}
+
+func TestHistorySize(t *testing.T) {
+	for history, want := range map[int]int{-1: 0, 0: 0, 5: 5, 100: MaxHistory} {
+		if got := HistorySize(models.PasswordPolicy{History: history}); got != want {
+			t.Errorf("HistorySize(%d) = %d, want %d", history, got, want)
+		}
+	}
+}
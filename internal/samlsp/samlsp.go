@@ -0,0 +1,126 @@
+// Package samlsp is Sentinel's SAML 2.0 service provider. Every tenant with a SAML
+// connection gets its own service provider, built from the identity provider metadata
+// the tenant's admin uploaded; its entity ID and ACS URL contain the tenant ID.
+package samlsp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"sentinel/internal/auth"
+
+	"github.com/crewjam/saml"
+)
+
+var ErrInvalidMetadata = errors.New("invalid IdP metadata")
+
+// MetadataURL is the tenant's SP metadata document; it doubles as the SP entity ID
+func MetadataURL(tenantID int) string {
+	return auth.Issuer() + "/saml/" + strconv.Itoa(tenantID) + "/metadata"
+}
+
+// ACSURL is where the tenant's IdP posts its responses
+func ACSURL(tenantID int) string {
+	return auth.Issuer() + "/saml/" + strconv.Itoa(tenantID) + "/acs"
+}
+
+// ParseIdPMetadata checks uploaded IdP metadata: it must describe an IdP with a signing
+// certificate and a single sign-on service reachable through the HTTP-Redirect binding.
+func ParseIdPMetadata(raw []byte) (*saml.EntityDescriptor, error) {
+	md := &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(raw, md); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+	if md.EntityID == "" {
+		return nil, fmt.Errorf("%w: no entity ID", ErrInvalidMetadata)
+	}
+	sp := &saml.ServiceProvider{IDPMetadata: md}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return nil, fmt.Errorf("%w: no HTTP-Redirect single sign-on service", ErrInvalidMetadata)
+	}
+	if !hasSigningCertificate(md) {
+		return nil, fmt.Errorf("%w: no signing certificate", ErrInvalidMetadata)
+	}
+	return md, nil
+}
+
+func hasSigningCertificate(md *saml.EntityDescriptor) bool {
+	for _, idp := range md.IDPSSODescriptors {
+		for _, kd := range idp.KeyDescriptors {
+			if (kd.Use == "" || kd.Use == "signing") && len(kd.KeyInfo.X509Data.X509Certificates) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// New returns the service provider of a tenant. Responses and assertions must be signed
+// with a certificate from the IdP metadata; InResponseTo is only skipped when
+// allowIdPInitiated is set, for responses the IdP sends unasked.
+func New(tenantID int, idpMetadata []byte, allowIdPInitiated bool) (*saml.ServiceProvider, error) {
+	md, err := ParseIdPMetadata(idpMetadata)
+	if err != nil {
+		return nil, err
+	}
+	metadataURL, err := url.Parse(MetadataURL(tenantID))
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(ACSURL(tenantID))
+	if err != nil {
+		return nil, err
+	}
+	return &saml.ServiceProvider{
+		EntityID:          metadataURL.String(),
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       md,
+		AllowIDPInitiated: allowIdPInitiated,
+		AuthnNameIDFormat: saml.EmailAddressNameIDFormat,
+	}, nil
+}
+
+// Metadata renders the SP metadata for the IdP. Only the HTTP-POST binding is advertised
+// for the ACS, as artifact resolution is not supported.
+func Metadata(sp *saml.ServiceProvider) ([]byte, error) {
+	md := sp.Metadata()
+	for i := range md.SPSSODescriptors {
+		acs := md.SPSSODescriptors[i].AssertionConsumerServices[:0]
+		for _, ep := range md.SPSSODescriptors[i].AssertionConsumerServices {
+			if ep.Binding == saml.HTTPPostBinding {
+				acs = append(acs, ep)
+			}
+		}
+		md.SPSSODescriptors[i].AssertionConsumerServices = acs
+	}
+	return xml.MarshalIndent(md, "", "  ")
+}
+
+// Attributes flattens the attribute statements of an assertion. Values are listed under
+// the attribute's name and, when it has one, its friendly name.
+func Attributes(a *saml.Assertion) map[string][]string {
+	attrs := map[string][]string{}
+	for _, stmt := range a.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			for _, v := range attr.Values {
+				attrs[attr.Name] = append(attrs[attr.Name], v.Value)
+				if attr.FriendlyName != "" && attr.FriendlyName != attr.Name {
+					attrs[attr.FriendlyName] = append(attrs[attr.FriendlyName], v.Value)
+				}
+			}
+		}
+	}
+	return attrs
+}
+
+// NameID is the subject of an assertion
+func NameID(a *saml.Assertion) string {
+	if a.Subject == nil || a.Subject.NameID == nil {
+		return ""
+	}
+	return a.Subject.NameID.Value
+}
@@ -0,0 +1,98 @@
+package samlsp
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"sentinel/internal/samlsp/samlsptest"
+
+	"github.com/crewjam/saml"
+)
+
+func TestParseIdPMetadata(t *testing.T) {
+	idp := samlsptest.NewIdP("https://idp.example.com")
+	if _, err := ParseIdPMetadata(idp.MetadataXML()); err != nil {
+		t.Fatalf("valid metadata refused: %v", err)
+	}
+
+	unsigned := strings.Replace(string(idp.MetadataXML()), `use="signing"`, `use="encryption"`, -1)
+	tests := map[string]string{
+		"Not XML":           "not xml",
+		"No signing key":    unsigned,
+		"No SSO service":    `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com"></EntityDescriptor>`,
+		"Missing entity ID": `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata"></EntityDescriptor>`,
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseIdPMetadata([]byte(raw)); !errors.Is(err, ErrInvalidMetadata) {
+				t.Errorf("expected ErrInvalidMetadata, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	idp := samlsptest.NewIdP("https://idp.example.com")
+	sp, err := New(4, idp.MetadataXML(), false)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	raw, err := Metadata(sp)
+	if err != nil {
+		t.Fatalf("Metadata failed: %v", err)
+	}
+	md := string(raw)
+	if !strings.Contains(md, `entityID="`+MetadataURL(4)+`"`) {
+		t.Errorf("metadata does not carry the tenant's entity ID:\n%s", md)
+	}
+	if !strings.Contains(md, ACSURL(4)) || strings.Contains(md, saml.HTTPArtifactBinding) {
+		t.Errorf("expected the POST ACS only:\n%s", md)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	idp := samlsptest.NewIdP("https://idp.example.com")
+	other := samlsptest.NewIdP("https://idp.example.com")
+	attrs := map[string][]string{"email": {"jane@example.com"}, "groups": {"engineering", "admins"}}
+
+	tests := []struct {
+		name              string
+		signer            *samlsptest.IdP
+		inResponseTo      string
+		allowIdPInitiated bool
+		wantErr           bool
+	}{
+		{"SP-initiated", idp, "id-request-1", false, false},
+		{"Unknown request ID", idp, "id-request-2", false, true},
+		{"IdP-initiated allowed", idp, "", true, false},
+		{"IdP-initiated refused", idp, "", false, true},
+		{"Signed with another key", other, "id-request-1", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, err := New(4, idp.MetadataXML(), tt.allowIdPInitiated)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			raw, _ := base64.StdEncoding.DecodeString(tt.signer.Response(sp, tt.inResponseTo, "jane@example.com", attrs))
+			assertion, err := sp.ParseXMLResponse(raw, []string{"id-request-1"}, sp.AcsURL)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected the response to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("response refused: %v", err)
+			}
+			if NameID(assertion) != "jane@example.com" {
+				t.Errorf("unexpected NameID %q", NameID(assertion))
+			}
+			if got := Attributes(assertion)["groups"]; len(got) != 2 || got[0] != "engineering" {
+				t.Errorf("unexpected groups %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Package samlsptest provides a SAML identity provider for tests of SAML single sign-on
+package samlsptest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+// IdP signs SAML responses with a self-signed certificate published in its metadata
+type IdP struct {
+	*saml.IdentityProvider
+}
+
+// NewIdP creates an identity provider with the given entity ID
+func NewIdP(entityID string) *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "samlsptest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	metadataURL, _ := url.Parse(entityID)
+	ssoURL, _ := url.Parse(entityID + "/sso")
+	return &IdP{&saml.IdentityProvider{
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		SSOURL:      *ssoURL,
+	}}
+}
+
+// MetadataXML is the IdP metadata a tenant admin would upload
+func (p *IdP) MetadataXML() []byte {
+	raw, err := xml.MarshalIndent(p.Metadata(), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// Response returns a signed, base64 encoded SAMLResponse for the service provider.
+// inResponseTo is empty for an IdP-initiated login; attributes are sent with the
+// basic name format.
+func (p *IdP) Response(sp *saml.ServiceProvider, inResponseTo, nameID string, attributes map[string][]string) string {
+	session := &saml.Session{
+		NameID:       nameID,
+		NameIDFormat: string(saml.EmailAddressNameIDFormat),
+		CreateTime:   time.Now(),
+		Index:        "1",
+	}
+	for name, values := range attributes {
+		attr := saml.Attribute{Name: name, NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"}
+		for _, v := range values {
+			attr.Values = append(attr.Values, saml.AttributeValue{Type: "xs:string", Value: v})
+		}
+		session.CustomAttributes = append(session.CustomAttributes, attr)
+	}
+
+	spMetadata := sp.Metadata()
+	req := &saml.IdpAuthnRequest{
+		IDP:                     p.IdentityProvider,
+		HTTPRequest:             httptest.NewRequest("POST", sp.AcsURL.String(), nil),
+		Request:                 saml.AuthnRequest{ID: inResponseTo, IssueInstant: saml.TimeNow()},
+		ServiceProviderMetadata: spMetadata,
+		SPSSODescriptor:         &spMetadata.SPSSODescriptors[0],
+		ACSEndpoint:             &saml.IndexedEndpoint{Binding: saml.HTTPPostBinding, Location: sp.AcsURL.String()},
+		Now:                     saml.TimeNow(),
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		panic(err)
+	}
+	if err := req.MakeResponse(); err != nil {
+		panic(err)
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}